@@ -0,0 +1,170 @@
+package main
+
+import (
+  "context"
+  "errors"
+  "flag"
+  "fmt"
+  "io"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "time"
+
+  "elysium-backend/config"
+  "elysium-backend/pkg/backup"
+  "elysium-backend/pkg/db"
+  "elysium-backend/pkg/wgutil"
+)
+
+const backupUsage = `usage: main [flags] backup [-o <file>]
+       main [flags] restore <file>
+
+backup writes an archive of the database, the server and signing keys and
+OUTPUT_DIR to <file> (default elysium-backup-<time>.tar.gz, - for stdout),
+encrypted when BACKUP_PASSPHRASE is set. restore replaces them with the
+contents of an archive once it has been verified; stop the server first.`
+
+// sqlitePath returns the file of the SQLite database, which is only known
+// for the sqlite driver.
+func sqlitePath(cfg config.DatabaseConfig) (string, error) {
+  dialect, err := db.ParseDialect(cfg.Driver)
+  if err != nil {
+    return "", err
+  }
+  if dialect != db.SQLite {
+    return "", fmt.Errorf("backups require the SQLite database, DB_DRIVER is %s", dialect)
+  }
+  file := db.SQLiteFile(cfg.DSN)
+  if file == "" {
+    return "", fmt.Errorf("backups require an SQLite database file, not %q", cfg.DSN)
+  }
+  return file, nil
+}
+
+// backupPaths locates the state a backup covers.
+func backupPaths(cfg *config.Config, database string) backup.Paths {
+  return backup.Paths{
+    Database:  database,
+    Keys:      []string{filepath.Join(wgutil.ServerKeyDir, wgutil.ServerKeyFile), filepath.Join(wgutil.ServerKeyDir, wgutil.AltServerKeyFile), cfg.Artifacts.SigningKeyFile},
+    OutputDir: cfg.Build.OutputDir,
+  }
+}
+
+// runBackup implements the backup subcommand and returns the exit code.
+func runBackup(args []string) int {
+  flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+  output := flags.String("o", "", "Write the archive to this file")
+  flags.Usage = func() { fmt.Fprintln(os.Stderr, backupUsage) }
+  if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+    flags.Usage()
+    return 2
+  }
+
+  cfg, err := config.Load()
+  if err != nil {
+    slog.Error("invalid configuration", "err", err)
+    return 1
+  }
+  database, err := sqlitePath(cfg.Database)
+  if err != nil {
+    slog.Error("backup failed", "err", err)
+    return 1
+  }
+
+  path := *output
+  if path == "" {
+    path = "elysium-backup-" + time.Now().UTC().Format("20060102T150405Z") + ".tar.gz"
+    if cfg.Backup.Passphrase != "" {
+      path += ".enc"
+    }
+  }
+
+  pool, err := db.InitializeDatabaseConnection(cfg.Database)
+  if err != nil {
+    slog.Error("backup failed", "err", err)
+    return 1
+  }
+  defer pool.Close()
+
+  var w io.Writer = os.Stdout
+  var file *os.File
+  if path != "-" {
+    // The archive only appears under its name once it is complete.
+    if file, err = os.CreateTemp(filepath.Dir(path), ".elysium-backup-"); err != nil {
+      slog.Error("backup failed", "err", err)
+      return 1
+    }
+    defer os.Remove(file.Name())
+    defer file.Close()
+    w = file
+  }
+
+  manifest, err := backup.Create(context.Background(), w, pool, backupPaths(cfg, database), cfg.Backup.Passphrase)
+  if err == nil && file != nil {
+    if err = file.Close(); err == nil {
+      err = os.Rename(file.Name(), path)
+    }
+  }
+  if err != nil {
+    slog.Error("backup failed", "err", err)
+    return 1
+  }
+  slog.Info("backup complete", "file", path, "schema_version", manifest.SchemaVersion, "encrypted", manifest.Encrypted)
+  return 0
+}
+
+// runRestore implements the restore subcommand and returns the exit code.
+func runRestore(args []string) int {
+  if len(args) != 1 {
+    fmt.Fprintln(os.Stderr, backupUsage)
+    return 2
+  }
+
+  cfg, err := config.Load()
+  if err != nil {
+    slog.Error("invalid configuration", "err", err)
+    return 1
+  }
+  database, err := sqlitePath(cfg.Database)
+  if err != nil {
+    slog.Error("restore failed", "err", err)
+    return 1
+  }
+  latest, err := db.LatestMigration(db.SQLite, cfg.MigrationPath)
+  if err != nil {
+    slog.Error("unable to read the migrations", "path", cfg.MigrationPath, "err", err)
+    return 1
+  }
+
+  file, err := os.Open(args[0])
+  if err != nil {
+    slog.Error("restore failed", "err", err)
+    return 1
+  }
+  defer file.Close()
+
+  manifest, err := backup.Restore(context.Background(), file, backupPaths(cfg, database), latest, cfg.Backup.Passphrase)
+  var replaceErr *backup.ReplaceError
+  switch {
+  case err == nil:
+  case errors.Is(err, db.ErrDatabaseInUse):
+    slog.Error("restore refused, stop the server and other commands using the database first", "err", err)
+    return 1
+  case errors.As(err, &replaceErr) && replaceErr.RollbackErr != nil:
+    slog.Error("restore failed part way and the previous state could not be put back; it is kept in the "+backup.PreRestoreSuffix+" files", "err", replaceErr.Err, "rollback_err", replaceErr.RollbackErr)
+    return 1
+  case errors.As(err, &replaceErr):
+    slog.Error("restore failed while replacing the state, the previous state was put back", "err", replaceErr.Err)
+    return 1
+  default:
+    slog.Error("restore failed, nothing was replaced", "err", err)
+    return 1
+  }
+  slog.Info("restore complete", "created_at", manifest.CreatedAt, "app_version", manifest.AppVersion, "schema_version", manifest.SchemaVersion,
+    "previous_state", database+backup.PreRestoreSuffix)
+  if manifest.SchemaVersion < latest {
+    slog.Info("the restored database is migrated on the next start", "from", manifest.SchemaVersion, "to", latest)
+  }
+  return 0
+}
@@ -1,17 +1,278 @@
 package config
 
 import (
+  "elysium-backend/pkg/logger"
   "encoding/binary"
   "fmt"
-  "log"
+  "log/slog"
   "math"
   "math/big"
   "net"
   "os"
+  "strconv"
+  "strings"
+  "time"
 
   "github.com/joho/godotenv"
 )
 
+// Config is the typed application configuration. It is built once at
+// startup by Load and handed to the components that need it, so nothing
+// below main reads the environment directly.
+type Config struct {
+  Port            string
+  MigrationPath   string
+  ShutdownTimeout time.Duration
+  DBQueryTimeout  time.Duration
+
+  Database  DatabaseConfig
+  TLS       TLSConfig
+  WireGuard WireGuardConfig
+  Build     BuildConfig
+  Download  DownloadConfig
+  Artifacts ArtifactConfig
+  Backup    BackupConfig
+  Keys      KeysConfig
+
+  // IPRanges splits the WireGuard network into the blocks peers are
+  // allocated from.
+  IPRanges []Ip_Range
+
+  AdminToken             string
+  AdminRequireClientCert bool
+}
+
+// DatabaseConfig selects the database. DSN is DB_DSN or, when it is unset,
+// the DB_NAME file of the SQLite database.
+type DatabaseConfig struct {
+  Driver string
+  DSN    string
+}
+
+// TLSConfig controls HTTPS. The certificate in CertFile and KeyFile is
+// reloaded every ReloadInterval; with DevMode and neither set, one for
+// DevHosts is generated in DevDir. Client certificates signed by the CA in
+// ClientCAFile are verified when presented.
+type TLSConfig struct {
+  CertFile       string
+  KeyFile        string
+  ClientCAFile   string
+  ReloadInterval time.Duration
+  DevMode        bool
+  DevDir         string
+  DevHosts       []string
+}
+
+// WireGuardConfig describes the server interface. Key rotations alternate
+// between Interface and Port and AltInterface and AltPort: the new key is
+// served on the pair not in use while clients migrate to it, and the old
+// pair is retired after RotationGrace at the latest. With PresharedKeys new
+// peers get a preshared key on top of their key pair. The handshakes of
+// peers are recorded as their last_seen every LastSeenInterval.
+type WireGuardConfig struct {
+  Interface      string
+  Port           int
+  AltInterface   string
+  AltPort        int
+  IP             net.IP
+  NetworkMask    string
+  TeardownOnExit bool
+  PresharedKeys  bool
+
+  RotationGrace         time.Duration
+  RotationCheckInterval time.Duration
+  LastSeenInterval      time.Duration
+}
+
+// BuildConfig controls how clients are compiled. Backend selects between
+// running cargo on the host ("cargo") and inside ContainerImage through
+// ContainerRuntime ("container").
+type BuildConfig struct {
+  ClientDir        string
+  BinaryName       string
+  OutputDir        string
+  CompileArgs      []string
+  Timeout          time.Duration
+  Backend          string
+  ContainerRuntime string
+  ContainerImage   string
+  Targets          []TargetConfig
+}
+
+const (
+  BuildBackendCargo     = "cargo"
+  BuildBackendContainer = "container"
+)
+
+// DownloadConfig controls the signed links artifacts are downloaded
+// through. An empty SigningKey makes the server sign with a random key, so
+// links do not survive a restart. A download may be resumed for
+// ResumeWindow after it started without counting another use.
+type DownloadConfig struct {
+  SigningKey   []byte
+  LinkTTL      time.Duration
+  MaxUses      int
+  ResumeWindow time.Duration
+}
+
+// ArtifactConfig controls how long compiled binaries are kept, how often
+// expired ones are collected and where the key they are signed with lives.
+type ArtifactConfig struct {
+  TTL            time.Duration
+  GCInterval     time.Duration
+  SigningKeyFile string
+}
+
+// BackupConfig controls backups of the control-plane state. Archives are
+// encrypted with Passphrase when it is set.
+type BackupConfig struct {
+  Passphrase string
+}
+
+// KeysConfig controls how private keys are stored. EncryptionKey, read from
+// KEY_ENCRYPTION_KEY or the file named by KEY_ENCRYPTION_KEY_FILE, or
+// Passphrase seal keys at rest; with neither they are stored in plaintext.
+type KeysConfig struct {
+  EncryptionKey string
+  Passphrase    string
+}
+
+// Load builds a Config from the environment, applying the documented
+// defaults for unset variables.
+func Load() (*Config, error) {
+  wgPort, err := strconv.Atoi(GetEnv("BACKEND_WG_PORT", "51820"))
+  if err != nil {
+    return nil, fmt.Errorf("invalid BACKEND_WG_PORT: %w", err)
+  }
+
+  wgInterface := GetEnv("BACKEND_WG_INTERFACE", "wg0")
+  altInterface := GetEnv("WG_ALT_INTERFACE", wgInterface+"-alt")
+  altPort, err := strconv.Atoi(GetEnv("WG_ALT_PORT", strconv.Itoa(wgPort+1)))
+  if err != nil {
+    return nil, fmt.Errorf("invalid WG_ALT_PORT: %w", err)
+  }
+  if altInterface == wgInterface || altPort == wgPort {
+    return nil, fmt.Errorf("WG_ALT_INTERFACE and WG_ALT_PORT must differ from BACKEND_WG_INTERFACE and BACKEND_WG_PORT")
+  }
+
+  serverIP := GetEnv("BACKEND_WG_IP", "10.0.0.1")
+  networkMask := GetEnv("WG_NETWORK_MASK", "/24")
+  ranges, err := generateIPRanges(serverIP, networkMask)
+  if err != nil {
+    return nil, fmt.Errorf("invalid WireGuard network %s%s: %w", serverIP, networkMask, err)
+  }
+  for i, r := range ranges {
+    slog.Debug("ip range configured", "index", i+1, "start", r.Start.String(), "end", r.End.String())
+  }
+
+  maxUses, err := strconv.Atoi(GetEnv("DOWNLOAD_LINK_MAX_USES", "1"))
+  if err != nil || maxUses < 1 {
+    return nil, fmt.Errorf("invalid DOWNLOAD_LINK_MAX_USES: must be a positive integer")
+  }
+
+  buildBackend := GetEnv("BUILD_BACKEND", BuildBackendCargo)
+  if buildBackend != BuildBackendCargo && buildBackend != BuildBackendContainer {
+    return nil, fmt.Errorf("invalid BUILD_BACKEND %q: must be %q or %q", buildBackend, BuildBackendCargo, BuildBackendContainer)
+  }
+
+  targets := DefaultTargets()
+  if path := GetEnv("BUILD_TARGETS_FILE", ""); path != "" {
+    if targets, err = LoadTargets(path); err != nil {
+      return nil, err
+    }
+  }
+
+  tlsReload, err := time.ParseDuration(GetEnv("TLS_RELOAD_INTERVAL", "30s"))
+  if err != nil {
+    return nil, fmt.Errorf("invalid TLS_RELOAD_INTERVAL: %w", err)
+  }
+
+  encryptionKey := GetEnv("KEY_ENCRYPTION_KEY", "")
+  if path := GetEnv("KEY_ENCRYPTION_KEY_FILE", ""); path != "" {
+    if encryptionKey != "" {
+      return nil, fmt.Errorf("KEY_ENCRYPTION_KEY and KEY_ENCRYPTION_KEY_FILE are mutually exclusive")
+    }
+    data, err := os.ReadFile(path)
+    if err != nil {
+      return nil, fmt.Errorf("invalid KEY_ENCRYPTION_KEY_FILE: %w", err)
+    }
+    encryptionKey = strings.TrimSpace(string(data))
+  }
+
+  return &Config{
+    Port:            GetEnv("PORT", "8080"),
+    MigrationPath:   GetEnv("MIGRATION_PATH", "migrations"),
+    ShutdownTimeout: GetDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+    DBQueryTimeout:  GetDuration("DB_QUERY_TIMEOUT", 5*time.Second),
+    Database:        LoadDatabase(),
+    TLS: TLSConfig{
+      CertFile:       GetEnv("TLS_CERT_FILE", ""),
+      KeyFile:        GetEnv("TLS_KEY_FILE", ""),
+      ClientCAFile:   GetEnv("TLS_CLIENT_CA_FILE", ""),
+      ReloadInterval: tlsReload,
+      DevMode:        GetEnv("TLS_DEV_MODE", "false") == "true",
+      DevDir:         GetEnv("TLS_DEV_DIR", "config/tls"),
+      DevHosts:       strings.Split(GetEnv("TLS_DEV_HOSTS", "localhost,127.0.0.1,::1"), ","),
+    },
+    WireGuard: WireGuardConfig{
+      Interface:      wgInterface,
+      Port:           wgPort,
+      AltInterface:   altInterface,
+      AltPort:        altPort,
+      IP:             net.ParseIP(serverIP),
+      NetworkMask:    networkMask,
+      TeardownOnExit: GetEnv("WG_TEARDOWN_ON_EXIT", "false") == "true",
+      PresharedKeys:  GetEnv("WG_PRESHARED_KEYS", "false") == "true",
+
+      RotationGrace:         GetDuration("WG_ROTATION_GRACE", 7*24*time.Hour),
+      RotationCheckInterval: GetDuration("WG_ROTATION_CHECK_INTERVAL", time.Minute),
+      LastSeenInterval:      GetDuration("WG_LAST_SEEN_INTERVAL", time.Minute),
+    },
+    Build: BuildConfig{
+      ClientDir:        GetEnv("CLIENT_DIR", "./client"),
+      BinaryName:       GetEnv("BINARY_NAME", "elysium-client"),
+      OutputDir:        GetEnv("OUTPUT_DIR", "./compiled_binaries"),
+      CompileArgs:      strings.Fields(GetEnv("COMPILE_ARGS", "")),
+      Timeout:          GetDuration("BUILD_TIMEOUT", 15*time.Minute),
+      Backend:          buildBackend,
+      ContainerRuntime: GetEnv("BUILD_CONTAINER_RUNTIME", "docker"),
+      ContainerImage:   GetEnv("BUILD_CONTAINER_IMAGE", "rust:1.84.0-slim"),
+      Targets:          targets,
+    },
+    Download: DownloadConfig{
+      SigningKey:   []byte(GetEnv("DOWNLOAD_SIGNING_KEY", "")),
+      LinkTTL:      GetDuration("DOWNLOAD_LINK_TTL", 24*time.Hour),
+      MaxUses:      maxUses,
+      ResumeWindow: GetDuration("DOWNLOAD_RESUME_WINDOW", 30*time.Minute),
+    },
+    Artifacts: ArtifactConfig{
+      TTL:            GetDuration("ARTIFACT_TTL", 7*24*time.Hour),
+      GCInterval:     GetDuration("ARTIFACT_GC_INTERVAL", time.Hour),
+      SigningKeyFile: GetEnv("ARTIFACT_SIGNING_KEY_FILE", "config/keys/artifact_signing.pem"),
+    },
+    Backup: BackupConfig{
+      Passphrase: GetEnv("BACKUP_PASSPHRASE", ""),
+    },
+    Keys: KeysConfig{
+      EncryptionKey: encryptionKey,
+      Passphrase:    GetEnv("KEY_PASSPHRASE", ""),
+    },
+    IPRanges:               ranges,
+    AdminToken:             GetEnv("ADMIN_TOKEN", ""),
+    AdminRequireClientCert: GetEnv("ADMIN_REQUIRE_CLIENT_CERT", "false") == "true",
+  }, nil
+}
+
+// LoadDatabase reads the database settings alone, for the commands that
+// only need the database.
+func LoadDatabase() DatabaseConfig {
+  dsn := GetEnv("DB_DSN", "")
+  if dsn == "" {
+    dsn = GetEnv("DB_NAME", "elysium.db")
+  }
+  return DatabaseConfig{Driver: GetEnv("DB_DRIVER", "sqlite"), DSN: dsn}
+}
+
 type Ip_Range struct {
   Start net.IP
   End   net.IP
@@ -19,33 +280,108 @@ type Ip_Range struct {
 
 var range_max int64 = 256
 
-var logLevel string
+// knownKeys lists the environment variables the backend reads, used when
+// reporting the effective configuration.
+var knownKeys = []string{
+  "DB_DRIVER",
+  "DB_NAME",
+  "DB_DSN",
+  "MIGRATION_PATH",
+  "PORT",
+  "LOG_LEVEL",
+  "LOG_FORMAT",
+  "BACKEND_WG_INTERFACE",
+  "BACKEND_WG_PORT",
+  "BACKEND_WG_IP",
+  "WG_NETWORK_MASK",
+  "WG_ALT_INTERFACE",
+  "WG_ALT_PORT",
+  "WG_ROTATION_GRACE",
+  "WG_ROTATION_CHECK_INTERVAL",
+  "WG_LAST_SEEN_INTERVAL",
+  "WG_PRESHARED_KEYS",
+  "CLIENT_DIR",
+  "BINARY_NAME",
+  "OUTPUT_DIR",
+  "COMPILE_ARGS",
+  "SHUTDOWN_TIMEOUT",
+  "DB_QUERY_TIMEOUT",
+  "BUILD_TIMEOUT",
+  "BUILD_BACKEND",
+  "BUILD_CONTAINER_RUNTIME",
+  "BUILD_CONTAINER_IMAGE",
+  "BUILD_TARGETS_FILE",
+  "DOWNLOAD_SIGNING_KEY",
+  "DOWNLOAD_LINK_TTL",
+  "DOWNLOAD_LINK_MAX_USES",
+  "DOWNLOAD_RESUME_WINDOW",
+  "ARTIFACT_TTL",
+  "ARTIFACT_GC_INTERVAL",
+  "ARTIFACT_SIGNING_KEY_FILE",
+  "WG_TEARDOWN_ON_EXIT",
+  "BACKUP_PASSPHRASE",
+  "KEY_ENCRYPTION_KEY",
+  "KEY_ENCRYPTION_KEY_FILE",
+  "KEY_PASSPHRASE",
+  "ADMIN_TOKEN",
+  "ADMIN_REQUIRE_CLIENT_CERT",
+  "TLS_CERT_FILE",
+  "TLS_KEY_FILE",
+  "TLS_CLIENT_CA_FILE",
+  "TLS_RELOAD_INTERVAL",
+  "TLS_DEV_MODE",
+  "TLS_DEV_DIR",
+  "TLS_DEV_HOSTS",
+}
 
-var ip_ranges []Ip_Range
+// Variables ending in one of these markers hold secrets. Paths such as
+// TLS_KEY_FILE end in _FILE and are reported as is.
+var secretMarkers = []string{"TOKEN", "SECRET", "PASSWORD", "PASSPHRASE", "KEY", "DSN"}
 
-func setLogLevel() {
-  logLevel = GetEnv("LOG_LEVEL", "INFO")
-}
+const redacted = "[REDACTED]"
 
-func GetLogLevel() string {
-  return logLevel
+// Size returns the number of addresses in the range, inclusive of both ends.
+func (r Ip_Range) Size() int64 {
+  return ipToInt64(r.End) - ipToInt64(r.Start) + 1
 }
 
-func GetIpRanges() []Ip_Range {
-  return ip_ranges
+func (r Ip_Range) Contains(ip net.IP) bool {
+  if ip.To4() == nil {
+    return false
+  }
+  n := ipToInt64(ip)
+  return n >= ipToInt64(r.Start) && n <= ipToInt64(r.End)
 }
 
-func LoadEnv(provided_path string) {
-  err := godotenv.Load(provided_path)
-  if err != nil {
-    log.Println("No .env file found, using default environment variables")
+func ipToInt64(ip net.IP) int64 {
+  v4 := ip.To4()
+  if v4 == nil {
+    return 0
   }
-  setLogLevel()
-  ip_ranges, _ = generateIPRanges(GetEnv("BACKEND_WG_IP", "10.0.0.1"), GetEnv("WG_NETWORK_MASK", "/24"))
-  for i, r := range ip_ranges {
-    fmt.Printf("Range %d: Start = %s, End = %s\n", i+1, r.Start.String(), r.End.String())
+  return int64(binary.BigEndian.Uint32(v4))
+}
+
+// LoadEnv reads provided_path into the process environment and sets up
+// logging, returning the log level that can be changed at runtime. The typed
+// configuration is built from it with Load.
+func LoadEnv(provided_path string) *slog.LevelVar {
+  envErr := godotenv.Load(provided_path)
+  level := setupLogger()
+  if envErr != nil {
+    slog.Warn("no .env file found, using default environment variables", "path", provided_path)
   }
+  return level
+}
 
+func setupLogger() *slog.LevelVar {
+  format := GetEnv("LOG_FORMAT", "text")
+  levelName := GetEnv("LOG_LEVEL", "INFO")
+  level, err := logger.Init(format, levelName)
+  if err != nil {
+    level, _ = logger.Init("text", "INFO")
+    slog.Warn("invalid logging configuration, falling back to text/INFO", "format", format, "level", levelName, "err", err)
+  }
+  return level
 }
 
 func GetEnv(key, defaultValue string) string {
@@ -55,6 +391,22 @@ func GetEnv(key, defaultValue string) string {
   return defaultValue
 }
 
+// GetDuration parses key as a time.Duration such as "5s" or "15m", falling
+// back to defaultValue when it is unset or invalid.
+func GetDuration(key string, defaultValue time.Duration) time.Duration {
+  value, exists := os.LookupEnv(key)
+  if !exists || value == "" {
+    return defaultValue
+  }
+
+  d, err := time.ParseDuration(value)
+  if err != nil || d <= 0 {
+    slog.Warn("invalid duration, using default", "key", key, "value", value, "default", defaultValue)
+    return defaultValue
+  }
+  return d
+}
+
 func generateIPRanges(serverIP, mask string) ([]Ip_Range, error) {
   _, ipNet, err := net.ParseCIDR(serverIP + mask)
   if err != nil {
@@ -89,3 +441,34 @@ func generateIPRanges(serverIP, mask string) ([]Ip_Range, error) {
   return ranges, nil
 
 }
+
+// Redact returns value, or a placeholder when key names a secret.
+func Redact(key, value string) string {
+  if isSecret(key) && value != "" {
+    return redacted
+  }
+  return value
+}
+
+func isSecret(key string) bool {
+  for _, marker := range secretMarkers {
+    if strings.HasSuffix(key, marker) {
+      return true
+    }
+  }
+  return false
+}
+
+// Snapshot returns the configuration variables that are currently set, with
+// the values of secrets replaced by a placeholder.
+func Snapshot() map[string]string {
+  snapshot := make(map[string]string)
+  for _, key := range knownKeys {
+    value, exists := os.LookupEnv(key)
+    if !exists {
+      continue
+    }
+    snapshot[key] = Redact(key, value)
+  }
+  return snapshot
+}
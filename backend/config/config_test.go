@@ -2,7 +2,10 @@ package config
 
 import (
   "net"
+  "os"
+  "path/filepath"
   "testing"
+  "time"
 )
 
 func TestGenerateIPRanges(t *testing.T) {
@@ -101,3 +104,144 @@ func TestGenerateIPRanges(t *testing.T) {
     })
   }
 }
+
+func TestIpRangeSizeAndContains(t *testing.T) {
+  r := Ip_Range{Start: net.ParseIP("10.0.0.1").To4(), End: net.ParseIP("10.0.0.254").To4()}
+
+  if r.Size() != 254 {
+    t.Errorf("expected size 254, got %d", r.Size())
+  }
+
+  tests := []struct {
+    ip       string
+    expected bool
+  }{
+    {ip: "10.0.0.1", expected: true},
+    {ip: "10.0.0.254", expected: true},
+    {ip: "10.0.0.0", expected: false},
+    {ip: "10.0.1.1", expected: false},
+    {ip: "::1", expected: false},
+  }
+
+  for _, tt := range tests {
+    if got := r.Contains(net.ParseIP(tt.ip)); got != tt.expected {
+      t.Errorf("Contains(%s) = %v, expected %v", tt.ip, got, tt.expected)
+    }
+  }
+}
+
+func TestSnapshotRedactsSecrets(t *testing.T) {
+  t.Setenv("ADMIN_TOKEN", "super-secret")
+  t.Setenv("PORT", "9090")
+  t.Setenv("TLS_KEY_FILE", "/etc/elysium/server.key")
+
+  snapshot := Snapshot()
+  if snapshot["ADMIN_TOKEN"] != redacted {
+    t.Errorf("expected ADMIN_TOKEN to be redacted, got %q", snapshot["ADMIN_TOKEN"])
+  }
+  if snapshot["TLS_KEY_FILE"] != "/etc/elysium/server.key" {
+    t.Errorf("expected TLS_KEY_FILE path not to be redacted, got %q", snapshot["TLS_KEY_FILE"])
+  }
+  if snapshot["PORT"] != "9090" {
+    t.Errorf("expected PORT to be reported, got %q", snapshot["PORT"])
+  }
+}
+
+func TestGetDuration(t *testing.T) {
+  t.Setenv("DB_QUERY_TIMEOUT", "250ms")
+  if got := GetDuration("DB_QUERY_TIMEOUT", time.Second); got != 250*time.Millisecond {
+    t.Errorf("expected 250ms, got %s", got)
+  }
+
+  t.Setenv("DB_QUERY_TIMEOUT", "soon")
+  if got := GetDuration("DB_QUERY_TIMEOUT", time.Second); got != time.Second {
+    t.Errorf("expected default for invalid value, got %s", got)
+  }
+
+  if got := GetDuration("UNSET_DURATION_KEY", 3*time.Second); got != 3*time.Second {
+    t.Errorf("expected default for unset key, got %s", got)
+  }
+}
+
+func TestLoad(t *testing.T) {
+  t.Setenv("BACKEND_WG_IP", "10.1.0.1")
+  t.Setenv("WG_NETWORK_MASK", "/29")
+  t.Setenv("BACKEND_WG_PORT", "51999")
+  t.Setenv("COMPILE_ARGS", "--features  extra")
+  t.Setenv("ADMIN_REQUIRE_CLIENT_CERT", "true")
+  t.Setenv("DB_NAME", "test.db")
+  t.Setenv("TLS_DEV_MODE", "true")
+  t.Setenv("TLS_DEV_HOSTS", "vpn.example.com,10.1.0.1")
+
+  cfg, err := Load()
+  if err != nil {
+    t.Fatalf("Load failed: %v", err)
+  }
+
+  if cfg.WireGuard.Port != 51999 || !cfg.WireGuard.IP.Equal(net.ParseIP("10.1.0.1")) {
+    t.Errorf("unexpected WireGuard config: %+v", cfg.WireGuard)
+  }
+  if len(cfg.IPRanges) != 1 || !cfg.IPRanges[0].End.Equal(net.ParseIP("10.1.0.6")) {
+    t.Errorf("unexpected IP ranges: %v", cfg.IPRanges)
+  }
+  if len(cfg.Build.CompileArgs) != 2 || cfg.Build.CompileArgs[1] != "extra" {
+    t.Errorf("unexpected compile args: %q", cfg.Build.CompileArgs)
+  }
+  if !cfg.AdminRequireClientCert || cfg.Port != "8080" || cfg.Build.Backend != BuildBackendCargo {
+    t.Errorf("unexpected defaults: %+v", cfg)
+  }
+  if cfg.Database.Driver != "sqlite" || cfg.Database.DSN != "test.db" {
+    t.Errorf("unexpected database config: %+v", cfg.Database)
+  }
+  if !cfg.TLS.DevMode || len(cfg.TLS.DevHosts) != 2 || cfg.TLS.DevDir != "config/tls" || cfg.TLS.ReloadInterval != 30*time.Second {
+    t.Errorf("unexpected TLS config: %+v", cfg.TLS)
+  }
+  t.Setenv("DB_DSN", "file:other.db")
+  if db := LoadDatabase(); db.DSN != "file:other.db" {
+    t.Errorf("expected DB_DSN to take precedence over DB_NAME, got %q", db.DSN)
+  }
+
+  t.Setenv("TLS_RELOAD_INTERVAL", "often")
+  if _, err := Load(); err == nil {
+    t.Error("expected an invalid TLS reload interval to be rejected")
+  }
+  t.Setenv("TLS_RELOAD_INTERVAL", "30s")
+
+  t.Setenv("BUILD_BACKEND", "make")
+  if _, err := Load(); err == nil {
+    t.Error("expected an unknown build backend to be rejected")
+  }
+  t.Setenv("BUILD_BACKEND", BuildBackendContainer)
+
+  t.Setenv("BACKEND_WG_PORT", "port")
+  if _, err := Load(); err == nil {
+    t.Error("expected an invalid port to be rejected")
+  }
+}
+
+func TestLoadTargets(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "targets.json")
+  os.WriteFile(path, []byte(`[
+    {"triple": "x86_64-unknown-linux-musl", "linker": "musl-gcc", "env": {"CC": "musl-gcc"}},
+    {"triple": "x86_64-pc-windows-gnu", "suffix": ".exe", "enabled": false}
+  ]`), 0o644)
+
+  targets, err := LoadTargets(path)
+  if err != nil {
+    t.Fatalf("LoadTargets failed: %v", err)
+  }
+  if len(targets) != 2 || !targets[0].Enabled || targets[0].Env["CC"] != "musl-gcc" || targets[1].Enabled || targets[1].Suffix != ".exe" {
+    t.Errorf("unexpected targets %+v", targets)
+  }
+
+  for name, content := range map[string]string{
+    "duplicate": `[{"triple": "a"}, {"triple": "a"}]`,
+    "no triple": `[{"suffix": ".exe"}]`,
+    "none enabled": `[{"triple": "a", "enabled": false}]`,
+  } {
+    os.WriteFile(path, []byte(content), 0o644)
+    if _, err := LoadTargets(path); err == nil {
+      t.Errorf("%s: expected an error", name)
+    }
+  }
+}
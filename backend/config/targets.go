@@ -0,0 +1,77 @@
+package config
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "os"
+)
+
+// TargetConfig describes a platform the client can be built for. Linker,
+// when set, is passed to rustc and must be on PATH; RustFlags and Env are
+// added to the environment cargo runs in.
+type TargetConfig struct {
+  Triple    string            `json:"triple"`
+  Suffix    string            `json:"suffix"`
+  Linker    string            `json:"linker"`
+  RustFlags string            `json:"rustflags"`
+  Env       map[string]string `json:"env"`
+  Enabled   bool              `json:"enabled"`
+}
+
+// DefaultTargets are used when BUILD_TARGETS_FILE is not set.
+func DefaultTargets() []TargetConfig {
+  return []TargetConfig{
+    {Triple: "x86_64-unknown-linux-musl", Linker: "x86_64-linux-gnu-gcc", Enabled: true},
+    {Triple: "aarch64-unknown-linux-musl", Enabled: true},
+    {Triple: "x86_64-pc-windows-gnu", Suffix: ".exe", Enabled: true},
+  }
+}
+
+// LoadTargets reads a JSON array of targets from path. Targets without an
+// "enabled" field are enabled.
+func LoadTargets(path string) ([]TargetConfig, error) {
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+
+  var raw []json.RawMessage
+  if err := json.Unmarshal(data, &raw); err != nil {
+    return nil, fmt.Errorf("invalid targets file %s: %w", path, err)
+  }
+
+  targets := make([]TargetConfig, 0, len(raw))
+  for _, r := range raw {
+    target := TargetConfig{Enabled: true}
+    if err := json.Unmarshal(r, &target); err != nil {
+      return nil, fmt.Errorf("invalid targets file %s: %w", path, err)
+    }
+    targets = append(targets, target)
+  }
+  if err := validateTargets(targets); err != nil {
+    return nil, fmt.Errorf("invalid targets file %s: %w", path, err)
+  }
+  return targets, nil
+}
+
+func validateTargets(targets []TargetConfig) error {
+  seen := make(map[string]bool)
+  enabled := 0
+  for _, target := range targets {
+    if target.Triple == "" {
+      return errors.New("target without a triple")
+    }
+    if seen[target.Triple] {
+      return fmt.Errorf("target %s is defined twice", target.Triple)
+    }
+    seen[target.Triple] = true
+    if target.Enabled {
+      enabled++
+    }
+  }
+  if enabled == 0 {
+    return errors.New("no target is enabled")
+  }
+  return nil
+}
@@ -0,0 +1,112 @@
+// Package audit writes the append-only audit log. Middleware attaches the
+// request metadata every event needs; handlers and services then describe
+// what changed with Record.
+package audit
+
+import (
+  "context"
+  "elysium-backend/internal/models"
+  "elysium-backend/pkg/logger"
+  "encoding/json"
+  "sync"
+  "time"
+)
+
+// SystemActor is recorded for changes the server makes on its own, such as
+// configuring the WireGuard device at startup.
+const SystemActor = "system"
+
+// AnonymousActor is recorded for requests that did not authenticate.
+const AnonymousActor = "anonymous"
+
+// Recorder persists audit events.
+type Recorder interface {
+  InsertAuditEvent(ctx context.Context, event *models.AuditEvent) error
+}
+
+type ctxKey struct{}
+
+// requestInfo is shared between Middleware and the handlers below it, so
+// the actor can be filled in once authentication succeeded.
+type requestInfo struct {
+  mu        sync.Mutex
+  actor     string
+  sourceIP  string
+  requestID string
+  recorded  bool
+}
+
+func withRequestInfo(ctx context.Context, info *requestInfo) context.Context {
+  return context.WithValue(ctx, ctxKey{}, info)
+}
+
+func fromContext(ctx context.Context) *requestInfo {
+  if ctx != nil {
+    if info, ok := ctx.Value(ctxKey{}).(*requestInfo); ok {
+      return info
+    }
+  }
+  return nil
+}
+
+// SetActor records who is making the current request.
+func SetActor(ctx context.Context, actor string) {
+  if info := fromContext(ctx); info != nil {
+    info.mu.Lock()
+    info.actor = actor
+    info.mu.Unlock()
+  }
+}
+
+// Actor returns the actor of the current request, SystemActor outside of
+// one.
+func Actor(ctx context.Context) string {
+  info := fromContext(ctx)
+  if info == nil {
+    return SystemActor
+  }
+  info.mu.Lock()
+  defer info.mu.Unlock()
+  return info.actor
+}
+
+// Record writes an event for action on target. before and after are stored
+// as JSON and may be nil. Failures are logged rather than returned: the
+// change itself has already happened and must not be reported as failed.
+func Record(ctx context.Context, rec Recorder, action, target string, before, after any) {
+  event := &models.AuditEvent{
+    OccurredAt: time.Now().UTC(),
+    Actor:      SystemActor,
+    Action:     action,
+    Target:     target,
+    Before:     marshal(ctx, before),
+    After:      marshal(ctx, after),
+  }
+
+  if info := fromContext(ctx); info != nil {
+    info.mu.Lock()
+    event.Actor = info.actor
+    event.SourceIP = info.sourceIP
+    event.RequestID = info.requestID
+    info.recorded = true
+    info.mu.Unlock()
+  }
+
+  // The event is written even if the request was cancelled after the
+  // change was made.
+  if err := rec.InsertAuditEvent(context.WithoutCancel(ctx), event); err != nil {
+    logger.FromContext(ctx).Error("failed to write audit event", "action", action, "target", target, "err", err)
+  }
+}
+
+func marshal(ctx context.Context, v any) json.RawMessage {
+  if v == nil {
+    return nil
+  }
+  raw, err := json.Marshal(v)
+  if err != nil {
+    logger.FromContext(ctx).Warn("unable to encode audit state", "err", err)
+    return nil
+  }
+  return raw
+}
@@ -0,0 +1,65 @@
+package audit
+
+import (
+  "elysium-backend/pkg/logger"
+  "net"
+  "net/http"
+
+  "github.com/gorilla/mux"
+)
+
+func isMutating(method string) bool {
+  switch method {
+  case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+    return true
+  }
+  return false
+}
+
+// Middleware attaches the source address and request ID to the request
+// context for Record. Mutating requests whose handler did not record a more
+// specific event are logged as "http.<METHOD>" against the matched route
+// with the response status. Anonymous requests rejected with a 4xx status
+// are left to the request log: anyone can send them, and recording each one
+// would let them grow the append-only table without bound.
+func Middleware(rec Recorder) mux.MiddlewareFunc {
+  return func(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      sourceIP, _, err := net.SplitHostPort(r.RemoteAddr)
+      if err != nil {
+        sourceIP = r.RemoteAddr
+      }
+
+      info := &requestInfo{
+        actor:     AnonymousActor,
+        sourceIP:  sourceIP,
+        requestID: w.Header().Get(logger.RequestIDHeader),
+      }
+      ctx := withRequestInfo(r.Context(), info)
+
+      sr := logger.NewStatusRecorder(w)
+      next.ServeHTTP(sr, r.WithContext(ctx))
+
+      info.mu.Lock()
+      recorded, actor := info.recorded, info.actor
+      info.mu.Unlock()
+      if recorded || !isMutating(r.Method) {
+        return
+      }
+      if actor == AnonymousActor && sr.Status >= 400 && sr.Status < 500 {
+        return
+      }
+
+      route := r.URL.Path
+      if current := mux.CurrentRoute(r); current != nil {
+        if tpl, err := current.GetPathTemplate(); err == nil {
+          route = tpl
+        }
+      }
+      Record(ctx, rec, "http."+r.Method, route, nil, map[string]any{
+        "path":   r.URL.Path,
+        "status": sr.Status,
+      })
+    })
+  }
+}
@@ -0,0 +1,39 @@
+package fakes
+
+import (
+  "context"
+  "elysium-backend/internal/models"
+  "encoding/binary"
+  "net"
+  "sync"
+)
+
+// Allocator hands out consecutive addresses starting at Next. Err, when
+// set, is returned instead.
+type Allocator struct {
+  // Mutex is the batch lock callers hold; mu guards Next.
+  sync.Mutex
+  mu   sync.Mutex
+  Next net.IP
+  Err  error
+}
+
+// NewAllocator returns an allocator whose first address is start.
+func NewAllocator(start net.IP) *Allocator {
+  return &Allocator{Next: start.To4()}
+}
+
+func (a *Allocator) Allocate(ctx context.Context, peer *models.Peer) error {
+  a.mu.Lock()
+  defer a.mu.Unlock()
+
+  if a.Err != nil {
+    return a.Err
+  }
+  peer.AssignedIP = a.Next
+
+  next := make(net.IP, 4)
+  binary.BigEndian.PutUint32(next, binary.BigEndian.Uint32(a.Next.To4())+1)
+  a.Next = next
+  return nil
+}
@@ -0,0 +1,90 @@
+package fakes
+
+import (
+  "context"
+  "crypto/sha256"
+  "elysium-backend/internal/models"
+  "elysium-backend/internal/services"
+  "encoding/hex"
+  "fmt"
+  "os"
+  "path/filepath"
+  "sync"
+)
+
+// Builder writes a small placeholder artifact describing the request into
+// OutputDir instead of running cargo, so download links returned by the
+// API resolve to a real file. Its output depends only on the request and
+// on how many builds came before it, so tests can predict artifact paths,
+// contents and digests. Each build writes one line of output, before Err,
+// when set, fails it.
+type Builder struct {
+  mu        sync.Mutex
+  OutputDir string
+  Requests  []services.BuildRequest
+  Err       error
+  draining  bool
+}
+
+func NewBuilder(outputDir string) *Builder {
+  return &Builder{OutputDir: outputDir}
+}
+
+// Content returns the artifact the builder produces for req.
+func (b *Builder) Content(req services.BuildRequest) []byte {
+  return []byte(fmt.Sprintf("fake client %s for %s at %s with %s\n", req.ID, req.Target, req.Bundle.AssignedIP, req.Bundle.PublicKey))
+}
+
+func (b *Builder) Build(ctx context.Context, req services.BuildRequest) (*services.BuildResult, error) {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+
+  if b.draining {
+    return nil, services.ErrShuttingDown
+  }
+  if err := ctx.Err(); err != nil {
+    return nil, err
+  }
+  if req.Output != nil {
+    req.Output(fmt.Sprintf("fake build for %s", req.Target))
+  }
+  if b.Err != nil {
+    return nil, b.Err
+  }
+
+  b.Requests = append(b.Requests, req)
+
+  relativePath := filepath.Join(fmt.Sprintf("%d", len(b.Requests)), "elysium-client")
+  destPath := filepath.Join(b.OutputDir, relativePath)
+  if err := os.MkdirAll(filepath.Dir(destPath), 0o755); err != nil {
+    return nil, err
+  }
+  content := b.Content(req)
+  if err := os.WriteFile(destPath, content, 0o644); err != nil {
+    return nil, err
+  }
+  digest := sha256.Sum256(content)
+  return &services.BuildResult{
+    ArtifactPath: relativePath,
+    Logs:         []string{fmt.Sprintf("fake build for %s", req.Target)},
+    SHA256:       hex.EncodeToString(digest[:]),
+    Provenance: &models.BuildProvenance{
+      CacheKey:     "fake",
+      CargoVersion: "cargo 0.0.0 (fake)",
+      RustcVersion: "rustc 0.0.0 (fake)",
+      Backend:      "fake",
+      Target:       req.Target,
+    },
+  }, nil
+}
+
+func (b *Builder) CheckToolchain(ctx context.Context) error {
+  return nil
+}
+
+func (b *Builder) Shutdown(ctx context.Context) error {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  b.draining = true
+  return nil
+}
@@ -0,0 +1,13 @@
+// Package fakes provides in-memory implementations of the interfaces in
+// internal/services, so handlers can be exercised without a database,
+// WireGuard or a Rust toolchain.
+package fakes
+
+import "elysium-backend/internal/services"
+
+var (
+  _ services.Store     = (*Store)(nil)
+  _ services.Allocator = (*Allocator)(nil)
+  _ services.WireGuard = (*WireGuard)(nil)
+  _ services.Builder   = (*Builder)(nil)
+)
@@ -0,0 +1,808 @@
+package fakes
+
+import (
+  "context"
+  "database/sql"
+  "elysium-backend/internal/models"
+  "fmt"
+  "net"
+  "sync"
+  "time"
+
+  "github.com/google/uuid"
+)
+
+// Store keeps peers, download links, artifacts, key rotations and audit
+// events in memory.
+// Like the SQL schema it rejects two peers sharing an address. Err, when
+// set, is returned from every call.
+type Store struct {
+  mu        sync.Mutex
+  peers     []models.Peer
+  events    []models.AuditEvent
+  links     []models.DownloadLink
+  artifacts []models.Artifact
+  builds    []models.Build
+  buildLogs map[uuid.UUID][]models.BuildLogLine
+  bulkJobs  []models.BulkJob
+  rotations []models.KeyRotation
+  Err       error
+}
+
+func NewStore() *Store {
+  return &Store{}
+}
+
+func (s *Store) InsertPeer(ctx context.Context, peer *models.Peer) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return s.Err
+  }
+  return s.insertPeer(peer)
+}
+
+func (s *Store) insertPeer(peer *models.Peer) error {
+  if err := s.checkIP(peer.AssignedIP); err != nil {
+    return err
+  }
+
+  id := uuid.New()
+  peer.ID = &id
+  s.peers = append(s.peers, *peer)
+  return nil
+}
+
+func (s *Store) checkIP(ip net.IP) error {
+  for _, existing := range s.peers {
+    if existing.AssignedIP.Equal(ip) {
+      return fmt.Errorf("assigned_ip %s is already in use", ip)
+    }
+  }
+  return nil
+}
+
+func (s *Store) IsIpAvailable(ctx context.Context, ip net.IP) (bool, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return false, s.Err
+  }
+  for _, peer := range s.peers {
+    if peer.AssignedIP.Equal(ip) {
+      return false, nil
+    }
+  }
+  return true, nil
+}
+
+func (s *Store) GetPeer(ctx context.Context, id uuid.UUID) (*models.Peer, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return nil, s.Err
+  }
+  for _, peer := range s.peers {
+    if *peer.ID == id {
+      found := peer
+      return &found, nil
+    }
+  }
+  return nil, sql.ErrNoRows
+}
+
+func (s *Store) GetAllPeer(ctx context.Context) ([]models.Peer, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return nil, s.Err
+  }
+  return append([]models.Peer(nil), s.peers...), nil
+}
+
+func (s *Store) GetAssignedIPs(ctx context.Context) ([]net.IP, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return nil, s.Err
+  }
+  var ips []net.IP
+  for _, peer := range s.peers {
+    ips = append(ips, peer.AssignedIP)
+  }
+  return ips, nil
+}
+
+func (s *Store) CountPeersByStatus(ctx context.Context) (map[string]int, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return nil, s.Err
+  }
+  counts := make(map[string]int)
+  for _, peer := range s.peers {
+    counts[peer.Status]++
+  }
+  return counts, nil
+}
+
+func (s *Store) SetPeerStatus(ctx context.Context, id uuid.UUID, status string) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return s.Err
+  }
+  now := time.Now().UTC()
+  for i := range s.peers {
+    if *s.peers[i].ID == id {
+      s.peers[i].Status = status
+      s.peers[i].UpdatedOn = now
+      if status == models.PeerStatusDisabled {
+        s.revokeLinks(id, now)
+      }
+      return nil
+    }
+  }
+  return sql.ErrNoRows
+}
+
+func (s *Store) SetPeerPresharedKey(ctx context.Context, id uuid.UUID, sealed string) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return s.Err
+  }
+  for i := range s.peers {
+    if *s.peers[i].ID == id {
+      s.peers[i].PresharedKey = sealed
+      s.peers[i].UpdatedOn = time.Now().UTC()
+      return nil
+    }
+  }
+  return sql.ErrNoRows
+}
+
+func (s *Store) SetPeersLastSeen(ctx context.Context, seen map[string]time.Time) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return s.Err
+  }
+  for i := range s.peers {
+    at, ok := seen[s.peers[i].PublicKey]
+    if !ok || s.peers[i].PublicKey == "" || (s.peers[i].LastSeen != nil && !at.After(*s.peers[i].LastSeen)) {
+      continue
+    }
+    at = at.UTC()
+    s.peers[i].LastSeen = &at
+  }
+  return nil
+}
+
+func (s *Store) UpdatePeer(ctx context.Context, peer *models.Peer) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return s.Err
+  }
+  return s.updatePeer(peer)
+}
+
+func (s *Store) updatePeer(peer *models.Peer) error {
+  for _, existing := range s.peers {
+    if *existing.ID != *peer.ID && existing.AssignedIP.Equal(peer.AssignedIP) {
+      return fmt.Errorf("assigned_ip %s is already in use", peer.AssignedIP)
+    }
+  }
+  now := time.Now().UTC()
+  for i := range s.peers {
+    if *s.peers[i].ID == *peer.ID {
+      wasDisabled := s.peers[i].Status == models.PeerStatusDisabled
+      peer.UpdatedOn = now
+      s.peers[i].PublicKey = peer.PublicKey
+      s.peers[i].AssignedIP = peer.AssignedIP
+      s.peers[i].Status = peer.Status
+      s.peers[i].IsGateway = peer.IsGateway
+      s.peers[i].Metadata = peer.Metadata
+      s.peers[i].UpdatedOn = now
+      if peer.Status == models.PeerStatusDisabled && !wasDisabled {
+        s.revokeLinks(*peer.ID, now)
+      }
+      return nil
+    }
+  }
+  return sql.ErrNoRows
+}
+
+func (s *Store) DeletePeer(ctx context.Context, id uuid.UUID) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return s.Err
+  }
+  return s.deletePeer(id)
+}
+
+func (s *Store) deletePeer(id uuid.UUID) error {
+  for i := range s.peers {
+    if *s.peers[i].ID == id {
+      s.peers = append(s.peers[:i], s.peers[i+1:]...)
+      links := s.links[:0]
+      for _, link := range s.links {
+        if link.PeerID != id {
+          links = append(links, link)
+        }
+      }
+      s.links = links
+      return nil
+    }
+  }
+  return sql.ErrNoRows
+}
+
+// ApplyPeerChanges applies the changes in order and restores the peers and
+// links when one of them fails.
+func (s *Store) ApplyPeerChanges(ctx context.Context, deletes []uuid.UUID, updates, creates []*models.Peer) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return s.Err
+  }
+  peers := append([]models.Peer(nil), s.peers...)
+  links := append([]models.DownloadLink(nil), s.links...)
+  err := func() error {
+    for _, id := range deletes {
+      if err := s.deletePeer(id); err != nil {
+        return err
+      }
+    }
+    for _, peer := range updates {
+      if err := s.updatePeer(peer); err != nil {
+        return err
+      }
+    }
+    for _, peer := range creates {
+      if err := s.insertPeer(peer); err != nil {
+        return err
+      }
+    }
+    return nil
+  }()
+  if err != nil {
+    s.peers, s.links = peers, links
+  }
+  return err
+}
+
+func (s *Store) revokeLinks(peerID uuid.UUID, now time.Time) {
+  for i := range s.links {
+    if s.links[i].PeerID == peerID && s.links[i].RevokedAt == nil {
+      s.links[i].RevokedAt = &now
+    }
+  }
+}
+
+func (s *Store) InsertDownloadLink(ctx context.Context, link *models.DownloadLink) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return s.Err
+  }
+  s.links = append(s.links, *link)
+  return nil
+}
+
+func (s *Store) ConsumeDownloadLink(ctx context.Context, id string, now, resumeUntil time.Time) (*models.DownloadLink, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return nil, s.Err
+  }
+  for i := range s.links {
+    link := &s.links[i]
+    if link.ID != id {
+      continue
+    }
+    if link.RevokedAt != nil || link.Uses >= link.MaxUses || !link.ExpiresAt.After(now) {
+      break
+    }
+    link.Uses++
+    link.ResumeUntil = &resumeUntil
+    found := *link
+    return &found, nil
+  }
+  return nil, sql.ErrNoRows
+}
+
+func (s *Store) FinishDownload(ctx context.Context, id string) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return s.Err
+  }
+  for i := range s.links {
+    if s.links[i].ID == id {
+      s.links[i].ResumeUntil = nil
+    }
+  }
+  return nil
+}
+
+func (s *Store) GetDownloadLink(ctx context.Context, id string) (*models.DownloadLink, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return nil, s.Err
+  }
+  for _, link := range s.links {
+    if link.ID == id {
+      return &link, nil
+    }
+  }
+  return nil, sql.ErrNoRows
+}
+
+func (s *Store) GetDownloadLinks(ctx context.Context, peerID uuid.UUID) ([]models.DownloadLink, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return nil, s.Err
+  }
+  var links []models.DownloadLink
+  for _, link := range s.links {
+    if link.PeerID == peerID {
+      links = append(links, link)
+    }
+  }
+  return links, nil
+}
+
+func (s *Store) InsertArtifact(ctx context.Context, artifact *models.Artifact) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return s.Err
+  }
+  s.artifacts = append(s.artifacts, *artifact)
+  return nil
+}
+
+func (s *Store) GetArtifact(ctx context.Context, id uuid.UUID) (*models.Artifact, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return nil, s.Err
+  }
+  for _, artifact := range s.artifacts {
+    if artifact.ID == id {
+      return &artifact, nil
+    }
+  }
+  return nil, sql.ErrNoRows
+}
+
+func (s *Store) GetArtifactByPath(ctx context.Context, path string) (*models.Artifact, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return nil, s.Err
+  }
+  for _, artifact := range s.artifacts {
+    if artifact.Path == path {
+      return &artifact, nil
+    }
+  }
+  return nil, sql.ErrNoRows
+}
+
+func (s *Store) ListArtifacts(ctx context.Context, peerID *uuid.UUID) ([]models.Artifact, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return nil, s.Err
+  }
+  var artifacts []models.Artifact
+  for _, artifact := range s.artifacts {
+    if peerID == nil || (artifact.PeerID != nil && *artifact.PeerID == *peerID) {
+      artifacts = append(artifacts, artifact)
+    }
+  }
+  return artifacts, nil
+}
+
+func (s *Store) ListCollectableArtifacts(ctx context.Context, now time.Time) ([]models.Artifact, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return nil, s.Err
+  }
+  var artifacts []models.Artifact
+  for _, artifact := range s.artifacts {
+    if !artifact.ExpiresAt.After(now) || artifact.PeerID == nil || !s.hasPeer(*artifact.PeerID) {
+      artifacts = append(artifacts, artifact)
+    }
+  }
+  return artifacts, nil
+}
+
+func (s *Store) hasPeer(id uuid.UUID) bool {
+  for _, peer := range s.peers {
+    if *peer.ID == id {
+      return true
+    }
+  }
+  return false
+}
+
+func (s *Store) DeleteArtifact(ctx context.Context, id uuid.UUID) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return s.Err
+  }
+  for i, artifact := range s.artifacts {
+    if artifact.ID == id {
+      s.artifacts = append(s.artifacts[:i], s.artifacts[i+1:]...)
+      return nil
+    }
+  }
+  return sql.ErrNoRows
+}
+
+func (s *Store) InsertBuild(ctx context.Context, build *models.Build) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return s.Err
+  }
+  s.builds = append(s.builds, *build)
+  return nil
+}
+
+func (s *Store) FinishBuild(ctx context.Context, build *models.Build) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return s.Err
+  }
+  for i := range s.builds {
+    if s.builds[i].ID == build.ID {
+      s.builds[i] = *build
+      return nil
+    }
+  }
+  return sql.ErrNoRows
+}
+
+func (s *Store) GetBuild(ctx context.Context, id uuid.UUID) (*models.Build, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return nil, s.Err
+  }
+  for _, build := range s.builds {
+    if build.ID == id {
+      return &build, nil
+    }
+  }
+  return nil, sql.ErrNoRows
+}
+
+func (s *Store) ListBuilds(ctx context.Context, status string, limit int) ([]models.Build, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return nil, s.Err
+  }
+  var builds []models.Build
+  for i := len(s.builds) - 1; i >= 0 && len(builds) < limit; i-- {
+    if status == "" || s.builds[i].Status == status {
+      builds = append(builds, s.builds[i])
+    }
+  }
+  return builds, nil
+}
+
+func (s *Store) InsertBuildLogs(ctx context.Context, buildID uuid.UUID, lines []models.BuildLogLine) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return s.Err
+  }
+  if s.buildLogs == nil {
+    s.buildLogs = make(map[uuid.UUID][]models.BuildLogLine)
+  }
+  s.buildLogs[buildID] = append(s.buildLogs[buildID], lines...)
+  return nil
+}
+
+func (s *Store) ListBuildLogs(ctx context.Context, buildID uuid.UUID, afterSeq int) ([]models.BuildLogLine, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return nil, s.Err
+  }
+  var lines []models.BuildLogLine
+  for _, line := range s.buildLogs[buildID] {
+    if line.Seq > afterSeq {
+      lines = append(lines, line)
+    }
+  }
+  return lines, nil
+}
+
+// InsertBulkJob stores job and peers, or none of them when an address is
+// taken.
+func (s *Store) InsertBulkJob(ctx context.Context, job *models.BulkJob, peers []*models.Peer) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return s.Err
+  }
+  for i, peer := range peers {
+    if err := s.checkIP(peer.AssignedIP); err != nil {
+      return err
+    }
+    for _, other := range peers[:i] {
+      if other.AssignedIP.Equal(peer.AssignedIP) {
+        return fmt.Errorf("assigned_ip %s is already in use", peer.AssignedIP)
+      }
+    }
+  }
+
+  for i, peer := range peers {
+    id := uuid.New()
+    peer.ID = &id
+    s.peers = append(s.peers, *peer)
+    job.Items[i].PeerID = &id
+  }
+  stored := *job
+  stored.Items = append([]models.BulkJobItem(nil), job.Items...)
+  s.bulkJobs = append(s.bulkJobs, stored)
+  return nil
+}
+
+func (s *Store) UpdateBulkJobItem(ctx context.Context, jobID uuid.UUID, item *models.BulkJobItem) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return s.Err
+  }
+  for i := range s.bulkJobs {
+    if s.bulkJobs[i].ID == jobID && item.Seq >= 1 && item.Seq <= len(s.bulkJobs[i].Items) {
+      s.bulkJobs[i].Items[item.Seq-1] = *item
+      return nil
+    }
+  }
+  return sql.ErrNoRows
+}
+
+func (s *Store) FinishBulkJob(ctx context.Context, job *models.BulkJob) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return s.Err
+  }
+  for i := range s.bulkJobs {
+    if s.bulkJobs[i].ID == job.ID {
+      s.bulkJobs[i].Status = job.Status
+      s.bulkJobs[i].FinishedAt = job.FinishedAt
+      return nil
+    }
+  }
+  return sql.ErrNoRows
+}
+
+func (s *Store) GetBulkJob(ctx context.Context, id uuid.UUID) (*models.BulkJob, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return nil, s.Err
+  }
+  for _, job := range s.bulkJobs {
+    if job.ID == id {
+      found := job
+      found.Items = append([]models.BulkJobItem(nil), job.Items...)
+      return &found, nil
+    }
+  }
+  return nil, sql.ErrNoRows
+}
+
+func (s *Store) ListBulkJobIDs(ctx context.Context, status string) ([]uuid.UUID, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return nil, s.Err
+  }
+  var ids []uuid.UUID
+  for _, job := range s.bulkJobs {
+    if job.Status == status {
+      ids = append(ids, job.ID)
+    }
+  }
+  return ids, nil
+}
+
+func (s *Store) InsertKeyRotation(ctx context.Context, rotation *models.KeyRotation) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return s.Err
+  }
+  stored := *rotation
+  stored.Peers = append([]models.KeyRotationPeer(nil), rotation.Peers...)
+  s.rotations = append(s.rotations, stored)
+  return nil
+}
+
+func (s *Store) InsertKeyRotationPeer(ctx context.Context, rotationID uuid.UUID, peer *models.KeyRotationPeer) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return s.Err
+  }
+  for i := range s.rotations {
+    if s.rotations[i].ID == rotationID {
+      s.rotations[i].Peers = append(s.rotations[i].Peers, *peer)
+      return nil
+    }
+  }
+  return sql.ErrNoRows
+}
+
+func (s *Store) UpdateKeyRotationPeer(ctx context.Context, rotationID uuid.UUID, peer *models.KeyRotationPeer) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return s.Err
+  }
+  for i := range s.rotations {
+    if s.rotations[i].ID != rotationID {
+      continue
+    }
+    for j := range s.rotations[i].Peers {
+      if s.rotations[i].Peers[j].PeerID == peer.PeerID {
+        s.rotations[i].Peers[j] = *peer
+        return nil
+      }
+    }
+  }
+  return sql.ErrNoRows
+}
+
+func (s *Store) FinishKeyRotation(ctx context.Context, rotation *models.KeyRotation) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return s.Err
+  }
+  for i := range s.rotations {
+    if s.rotations[i].ID == rotation.ID {
+      s.rotations[i].Status = rotation.Status
+      s.rotations[i].FinishedAt = rotation.FinishedAt
+      return nil
+    }
+  }
+  return sql.ErrNoRows
+}
+
+func (s *Store) GetKeyRotation(ctx context.Context, id uuid.UUID) (*models.KeyRotation, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return nil, s.Err
+  }
+  for _, rotation := range s.rotations {
+    if rotation.ID == id {
+      found := rotation
+      found.Peers = append([]models.KeyRotationPeer(nil), rotation.Peers...)
+      return &found, nil
+    }
+  }
+  return nil, sql.ErrNoRows
+}
+
+// LatestKeyRotation returns the rotation inserted last.
+func (s *Store) LatestKeyRotation(ctx context.Context) (*models.KeyRotation, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return nil, s.Err
+  }
+  if len(s.rotations) == 0 {
+    return nil, sql.ErrNoRows
+  }
+  found := s.rotations[len(s.rotations)-1]
+  found.Peers = append([]models.KeyRotationPeer(nil), found.Peers...)
+  return &found, nil
+}
+
+func (s *Store) InsertAuditEvent(ctx context.Context, event *models.AuditEvent) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return s.Err
+  }
+  event.ID = int64(len(s.events) + 1)
+  s.events = append(s.events, *event)
+  return nil
+}
+
+func (s *Store) ListAuditEvents(ctx context.Context, filter models.AuditFilter) ([]models.AuditEvent, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.Err != nil {
+    return nil, s.Err
+  }
+
+  var events []models.AuditEvent
+  for i := range s.events {
+    event := s.events[i]
+    if !filter.Ascending {
+      event = s.events[len(s.events)-1-i]
+    }
+    switch {
+    case filter.Actor != "" && event.Actor != filter.Actor,
+      filter.Action != "" && event.Action != filter.Action,
+      filter.Target != "" && event.Target != filter.Target,
+      !filter.Since.IsZero() && event.OccurredAt.Before(filter.Since),
+      !filter.Until.IsZero() && !event.OccurredAt.Before(filter.Until),
+      filter.BeforeID > 0 && event.ID >= filter.BeforeID:
+      continue
+    }
+    events = append(events, event)
+    if filter.Limit > 0 && len(events) == filter.Limit {
+      break
+    }
+  }
+  return events, nil
+}
+
+func (s *Store) Ping(ctx context.Context) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  return s.Err
+}
@@ -0,0 +1,207 @@
+package fakes
+
+import (
+  "context"
+  "elysium-backend/pkg/wgutil"
+  "errors"
+  "net"
+  "sort"
+  "sync"
+  "time"
+)
+
+// WireGuard records whether the interface was initialised or torn down and
+// which peers are configured on it instead of touching the kernel. Err,
+// when set, is returned from every call and ConfigureErr from ConfigurePeers
+// only. A key rotation serves NextKey on Next; Handshake simulates a peer
+// connecting with it, which only counts once the peer is configured, and
+// Routed records the addresses routed to it.
+type WireGuard struct {
+  mu           sync.Mutex
+  Key          string
+  NextKey      string
+  Up           bool
+  Next         *wgutil.Endpoint
+  Routed       []net.IP
+  peers        map[string][]string
+  psks         map[string]string
+  handshakes   map[string]time.Time
+  Err          error
+  ConfigureErr error
+}
+
+func NewWireGuard(publicKey string) *WireGuard {
+  return &WireGuard{Key: publicKey, NextKey: "rotated-key", peers: make(map[string][]string), psks: make(map[string]string), handshakes: make(map[string]time.Time)}
+}
+
+func (w *WireGuard) Init(ctx context.Context) (string, error) {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+
+  if w.Err != nil {
+    return "", w.Err
+  }
+  w.Up = true
+  return w.Key, nil
+}
+
+func (w *WireGuard) PublicKey() (string, error) {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+
+  if w.Err != nil {
+    return "", w.Err
+  }
+  return w.Key, nil
+}
+
+func (w *WireGuard) Check(ctx context.Context) error {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+
+  if w.Err != nil {
+    return w.Err
+  }
+  if !w.Up {
+    return errors.New("interface is down")
+  }
+  return nil
+}
+
+// Peers returns the configured peers ordered by public key.
+func (w *WireGuard) Peers(ctx context.Context) ([]wgutil.DevicePeer, error) {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+
+  if w.Err != nil {
+    return nil, w.Err
+  }
+  peers := make([]wgutil.DevicePeer, 0, len(w.peers))
+  for key, allowed := range w.peers {
+    peers = append(peers, wgutil.DevicePeer{PublicKey: key, AllowedIPs: append([]string(nil), allowed...), PresharedKey: w.psks[key]})
+  }
+  sort.Slice(peers, func(i, j int) bool { return peers[i].PublicKey < peers[j].PublicKey })
+  return peers, nil
+}
+
+func (w *WireGuard) ConfigurePeers(ctx context.Context, set []wgutil.DevicePeer, remove []string) error {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+
+  if w.Err != nil {
+    return w.Err
+  }
+  if w.ConfigureErr != nil {
+    return w.ConfigureErr
+  }
+  for _, peer := range set {
+    allowed := append([]string(nil), peer.AllowedIPs...)
+    sort.Strings(allowed)
+    w.peers[peer.PublicKey] = allowed
+    if peer.PresharedKey != "" {
+      w.psks[peer.PublicKey] = peer.PresharedKey
+    }
+  }
+  for _, key := range remove {
+    delete(w.peers, key)
+    delete(w.psks, key)
+  }
+  return nil
+}
+
+func (w *WireGuard) BeginRotation(ctx context.Context, next wgutil.Endpoint, resume bool) (string, error) {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+
+  if w.Err != nil {
+    return "", w.Err
+  }
+  w.Next = &next
+  return w.NextKey, nil
+}
+
+// Handshake records a handshake of the peer holding key with the new key of
+// the rotation in progress.
+func (w *WireGuard) Handshake(key string, at time.Time) {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  w.handshakes[key] = at
+}
+
+// Handshakes returns the handshakes recorded with Handshake, during a
+// rotation or not.
+func (w *WireGuard) Handshakes(ctx context.Context) (map[string]time.Time, error) {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+
+  if w.Err != nil {
+    return nil, w.Err
+  }
+  handshakes := make(map[string]time.Time, len(w.handshakes))
+  for key, at := range w.handshakes {
+    handshakes[key] = at
+  }
+  return handshakes, nil
+}
+
+func (w *WireGuard) RotationHandshakes(ctx context.Context) (map[string]time.Time, error) {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+
+  if w.Err != nil {
+    return nil, w.Err
+  }
+  if w.Next == nil {
+    return nil, wgutil.ErrNoRotation
+  }
+  handshakes := make(map[string]time.Time, len(w.handshakes))
+  for key, at := range w.handshakes {
+    if _, ok := w.peers[key]; ok {
+      handshakes[key] = at
+    }
+  }
+  return handshakes, nil
+}
+
+func (w *WireGuard) RoutePeers(ctx context.Context, ips []net.IP) error {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+
+  if w.Err != nil {
+    return w.Err
+  }
+  if w.Next == nil {
+    return wgutil.ErrNoRotation
+  }
+  w.Routed = append(w.Routed, ips...)
+  return nil
+}
+
+func (w *WireGuard) EndRotation(ctx context.Context, promote bool) error {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+
+  if w.Err != nil {
+    return w.Err
+  }
+  if w.Next == nil {
+    return wgutil.ErrNoRotation
+  }
+  if promote {
+    w.Key = w.NextKey
+  }
+  w.Next, w.Routed = nil, nil
+  w.handshakes = make(map[string]time.Time)
+  return nil
+}
+
+func (w *WireGuard) Teardown() error {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+
+  if w.Err != nil {
+    return w.Err
+  }
+  w.Up = false
+  return nil
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+  "crypto/ed25519"
+  "elysium-backend/config"
+  "elysium-backend/internal/health"
+  "elysium-backend/internal/metrics"
+  "elysium-backend/internal/services"
+  "elysium-backend/pkg/keystore"
+  "log/slog"
+  "time"
+)
+
+// App holds the dependencies shared by the HTTP handlers. main wires the
+// production implementations; tests substitute the in-memory fakes from
+// internal/fakes.
+type App struct {
+  Config     *config.Config
+  Store      services.Store
+  Allocator  services.Allocator
+  // WireGuard is nil when the server runs without managing an interface.
+  WireGuard  services.WireGuard
+  Builder    services.Builder
+  Targets    *services.TargetRegistry
+  // Builds runs Builder and records every build.
+  Builds     *services.BuildHistory
+  // BuildLogs streams and stores the output of builds.
+  BuildLogs  *services.BuildLogs
+  // Links signs and verifies download URLs.
+  Links      *services.LinkSigner
+  Artifacts  *services.ArtifactStore
+  // Bulk provisions batches of peers.
+  Bulk       *services.BulkProvisioner
+  // Reconciler applies declarative desired state files.
+  Reconciler *services.Reconciler
+  // Backups is nil when the database cannot be backed up online.
+  Backups    services.Backuper
+  // Rotations is nil when WireGuard is nil.
+  Rotations  *services.KeyRotator
+  // Endpoints resolves the server key and port clients are built against.
+  Endpoints  *services.ClientEndpoints
+  // PSKs generates and seals the preshared keys of peers.
+  PSKs       *services.PresharedKeys
+  // Devices puts new peers on the interface.
+  Devices    *services.DevicePeers
+  // Health holds the readiness checks reported by /readyz.
+  Health     *health.Registry
+  // Metrics is served on /metrics; the builder records its builds there.
+  Metrics    *metrics.Metrics
+  // LogLevel is the level of the process wide logger.
+  LogLevel   *slog.LevelVar
+
+  startedAt time.Time
+}
+
+// NewApp wires the handlers to their dependencies. signingKey signs the
+// artifacts delivered to peers and keys seals their preshared keys. Health,
+// Metrics and LogLevel start out fresh; main replaces them with the ones the
+// checks, the builder and the logger were set up with.
+func NewApp(cfg *config.Config, store services.Store, allocator services.Allocator, wireGuard services.WireGuard, builder services.Builder, targets *services.TargetRegistry, signingKey ed25519.PrivateKey, keys *keystore.Keystore) *App {
+  buildLogs := services.NewBuildLogs(store)
+  builds := services.NewBuildHistory(store, builder, buildLogs)
+  artifacts := services.NewArtifactStore(store, cfg.Build.OutputDir, cfg.Artifacts.TTL, signingKey)
+  psks := services.NewPresharedKeys(store, wireGuard, keys, cfg.WireGuard.PresharedKeys)
+  devices := services.NewDevicePeers(wireGuard)
+  var rotations *services.KeyRotator
+  if wireGuard != nil {
+    rotations = services.NewKeyRotator(store, wireGuard, cfg.WireGuard, builds, artifacts, psks)
+  }
+  endpoints := services.NewClientEndpoints(store, cfg.WireGuard, rotations)
+  return &App{
+    Config:     cfg,
+    Store:      store,
+    Allocator:  allocator,
+    WireGuard:  wireGuard,
+    Builder:    builder,
+    Targets:    targets,
+    Builds:     builds,
+    BuildLogs:  buildLogs,
+    Links:      services.NewLinkSigner(cfg.Download.SigningKey),
+    Artifacts:  artifacts,
+    Bulk:       services.NewBulkProvisioner(store, allocator, targets, cfg.IPRanges, builds, artifacts, psks, devices, endpoints),
+    Reconciler: services.NewReconciler(store, allocator, wireGuard, cfg, psks),
+    Rotations:  rotations,
+    Endpoints:  endpoints,
+    PSKs:       psks,
+    Devices:    devices,
+    Health:     health.NewRegistry(),
+    Metrics:    metrics.New(),
+    LogLevel:   new(slog.LevelVar),
+    startedAt:  time.Now(),
+  }
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+  "database/sql"
+  "elysium-backend/internal/audit"
+  "elysium-backend/internal/models"
+  "elysium-backend/pkg/logger"
+  "encoding/json"
+  "errors"
+  "net/http"
+
+  "github.com/google/uuid"
+  "github.com/gorilla/mux"
+)
+
+// GetArtifactsHandler lists stored artifacts, optionally only those of the
+// peer given as peer_id.
+func (a *App) GetArtifactsHandler(w http.ResponseWriter, r *http.Request) {
+  log := logger.FromContext(r.Context())
+
+  var peerID *uuid.UUID
+  if value := r.URL.Query().Get("peer_id"); value != "" {
+    id, err := uuid.Parse(value)
+    if err != nil {
+      http.Error(w, "Invalid peer_id", http.StatusBadRequest)
+      return
+    }
+    peerID = &id
+  }
+
+  artifacts, err := a.Store.ListArtifacts(r.Context(), peerID)
+  if err != nil {
+    log.Error("error listing artifacts", "err", err)
+    writeError(w, err, http.StatusInternalServerError, "Internal server error")
+    return
+  }
+  if artifacts == nil {
+    artifacts = []models.Artifact{}
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  if err := json.NewEncoder(w).Encode(artifacts); err != nil {
+    http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+  }
+}
+
+// DeleteArtifactHandler removes an artifact and its file.
+func (a *App) DeleteArtifactHandler(w http.ResponseWriter, r *http.Request) {
+  log := logger.FromContext(r.Context())
+
+  id, err := uuid.Parse(mux.Vars(r)["id"])
+  if err != nil {
+    http.Error(w, "Invalid ID format", http.StatusBadRequest)
+    return
+  }
+  log = log.With("artifact_id", id.String())
+
+  artifact, err := a.Store.GetArtifact(r.Context(), id)
+  if err == nil {
+    err = a.Artifacts.Delete(r.Context(), artifact)
+  }
+  if errors.Is(err, sql.ErrNoRows) {
+    http.Error(w, "Artifact not found", http.StatusNotFound)
+    return
+  } else if err != nil {
+    log.Error("error deleting artifact", "err", err)
+    writeError(w, err, http.StatusInternalServerError, "Internal server error")
+    return
+  }
+  log.Info("artifact deleted", "path", artifact.Path)
+  audit.Record(r.Context(), a.Store, "artifact.delete", id.String(), artifact, nil)
+
+  w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+  "elysium-backend/internal/models"
+  "elysium-backend/pkg/logger"
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "net/url"
+  "strconv"
+  "time"
+)
+
+const (
+  defaultAuditLimit = 100
+  maxAuditLimit     = 1000
+)
+
+// parseAuditFilter reads the actor, action, target, since, until (RFC 3339),
+// before_id and limit query parameters.
+func parseAuditFilter(query url.Values) (models.AuditFilter, error) {
+  filter := models.AuditFilter{
+    Actor:  query.Get("actor"),
+    Action: query.Get("action"),
+    Target: query.Get("target"),
+  }
+
+  for name, dest := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+    if value := query.Get(name); value != "" {
+      t, err := time.Parse(time.RFC3339, value)
+      if err != nil {
+        return filter, fmt.Errorf("%s must be an RFC 3339 timestamp", name)
+      }
+      *dest = t
+    }
+  }
+
+  if value := query.Get("before_id"); value != "" {
+    id, err := strconv.ParseInt(value, 10, 64)
+    if err != nil || id < 1 {
+      return filter, fmt.Errorf("before_id must be a positive integer")
+    }
+    filter.BeforeID = id
+  }
+
+  if value := query.Get("limit"); value != "" {
+    limit, err := strconv.Atoi(value)
+    if err != nil || limit < 1 {
+      return filter, fmt.Errorf("limit must be a positive integer")
+    }
+    filter.Limit = limit
+  }
+  return filter, nil
+}
+
+// GetAuditHandler lists audit events newest first as JSON. With
+// format=jsonl the matching events are exported oldest first as JSON Lines,
+// without the default page size.
+func (a *App) GetAuditHandler(w http.ResponseWriter, r *http.Request) {
+  log := logger.FromContext(r.Context())
+
+  filter, err := parseAuditFilter(r.URL.Query())
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+
+  export := r.URL.Query().Get("format") == "jsonl"
+  if export {
+    filter.Ascending = true
+  } else if filter.Limit == 0 || filter.Limit > maxAuditLimit {
+    if filter.Limit == 0 {
+      filter.Limit = defaultAuditLimit
+    } else {
+      filter.Limit = maxAuditLimit
+    }
+  }
+
+  events, err := a.Store.ListAuditEvents(r.Context(), filter)
+  if err != nil {
+    log.Error("error listing audit events", "err", err)
+    writeError(w, err, http.StatusInternalServerError, "Internal server error")
+    return
+  }
+
+  if export {
+    w.Header().Set("Content-Type", "application/x-ndjson")
+    w.Header().Set("Content-Disposition", "attachment; filename=audit.jsonl")
+    encoder := json.NewEncoder(w)
+    for _, event := range events {
+      if err := encoder.Encode(event); err != nil {
+        log.Warn("audit export interrupted", "err", err)
+        return
+      }
+    }
+    return
+  }
+
+  if events == nil {
+    events = []models.AuditEvent{}
+  }
+  w.Header().Set("Content-Type", "application/json")
+  if err := json.NewEncoder(w).Encode(events); err != nil {
+    http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+  }
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+  "elysium-backend/internal/audit"
+  "elysium-backend/pkg/logger"
+  "io"
+  "net/http"
+  "os"
+  "strconv"
+)
+
+// GetBackupHandler serves an archive of the control-plane state, encrypted
+// when BACKUP_PASSPHRASE is set. The archive is written to a temporary file
+// first so a failed backup is reported instead of arriving truncated.
+func (a *App) GetBackupHandler(w http.ResponseWriter, r *http.Request) {
+  log := logger.FromContext(r.Context())
+
+  if a.Backups == nil {
+    http.Error(w, "Online backups require the SQLite database", http.StatusNotImplemented)
+    return
+  }
+
+  file, err := os.CreateTemp("", "elysium-backup-*.tar.gz")
+  if err != nil {
+    log.Error("error creating backup file", "err", err)
+    http.Error(w, "Error creating backup", http.StatusInternalServerError)
+    return
+  }
+  defer os.Remove(file.Name())
+  defer file.Close()
+
+  manifest, err := a.Backups.Backup(r.Context(), file)
+  if err != nil {
+    log.Error("error creating backup", "err", err)
+    writeError(w, err, http.StatusInternalServerError, "Error creating backup")
+    return
+  }
+  size, err := file.Seek(0, io.SeekCurrent)
+  if err == nil {
+    _, err = file.Seek(0, io.SeekStart)
+  }
+  if err != nil {
+    log.Error("error reading backup file", "err", err)
+    http.Error(w, "Error creating backup", http.StatusInternalServerError)
+    return
+  }
+
+  audit.Record(r.Context(), a.Store, "backup.create", "", nil, manifest)
+
+  name := "elysium-backup-" + manifest.CreatedAt.Format("20060102T150405Z") + ".tar.gz"
+  if manifest.Encrypted {
+    name += ".enc"
+  }
+  w.Header().Set("Content-Type", "application/octet-stream")
+  w.Header().Set("Content-Disposition", "attachment; filename="+name)
+  w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+  w.Header().Set("Cache-Control", "no-store")
+  if _, err := io.Copy(w, file); err != nil {
+    log.Error("error sending backup", "err", err)
+  }
+}
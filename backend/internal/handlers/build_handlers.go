@@ -0,0 +1,225 @@
+package handlers
+
+import (
+  "database/sql"
+  "elysium-backend/internal/models"
+  "elysium-backend/internal/services"
+  "elysium-backend/pkg/logger"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+
+  "github.com/google/uuid"
+  "github.com/gorilla/mux"
+)
+
+const (
+  defaultBuildLimit = 100
+  maxBuildLimit     = 1000
+
+  // buildLogKeepAlive is how often an idle log stream sends a comment so
+  // proxies do not drop it while cargo is quiet.
+  buildLogKeepAlive = 15 * time.Second
+)
+
+// GetBuildsHandler lists builds newest first, optionally only those with the
+// given status, so running builds can be found and followed.
+func (a *App) GetBuildsHandler(w http.ResponseWriter, r *http.Request) {
+  log := logger.FromContext(r.Context())
+  query := r.URL.Query()
+
+  status := query.Get("status")
+  if status != "" && status != models.BuildStatusRunning && status != models.BuildStatusSucceeded && status != models.BuildStatusFailed {
+    http.Error(w, "Invalid status", http.StatusBadRequest)
+    return
+  }
+
+  limit := defaultBuildLimit
+  if value := query.Get("limit"); value != "" {
+    n, err := strconv.Atoi(value)
+    if err != nil || n < 1 {
+      http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+      return
+    }
+    limit = min(n, maxBuildLimit)
+  }
+
+  builds, err := a.Store.ListBuilds(r.Context(), status, limit)
+  if err != nil {
+    log.Error("error listing builds", "err", err)
+    writeError(w, err, http.StatusInternalServerError, "Internal server error")
+    return
+  }
+
+  if builds == nil {
+    builds = []models.Build{}
+  }
+  w.Header().Set("Content-Type", "application/json")
+  if err := json.NewEncoder(w).Encode(builds); err != nil {
+    http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+  }
+}
+
+// GetBuildHandler returns a build with its outcome and provenance.
+func (a *App) GetBuildHandler(w http.ResponseWriter, r *http.Request) {
+  build, ok := a.lookupBuild(w, r)
+  if !ok {
+    return
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  if err := json.NewEncoder(w).Encode(build); err != nil {
+    http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+  }
+}
+
+// GetBuildLogsHandler streams the output of a build as Server-Sent Events,
+// one event per line with the line number as its ID, from the start or from
+// after the Last-Event-ID a reconnecting client sends. Running builds are
+// followed until they finish; the stream then ends with an "end" event
+// carrying the build's status.
+func (a *App) GetBuildLogsHandler(w http.ResponseWriter, r *http.Request) {
+  log := logger.FromContext(r.Context())
+
+  build, ok := a.lookupBuild(w, r)
+  if !ok {
+    return
+  }
+  log = log.With("build_id", build.ID.String())
+
+  afterSeq := 0
+  if value := r.Header.Get("Last-Event-ID"); value != "" {
+    n, err := strconv.Atoi(value)
+    if err != nil || n < 0 {
+      http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+      return
+    }
+    afterSeq = n
+  }
+
+  flusher, ok := w.(http.Flusher)
+  if !ok {
+    http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+    return
+  }
+
+  lines, err := a.BuildLogs.Follow(r.Context(), build.ID, afterSeq)
+  if err != nil {
+    log.Error("error retrieving build output", "err", err)
+    writeError(w, err, http.StatusInternalServerError, "Internal server error")
+    return
+  }
+
+  w.Header().Set("Content-Type", "text/event-stream")
+  w.Header().Set("Cache-Control", "no-cache")
+  w.Header().Set("X-Accel-Buffering", "no")
+  flusher.Flush()
+
+  keepAlive := time.NewTicker(buildLogKeepAlive)
+  defer keepAlive.Stop()
+
+  for {
+    select {
+    case line, ok := <-lines:
+      if !ok {
+        if r.Context().Err() != nil {
+          return
+        }
+        a.endBuildLogs(w, r, build.ID)
+        flusher.Flush()
+        return
+      }
+      if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", line.Seq, sseData(line.Line)); err != nil {
+        log.Debug("build log stream closed", "err", err)
+        return
+      }
+      flusher.Flush()
+    case <-keepAlive.C:
+      fmt.Fprint(w, ": keep-alive\n\n")
+      flusher.Flush()
+    case <-r.Context().Done():
+      return
+    }
+  }
+}
+
+// endBuildLogs writes the event closing a build log stream with the build's
+// current status.
+func (a *App) endBuildLogs(w http.ResponseWriter, r *http.Request, id uuid.UUID) {
+  status := "unknown"
+  if build, err := a.Store.GetBuild(r.Context(), id); err == nil {
+    status = build.Status
+  }
+  fmt.Fprintf(w, "event: end\ndata: %s\n\n", status)
+}
+
+// sseData splits line so a stray carriage return cannot end the event early.
+func sseData(line string) string {
+  return strings.NewReplacer("\r\n", "\ndata: ", "\r", "\ndata: ", "\n", "\ndata: ").Replace(line)
+}
+
+// announceBuild returns the BuildRequest.Started callback for a request
+// that builds a client. Before anything is compiled it sends a 103 Early
+// Hints response with X-Build-ID and X-Build-Token, the token letting the
+// requester follow the build's output on /builds/{id}/logs. Both headers
+// are repeated on the final response, which also names failed builds.
+func (a *App) announceBuild(w http.ResponseWriter) func(*models.Build) {
+  return func(build *models.Build) {
+    w.Header().Set("X-Build-ID", build.ID.String())
+    w.Header().Set("X-Build-Token", a.Links.BuildToken(build.ID))
+    w.WriteHeader(http.StatusEarlyHints)
+  }
+}
+
+// resolveEndpoint returns the server endpoint to build a client against,
+// answering the request itself when it cannot be resolved. The endpoint
+// has to be passed to Endpoints.Track once the client is recorded.
+func (a *App) resolveEndpoint(w http.ResponseWriter, r *http.Request) (*services.ClientEndpoint, bool) {
+  endpoint, err := a.Endpoints.Resolve(r.Context())
+  if err != nil {
+    logger.FromContext(r.Context()).Error("unable to resolve the server endpoint", "err", err)
+    writeError(w, err, http.StatusInternalServerError, "Unable to resolve the server endpoint")
+    return nil, false
+  }
+  return endpoint, true
+}
+
+// rotationPeer describes peer and the client built for it for a key
+// rotation tracking it.
+func rotationPeer(peer *models.Peer, target models.OSArch, build *models.Build, artifact *models.Artifact) models.KeyRotationPeer {
+  return models.KeyRotationPeer{
+    PeerID:     *peer.ID,
+    PublicKey:  peer.PublicKey,
+    AssignedIP: peer.AssignedIP,
+    Target:     target,
+    BuildID:    &build.ID,
+    ArtifactID: &artifact.ID,
+  }
+}
+
+// lookupBuild returns the build named by the id route variable, answering
+// the request itself when there is none.
+func (a *App) lookupBuild(w http.ResponseWriter, r *http.Request) (*models.Build, bool) {
+  log := logger.FromContext(r.Context())
+
+  id, err := uuid.Parse(mux.Vars(r)["id"])
+  if err != nil {
+    http.Error(w, "Invalid ID format", http.StatusBadRequest)
+    return nil, false
+  }
+
+  build, err := a.Store.GetBuild(r.Context(), id)
+  if errors.Is(err, sql.ErrNoRows) {
+    http.Error(w, "Build not found", http.StatusNotFound)
+    return nil, false
+  } else if err != nil {
+    log.Error("error retrieving build", "build_id", id.String(), "err", err)
+    writeError(w, err, http.StatusInternalServerError, "Internal server error")
+    return nil, false
+  }
+  return build, true
+}
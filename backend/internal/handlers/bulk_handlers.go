@@ -0,0 +1,138 @@
+package handlers
+
+import (
+  "database/sql"
+  "elysium-backend/internal/audit"
+  "elysium-backend/internal/models"
+  "elysium-backend/internal/services"
+  "elysium-backend/pkg/logger"
+  "encoding/json"
+  "errors"
+  "mime"
+  "net/http"
+
+  "github.com/google/uuid"
+  "github.com/gorilla/mux"
+)
+
+// maxBulkBody bounds the size of a bulk provisioning request.
+const maxBulkBody = 1 << 20
+
+type bulkErrors struct {
+  Errors []models.BulkError `json:"errors"`
+}
+
+// PostBulkPeersHandler provisions the peers listed in a CSV (text/csv) or
+// JSON body. The list is validated as a whole: if any entry is invalid the
+// errors of all of them are returned and nothing is created. Otherwise every
+// peer is created with its address at once and the job building their
+// clients is returned with 202 Accepted while it runs.
+func (a *App) PostBulkPeersHandler(w http.ResponseWriter, r *http.Request) {
+  log := logger.FromContext(r.Context())
+  body := http.MaxBytesReader(w, r.Body, maxBulkBody)
+
+  var peers []models.BulkPeer
+  mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+  switch mediaType {
+  case "text/csv":
+    var err error
+    if peers, err = services.ParseBulkCSV(body); err != nil {
+      http.Error(w, "Invalid CSV: "+err.Error(), http.StatusBadRequest)
+      return
+    }
+  case "", "application/json":
+    if err := json.NewDecoder(body).Decode(&peers); err != nil {
+      http.Error(w, "Invalid Request", http.StatusBadRequest)
+      return
+    }
+  default:
+    http.Error(w, "Content-Type must be text/csv or application/json", http.StatusUnsupportedMediaType)
+    return
+  }
+
+  job, invalid, err := a.Bulk.Create(r.Context(), peers)
+  if err != nil {
+    log.Error("error creating bulk job", "err", err)
+    writeError(w, err, http.StatusInternalServerError, "Error creating peers")
+    return
+  }
+  if len(invalid) > 0 {
+    log.Info("rejected bulk request", "invalid", len(invalid))
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusBadRequest)
+    json.NewEncoder(w).Encode(bulkErrors{Errors: invalid})
+    return
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  w.Header().Set("Location", "/peers/bulk/"+job.ID.String())
+  w.WriteHeader(http.StatusAccepted)
+  json.NewEncoder(w).Encode(job)
+
+  // The job outlives the request; the response is written first as the job
+  // updates its items while it runs.
+  if err := a.Bulk.Start(r.Context(), job); err != nil {
+    log.Warn("bulk job left for the next start", "job_id", job.ID.String(), "err", err)
+  }
+}
+
+// GetBulkJobHandler returns a bulk job with the progress of every peer.
+func (a *App) GetBulkJobHandler(w http.ResponseWriter, r *http.Request) {
+  job, ok := a.lookupBulkJob(w, r)
+  if !ok {
+    return
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  if err := json.NewEncoder(w).Encode(job); err != nil {
+    http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+  }
+}
+
+// GetBulkBundleHandler serves the binaries and configurations of a completed
+// bulk job as a ZIP archive.
+func (a *App) GetBulkBundleHandler(w http.ResponseWriter, r *http.Request) {
+  log := logger.FromContext(r.Context())
+
+  job, ok := a.lookupBulkJob(w, r)
+  if !ok {
+    return
+  }
+  if job.Status != models.BulkJobStatusCompleted {
+    http.Error(w, "Bulk job is still running", http.StatusConflict)
+    return
+  }
+
+  audit.Record(r.Context(), a.Store, "bulk.download", job.ID.String(), nil, nil)
+
+  w.Header().Set("Content-Type", "application/zip")
+  w.Header().Set("Content-Disposition", "attachment; filename=bulk-"+job.ID.String()+".zip")
+  w.Header().Set("Cache-Control", "no-store")
+  if err := a.Bulk.WriteBundle(r.Context(), w, job); err != nil {
+    // The status has been sent already; the truncated archive will not open.
+    log.Error("error writing bulk bundle", "job_id", job.ID.String(), "err", err)
+  }
+}
+
+// lookupBulkJob returns the bulk job named by the id route variable,
+// answering the request itself when there is none.
+func (a *App) lookupBulkJob(w http.ResponseWriter, r *http.Request) (*models.BulkJob, bool) {
+  log := logger.FromContext(r.Context())
+
+  id, err := uuid.Parse(mux.Vars(r)["id"])
+  if err != nil {
+    http.Error(w, "Invalid ID format", http.StatusBadRequest)
+    return nil, false
+  }
+
+  job, err := a.Store.GetBulkJob(r.Context(), id)
+  if errors.Is(err, sql.ErrNoRows) {
+    http.Error(w, "Bulk job not found", http.StatusNotFound)
+    return nil, false
+  } else if err != nil {
+    log.Error("error retrieving bulk job", "job_id", id.String(), "err", err)
+    writeError(w, err, http.StatusInternalServerError, "Internal server error")
+    return nil, false
+  }
+  return job, true
+}
@@ -1,26 +1,218 @@
 package handlers
 
 import (
-  "elysium-backend/config"
-  "log"
+  "database/sql"
+  "elysium-backend/internal/audit"
+  "elysium-backend/internal/models"
+  "elysium-backend/internal/services"
+  "elysium-backend/pkg/logger"
+  "encoding/base64"
+  "encoding/hex"
+  "errors"
+  "fmt"
   "net/http"
   "os"
   "path/filepath"
+  "strconv"
+  "strings"
+  "time"
 )
 
-func DownloadHandler(w http.ResponseWriter, r *http.Request, uniqueID, filename string) {
-  baseDir := config.GetEnv("OUTPUT_DIR", "./compiled_binaries")
+// DownloadHandler serves an artifact through a signed download link. The
+// signature and expiry in the query string are checked first, then that the
+// artifact still exists, and only then is one use of the link counted in the
+// database, which fails once the link is used up, has expired or was revoked
+// along with its peer. A Range request starting past the first byte and
+// carrying the link's resume tag in If-Range continues an interrupted
+// download without counting another use, until the download finishes or
+// the resume window opened by the counted download closes.
+// The same link with ".sig" appended to the filename serves the detached
+// signature without counting a use.
+func (a *App) DownloadHandler(w http.ResponseWriter, r *http.Request, linkID, filename string) {
+  log := logger.FromContext(r.Context()).With("link_id", linkID)
 
-  realPath := filepath.Join(baseDir, uniqueID, filename)
+  artifactName, wantsSignature := strings.CutSuffix(filename, services.SignatureSuffix)
 
-  log.Println("handlers.DownloadHandler -> Serving file:", realPath)
+  query := r.URL.Query()
+  expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+  if err != nil || !a.Links.Verify(linkID, artifactName, expires, query.Get("signature")) {
+    log.Warn("rejected download with invalid signature")
+    http.Error(w, "Invalid download link", http.StatusForbidden)
+    return
+  }
+
+  now := time.Now().UTC()
+  if now.Unix() >= expires {
+    http.Error(w, "Download link has expired", http.StatusGone)
+    return
+  }
+
+  if wantsSignature {
+    a.serveSignature(w, r, linkID, now)
+    return
+  }
+
+  link, err := a.Store.GetDownloadLink(r.Context(), linkID)
+  if err == nil && (link.RevokedAt != nil || !link.ExpiresAt.After(now)) {
+    err = sql.ErrNoRows
+  }
+  if errors.Is(err, sql.ErrNoRows) {
+    log.Info("rejected download through unusable link")
+    http.Error(w, "Download link is no longer valid", http.StatusGone)
+    return
+  } else if err != nil {
+    log.Error("error retrieving download link", "err", err)
+    writeError(w, err, http.StatusInternalServerError, "Internal server error")
+    return
+  }
 
+  realPath := filepath.Join(a.Config.Build.OutputDir, link.ArtifactPath)
   info, err := os.Stat(realPath)
-  if os.IsNotExist(err) || info.IsDir() {
+  if err != nil || info.IsDir() {
     http.Error(w, "File not found", http.StatusNotFound)
     return
   }
 
+  resumeTag := a.Links.ResumeTag(link.ID)
+  resuming := link.Uses > 0 && link.ResumeUntil != nil && now.Before(*link.ResumeUntil) &&
+    r.Header.Get("If-Range") == resumeTag && resumesDownload(r.Header.Get("Range"))
+  if resuming {
+    log.Info("resuming download", "path", realPath, "peer_id", link.PeerID.String(), "range", r.Header.Get("Range"))
+  } else {
+    link, err = a.Store.ConsumeDownloadLink(r.Context(), linkID, now, now.Add(a.Config.Download.ResumeWindow))
+    if errors.Is(err, sql.ErrNoRows) {
+      log.Info("rejected download through unusable link")
+      http.Error(w, "Download link is no longer valid", http.StatusGone)
+      return
+    } else if err != nil {
+      log.Error("error consuming download link", "err", err)
+      writeError(w, err, http.StatusInternalServerError, "Internal server error")
+      return
+    }
+    log.Info("serving file", "path", realPath, "peer_id", link.PeerID.String(), "use", link.Uses, "max_uses", link.MaxUses)
+
+    audit.Record(r.Context(), a.Store, "artifact.download", link.PeerID.String(), nil, map[string]any{
+      "link_id":  link.ID,
+      "artifact": link.ArtifactPath,
+      "uses":     link.Uses,
+      "max_uses": link.MaxUses,
+    })
+  }
+
+  artifact, err := a.Store.GetArtifactByPath(r.Context(), link.ArtifactPath)
+  if err != nil {
+    log.Warn("no artifact record for download", "path", link.ArtifactPath, "err", err)
+  } else {
+    setArtifactHeaders(w, artifact)
+  }
+
+  w.Header().Set("Content-Disposition", "attachment; filename="+filepath.Base(realPath))
+  w.Header().Set("Content-Type", "application/octet-stream")
+  w.Header().Set("Cache-Control", "no-store")
+  w.Header().Set("ETag", resumeTag)
+  served := &downloadWriter{ResponseWriter: w}
+  http.ServeFile(served, r, realPath)
+
+  if served.finished(info.Size()) {
+    if err := a.Store.FinishDownload(r.Context(), link.ID); err != nil {
+      log.Warn("unable to close the resume window of the link", "err", err)
+    }
+  }
+}
+
+// resumesDownload reports whether rangeHeader only asks for bytes past the
+// start of the file: a range from the first byte, or from the end, fetches
+// the artifact afresh.
+func resumesDownload(rangeHeader string) bool {
+  specs, ok := strings.CutPrefix(rangeHeader, "bytes=")
+  if !ok {
+    return false
+  }
+  for _, spec := range strings.Split(specs, ",") {
+    start, _, _ := strings.Cut(strings.TrimSpace(spec), "-")
+    if offset, err := strconv.ParseInt(start, 10, 64); err != nil || offset <= 0 {
+      return false
+    }
+  }
+  return true
+}
+
+// downloadWriter records the status and the size of the body served, to
+// tell whether a download reached the end of the file.
+type downloadWriter struct {
+  http.ResponseWriter
+  status  int
+  written int64
+}
+
+func (w *downloadWriter) WriteHeader(status int) {
+  w.status = status
+  w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *downloadWriter) Write(p []byte) (int, error) {
+  if w.status == 0 {
+    w.status = http.StatusOK
+  }
+  n, err := w.ResponseWriter.Write(p)
+  w.written += int64(n)
+  return n, err
+}
+
+// finished reports whether the response delivered the file of size bytes
+// through to its last byte.
+func (w *downloadWriter) finished(size int64) bool {
+  switch w.status {
+  case http.StatusOK:
+    return w.written == size
+  case http.StatusPartialContent:
+    var first, last, total int64
+    if _, err := fmt.Sscanf(w.Header().Get("Content-Range"), "bytes %d-%d/%d", &first, &last, &total); err != nil {
+      return false
+    }
+    return last == size-1 && w.written == last-first+1
+  }
+  return false
+}
+
+// setArtifactHeaders exposes the digest and signature of artifact so the
+// download can be verified before it is executed.
+func setArtifactHeaders(w http.ResponseWriter, artifact *models.Artifact) {
+  if digest, err := hex.DecodeString(artifact.SHA256); err == nil {
+    w.Header().Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(digest)+":")
+  }
+  w.Header().Set("X-Checksum-Sha256", artifact.SHA256)
+  if artifact.Signature != "" {
+    w.Header().Set("X-Signature-Ed25519", artifact.Signature)
+  }
+}
+
+// serveSignature serves the raw Ed25519 signature of the artifact behind a
+// link that has not expired or been revoked, even once its downloads are
+// used up.
+func (a *App) serveSignature(w http.ResponseWriter, r *http.Request, linkID string, now time.Time) {
+  log := logger.FromContext(r.Context()).With("link_id", linkID)
+
+  link, err := a.Store.GetDownloadLink(r.Context(), linkID)
+  if err == nil && (link.RevokedAt != nil || !link.ExpiresAt.After(now)) {
+    err = sql.ErrNoRows
+  }
+  if errors.Is(err, sql.ErrNoRows) {
+    http.Error(w, "Download link is no longer valid", http.StatusGone)
+    return
+  } else if err != nil {
+    log.Error("error retrieving download link", "err", err)
+    writeError(w, err, http.StatusInternalServerError, "Internal server error")
+    return
+  }
+
+  realPath := filepath.Join(a.Config.Build.OutputDir, link.ArtifactPath+services.SignatureSuffix)
+  info, err := os.Stat(realPath)
+  if err != nil || info.IsDir() {
+    http.Error(w, "Signature not found", http.StatusNotFound)
+    return
+  }
+
   w.Header().Set("Content-Disposition", "attachment; filename="+filepath.Base(realPath))
   w.Header().Set("Content-Type", "application/octet-stream")
   http.ServeFile(w, r, realPath)
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+  "context"
+  "elysium-backend/internal/services"
+  "errors"
+  "net/http"
+)
+
+// StatusClientClosedRequest is the non-standard status recorded when the
+// client went away before the response was ready.
+const StatusClientClosedRequest = 499
+
+// writeError maps cancellation, shutdown and target errors onto their HTTP
+// status so that timeouts are not reported as generic server failures. Any
+// other error is answered with fallback and message.
+func writeError(w http.ResponseWriter, err error, fallback int, message string) {
+  switch {
+  case errors.Is(err, services.ErrShuttingDown):
+    http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+  case errors.Is(err, services.ErrUnknownTarget):
+    http.Error(w, "Unsupported OS_Arch", http.StatusBadRequest)
+  case errors.Is(err, services.ErrKeysNotEncrypted):
+    http.Error(w, "Preshared keys require a key encryption key or passphrase", http.StatusNotImplemented)
+  case errors.Is(err, services.ErrTargetUnavailable):
+    http.Error(w, "Target is not buildable right now", http.StatusServiceUnavailable)
+  case errors.Is(err, context.DeadlineExceeded):
+    http.Error(w, "Request timed out", http.StatusGatewayTimeout)
+  case errors.Is(err, context.Canceled):
+    http.Error(w, "Request cancelled", StatusClientClosedRequest)
+  default:
+    http.Error(w, message, fallback)
+  }
+}
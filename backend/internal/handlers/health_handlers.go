@@ -0,0 +1,69 @@
+package handlers
+
+import (
+  "elysium-backend/config"
+  "elysium-backend/internal/health"
+  "elysium-backend/internal/services"
+  "elysium-backend/internal/version"
+  "elysium-backend/pkg/logger"
+  "encoding/json"
+  "net/http"
+  "time"
+)
+
+func (a *App) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+func (a *App) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+  results, ready := a.Health.Run(r.Context())
+
+  status := "ready"
+  code := http.StatusOK
+  if !ready {
+    status = "not ready"
+    code = http.StatusServiceUnavailable
+    logger.FromContext(r.Context()).Warn("readiness check failed", "checks", results)
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(code)
+  json.NewEncoder(w).Encode(map[string]interface{}{
+    "status": status,
+    "checks": results,
+  })
+}
+
+type diagnostics struct {
+  Version   version.Info             `json:"version"`
+  StartedAt time.Time                `json:"started_at"`
+  Uptime    string                   `json:"uptime"`
+  Config    map[string]string        `json:"config"`
+  Pool      *services.PoolUsage      `json:"pool,omitempty"`
+  PoolError string                   `json:"pool_error,omitempty"`
+  Checks    map[string]health.Result `json:"checks"`
+}
+
+func (a *App) DiagnosticsHandler(w http.ResponseWriter, r *http.Request) {
+  res := diagnostics{
+    Version:   version.Get(),
+    StartedAt: a.startedAt.UTC(),
+    Uptime:    time.Since(a.startedAt).Round(time.Second).String(),
+    Config:    config.Snapshot(),
+  }
+
+  pool, err := services.GetPoolUsage(r.Context(), a.Store, a.Config.IPRanges)
+  if err != nil {
+    res.PoolError = err.Error()
+  } else {
+    res.Pool = pool
+  }
+
+  res.Checks, _ = a.Health.Run(r.Context())
+
+  w.Header().Set("Content-Type", "application/json")
+  if err := json.NewEncoder(w).Encode(res); err != nil {
+    http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+  }
+}
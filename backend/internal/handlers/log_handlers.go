@@ -0,0 +1,39 @@
+package handlers
+
+import (
+  "elysium-backend/internal/audit"
+  "elysium-backend/pkg/logger"
+  "encoding/json"
+  "net/http"
+)
+
+type logLevel struct {
+  Level string `json:"level"`
+}
+
+func (a *App) GetLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(logLevel{Level: a.LogLevel.Level().String()})
+}
+
+func (a *App) PutLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+  var req logLevel
+  if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+    http.Error(w, "Invalid Request", http.StatusBadRequest)
+    return
+  }
+
+  level, err := logger.ParseLevel(req.Level)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  before := logLevel{Level: a.LogLevel.Level().String()}
+  a.LogLevel.Set(level)
+  after := logLevel{Level: level.String()}
+  logger.FromContext(r.Context()).Warn("log level changed", "level", after.Level)
+  audit.Record(r.Context(), a.Store, "loglevel.update", "", before, after)
+
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(after)
+}
@@ -1,10 +1,15 @@
 package handlers
 
 import (
+  "context"
+  "database/sql"
+  "elysium-backend/internal/audit"
   "elysium-backend/internal/models"
   "elysium-backend/internal/services"
+  "elysium-backend/pkg/logger"
   "encoding/json"
-  "log"
+  "errors"
+  "io"
   "net/http"
   "time"
 
@@ -12,12 +17,14 @@ import (
   "github.com/gorilla/mux"
 )
 
-func GetAllPeersHandler(w http.ResponseWriter, r *http.Request) {
-  log.Println("handlers.GetAllPeersHandler  -> Processing request from", r.RemoteAddr)
+func (a *App) GetAllPeersHandler(w http.ResponseWriter, r *http.Request) {
+  log := logger.FromContext(r.Context())
+  log.Debug("listing peers")
 
-  res, err := services.GetAllPeer()
+  res, err := a.Store.GetAllPeer(r.Context())
   if err != nil {
-    http.Error(w, "Internal server error", http.StatusInternalServerError)
+    log.Error("error retrieving peers", "err", err)
+    writeError(w, err, http.StatusInternalServerError, "Internal server error")
     return
   }
 
@@ -29,9 +36,8 @@ func GetAllPeersHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func GetPeerHandler(w http.ResponseWriter, r *http.Request) {
-  log.Println("handlers.GetPeerHandler  -> Processing request from", r.RemoteAddr)
-
+func (a *App) GetPeerHandler(w http.ResponseWriter, r *http.Request) {
+  log := logger.FromContext(r.Context())
   vars := mux.Vars(r)
 
   id, err := uuid.Parse(vars["id"])
@@ -40,9 +46,13 @@ func GetPeerHandler(w http.ResponseWriter, r *http.Request) {
     return
   }
 
-  res, err := services.GetPeer(&id)
+  log = log.With("peer_id", id.String())
+  log.Debug("retrieving peer")
+
+  res, err := a.Store.GetPeer(r.Context(), id)
   if err != nil {
-    http.Error(w, "Internal server error", http.StatusInternalServerError)
+    log.Error("error retrieving peer", "err", err)
+    writeError(w, err, http.StatusInternalServerError, "Internal server error")
     return
   }
 
@@ -53,8 +63,8 @@ func GetPeerHandler(w http.ResponseWriter, r *http.Request) {
   }
 }
 
-func PostPeerHandler(w http.ResponseWriter, r *http.Request) {
-  log.Println("handlers.PostPeerHandler -> Processing request from", r.RemoteAddr)
+func (a *App) PostPeerHandler(w http.ResponseWriter, r *http.Request) {
+  log := logger.FromContext(r.Context())
 
   var peer_request *models.Peer_Request
 
@@ -66,39 +76,344 @@ func PostPeerHandler(w http.ResponseWriter, r *http.Request) {
   }
 
   if peer_request.PublicKey == nil || *peer_request.PublicKey == "" {
-    log.Println("handlers.PostPeerHandler -> PublicKey was not provided by", r.RemoteAddr)
+    log.Info("public key was not provided")
     empty_str := ""
     peer_request.PublicKey = &empty_str
   } else {
-    log.Println("handlers.PostPeerHandler -> Received PublicKey from", r.RemoteAddr)
+    log.Info("received public key")
+  }
+
+  if _, err := a.Targets.Lookup(peer_request.OSArch); err != nil {
+    log.Info("rejecting build target", "os_arch", string(peer_request.OSArch), "err", err)
+    writeError(w, err, http.StatusBadRequest, "Unsupported OS_Arch")
+    return
   }
 
   new_peer := models.Peer{
     PublicKey:  *peer_request.PublicKey,
     AssignedIP: nil,
-    Status:     "pending",
+    Status:     models.PeerStatusPending,
     IsGateway:  false,
     CreatedOn:  time.Now().UTC(),
   }
 
-  log.Println("handlers.PostPeerHandler -> requesting new IP")
-  if err := services.AssignNewIP(&new_peer); err != nil {
-    http.Error(w, "Unable to assign IP", http.StatusInternalServerError)
+  presharedKey, ok := a.reservePeer(w, r, &new_peer)
+  if !ok {
+    return
+  }
+
+  var build *models.Build
+  var artifact *models.Artifact
+  // The client is built again when the server key it was built for is
+  // discarded meanwhile.
+  for {
+    endpoint, ok := a.resolveEndpoint(w, r)
+    if !ok {
+      a.removePeer(r.Context(), &new_peer)
+      return
+    }
+
+    var err error
+    build, _, err = a.Builds.Run(r.Context(), services.BuildRequest{
+      Target: peer_request.OSArch,
+      Bundle: services.ClientBundle{
+        PublicKey:    endpoint.PublicKey,
+        AssignedIP:   new_peer.AssignedIP,
+        ServerPort:   endpoint.Port,
+        PresharedKey: presharedKey,
+      },
+      Started: a.announceBuild(w),
+    })
+    if err != nil {
+      log.Error("compilation failed", "err", err)
+      a.removePeer(r.Context(), &new_peer)
+      writeError(w, err, http.StatusInternalServerError, "Compilation failed: "+err.Error())
+      return
+    }
+
+    artifact, err = a.Artifacts.Record(r.Context(), *new_peer.ID, build)
+    if err != nil {
+      log.Error("error recording artifact", "peer_id", new_peer.ID.String(), "err", err)
+      writeError(w, err, http.StatusInternalServerError, "Error recording artifact")
+      return
+    }
+
+    if err := a.Devices.Add(r.Context(), &new_peer, presharedKey); err != nil {
+      log.Error("error adding peer to the interface", "peer_id", new_peer.ID.String(), "err", err)
+      writeError(w, err, http.StatusInternalServerError, "Error configuring peer on the interface")
+      return
+    }
+    if err := a.Endpoints.Track(r.Context(), endpoint, rotationPeer(&new_peer, peer_request.OSArch, build, artifact)); !errors.Is(err, services.ErrEndpointChanged) {
+      break
+    }
+  }
+
+  downloadLink, link, err := services.IssueDownloadLink(r.Context(), a.Store, a.Links, a.Config.Download, *new_peer.ID, build.ArtifactPath)
+  if err != nil {
+    log.Error("error issuing download link", "peer_id", new_peer.ID.String(), "err", err)
+    writeError(w, err, http.StatusInternalServerError, "Error creating download link")
+    return
+  }
+
+  response := map[string]string{
+    "download_link": downloadLink,
+    "build_id":      build.ID.String(),
+    "expires_at":    link.ExpiresAt.Format(time.RFC3339),
+    "sha256":        artifact.SHA256,
+    "signature":     artifact.Signature,
+  }
+  json.NewEncoder(w).Encode(response)
+}
+
+// reservePeer allocates an address for peer, gives it a preshared key when
+// they are enabled and stores it, returning the key in plaintext. The
+// allocator stays locked until the peer is stored, like for bulk jobs, so
+// the address cannot be handed out twice while the client is built. It
+// answers the request itself when it fails.
+func (a *App) reservePeer(w http.ResponseWriter, r *http.Request, peer *models.Peer) (string, bool) {
+  log := logger.FromContext(r.Context())
+  a.Allocator.Lock()
+  defer a.Allocator.Unlock()
+
+  log.Debug("requesting new IP")
+  if err := a.Allocator.Allocate(r.Context(), peer); err != nil {
+    log.Error("unable to assign IP", "err", err)
+    writeError(w, err, http.StatusInternalServerError, "Unable to assign IP")
+    return "", false
+  }
+
+  presharedKey, err := a.PSKs.ForNewPeer(peer)
+  if err != nil {
+    log.Error("unable to generate preshared key", "err", err)
+    writeError(w, err, http.StatusInternalServerError, "Unable to generate preshared key")
+    return "", false
+  }
+
+  if err := a.Store.InsertPeer(r.Context(), peer); err != nil {
+    log.Error("error inserting peer", "err", err)
+    writeError(w, err, http.StatusInternalServerError, "Error creating peer")
+    return "", false
   }
+  log.Info("peer created", "peer_id", peer.ID.String(), "assigned_ip", peer.AssignedIP.String())
+  audit.Record(r.Context(), a.Store, "peer.create", peer.ID.String(), nil, *peer)
+  return presharedKey, true
+}
+
+// removePeer deletes peer again when its client could not be built, even
+// when the request was abandoned.
+func (a *App) removePeer(ctx context.Context, peer *models.Peer) {
+  ctx = context.WithoutCancel(ctx)
+  if err := a.Store.DeletePeer(ctx, *peer.ID); err != nil {
+    logger.FromContext(ctx).Error("failed to remove peer of failed build", "peer_id", peer.ID.String(), "err", err)
+    return
+  }
+  audit.Record(ctx, a.Store, "peer.delete", peer.ID.String(), *peer, nil)
+}
 
-  exePath, err := services.CompileClient(*peer_request.PublicKey, peer_request.OSArch, new_peer.AssignedIP)
+type peerUpdate struct {
+  Status string `json:"status"`
+}
+
+// PatchPeerHandler changes the status of a peer. Disabling a peer revokes
+// its outstanding download links.
+func (a *App) PatchPeerHandler(w http.ResponseWriter, r *http.Request) {
+  log := logger.FromContext(r.Context())
+
+  id, err := uuid.Parse(mux.Vars(r)["id"])
   if err != nil {
-    http.Error(w, "Compilation failed: "+err.Error(), http.StatusInternalServerError)
+    http.Error(w, "Invalid ID format", http.StatusBadRequest)
     return
   }
+  log = log.With("peer_id", id.String())
 
-  if err := services.InsertPeer(&new_peer); err != nil {
-    http.Error(w, "Error creating peer", http.StatusInternalServerError)
+  var req peerUpdate
+  if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !models.ValidPeerStatus(req.Status) {
+    http.Error(w, "Invalid Request", http.StatusBadRequest)
     return
   }
 
-  relativeDownloadLink := "/downloads/" + exePath
+  before, err := a.Store.GetPeer(r.Context(), id)
+  if errors.Is(err, sql.ErrNoRows) {
+    http.Error(w, "Peer not found", http.StatusNotFound)
+    return
+  } else if err != nil {
+    log.Error("error retrieving peer", "err", err)
+    writeError(w, err, http.StatusInternalServerError, "Internal server error")
+    return
+  }
 
-  response := map[string]string{"download_link": relativeDownloadLink}
-  json.NewEncoder(w).Encode(response)
+  if err := a.Store.SetPeerStatus(r.Context(), id, req.Status); err != nil {
+    log.Error("error updating peer", "err", err)
+    writeError(w, err, http.StatusInternalServerError, "Internal server error")
+    return
+  }
+
+  after, err := a.Store.GetPeer(r.Context(), id)
+  if err != nil {
+    log.Error("error retrieving peer", "err", err)
+    writeError(w, err, http.StatusInternalServerError, "Internal server error")
+    return
+  }
+  log.Info("peer status changed", "from", before.Status, "to", after.Status)
+  audit.Record(r.Context(), a.Store, "peer.update", id.String(), before, after)
+
+  w.Header().Set("Content-Type", "application/json")
+  if err := json.NewEncoder(w).Encode(after); err != nil {
+    http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+  }
+}
+
+// DeletePeerHandler removes a peer and its download links.
+func (a *App) DeletePeerHandler(w http.ResponseWriter, r *http.Request) {
+  log := logger.FromContext(r.Context())
+
+  id, err := uuid.Parse(mux.Vars(r)["id"])
+  if err != nil {
+    http.Error(w, "Invalid ID format", http.StatusBadRequest)
+    return
+  }
+  log = log.With("peer_id", id.String())
+
+  before, err := a.Store.GetPeer(r.Context(), id)
+  if err == nil {
+    err = a.Store.DeletePeer(r.Context(), id)
+  }
+  if errors.Is(err, sql.ErrNoRows) {
+    http.Error(w, "Peer not found", http.StatusNotFound)
+    return
+  } else if err != nil {
+    log.Error("error deleting peer", "err", err)
+    writeError(w, err, http.StatusInternalServerError, "Internal server error")
+    return
+  }
+  audit.Record(r.Context(), a.Store, "peer.delete", id.String(), before, nil)
+
+  w.WriteHeader(http.StatusNoContent)
+}
+
+type presharedKeyRequest struct {
+  // OSArch defaults to the target of the peer's latest artifact.
+  OSArch models.OSArch `json:"OS_Arch"`
+}
+
+// PostPeerPresharedKeyHandler gives a peer a new preshared key and returns
+// a download link to a client carrying it, like PostPeerHandler. The key is
+// only replaced once the client is built, recorded and its link issued; from
+// then on the peer's previous client can no longer connect.
+func (a *App) PostPeerPresharedKeyHandler(w http.ResponseWriter, r *http.Request) {
+  log := logger.FromContext(r.Context())
+
+  id, err := uuid.Parse(mux.Vars(r)["id"])
+  if err != nil {
+    http.Error(w, "Invalid ID format", http.StatusBadRequest)
+    return
+  }
+  log = log.With("peer_id", id.String())
+
+  var req presharedKeyRequest
+  if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+    http.Error(w, "Invalid Request", http.StatusBadRequest)
+    return
+  }
+
+  peer, err := a.Store.GetPeer(r.Context(), id)
+  if errors.Is(err, sql.ErrNoRows) {
+    http.Error(w, "Peer not found", http.StatusNotFound)
+    return
+  } else if err != nil {
+    log.Error("error retrieving peer", "err", err)
+    writeError(w, err, http.StatusInternalServerError, "Internal server error")
+    return
+  }
+  if peer.Status == models.PeerStatusDisabled {
+    http.Error(w, "Peer is disabled", http.StatusConflict)
+    return
+  }
+
+  target := req.OSArch
+  if target == "" {
+    if target, err = a.Artifacts.LatestTarget(r.Context(), id); err != nil {
+      log.Error("error retrieving artifacts", "err", err)
+      writeError(w, err, http.StatusInternalServerError, "Internal server error")
+      return
+    }
+    if target == "" {
+      http.Error(w, "OS_Arch is required for a peer without artifacts", http.StatusBadRequest)
+      return
+    }
+  }
+  if _, err := a.Targets.Lookup(target); err != nil {
+    writeError(w, err, http.StatusBadRequest, "Unsupported OS_Arch")
+    return
+  }
+
+  presharedKey, sealed, err := a.PSKs.Generate()
+  if err != nil {
+    log.Error("unable to generate preshared key", "err", err)
+    writeError(w, err, http.StatusInternalServerError, "Unable to generate preshared key")
+    return
+  }
+
+  var build *models.Build
+  var artifact *models.Artifact
+  var downloadLink string
+  var link *models.DownloadLink
+  // The client is built again when the server key it was built for is
+  // discarded meanwhile.
+  for {
+    endpoint, ok := a.resolveEndpoint(w, r)
+    if !ok {
+      return
+    }
+
+    build, _, err = a.Builds.Run(r.Context(), services.BuildRequest{
+      Target: target,
+      Bundle: services.ClientBundle{
+        PublicKey:    endpoint.PublicKey,
+        AssignedIP:   peer.AssignedIP,
+        ServerPort:   endpoint.Port,
+        PresharedKey: presharedKey,
+      },
+      Started: a.announceBuild(w),
+    })
+    if err != nil {
+      log.Error("compilation failed", "err", err)
+      writeError(w, err, http.StatusInternalServerError, "Compilation failed: "+err.Error())
+      return
+    }
+
+    artifact, err = a.Artifacts.Record(r.Context(), id, build)
+    if err != nil {
+      log.Error("error recording artifact", "err", err)
+      writeError(w, err, http.StatusInternalServerError, "Error recording artifact")
+      return
+    }
+
+    downloadLink, link, err = services.IssueDownloadLink(r.Context(), a.Store, a.Links, a.Config.Download, id, build.ArtifactPath)
+    if err != nil {
+      log.Error("error issuing download link", "err", err)
+      writeError(w, err, http.StatusInternalServerError, "Error creating download link")
+      return
+    }
+
+    // The key is replaced last, so a failure above leaves the peer's previous
+    // client working.
+    if err := a.PSKs.Replace(r.Context(), peer, presharedKey, sealed); err != nil {
+      log.Error("error replacing preshared key", "err", err)
+      writeError(w, err, http.StatusInternalServerError, "Error replacing preshared key")
+      return
+    }
+    if err := a.Endpoints.Track(r.Context(), endpoint, rotationPeer(peer, target, build, artifact)); !errors.Is(err, services.ErrEndpointChanged) {
+      break
+    }
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(map[string]string{
+    "download_link": downloadLink,
+    "build_id":      build.ID.String(),
+    "expires_at":    link.ExpiresAt.Format(time.RFC3339),
+    "sha256":        artifact.SHA256,
+    "signature":     artifact.Signature,
+  })
 }
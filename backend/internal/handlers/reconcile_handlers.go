@@ -0,0 +1,45 @@
+package handlers
+
+import (
+  "elysium-backend/internal/services"
+  "elysium-backend/pkg/logger"
+  "encoding/json"
+  "errors"
+  "net/http"
+)
+
+// maxStateBody bounds the size of a desired state file.
+const maxStateBody = 4 << 20
+
+// PostReconcileHandler diffs the desired state in the YAML or JSON body
+// against the peers and the WireGuard device and returns the plan. With
+// ?apply=true the plan is also carried out, unless it has conflicts, in
+// which case it is returned with 409 Conflict.
+func (a *App) PostReconcileHandler(w http.ResponseWriter, r *http.Request) {
+  log := logger.FromContext(r.Context())
+  apply := r.URL.Query().Get("apply") == "true"
+
+  state, err := services.ParseDesiredState(http.MaxBytesReader(w, r.Body, maxStateBody))
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+
+  plan, err := a.Reconciler.Reconcile(r.Context(), state, apply)
+  if errors.Is(err, services.ErrInvalidState) {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  } else if err != nil {
+    log.Error("error reconciling desired state", "err", err)
+    writeError(w, err, http.StatusInternalServerError, "Error reconciling desired state")
+    return
+  }
+
+  status := http.StatusOK
+  if apply && len(plan.Conflicts) > 0 {
+    status = http.StatusConflict
+  }
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(status)
+  json.NewEncoder(w).Encode(plan)
+}
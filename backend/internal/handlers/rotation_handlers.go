@@ -0,0 +1,184 @@
+package handlers
+
+import (
+  "database/sql"
+  "elysium-backend/internal/audit"
+  "elysium-backend/internal/models"
+  "elysium-backend/internal/services"
+  "elysium-backend/pkg/logger"
+  "encoding/json"
+  "errors"
+  "io"
+  "net/http"
+  "time"
+
+  "github.com/google/uuid"
+  "github.com/gorilla/mux"
+)
+
+type rotationRequest struct {
+  // GracePeriod is how long the old key stays valid, as a Go duration.
+  GracePeriod string        `json:"grace_period"`
+  // Target is used for peers without an artifact to take it from.
+  Target      models.OSArch `json:"target"`
+}
+
+// PostRotationHandler starts rotating the server key. The new key is served
+// next to the old one at once and the rotation is returned with 202
+// Accepted while a client connecting to it is built for every peer.
+func (a *App) PostRotationHandler(w http.ResponseWriter, r *http.Request) {
+  log := logger.FromContext(r.Context())
+  if a.Rotations == nil {
+    http.Error(w, "WireGuard is not managed by this server", http.StatusNotImplemented)
+    return
+  }
+
+  var req rotationRequest
+  if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+    http.Error(w, "Invalid Request", http.StatusBadRequest)
+    return
+  }
+  var grace time.Duration
+  if req.GracePeriod != "" {
+    var err error
+    if grace, err = time.ParseDuration(req.GracePeriod); err != nil || grace <= 0 {
+      http.Error(w, "grace_period must be a positive duration", http.StatusBadRequest)
+      return
+    }
+  }
+  if req.Target != "" {
+    if _, err := a.Targets.Lookup(req.Target); err != nil {
+      writeError(w, err, http.StatusBadRequest, "Unsupported OS_Arch")
+      return
+    }
+  }
+
+  rotation, err := a.Rotations.Start(r.Context(), grace, req.Target)
+  if errors.Is(err, services.ErrRotationInProgress) {
+    http.Error(w, "A key rotation is already in progress", http.StatusConflict)
+    return
+  } else if err != nil {
+    log.Error("error starting key rotation", "err", err)
+    writeError(w, err, http.StatusInternalServerError, "Error starting key rotation")
+    return
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  w.Header().Set("Location", "/wireguard/rotations/"+rotation.ID.String())
+  w.WriteHeader(http.StatusAccepted)
+  json.NewEncoder(w).Encode(rotation)
+
+  if err := a.Rotations.StartReissue(r.Context(), rotation); err != nil {
+    log.Warn("clients left to re-issue on the next start", "rotation_id", rotation.ID.String(), "err", err)
+  }
+}
+
+// GetLatestRotationHandler returns the most recent key rotation.
+func (a *App) GetLatestRotationHandler(w http.ResponseWriter, r *http.Request) {
+  log := logger.FromContext(r.Context())
+
+  rotation, err := a.Store.LatestKeyRotation(r.Context())
+  if errors.Is(err, sql.ErrNoRows) {
+    http.Error(w, "The server key was never rotated", http.StatusNotFound)
+    return
+  } else if err != nil {
+    log.Error("error retrieving key rotation", "err", err)
+    writeError(w, err, http.StatusInternalServerError, "Internal server error")
+    return
+  }
+  writeRotation(w, rotation)
+}
+
+// GetRotationHandler returns a key rotation with the progress of every
+// peer.
+func (a *App) GetRotationHandler(w http.ResponseWriter, r *http.Request) {
+  rotation, ok := a.lookupRotation(w, r)
+  if !ok {
+    return
+  }
+  writeRotation(w, rotation)
+}
+
+// DeleteRotationHandler cancels a key rotation in progress: the new key is
+// discarded and peers keep the old one.
+func (a *App) DeleteRotationHandler(w http.ResponseWriter, r *http.Request) {
+  log := logger.FromContext(r.Context())
+  if a.Rotations == nil {
+    http.Error(w, "WireGuard is not managed by this server", http.StatusNotImplemented)
+    return
+  }
+
+  id, err := uuid.Parse(mux.Vars(r)["id"])
+  if err != nil {
+    http.Error(w, "Invalid ID format", http.StatusBadRequest)
+    return
+  }
+
+  rotation, err := a.Rotations.Cancel(r.Context(), id)
+  switch {
+  case errors.Is(err, sql.ErrNoRows):
+    http.Error(w, "Key rotation not found", http.StatusNotFound)
+  case errors.Is(err, services.ErrRotationFinished):
+    http.Error(w, "Key rotation has already finished", http.StatusConflict)
+  case err != nil:
+    log.Error("error cancelling key rotation", "rotation_id", id.String(), "err", err)
+    writeError(w, err, http.StatusInternalServerError, "Error cancelling key rotation")
+  default:
+    writeRotation(w, rotation)
+  }
+}
+
+// GetRotationBundleHandler serves the clients re-issued by a key rotation
+// as a ZIP archive.
+func (a *App) GetRotationBundleHandler(w http.ResponseWriter, r *http.Request) {
+  log := logger.FromContext(r.Context())
+  if a.Rotations == nil {
+    http.Error(w, "WireGuard is not managed by this server", http.StatusNotImplemented)
+    return
+  }
+
+  rotation, ok := a.lookupRotation(w, r)
+  if !ok {
+    return
+  }
+
+  audit.Record(r.Context(), a.Store, "wireguard.rotation.download", rotation.ID.String(), nil, nil)
+
+  w.Header().Set("Content-Type", "application/zip")
+  w.Header().Set("Content-Disposition", "attachment; filename=rotation-"+rotation.ID.String()+".zip")
+  w.Header().Set("Cache-Control", "no-store")
+  if err := a.Rotations.WriteBundle(r.Context(), w, rotation); err != nil {
+    // The status has been sent already; the truncated archive will not open.
+    log.Error("error writing rotation bundle", "rotation_id", rotation.ID.String(), "err", err)
+  }
+}
+
+func writeRotation(w http.ResponseWriter, rotation *models.KeyRotation) {
+  w.Header().Set("Content-Type", "application/json")
+  if err := json.NewEncoder(w).Encode(rotation); err != nil {
+    http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+  }
+}
+
+// lookupRotation returns the key rotation named by the id route variable,
+// answering the request itself when there is none.
+func (a *App) lookupRotation(w http.ResponseWriter, r *http.Request) (*models.KeyRotation, bool) {
+  log := logger.FromContext(r.Context())
+
+  id, err := uuid.Parse(mux.Vars(r)["id"])
+  if err != nil {
+    http.Error(w, "Invalid ID format", http.StatusBadRequest)
+    return nil, false
+  }
+
+  rotation, err := a.Store.GetKeyRotation(r.Context(), id)
+  if errors.Is(err, sql.ErrNoRows) {
+    http.Error(w, "Key rotation not found", http.StatusNotFound)
+    return nil, false
+  } else if err != nil {
+    log.Error("error retrieving key rotation", "rotation_id", id.String(), "err", err)
+    writeError(w, err, http.StatusInternalServerError, "Internal server error")
+    return nil, false
+  }
+  return rotation, true
+}
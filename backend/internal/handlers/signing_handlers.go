@@ -0,0 +1,31 @@
+package handlers
+
+import (
+  "elysium-backend/pkg/signing"
+  "encoding/base64"
+  "encoding/json"
+  "net/http"
+)
+
+// SigningKeyHandler publishes the Ed25519 public key artifact signatures
+// verify against, as JSON or, with format=pem, as a PEM file.
+func (a *App) SigningKeyHandler(w http.ResponseWriter, r *http.Request) {
+  publicPEM, err := signing.PublicKeyPEM(a.Artifacts.PublicKey())
+  if err != nil {
+    http.Error(w, "Internal server error", http.StatusInternalServerError)
+    return
+  }
+
+  if r.URL.Query().Get("format") == "pem" {
+    w.Header().Set("Content-Type", "application/x-pem-file")
+    w.Write(publicPEM)
+    return
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(map[string]string{
+    "algorithm":  "ed25519",
+    "public_key": base64.StdEncoding.EncodeToString(a.Artifacts.PublicKey()),
+    "pem":        string(publicPEM),
+  })
+}
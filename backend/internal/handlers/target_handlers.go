@@ -0,0 +1,13 @@
+package handlers
+
+import (
+  "encoding/json"
+  "net/http"
+)
+
+// GetTargetsHandler lists the enabled build targets and whether the
+// toolchain can currently build them.
+func (a *App) GetTargetsHandler(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(a.Targets.List())
+}
@@ -0,0 +1,83 @@
+package health
+
+import (
+  "context"
+  "sync"
+  "time"
+)
+
+// Check reports whether a dependency is usable. A nil error means healthy.
+type Check func(ctx context.Context) error
+
+type Result struct {
+  Status string `json:"status"`
+  Error  string `json:"error,omitempty"`
+}
+
+const checkTimeout = 5 * time.Second
+
+// Registry holds the readiness checks reported by /readyz.
+type Registry struct {
+  mu     sync.RWMutex
+  names  []string
+  checks map[string]Check
+}
+
+func NewRegistry() *Registry {
+  return &Registry{checks: make(map[string]Check)}
+}
+
+// Register adds a readiness check. Registering the same name twice replaces
+// the earlier check.
+func (r *Registry) Register(name string, check Check) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+
+  if _, exists := r.checks[name]; !exists {
+    r.names = append(r.names, name)
+  }
+  r.checks[name] = check
+}
+
+// Run executes every registered check concurrently and reports whether all of
+// them passed.
+func (r *Registry) Run(ctx context.Context) (map[string]Result, bool) {
+  r.mu.RLock()
+  registered := make(map[string]Check, len(r.checks))
+  for _, name := range r.names {
+    registered[name] = r.checks[name]
+  }
+  r.mu.RUnlock()
+
+  var (
+    wg       sync.WaitGroup
+    resultMu sync.Mutex
+    results  = make(map[string]Result, len(registered))
+    ready    = true
+  )
+
+  for name, check := range registered {
+    wg.Add(1)
+    go func(name string, check Check) {
+      defer wg.Done()
+
+      checkCtx, cancel := context.WithTimeout(ctx, checkTimeout)
+      defer cancel()
+
+      result := Result{Status: "ok"}
+      if err := check(checkCtx); err != nil {
+        result = Result{Status: "fail", Error: err.Error()}
+      }
+
+      resultMu.Lock()
+      defer resultMu.Unlock()
+      results[name] = result
+      if result.Status != "ok" {
+        ready = false
+      }
+    }(name, check)
+  }
+  wg.Wait()
+
+  return results, ready
+}
@@ -0,0 +1,29 @@
+package health
+
+import (
+  "context"
+  "errors"
+  "testing"
+)
+
+func TestRun(t *testing.T) {
+  checks := NewRegistry()
+  checks.Register("database", func(ctx context.Context) error { return nil })
+  checks.Register("wireguard", func(ctx context.Context) error { return errors.New("interface wg0 not found") })
+
+  results, ready := checks.Run(context.Background())
+  if ready {
+    t.Fatal("expected not ready when a check fails")
+  }
+  if results["database"].Status != "ok" {
+    t.Errorf("expected database check to pass, got %+v", results["database"])
+  }
+  if results["wireguard"].Status != "fail" || results["wireguard"].Error != "interface wg0 not found" {
+    t.Errorf("expected wireguard check to fail with its error, got %+v", results["wireguard"])
+  }
+
+  checks.Register("wireguard", func(ctx context.Context) error { return nil })
+  if _, ready := checks.Run(context.Background()); !ready {
+    t.Error("expected ready once the failing check is replaced")
+  }
+}
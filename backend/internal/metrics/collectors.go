@@ -0,0 +1,163 @@
+package metrics
+
+import (
+  "context"
+  "elysium-backend/config"
+  "log/slog"
+  "net"
+
+  "github.com/prometheus/client_golang/prometheus"
+  "golang.zx2c4.com/wireguard/wgctrl"
+)
+
+// PeerSource is the read side of the peer store consulted at scrape time.
+type PeerSource interface {
+  GetAssignedIPs(ctx context.Context) ([]net.IP, error)
+  CountPeersByStatus(ctx context.Context) (map[string]int, error)
+}
+
+// RegisterCollectors adds the collectors backed by the peer store and the
+// WireGuard interface named by wgInterface to the registry. wgInterface is
+// asked on every scrape as a key rotation moves the server to another
+// interface.
+func (m *Metrics) RegisterCollectors(source PeerSource, ranges []config.Ip_Range, wgInterface func() string) {
+  m.Registry.MustRegister(
+    newPoolCollector(source, ranges),
+    newPeerCollector(source),
+    newWireGuardCollector(wgInterface),
+  )
+}
+
+// poolCollector reports the size and usage of the configured IP pool. Values
+// are read from the database at scrape time.
+type poolCollector struct {
+  source PeerSource
+  ranges []config.Ip_Range
+  size   *prometheus.Desc
+  used   *prometheus.Desc
+  free   *prometheus.Desc
+}
+
+func newPoolCollector(source PeerSource, ranges []config.Ip_Range) *poolCollector {
+  return &poolCollector{
+    source: source,
+    ranges: ranges,
+    size: prometheus.NewDesc(namespace+"_ip_pool_size", "Total number of assignable addresses in the IP pool.", nil, nil),
+    used: prometheus.NewDesc(namespace+"_ip_pool_used", "Number of pool addresses assigned to peers.", nil, nil),
+    free: prometheus.NewDesc(namespace+"_ip_pool_free", "Number of pool addresses still available.", nil, nil),
+  }
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+  ch <- c.size
+  ch <- c.used
+  ch <- c.free
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+  var size int64
+  for _, r := range c.ranges {
+    size += r.Size()
+  }
+  ch <- prometheus.MustNewConstMetric(c.size, prometheus.GaugeValue, float64(size))
+
+  assigned, err := c.source.GetAssignedIPs(context.Background())
+  if err != nil {
+    slog.Warn("failed to read assigned IPs for metrics", "err", err)
+    return
+  }
+
+  var used int64
+  for _, ip := range assigned {
+    for _, r := range c.ranges {
+      if r.Contains(ip) {
+        used++
+        break
+      }
+    }
+  }
+  ch <- prometheus.MustNewConstMetric(c.used, prometheus.GaugeValue, float64(used))
+  ch <- prometheus.MustNewConstMetric(c.free, prometheus.GaugeValue, float64(size-used))
+}
+
+// peerCollector reports the number of peers grouped by status.
+type peerCollector struct {
+  source PeerSource
+  peers  *prometheus.Desc
+}
+
+func newPeerCollector(source PeerSource) *peerCollector {
+  return &peerCollector{
+    source: source,
+    peers: prometheus.NewDesc(namespace+"_peers", "Number of peers by status.", []string{"status"}, nil),
+  }
+}
+
+func (c *peerCollector) Describe(ch chan<- *prometheus.Desc) {
+  ch <- c.peers
+}
+
+func (c *peerCollector) Collect(ch chan<- prometheus.Metric) {
+  counts, err := c.source.CountPeersByStatus(context.Background())
+  if err != nil {
+    slog.Warn("failed to count peers for metrics", "err", err)
+    return
+  }
+
+  for status, count := range counts {
+    ch <- prometheus.MustNewConstMetric(c.peers, prometheus.GaugeValue, float64(count), status)
+  }
+}
+
+// wireGuardCollector exposes per-peer transfer counters and handshake times
+// read from the live WireGuard device. Nothing is reported when the device
+// cannot be queried, e.g. when running with -setupWg=false.
+type wireGuardCollector struct {
+  iface         func() string
+  receiveBytes  *prometheus.Desc
+  transmitBytes *prometheus.Desc
+  lastHandshake *prometheus.Desc
+}
+
+func newWireGuardCollector(iface func() string) *wireGuardCollector {
+  labels := []string{"interface", "public_key"}
+  return &wireGuardCollector{
+    iface:         iface,
+    receiveBytes:  prometheus.NewDesc(namespace+"_wireguard_peer_receive_bytes_total", "Bytes received from the peer.", labels, nil),
+    transmitBytes: prometheus.NewDesc(namespace+"_wireguard_peer_transmit_bytes_total", "Bytes transmitted to the peer.", labels, nil),
+    lastHandshake: prometheus.NewDesc(namespace+"_wireguard_peer_last_handshake_seconds", "Unix time of the last handshake with the peer.", labels, nil),
+  }
+}
+
+func (c *wireGuardCollector) Describe(ch chan<- *prometheus.Desc) {
+  ch <- c.receiveBytes
+  ch <- c.transmitBytes
+  ch <- c.lastHandshake
+}
+
+func (c *wireGuardCollector) Collect(ch chan<- prometheus.Metric) {
+  iface := c.iface()
+
+  client, err := wgctrl.New()
+  if err != nil {
+    return
+  }
+  defer client.Close()
+
+  device, err := client.Device(iface)
+  if err != nil {
+    return
+  }
+
+  for _, peer := range device.Peers {
+    key := peer.PublicKey.String()
+    ch <- prometheus.MustNewConstMetric(c.receiveBytes, prometheus.CounterValue, float64(peer.ReceiveBytes), iface, key)
+    ch <- prometheus.MustNewConstMetric(c.transmitBytes, prometheus.CounterValue, float64(peer.TransmitBytes), iface, key)
+
+    var handshake float64
+    if !peer.LastHandshakeTime.IsZero() {
+      handshake = float64(peer.LastHandshakeTime.Unix())
+    }
+    ch <- prometheus.MustNewConstMetric(c.lastHandshake, prometheus.GaugeValue, handshake, iface, key)
+  }
+}
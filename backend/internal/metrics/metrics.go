@@ -0,0 +1,135 @@
+package metrics
+
+import (
+  "elysium-backend/pkg/logger"
+  "net/http"
+  "strconv"
+  "time"
+
+  "github.com/gorilla/mux"
+  "github.com/prometheus/client_golang/prometheus"
+  "github.com/prometheus/client_golang/prometheus/collectors"
+  "github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "elysium"
+
+// Metrics holds the registry and the collectors of one server, so every
+// App (and every test) counts on its own.
+type Metrics struct {
+  Registry *prometheus.Registry
+
+  httpRequestsTotal   *prometheus.CounterVec
+  httpRequestDuration *prometheus.HistogramVec
+  buildQueueDepth     prometheus.Gauge
+  buildDuration       *prometheus.HistogramVec
+  buildCacheHits      *prometheus.CounterVec
+}
+
+func New() *Metrics {
+  m := &Metrics{
+    Registry: prometheus.NewRegistry(),
+
+    httpRequestsTotal: prometheus.NewCounterVec(
+      prometheus.CounterOpts{
+        Namespace: namespace,
+        Name:      "http_requests_total",
+        Help:      "Total number of HTTP requests handled, by route, method and status code.",
+      },
+      []string{"route", "method", "code"},
+    ),
+
+    httpRequestDuration: prometheus.NewHistogramVec(
+      prometheus.HistogramOpts{
+        Namespace: namespace,
+        Name:      "http_request_duration_seconds",
+        Help:      "Latency of HTTP requests, by route and method.",
+        Buckets:   prometheus.DefBuckets,
+      },
+      []string{"route", "method"},
+    ),
+
+    buildQueueDepth: prometheus.NewGauge(
+      prometheus.GaugeOpts{
+        Namespace: namespace,
+        Name:      "build_queue_depth",
+        Help:      "Number of client builds currently waiting or running.",
+      },
+    ),
+
+    buildDuration: prometheus.NewHistogramVec(
+      prometheus.HistogramOpts{
+        Namespace: namespace,
+        Name:      "build_duration_seconds",
+        Help:      "Duration of client builds, by target and result.",
+        Buckets:   []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200},
+      },
+      []string{"os_arch", "result"},
+    ),
+
+    buildCacheHits: prometheus.NewCounterVec(
+      prometheus.CounterOpts{
+        Namespace: namespace,
+        Name:      "build_cache_hits_total",
+        Help:      "Number of client packages served from a cached build, by target.",
+      },
+      []string{"os_arch"},
+    ),
+  }
+
+  m.Registry.MustRegister(
+    collectors.NewGoCollector(),
+    collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+    m.httpRequestsTotal,
+    m.httpRequestDuration,
+    m.buildQueueDepth,
+    m.buildDuration,
+    m.buildCacheHits,
+  )
+  return m
+}
+
+func (m *Metrics) Handler() http.Handler {
+  return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{Registry: m.Registry})
+}
+
+// Middleware records request counts and latencies labelled with the matched
+// route template, so /peer/{id} is a single series regardless of the ID.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    route := "unmatched"
+    if current := mux.CurrentRoute(r); current != nil {
+      if tpl, err := current.GetPathTemplate(); err == nil {
+        route = tpl
+      }
+    }
+
+    rec := logger.NewStatusRecorder(w)
+    start := time.Now()
+    next.ServeHTTP(rec, r)
+
+    m.httpRequestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+    m.httpRequestsTotal.WithLabelValues(route, r.Method, strconv.Itoa(rec.Status)).Inc()
+  })
+}
+
+// BuildStarted marks a build as queued and returns a function that must be
+// called with the outcome once the build has finished.
+func (m *Metrics) BuildStarted(osArch string) func(err error) {
+  m.buildQueueDepth.Inc()
+  start := time.Now()
+
+  return func(err error) {
+    m.buildQueueDepth.Dec()
+    result := "success"
+    if err != nil {
+      result = "failure"
+    }
+    m.buildDuration.WithLabelValues(osArch, result).Observe(time.Since(start).Seconds())
+  }
+}
+
+// BuildCacheHit counts a client packaged without compiling.
+func (m *Metrics) BuildCacheHit(osArch string) {
+  m.buildCacheHits.WithLabelValues(osArch).Inc()
+}
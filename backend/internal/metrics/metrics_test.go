@@ -0,0 +1,98 @@
+package metrics
+
+import (
+  "context"
+  "errors"
+  "io"
+  "net"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+
+  "github.com/gorilla/mux"
+)
+
+func scrape(t *testing.T, m *Metrics) string {
+  t.Helper()
+
+  rec := httptest.NewRecorder()
+  m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+  if rec.Code != http.StatusOK {
+    t.Fatalf("expected status 200 from metrics handler, got %d", rec.Code)
+  }
+
+  body, err := io.ReadAll(rec.Body)
+  if err != nil {
+    t.Fatalf("failed to read metrics body: %v", err)
+  }
+  return string(body)
+}
+
+func TestMiddlewareRecordsRouteTemplate(t *testing.T) {
+  m := New()
+  router := mux.NewRouter()
+  router.Use(m.Middleware)
+  router.HandleFunc("/peer/{id}", func(w http.ResponseWriter, r *http.Request) {
+    http.Error(w, "not found", http.StatusNotFound)
+  })
+
+  for _, id := range []string{"a", "b"} {
+    router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/peer/"+id, nil))
+  }
+
+  body := scrape(t, m)
+  expected := `elysium_http_requests_total{code="404",method="GET",route="/peer/{id}"} 2`
+  if !strings.Contains(body, expected) {
+    t.Errorf("expected metrics to contain %q, got:\n%s", expected, body)
+  }
+  if !strings.Contains(body, `elysium_http_request_duration_seconds_count{method="GET",route="/peer/{id}"} 2`) {
+    t.Errorf("expected latency histogram for /peer/{id}")
+  }
+}
+
+func TestBuildStarted(t *testing.T) {
+  m := New()
+  done := m.BuildStarted("x86_64-unknown-linux-musl")
+  if body := scrape(t, m); !strings.Contains(body, "elysium_build_queue_depth 1") {
+    t.Errorf("expected queue depth of 1 while build is running")
+  }
+
+  done(errors.New("exit status 101"))
+
+  body := scrape(t, m)
+  if !strings.Contains(body, "elysium_build_queue_depth 0") {
+    t.Errorf("expected queue depth of 0 after build finished")
+  }
+  if !strings.Contains(body, `elysium_build_duration_seconds_count{os_arch="x86_64-unknown-linux-musl",result="failure"} 1`) {
+    t.Errorf("expected failed build to be recorded, got:\n%s", body)
+  }
+}
+
+type stubPeerSource struct {
+  counts map[string]int
+}
+
+func (s stubPeerSource) GetAssignedIPs(ctx context.Context) ([]net.IP, error) {
+  return nil, nil
+}
+
+func (s stubPeerSource) CountPeersByStatus(ctx context.Context) (map[string]int, error) {
+  return s.counts, nil
+}
+
+func TestPeerCollector(t *testing.T) {
+  collector := newPeerCollector(stubPeerSource{counts: map[string]int{"active": 2, "pending": 1}})
+  m := New()
+  m.Registry.MustRegister(collector)
+
+  body := scrape(t, m)
+  for _, expected := range []string{
+    `elysium_peers{status="active"} 2`,
+    `elysium_peers{status="pending"} 1`,
+  } {
+    if !strings.Contains(body, expected) {
+      t.Errorf("expected metrics to contain %q", expected)
+    }
+  }
+}
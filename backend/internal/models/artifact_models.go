@@ -0,0 +1,25 @@
+package models
+
+import (
+  "time"
+
+  "github.com/google/uuid"
+)
+
+// Artifact is a compiled client binary kept under the build output
+// directory. Path is relative to that directory. PeerID is nil once the peer
+// is gone, BuildID for artifacts recorded before builds were tracked.
+type Artifact struct {
+  ID        uuid.UUID  `json:"id"`
+  PeerID    *uuid.UUID `json:"peer_id"`
+  BuildID   *uuid.UUID `json:"build_id"`
+  Target    OSArch     `json:"target"`
+  Path      string     `json:"path"`
+  Size      int64      `json:"size"`
+  SHA256    string     `json:"sha256"`
+  // Signature is the base64 encoded Ed25519 signature over the file, empty
+  // for artifacts recorded before signing was introduced.
+  Signature string     `json:"signature"`
+  CreatedAt time.Time  `json:"created_at"`
+  ExpiresAt time.Time  `json:"expires_at"`
+}
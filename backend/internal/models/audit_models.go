@@ -0,0 +1,35 @@
+package models
+
+import (
+  "encoding/json"
+  "time"
+)
+
+// AuditEvent is one entry of the append-only audit log. Before and After
+// hold JSON snapshots of the target around the change, when known.
+type AuditEvent struct {
+  ID         int64           `json:"id" db:"id"`
+  OccurredAt time.Time       `json:"occurred_at" db:"occurred_at"`
+  Actor      string          `json:"actor" db:"actor"`
+  Action     string          `json:"action" db:"action"`
+  Target     string          `json:"target,omitempty" db:"target"`
+  Before     json.RawMessage `json:"before,omitempty" db:"before_state"`
+  After      json.RawMessage `json:"after,omitempty" db:"after_state"`
+  SourceIP   string          `json:"source_ip,omitempty" db:"source_ip"`
+  RequestID  string          `json:"request_id,omitempty" db:"request_id"`
+}
+
+// AuditFilter narrows an audit log query. Zero values match everything.
+type AuditFilter struct {
+  Actor  string
+  Action string
+  Target string
+  Since  time.Time
+  Until  time.Time
+  // BeforeID pages backwards through results ordered newest first.
+  BeforeID int64
+  // Limit caps the number of events returned; 0 means no limit.
+  Limit int
+  // Ascending returns the oldest events first.
+  Ascending bool
+}
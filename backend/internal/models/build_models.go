@@ -0,0 +1,57 @@
+package models
+
+import (
+  "time"
+
+  "github.com/google/uuid"
+)
+
+const (
+  BuildStatusRunning   = "running"
+  BuildStatusSucceeded = "succeeded"
+  BuildStatusFailed    = "failed"
+)
+
+// Build is a single client build. ArtifactPath and SHA256 are set once it
+// succeeded, Error once it failed.
+type Build struct {
+  ID           uuid.UUID        `json:"id"`
+  Target       OSArch           `json:"target"`
+  Status       string           `json:"status"`
+  ArtifactPath string           `json:"artifact_path,omitempty"`
+  SHA256       string           `json:"sha256,omitempty"`
+  Error        string           `json:"error,omitempty"`
+  Provenance   *BuildProvenance `json:"provenance,omitempty"`
+  StartedAt    time.Time        `json:"started_at"`
+  FinishedAt   *time.Time       `json:"finished_at,omitempty"`
+}
+
+// BuildProvenance describes what a client was compiled from, so a delivered
+// binary can be traced back to its sources and rebuilt. Cached is true when
+// the build reused a client compiled earlier, in which case CompiledAt is
+// when that happened. Secrets in Env are redacted.
+type BuildProvenance struct {
+  CacheKey     string            `json:"cache_key"`
+  Cached       bool              `json:"cached"`
+  SourceSHA256 string            `json:"source_sha256"`
+  GitCommit    string            `json:"git_commit,omitempty"`
+  GitTree      string            `json:"git_tree,omitempty"`
+  GitDirty     bool              `json:"git_dirty"`
+  CargoVersion string            `json:"cargo_version"`
+  RustcVersion string            `json:"rustc_version"`
+  Backend      string            `json:"backend"`
+  Image        string            `json:"image,omitempty"`
+  Target       OSArch            `json:"target"`
+  CompileArgs  []string          `json:"compile_args,omitempty"`
+  Features     []string          `json:"features,omitempty"`
+  Env          map[string]string `json:"env,omitempty"`
+  CompiledAt   time.Time         `json:"compiled_at"`
+}
+
+// BuildLogLine is a line of build output. Seq numbers the lines of a build
+// from 1.
+type BuildLogLine struct {
+  Seq  int       `json:"seq"`
+  Line string    `json:"line"`
+  Time time.Time `json:"time"`
+}
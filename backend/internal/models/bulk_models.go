@@ -0,0 +1,66 @@
+package models
+
+import (
+  "net"
+  "time"
+
+  "github.com/google/uuid"
+)
+
+const (
+  BulkJobStatusRunning   = "running"
+  BulkJobStatusCompleted = "completed"
+
+  BulkItemStatusPending   = "pending"
+  BulkItemStatusRunning   = "running"
+  BulkItemStatusSucceeded = "succeeded"
+  BulkItemStatusFailed    = "failed"
+)
+
+// BulkPeer is one entry of a bulk provisioning request. IP, a static
+// address for the peer, and PublicKey are optional; a free address is
+// allocated when IP is empty.
+type BulkPeer struct {
+  Name      string   `json:"name"`
+  Owner     string   `json:"owner"`
+  Target    OSArch   `json:"target"`
+  Tags      []string `json:"tags"`
+  IP        string   `json:"ip"`
+  PublicKey string   `json:"public_key"`
+}
+
+// BulkJob provisions a batch of peers, building a client for each of them
+// in turn. It is completed once every item succeeded or failed.
+type BulkJob struct {
+  ID         uuid.UUID     `json:"id"`
+  Status     string        `json:"status"`
+  CreatedAt  time.Time     `json:"created_at"`
+  FinishedAt *time.Time    `json:"finished_at,omitempty"`
+  Items      []BulkJobItem `json:"items"`
+}
+
+// BulkJobItem is the job for a single peer of a BulkJob. Seq numbers the
+// items from 1 in the order of the request. BuildID and ArtifactID are set
+// once the peer's client was built; the peer is removed again when that
+// fails.
+type BulkJobItem struct {
+  Seq        int        `json:"seq"`
+  Name       string     `json:"name"`
+  Owner      string     `json:"owner,omitempty"`
+  Target     OSArch     `json:"target"`
+  Tags       []string   `json:"tags,omitempty"`
+  PublicKey  string     `json:"public_key,omitempty"`
+  PeerID     *uuid.UUID `json:"peer_id"`
+  AssignedIP net.IP     `json:"assigned_ip"`
+  Status     string     `json:"status"`
+  BuildID    *uuid.UUID `json:"build_id,omitempty"`
+  ArtifactID *uuid.UUID `json:"artifact_id,omitempty"`
+  Error      string     `json:"error,omitempty"`
+}
+
+// BulkError reports an invalid entry of a bulk request. Row counts entries
+// from 1, not counting a CSV header.
+type BulkError struct {
+  Row   int    `json:"row"`
+  Error string `json:"error"`
+}
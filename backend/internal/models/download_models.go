@@ -0,0 +1,24 @@
+package models
+
+import (
+  "time"
+
+  "github.com/google/uuid"
+)
+
+// DownloadLink grants a limited number of downloads of a peer's artifact
+// until it expires or is revoked. ArtifactPath is relative to the build
+// output directory. ResumeUntil is set by a counted download: until then,
+// or until that download finishes, it may be resumed without counting
+// another use.
+type DownloadLink struct {
+  ID           string     `json:"id"`
+  PeerID       uuid.UUID  `json:"peer_id"`
+  ArtifactPath string     `json:"artifact_path"`
+  ExpiresAt    time.Time  `json:"expires_at"`
+  MaxUses      int        `json:"max_uses"`
+  Uses         int        `json:"uses"`
+  CreatedAt    time.Time  `json:"created_at"`
+  RevokedAt    *time.Time `json:"revoked_at"`
+  ResumeUntil  *time.Time `json:"resume_until"`
+}
@@ -1,7 +1,6 @@
 package models
 
 import (
-  "errors"
   "net"
   "time"
 
@@ -16,25 +15,33 @@ type Peer struct {
   IsGateway  bool                    `json:"is_gateway" db:"is_gateway"`
   Metadata   *map[string]interface{} `json:"metadata" db:"metadata"`
   CreatedOn  time.Time               `json:"created_on" db:"created_on"`
+  UpdatedOn  time.Time               `json:"updated_on" db:"updated_on"`
+  // LastSeen is the last time the peer was seen on the tunnel, nil if never.
+  LastSeen   *time.Time              `json:"last_seen" db:"last_seen"`
+  // PresharedKey is the sealed WireGuard preshared key of the peer, empty
+  // if it has none. It is never serialised.
+  PresharedKey string                `json:"-" db:"preshared_key"`
 }
 
-type OSArch string
-
 const (
-  OSArchx86_64Linux  OSArch = "x86_64-unknown-linux-musl"
-  OSArchAarch64Linux OSArch = "aarch64-unknown-linux-musl"
-  OSArchWindows      OSArch = "x86_64-pc-windows-gnu"
+  PeerStatusPending  = "pending"
+  PeerStatusActive   = "active"
+  PeerStatusDisabled = "disabled"
 )
 
-func (o OSArch) Validate() error {
-  switch o {
-  case OSArchx86_64Linux, OSArchWindows, OSArchAarch64Linux:
-    return nil
-  default:
-    return errors.New("invalid OS_Arch value")
+// ValidPeerStatus reports whether status is one a peer can be set to.
+func ValidPeerStatus(status string) bool {
+  switch status {
+  case PeerStatusPending, PeerStatusActive, PeerStatusDisabled:
+    return true
   }
+  return false
 }
 
+// OSArch is the Rust target triple a client is built for. The triples that
+// can be built come from the target registry.
+type OSArch string
+
 type Peer_Request struct {
   PublicKey *string `json:"public_key"`
   OSArch    OSArch  `json:"OS_Arch"`
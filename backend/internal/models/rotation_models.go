@@ -0,0 +1,66 @@
+package models
+
+import (
+  "net"
+  "time"
+
+  "github.com/google/uuid"
+)
+
+const (
+  KeyRotationStatusInProgress = "in_progress"
+  KeyRotationStatusCompleted  = "completed"
+  KeyRotationStatusExpired    = "expired"
+  KeyRotationStatusCancelled  = "cancelled"
+
+  RotationPeerStatusPending  = "pending"
+  RotationPeerStatusReissued = "reissued"
+  RotationPeerStatusFailed   = "failed"
+  RotationPeerStatusMigrated = "migrated"
+)
+
+// KeyRotation replaces the server key. While it is in progress both keys
+// are accepted, the new one on NewInterface and NewPort, and a client
+// connecting to the new key is built for every peer. The old key is retired
+// once every peer has connected with the new one (completed) or at
+// ExpiresAt (expired), whichever comes first.
+type KeyRotation struct {
+  ID           uuid.UUID         `json:"id"`
+  Status       string            `json:"status"`
+  OldPublicKey string            `json:"old_public_key"`
+  NewPublicKey string            `json:"new_public_key"`
+  OldInterface string            `json:"old_interface"`
+  OldPort      int               `json:"old_port"`
+  NewInterface string            `json:"new_interface"`
+  NewPort      int               `json:"new_port"`
+  StartedAt    time.Time         `json:"started_at"`
+  ExpiresAt    time.Time         `json:"expires_at"`
+  FinishedAt   *time.Time        `json:"finished_at,omitempty"`
+  Peers        []KeyRotationPeer `json:"peers"`
+}
+
+// KeyRotationPeer tracks a peer through a rotation: its client is
+// re-issued for Target, the target of its latest artifact, and it has
+// migrated once it connected with the new key.
+type KeyRotationPeer struct {
+  PeerID     uuid.UUID  `json:"peer_id"`
+  PublicKey  string     `json:"public_key"`
+  AssignedIP net.IP     `json:"assigned_ip"`
+  Target     OSArch     `json:"target,omitempty"`
+  Status     string     `json:"status"`
+  BuildID    *uuid.UUID `json:"build_id,omitempty"`
+  ArtifactID *uuid.UUID `json:"artifact_id,omitempty"`
+  Error      string     `json:"error,omitempty"`
+  MigratedAt *time.Time `json:"migrated_at,omitempty"`
+}
+
+// Peer returns the progress of the peer id, nil when it is not part of the
+// rotation.
+func (r *KeyRotation) Peer(id uuid.UUID) *KeyRotationPeer {
+  for i := range r.Peers {
+    if r.Peers[i].PeerID == id {
+      return &r.Peers[i]
+    }
+  }
+  return nil
+}
@@ -0,0 +1,72 @@
+package models
+
+import "github.com/google/uuid"
+
+const (
+  ReconcileOpCreate = "create"
+  ReconcileOpUpdate = "update"
+  ReconcileOpDelete = "delete"
+
+  ReconcileKindPeer       = "peer"
+  ReconcileKindGateway    = "gateway"
+  ReconcileKindDevicePeer = "device_peer"
+)
+
+// DesiredState is a declarative description of the network, read from a
+// YAML or JSON file. Network and Pools are checked against the server
+// configuration; peers and gateways are created, updated and deleted to
+// match the file.
+type DesiredState struct {
+  Network  *DesiredNetwork `json:"network,omitempty" yaml:"network,omitempty"`
+  Pools    []DesiredPool   `json:"pools,omitempty" yaml:"pools,omitempty"`
+  Peers    []DesiredPeer   `json:"peers" yaml:"peers"`
+  Gateways []DesiredPeer   `json:"gateways,omitempty" yaml:"gateways,omitempty"`
+}
+
+// DesiredNetwork describes the WireGuard interface of the server. Empty
+// fields are not checked.
+type DesiredNetwork struct {
+  Interface string `json:"interface,omitempty" yaml:"interface,omitempty"`
+  Port      int    `json:"port,omitempty" yaml:"port,omitempty"`
+  Address   string `json:"address,omitempty" yaml:"address,omitempty"`
+  Mask      string `json:"mask,omitempty" yaml:"mask,omitempty"`
+}
+
+// DesiredPool is a range of addresses peers without an IP are allocated
+// from. Pools must lie within the configured network.
+type DesiredPool struct {
+  Start string `json:"start" yaml:"start"`
+  End   string `json:"end" yaml:"end"`
+}
+
+// DesiredPeer is a peer or gateway identified by its unique Name. IP and
+// Status are optional; Routes, the networks reachable through a gateway,
+// are only allowed on gateways.
+type DesiredPeer struct {
+  Name      string   `json:"name" yaml:"name"`
+  PublicKey string   `json:"public_key,omitempty" yaml:"public_key,omitempty"`
+  IP        string   `json:"ip,omitempty" yaml:"ip,omitempty"`
+  Status    string   `json:"status,omitempty" yaml:"status,omitempty"`
+  Owner     string   `json:"owner,omitempty" yaml:"owner,omitempty"`
+  Tags      []string `json:"tags,omitempty" yaml:"tags,omitempty"`
+  Routes    []string `json:"routes,omitempty" yaml:"routes,omitempty"`
+}
+
+// ReconcileAction is one change needed to reach the desired state. Changes
+// describes the fields an update touches.
+type ReconcileAction struct {
+  Op      string     `json:"op"`
+  Kind    string     `json:"kind"`
+  Name    string     `json:"name"`
+  PeerID  *uuid.UUID `json:"peer_id,omitempty"`
+  Changes []string   `json:"changes,omitempty"`
+}
+
+// ReconcilePlan lists the actions needed to reach the desired state and the
+// differences that cannot be reconciled, such as a network that does not
+// match the server configuration. A plan with conflicts is not applied.
+type ReconcilePlan struct {
+  Actions   []ReconcileAction `json:"actions"`
+  Conflicts []string          `json:"conflicts,omitempty"`
+  Applied   bool              `json:"applied"`
+}
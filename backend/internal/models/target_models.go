@@ -0,0 +1,10 @@
+package models
+
+// Target is a build target as reported by GET /targets. Available is false
+// when the toolchain lacks the rustup target or linker listed in Missing.
+type Target struct {
+  Triple    OSArch   `json:"triple"`
+  Suffix    string   `json:"suffix,omitempty"`
+  Available bool     `json:"available"`
+  Missing   []string `json:"missing,omitempty"`
+}
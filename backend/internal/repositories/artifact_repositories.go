@@ -0,0 +1,183 @@
+package repositories
+
+import (
+  "context"
+  "database/sql"
+  "elysium-backend/internal/models"
+  "elysium-backend/pkg/db"
+  "elysium-backend/pkg/logger"
+  "time"
+
+  "github.com/google/uuid"
+)
+
+const artifactColumns = `a.id, a.peer_id, a.build_id, a.target, a.path, a.size_bytes, a.sha256, a.signature, a.created_at, a.expires_at`
+
+func scanArtifact(row rowScanner) (*models.Artifact, error) {
+  artifact := &models.Artifact{}
+  var peerID, buildID uuid.NullUUID
+  var signature sql.NullString
+  var createdAt, expiresAt db.Timestamp
+
+  err := row.Scan(&artifact.ID, &peerID, &buildID, &artifact.Target, &artifact.Path, &artifact.Size, &artifact.SHA256, &signature, &createdAt, &expiresAt)
+  if err != nil {
+    return nil, err
+  }
+
+  if peerID.Valid {
+    artifact.PeerID = &peerID.UUID
+  }
+  if buildID.Valid {
+    artifact.BuildID = &buildID.UUID
+  }
+  artifact.Signature = signature.String
+  artifact.CreatedAt = createdAt.Time
+  artifact.ExpiresAt = expiresAt.Time
+  return artifact, nil
+}
+
+func (s *SQLStore) queryArtifacts(ctx context.Context, query string, args ...any) ([]models.Artifact, error) {
+  rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query), args...)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+
+  var artifacts []models.Artifact
+  for rows.Next() {
+    artifact, err := scanArtifact(rows)
+    if err != nil {
+      return nil, err
+    }
+    artifacts = append(artifacts, *artifact)
+  }
+  return artifacts, rows.Err()
+}
+
+func (s *SQLStore) InsertArtifact(ctx context.Context, artifact *models.Artifact) error {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("inserting artifact", "path", artifact.Path)
+
+  query := `
+  INSERT INTO artifacts (id, peer_id, build_id, target, path, size_bytes, sha256, signature, created_at, expires_at)
+  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+  `
+
+  var peerID, buildID uuid.NullUUID
+  if artifact.PeerID != nil {
+    peerID = uuid.NullUUID{UUID: *artifact.PeerID, Valid: true}
+  }
+  if artifact.BuildID != nil {
+    buildID = uuid.NullUUID{UUID: *artifact.BuildID, Valid: true}
+  }
+
+  _, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), artifact.ID, peerID, buildID, string(artifact.Target), artifact.Path,
+    artifact.Size, artifact.SHA256, nullString(artifact.Signature), s.dialect.Timestamp(artifact.CreatedAt), s.dialect.Timestamp(artifact.ExpiresAt))
+  if err != nil {
+    log.Error("error inserting artifact", "path", artifact.Path, "err", err)
+    return wrapErr(ctx, err)
+  }
+  return nil
+}
+
+func (s *SQLStore) GetArtifact(ctx context.Context, id uuid.UUID) (*models.Artifact, error) {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("retrieving artifact", "artifact_id", id)
+
+  query := `SELECT ` + artifactColumns + ` FROM artifacts a WHERE a.id = ?`
+
+  artifact, err := scanArtifact(s.db.QueryRowContext(ctx, s.dialect.Rebind(query), id))
+  if err != nil {
+    log.Error("error retrieving artifact", "artifact_id", id, "err", err)
+    return nil, wrapErr(ctx, err)
+  }
+  return artifact, nil
+}
+
+func (s *SQLStore) GetArtifactByPath(ctx context.Context, path string) (*models.Artifact, error) {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("retrieving artifact", "path", path)
+
+  query := `SELECT ` + artifactColumns + ` FROM artifacts a WHERE a.path = ?`
+
+  artifact, err := scanArtifact(s.db.QueryRowContext(ctx, s.dialect.Rebind(query), path))
+  if err != nil {
+    if err != sql.ErrNoRows {
+      log.Error("error retrieving artifact", "path", path, "err", err)
+    }
+    return nil, wrapErr(ctx, err)
+  }
+  return artifact, nil
+}
+
+// ListArtifacts returns the artifacts of peerID, or all artifacts when
+// peerID is nil, oldest first.
+func (s *SQLStore) ListArtifacts(ctx context.Context, peerID *uuid.UUID) ([]models.Artifact, error) {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("listing artifacts")
+
+  query := `SELECT ` + artifactColumns + ` FROM artifacts a`
+  var args []any
+  if peerID != nil {
+    query += ` WHERE a.peer_id = ?`
+    args = append(args, *peerID)
+  }
+  query += ` ORDER BY a.created_at`
+
+  artifacts, err := s.queryArtifacts(ctx, query, args...)
+  if err != nil {
+    log.Error("error listing artifacts", "err", err)
+    return nil, wrapErr(ctx, err)
+  }
+  return artifacts, nil
+}
+
+// ListCollectableArtifacts returns the artifacts that expired before now or
+// whose peer no longer exists.
+func (s *SQLStore) ListCollectableArtifacts(ctx context.Context, now time.Time) ([]models.Artifact, error) {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("listing collectable artifacts")
+
+  // The join catches peers deleted while SQLite did not enforce the
+  // foreign key.
+  query := `
+  SELECT ` + artifactColumns + ` FROM artifacts a
+  LEFT JOIN peers p ON p.id = a.peer_id
+  WHERE a.expires_at <= ? OR p.id IS NULL
+  ORDER BY a.created_at
+  `
+
+  artifacts, err := s.queryArtifacts(ctx, query, s.dialect.Timestamp(now))
+  if err != nil {
+    log.Error("error listing collectable artifacts", "err", err)
+    return nil, wrapErr(ctx, err)
+  }
+  return artifacts, nil
+}
+
+func (s *SQLStore) DeleteArtifact(ctx context.Context, id uuid.UUID) error {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("deleting artifact", "artifact_id", id)
+
+  res, err := s.db.ExecContext(ctx, s.dialect.Rebind(`DELETE FROM artifacts WHERE id = ?`), id)
+  if err == nil {
+    err = expectRows(res)
+  }
+  if err != nil {
+    log.Error("error deleting artifact", "artifact_id", id, "err", err)
+    return wrapErr(ctx, err)
+  }
+  return nil
+}
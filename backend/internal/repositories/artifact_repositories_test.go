@@ -0,0 +1,83 @@
+package repositories
+
+import (
+  "context"
+  "database/sql"
+  "elysium-backend/internal/models"
+  "errors"
+  "testing"
+  "time"
+
+  "github.com/google/uuid"
+)
+
+func TestArtifacts(t *testing.T) {
+  forEachDatabase(t, func(t *testing.T, store *SQLStore) {
+    ctx := context.Background()
+    now := time.Now().UTC().Truncate(time.Microsecond)
+
+    kept, gone := newPeer("10.0.0.2", "active"), newPeer("10.0.0.3", "active")
+    for _, peer := range []*models.Peer{kept, gone} {
+      if err := store.InsertPeer(ctx, peer); err != nil {
+        t.Fatalf("InsertPeer failed: %v", err)
+      }
+    }
+
+    newArtifact := func(peer *models.Peer, path string, expiresAt time.Time) *models.Artifact {
+      artifact := &models.Artifact{
+        ID:        uuid.New(),
+        PeerID:    peer.ID,
+        Target:    models.OSArch("x86_64-unknown-linux-musl"),
+        Path:      path,
+        Size:      42,
+        SHA256:    "ab",
+        CreatedAt: now,
+        ExpiresAt: expiresAt,
+      }
+      if err := store.InsertArtifact(ctx, artifact); err != nil {
+        t.Fatalf("InsertArtifact failed: %v", err)
+      }
+      return artifact
+    }
+    current := newArtifact(kept, "a/elysium-client", now.Add(time.Hour))
+    expired := newArtifact(kept, "b/elysium-client", now.Add(-time.Hour))
+    orphaned := newArtifact(gone, "c/elysium-client", now.Add(time.Hour))
+
+    got, err := store.GetArtifact(ctx, current.ID)
+    if err != nil {
+      t.Fatalf("GetArtifact failed: %v", err)
+    }
+    if *got.PeerID != *kept.ID || got.Size != 42 || got.Target != models.OSArch("x86_64-unknown-linux-musl") || !got.ExpiresAt.Equal(current.ExpiresAt) {
+      t.Errorf("unexpected artifact %+v", got)
+    }
+
+    if all, _ := store.ListArtifacts(ctx, nil); len(all) != 3 {
+      t.Errorf("expected 3 artifacts, got %d", len(all))
+    }
+    if own, _ := store.ListArtifacts(ctx, kept.ID); len(own) != 2 {
+      t.Errorf("expected 2 artifacts for the peer, got %d", len(own))
+    }
+
+    if err := store.DeletePeer(ctx, *gone.ID); err != nil {
+      t.Fatalf("DeletePeer failed: %v", err)
+    }
+    collectable, err := store.ListCollectableArtifacts(ctx, now)
+    if err != nil {
+      t.Fatalf("ListCollectableArtifacts failed: %v", err)
+    }
+    ids := map[uuid.UUID]bool{}
+    for _, artifact := range collectable {
+      ids[artifact.ID] = true
+    }
+    if len(ids) != 2 || !ids[expired.ID] || !ids[orphaned.ID] {
+      t.Errorf("expected the expired and orphaned artifacts, got %+v", collectable)
+    }
+
+    if err := store.DeleteArtifact(ctx, expired.ID); err != nil {
+      t.Fatalf("DeleteArtifact failed: %v", err)
+    }
+    if err := store.DeleteArtifact(ctx, expired.ID); !errors.Is(err, sql.ErrNoRows) {
+      t.Errorf("expected sql.ErrNoRows deleting twice, got %v", err)
+    }
+  })
+}
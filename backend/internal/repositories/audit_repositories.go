@@ -0,0 +1,114 @@
+package repositories
+
+import (
+  "context"
+  "database/sql"
+  "elysium-backend/internal/models"
+  "elysium-backend/pkg/db"
+  "elysium-backend/pkg/logger"
+  "strings"
+)
+
+func (s *SQLStore) InsertAuditEvent(ctx context.Context, event *models.AuditEvent) error {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+
+  query := `
+  INSERT INTO audit_events (occurred_at, actor, action, target, before_state, after_state, source_ip, request_id)
+  VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+  RETURNING id
+  `
+
+  err := s.db.QueryRowContext(ctx, s.dialect.Rebind(query), s.dialect.Timestamp(event.OccurredAt), event.Actor, event.Action,
+    nullString(event.Target), nullJSON(event.Before), nullJSON(event.After), nullString(event.SourceIP), nullString(event.RequestID)).Scan(&event.ID)
+  if err != nil {
+    log.Error("error inserting audit event", "action", event.Action, "err", err)
+    return wrapErr(ctx, err)
+  }
+  return nil
+}
+
+func (s *SQLStore) ListAuditEvents(ctx context.Context, filter models.AuditFilter) ([]models.AuditEvent, error) {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("listing audit events", "filter", filter)
+
+  var conditions []string
+  var args []any
+  add := func(condition string, arg any) {
+    conditions = append(conditions, condition)
+    args = append(args, arg)
+  }
+  if filter.Actor != "" {
+    add("actor = ?", filter.Actor)
+  }
+  if filter.Action != "" {
+    add("action = ?", filter.Action)
+  }
+  if filter.Target != "" {
+    add("target = ?", filter.Target)
+  }
+  if !filter.Since.IsZero() {
+    add("occurred_at >= ?", s.dialect.Timestamp(filter.Since))
+  }
+  if !filter.Until.IsZero() {
+    add("occurred_at < ?", s.dialect.Timestamp(filter.Until))
+  }
+  if filter.BeforeID > 0 {
+    add("id < ?", filter.BeforeID)
+  }
+
+  query := `SELECT id, occurred_at, actor, action, target, before_state, after_state, source_ip, request_id FROM audit_events`
+  if len(conditions) > 0 {
+    query += " WHERE " + strings.Join(conditions, " AND ")
+  }
+  if filter.Ascending {
+    query += " ORDER BY id ASC"
+  } else {
+    query += " ORDER BY id DESC"
+  }
+  if filter.Limit > 0 {
+    query += " LIMIT ?"
+    args = append(args, filter.Limit)
+  }
+
+  rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query), args...)
+  if err != nil {
+    log.Error("error listing audit events", "err", err)
+    return nil, wrapErr(ctx, err)
+  }
+  defer rows.Close()
+
+  var events []models.AuditEvent
+  for rows.Next() {
+    var event models.AuditEvent
+    var occurredAt db.Timestamp
+    var target, before, after, sourceIP, requestID sql.NullString
+    if err := rows.Scan(&event.ID, &occurredAt, &event.Actor, &event.Action, &target, &before, &after, &sourceIP, &requestID); err != nil {
+      log.Error("error scanning audit event", "err", err)
+      return nil, wrapErr(ctx, err)
+    }
+    event.OccurredAt = occurredAt.Time
+    event.Target = target.String
+    event.SourceIP = sourceIP.String
+    event.RequestID = requestID.String
+    if before.Valid {
+      event.Before = []byte(before.String)
+    }
+    if after.Valid {
+      event.After = []byte(after.String)
+    }
+    events = append(events, event)
+  }
+  return events, wrapErr(ctx, rows.Err())
+}
+
+func nullString(s string) sql.NullString {
+  return sql.NullString{String: s, Valid: s != ""}
+}
+
+func nullJSON(raw []byte) sql.NullString {
+  return sql.NullString{String: string(raw), Valid: len(raw) > 0}
+}
@@ -0,0 +1,74 @@
+package repositories
+
+import (
+  "context"
+  "elysium-backend/internal/models"
+  "encoding/json"
+  "testing"
+  "time"
+)
+
+func TestAuditEvents(t *testing.T) {
+  forEachDatabase(t, func(t *testing.T, store *SQLStore) {
+    ctx := context.Background()
+    base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+    events := []*models.AuditEvent{
+      {OccurredAt: base, Actor: "system", Action: "wireguard.init", Target: "wg0"},
+      {OccurredAt: base.Add(time.Minute), Actor: "anonymous", Action: "peer.create", Target: "a", After: json.RawMessage(`{"status":"pending"}`), SourceIP: "127.0.0.1"},
+      {OccurredAt: base.Add(2 * time.Minute), Actor: "admin-token", Action: "loglevel.update", Before: json.RawMessage(`{"level":"INFO"}`), After: json.RawMessage(`{"level":"DEBUG"}`)},
+    }
+    for _, event := range events {
+      if err := store.InsertAuditEvent(ctx, event); err != nil {
+        t.Fatalf("InsertAuditEvent failed: %v", err)
+      }
+      if event.ID == 0 {
+        t.Fatalf("expected an ID to be assigned")
+      }
+    }
+
+    all, err := store.ListAuditEvents(ctx, models.AuditFilter{})
+    if err != nil {
+      t.Fatalf("ListAuditEvents failed: %v", err)
+    }
+    if len(all) != 3 || all[0].Action != "loglevel.update" || all[2].Action != "wireguard.init" {
+      t.Fatalf("expected events newest first, got %+v", all)
+    }
+    if !all[1].OccurredAt.Equal(base.Add(time.Minute)) || all[1].SourceIP != "127.0.0.1" {
+      t.Errorf("unexpected event %+v", all[1])
+    }
+    var after map[string]string
+    if err := json.Unmarshal(all[0].After, &after); err != nil || after["level"] != "DEBUG" {
+      t.Errorf("unexpected after state %s", all[0].After)
+    }
+
+    filtered, err := store.ListAuditEvents(ctx, models.AuditFilter{Since: base.Add(30 * time.Second), Ascending: true, Limit: 1})
+    if err != nil {
+      t.Fatalf("ListAuditEvents failed: %v", err)
+    }
+    if len(filtered) != 1 || filtered[0].Action != "peer.create" {
+      t.Errorf("unexpected filtered events %+v", filtered)
+    }
+
+    byActor, _ := store.ListAuditEvents(ctx, models.AuditFilter{Actor: "system"})
+    if len(byActor) != 1 || byActor[0].Target != "wg0" {
+      t.Errorf("unexpected events for actor system: %+v", byActor)
+    }
+  })
+}
+
+func TestAuditEventsAreAppendOnly(t *testing.T) {
+  forEachDatabase(t, func(t *testing.T, store *SQLStore) {
+    ctx := context.Background()
+    if err := store.InsertAuditEvent(ctx, &models.AuditEvent{OccurredAt: time.Now(), Actor: "system", Action: "test"}); err != nil {
+      t.Fatalf("InsertAuditEvent failed: %v", err)
+    }
+
+    if _, err := store.db.ExecContext(ctx, "UPDATE audit_events SET actor = 'someone'"); err == nil {
+      t.Errorf("expected UPDATE to be rejected")
+    }
+    if _, err := store.db.ExecContext(ctx, "DELETE FROM audit_events"); err == nil {
+      t.Errorf("expected DELETE to be rejected")
+    }
+  })
+}
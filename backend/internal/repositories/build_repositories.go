@@ -0,0 +1,219 @@
+package repositories
+
+import (
+  "context"
+  "database/sql"
+  "elysium-backend/internal/models"
+  "elysium-backend/pkg/db"
+  "elysium-backend/pkg/logger"
+  "encoding/json"
+
+  "github.com/google/uuid"
+)
+
+const buildColumns = `id, target, status, artifact_path, sha256, error, provenance, started_at, finished_at`
+
+func scanBuild(row rowScanner) (*models.Build, error) {
+  build := &models.Build{}
+  var artifactPath, sha256, buildErr, provenance sql.NullString
+  var startedAt, finishedAt db.Timestamp
+
+  err := row.Scan(&build.ID, &build.Target, &build.Status, &artifactPath, &sha256, &buildErr, &provenance, &startedAt, &finishedAt)
+  if err != nil {
+    return nil, err
+  }
+
+  build.ArtifactPath = artifactPath.String
+  build.SHA256 = sha256.String
+  build.Error = buildErr.String
+  if provenance.Valid {
+    build.Provenance = &models.BuildProvenance{}
+    if err := json.Unmarshal([]byte(provenance.String), build.Provenance); err != nil {
+      return nil, err
+    }
+  }
+  build.StartedAt = startedAt.Time
+  build.FinishedAt = finishedAt.Ptr()
+  return build, nil
+}
+
+// encodeProvenance returns provenance as JSON, or nil when there is none.
+func encodeProvenance(provenance *models.BuildProvenance) ([]byte, error) {
+  if provenance == nil {
+    return nil, nil
+  }
+  return json.Marshal(provenance)
+}
+
+func (s *SQLStore) InsertBuild(ctx context.Context, build *models.Build) error {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("inserting build", "build_id", build.ID)
+
+  provenance, err := encodeProvenance(build.Provenance)
+  if err != nil {
+    return err
+  }
+
+  query := `
+  INSERT INTO builds (id, target, status, artifact_path, sha256, error, provenance, started_at)
+  VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+  `
+
+  _, err = s.db.ExecContext(ctx, s.dialect.Rebind(query), build.ID, string(build.Target), build.Status, nullString(build.ArtifactPath),
+    nullString(build.SHA256), nullString(build.Error), nullJSON(provenance), s.dialect.Timestamp(build.StartedAt))
+  if err != nil {
+    log.Error("error inserting build", "build_id", build.ID, "err", err)
+    return wrapErr(ctx, err)
+  }
+  return nil
+}
+
+// FinishBuild stores the outcome of build: its status, artifact, error,
+// provenance and FinishedAt. It returns sql.ErrNoRows when the build does
+// not exist.
+func (s *SQLStore) FinishBuild(ctx context.Context, build *models.Build) error {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("finishing build", "build_id", build.ID, "status", build.Status)
+
+  provenance, err := encodeProvenance(build.Provenance)
+  if err != nil {
+    return err
+  }
+
+  var finishedAt any
+  if build.FinishedAt != nil {
+    finishedAt = s.dialect.Timestamp(*build.FinishedAt)
+  }
+
+  query := `
+  UPDATE builds SET status = ?, artifact_path = ?, sha256 = ?, error = ?, provenance = ?, finished_at = ?
+  WHERE id = ?
+  `
+
+  res, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), build.Status, nullString(build.ArtifactPath), nullString(build.SHA256),
+    nullString(build.Error), nullJSON(provenance), finishedAt, build.ID)
+  if err == nil {
+    err = expectRows(res)
+  }
+  if err != nil {
+    log.Error("error finishing build", "build_id", build.ID, "err", err)
+    return wrapErr(ctx, err)
+  }
+  return nil
+}
+
+func (s *SQLStore) GetBuild(ctx context.Context, id uuid.UUID) (*models.Build, error) {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("retrieving build", "build_id", id)
+
+  query := `SELECT ` + buildColumns + ` FROM builds WHERE id = ?`
+
+  build, err := scanBuild(s.db.QueryRowContext(ctx, s.dialect.Rebind(query), id))
+  if err != nil {
+    log.Error("error retrieving build", "build_id", id, "err", err)
+    return nil, wrapErr(ctx, err)
+  }
+  return build, nil
+}
+
+// ListBuilds returns up to limit builds, newest first, only those with
+// status unless it is empty.
+func (s *SQLStore) ListBuilds(ctx context.Context, status string, limit int) ([]models.Build, error) {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("listing builds", "status", status)
+
+  query := `SELECT ` + buildColumns + ` FROM builds`
+  var args []any
+  if status != "" {
+    query += ` WHERE status = ?`
+    args = append(args, status)
+  }
+  query += ` ORDER BY started_at DESC LIMIT ?`
+  args = append(args, limit)
+
+  rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query), args...)
+  if err != nil {
+    log.Error("error listing builds", "err", err)
+    return nil, wrapErr(ctx, err)
+  }
+  defer rows.Close()
+
+  var builds []models.Build
+  for rows.Next() {
+    build, err := scanBuild(rows)
+    if err != nil {
+      log.Error("error scanning build", "err", err)
+      return nil, wrapErr(ctx, err)
+    }
+    builds = append(builds, *build)
+  }
+  return builds, wrapErr(ctx, rows.Err())
+}
+
+// InsertBuildLogs stores the output of a build in one transaction.
+func (s *SQLStore) InsertBuildLogs(ctx context.Context, buildID uuid.UUID, lines []models.BuildLogLine) error {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("storing build output", "build_id", buildID, "lines", len(lines))
+
+  query := `INSERT INTO build_logs (build_id, seq, line, logged_at) VALUES (?, ?, ?, ?)`
+
+  err := s.inTx(ctx, func(tx *sql.Tx) error {
+    stmt, err := tx.PrepareContext(ctx, s.dialect.Rebind(query))
+    if err != nil {
+      return err
+    }
+    defer stmt.Close()
+
+    for _, line := range lines {
+      if _, err := stmt.ExecContext(ctx, buildID, line.Seq, line.Line, s.dialect.Timestamp(line.Time)); err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+  if err != nil {
+    log.Error("error storing build output", "build_id", buildID, "err", err)
+    return wrapErr(ctx, err)
+  }
+  return nil
+}
+
+// ListBuildLogs returns the output of a build after line afterSeq.
+func (s *SQLStore) ListBuildLogs(ctx context.Context, buildID uuid.UUID, afterSeq int) ([]models.BuildLogLine, error) {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("retrieving build output", "build_id", buildID, "after", afterSeq)
+
+  query := `SELECT seq, line, logged_at FROM build_logs WHERE build_id = ? AND seq > ? ORDER BY seq`
+
+  rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query), buildID, afterSeq)
+  if err != nil {
+    log.Error("error retrieving build output", "build_id", buildID, "err", err)
+    return nil, wrapErr(ctx, err)
+  }
+  defer rows.Close()
+
+  var lines []models.BuildLogLine
+  for rows.Next() {
+    var line models.BuildLogLine
+    var loggedAt db.Timestamp
+    if err := rows.Scan(&line.Seq, &line.Line, &loggedAt); err != nil {
+      log.Error("error scanning build output", "build_id", buildID, "err", err)
+      return nil, wrapErr(ctx, err)
+    }
+    line.Time = loggedAt.Time
+    lines = append(lines, line)
+  }
+  return lines, wrapErr(ctx, rows.Err())
+}
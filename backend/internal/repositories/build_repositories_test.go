@@ -0,0 +1,123 @@
+package repositories
+
+import (
+  "context"
+  "database/sql"
+  "elysium-backend/internal/models"
+  "errors"
+  "testing"
+  "time"
+
+  "github.com/google/uuid"
+)
+
+func TestBuilds(t *testing.T) {
+  forEachDatabase(t, func(t *testing.T, store *SQLStore) {
+    ctx := context.Background()
+    now := time.Now().UTC().Truncate(time.Microsecond)
+
+    build := &models.Build{
+      ID:        uuid.New(),
+      Target:    models.OSArch("x86_64-unknown-linux-musl"),
+      Status:    models.BuildStatusRunning,
+      StartedAt: now,
+    }
+    if err := store.InsertBuild(ctx, build); err != nil {
+      t.Fatalf("InsertBuild failed: %v", err)
+    }
+
+    got, err := store.GetBuild(ctx, build.ID)
+    if err != nil {
+      t.Fatalf("GetBuild failed: %v", err)
+    }
+    if got.Status != models.BuildStatusRunning || got.Provenance != nil || got.FinishedAt != nil || !got.StartedAt.Equal(now) {
+      t.Errorf("unexpected running build %+v", got)
+    }
+
+    finishedAt := now.Add(time.Minute)
+    build.Status = models.BuildStatusSucceeded
+    build.ArtifactPath = "a/elysium-client"
+    build.SHA256 = "ab"
+    build.FinishedAt = &finishedAt
+    build.Provenance = &models.BuildProvenance{
+      CacheKey:     "0123456789abcdef",
+      GitCommit:    "c0ffee",
+      CargoVersion: "cargo 1.84.0",
+      Features:     []string{"tun"},
+      Env:          map[string]string{"CONFIGPUB": "ab"},
+      CompiledAt:   now,
+    }
+    if err := store.FinishBuild(ctx, build); err != nil {
+      t.Fatalf("FinishBuild failed: %v", err)
+    }
+
+    got, _ = store.GetBuild(ctx, build.ID)
+    if got.Status != models.BuildStatusSucceeded || got.ArtifactPath != "a/elysium-client" || got.FinishedAt == nil || !got.FinishedAt.Equal(finishedAt) {
+      t.Errorf("unexpected finished build %+v", got)
+    }
+    if got.Provenance == nil || got.Provenance.GitCommit != "c0ffee" || got.Provenance.Features[0] != "tun" || !got.Provenance.CompiledAt.Equal(now) {
+      t.Errorf("unexpected provenance %+v", got.Provenance)
+    }
+
+    if _, err := store.GetBuild(ctx, uuid.New()); !errors.Is(err, sql.ErrNoRows) {
+      t.Errorf("expected sql.ErrNoRows for an unknown build, got %v", err)
+    }
+    if err := store.FinishBuild(ctx, &models.Build{ID: uuid.New(), Status: models.BuildStatusFailed}); !errors.Is(err, sql.ErrNoRows) {
+      t.Errorf("expected sql.ErrNoRows when finishing an unknown build, got %v", err)
+    }
+  })
+}
+
+func TestListBuildsAndLogs(t *testing.T) {
+  forEachDatabase(t, func(t *testing.T, store *SQLStore) {
+    ctx := context.Background()
+    now := time.Now().UTC().Truncate(time.Microsecond)
+
+    var ids []uuid.UUID
+    for i, status := range []string{models.BuildStatusFailed, models.BuildStatusRunning, models.BuildStatusRunning} {
+      build := &models.Build{
+        ID:        uuid.New(),
+        Target:    models.OSArch("x86_64-unknown-linux-musl"),
+        Status:    status,
+        StartedAt: now.Add(time.Duration(i) * time.Minute),
+      }
+      if err := store.InsertBuild(ctx, build); err != nil {
+        t.Fatalf("InsertBuild failed: %v", err)
+      }
+      ids = append(ids, build.ID)
+    }
+
+    running, err := store.ListBuilds(ctx, models.BuildStatusRunning, 10)
+    if err != nil {
+      t.Fatalf("ListBuilds failed: %v", err)
+    }
+    if len(running) != 2 || running[0].ID != ids[2] || running[1].ID != ids[1] {
+      t.Errorf("expected the running builds newest first, got %+v", running)
+    }
+    if all, _ := store.ListBuilds(ctx, "", 2); len(all) != 2 || all[1].ID != ids[1] {
+      t.Errorf("expected the two newest builds, got %+v", all)
+    }
+
+    lines := []models.BuildLogLine{
+      {Seq: 1, Line: "   Compiling elysium-client", Time: now},
+      {Seq: 2, Line: "error[E0425]: cannot find value `x`", Time: now.Add(time.Second)},
+    }
+    if err := store.InsertBuildLogs(ctx, ids[0], lines); err != nil {
+      t.Fatalf("InsertBuildLogs failed: %v", err)
+    }
+
+    got, err := store.ListBuildLogs(ctx, ids[0], 0)
+    if err != nil {
+      t.Fatalf("ListBuildLogs failed: %v", err)
+    }
+    if len(got) != 2 || got[1].Seq != 2 || got[1].Line != lines[1].Line || !got[0].Time.Equal(now) {
+      t.Errorf("expected the stored output, got %+v", got)
+    }
+    if got, _ := store.ListBuildLogs(ctx, ids[0], 1); len(got) != 1 || got[0].Seq != 2 {
+      t.Errorf("expected the output after line 1, got %+v", got)
+    }
+    if got, _ := store.ListBuildLogs(ctx, ids[1], 0); len(got) != 0 {
+      t.Errorf("expected no output for a build without any, got %+v", got)
+    }
+  })
+}
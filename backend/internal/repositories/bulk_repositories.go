@@ -0,0 +1,217 @@
+package repositories
+
+import (
+  "context"
+  "database/sql"
+  "elysium-backend/internal/models"
+  "elysium-backend/pkg/db"
+  "elysium-backend/pkg/logger"
+  "encoding/json"
+
+  "github.com/google/uuid"
+)
+
+const bulkItemColumns = `seq, name, owner, target, tags, public_key, peer_id, assigned_ip, status, build_id, artifact_id, error`
+
+func scanBulkItem(row rowScanner) (*models.BulkJobItem, error) {
+  item := &models.BulkJobItem{}
+  var owner, tags, publicKey, itemErr sql.NullString
+  var peerID, buildID, artifactID uuid.NullUUID
+
+  err := row.Scan(&item.Seq, &item.Name, &owner, &item.Target, &tags, &publicKey, &peerID, &item.AssignedIP, &item.Status, &buildID, &artifactID, &itemErr)
+  if err != nil {
+    return nil, err
+  }
+
+  item.Owner = owner.String
+  item.PublicKey = publicKey.String
+  item.Error = itemErr.String
+  if tags.Valid {
+    if err := json.Unmarshal([]byte(tags.String), &item.Tags); err != nil {
+      return nil, err
+    }
+  }
+  item.PeerID = nullUUIDPtr(peerID)
+  item.BuildID = nullUUIDPtr(buildID)
+  item.ArtifactID = nullUUIDPtr(artifactID)
+  return item, nil
+}
+
+func nullUUIDPtr(id uuid.NullUUID) *uuid.UUID {
+  if !id.Valid {
+    return nil
+  }
+  return &id.UUID
+}
+
+func nullUUID(id *uuid.UUID) uuid.NullUUID {
+  if id == nil {
+    return uuid.NullUUID{}
+  }
+  return uuid.NullUUID{UUID: *id, Valid: true}
+}
+
+// InsertBulkJob stores job together with peers, the peer of each of its
+// items, in one transaction, so either every address of the batch is taken
+// or none is. The IDs of the inserted peers are set on them and their items.
+func (s *SQLStore) InsertBulkJob(ctx context.Context, job *models.BulkJob, peers []*models.Peer) error {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("inserting bulk job", "job_id", job.ID, "peers", len(peers))
+
+  err := s.inTx(ctx, func(tx *sql.Tx) error {
+    query := `INSERT INTO bulk_jobs (id, status, created_at) VALUES (?, ?, ?)`
+    if _, err := tx.ExecContext(ctx, s.dialect.Rebind(query), job.ID, job.Status, s.dialect.Timestamp(job.CreatedAt)); err != nil {
+      return err
+    }
+
+    query = `
+    INSERT INTO bulk_job_items (job_id, seq, name, owner, target, tags, public_key, peer_id, assigned_ip, status)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `
+    for i, peer := range peers {
+      if err := s.insertPeer(ctx, tx, peer); err != nil {
+        return err
+      }
+
+      item := &job.Items[i]
+      item.PeerID = peer.ID
+      tags, err := encodeTags(item.Tags)
+      if err != nil {
+        return err
+      }
+      if _, err := tx.ExecContext(ctx, s.dialect.Rebind(query), job.ID, item.Seq, item.Name, nullString(item.Owner), string(item.Target),
+        nullJSON(tags), nullString(item.PublicKey), nullUUID(item.PeerID), ipValue(item.AssignedIP), item.Status); err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+  if err != nil {
+    log.Error("error inserting bulk job", "job_id", job.ID, "err", err)
+    return wrapErr(ctx, err)
+  }
+  return nil
+}
+
+// encodeTags returns tags as JSON, or nil when there are none.
+func encodeTags(tags []string) ([]byte, error) {
+  if len(tags) == 0 {
+    return nil, nil
+  }
+  return json.Marshal(tags)
+}
+
+// UpdateBulkJobItem stores the progress of item in job jobID. It returns
+// sql.ErrNoRows when there is no such item.
+func (s *SQLStore) UpdateBulkJobItem(ctx context.Context, jobID uuid.UUID, item *models.BulkJobItem) error {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("updating bulk job item", "job_id", jobID, "seq", item.Seq, "status", item.Status)
+
+  query := `
+  UPDATE bulk_job_items SET peer_id = ?, status = ?, build_id = ?, artifact_id = ?, error = ?
+  WHERE job_id = ? AND seq = ?
+  `
+
+  res, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), nullUUID(item.PeerID), item.Status, nullUUID(item.BuildID),
+    nullUUID(item.ArtifactID), nullString(item.Error), jobID, item.Seq)
+  if err == nil {
+    err = expectRows(res)
+  }
+  if err != nil {
+    log.Error("error updating bulk job item", "job_id", jobID, "seq", item.Seq, "err", err)
+    return wrapErr(ctx, err)
+  }
+  return nil
+}
+
+// FinishBulkJob stores the status and finish time of job. It returns
+// sql.ErrNoRows when the job does not exist.
+func (s *SQLStore) FinishBulkJob(ctx context.Context, job *models.BulkJob) error {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("finishing bulk job", "job_id", job.ID, "status", job.Status)
+
+  query := `UPDATE bulk_jobs SET status = ?, finished_at = ? WHERE id = ?`
+
+  var finishedAt any
+  if job.FinishedAt != nil {
+    finishedAt = s.dialect.Timestamp(*job.FinishedAt)
+  }
+  res, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), job.Status, finishedAt, job.ID)
+  if err == nil {
+    err = expectRows(res)
+  }
+  if err != nil {
+    log.Error("error finishing bulk job", "job_id", job.ID, "err", err)
+    return wrapErr(ctx, err)
+  }
+  return nil
+}
+
+// ListBulkJobIDs returns the IDs of the bulk jobs with status, oldest first.
+func (s *SQLStore) ListBulkJobIDs(ctx context.Context, status string) ([]uuid.UUID, error) {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("listing bulk jobs", "status", status)
+
+  query := `SELECT id FROM bulk_jobs WHERE status = ? ORDER BY created_at`
+  rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query), status)
+  if err != nil {
+    log.Error("error listing bulk jobs", "err", err)
+    return nil, wrapErr(ctx, err)
+  }
+  defer rows.Close()
+
+  var ids []uuid.UUID
+  for rows.Next() {
+    var id uuid.UUID
+    if err := rows.Scan(&id); err != nil {
+      log.Error("error scanning bulk job", "err", err)
+      return nil, wrapErr(ctx, err)
+    }
+    ids = append(ids, id)
+  }
+  return ids, wrapErr(ctx, rows.Err())
+}
+
+// GetBulkJob returns a bulk job with its items in request order.
+func (s *SQLStore) GetBulkJob(ctx context.Context, id uuid.UUID) (*models.BulkJob, error) {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("retrieving bulk job", "job_id", id)
+
+  job := &models.BulkJob{ID: id}
+  var createdAt, finishedAt db.Timestamp
+  query := `SELECT status, created_at, finished_at FROM bulk_jobs WHERE id = ?`
+  if err := s.db.QueryRowContext(ctx, s.dialect.Rebind(query), id).Scan(&job.Status, &createdAt, &finishedAt); err != nil {
+    log.Error("error retrieving bulk job", "job_id", id, "err", err)
+    return nil, wrapErr(ctx, err)
+  }
+  job.CreatedAt = createdAt.Time
+  job.FinishedAt = finishedAt.Ptr()
+
+  query = `SELECT ` + bulkItemColumns + ` FROM bulk_job_items WHERE job_id = ? ORDER BY seq`
+  rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query), id)
+  if err != nil {
+    log.Error("error retrieving bulk job items", "job_id", id, "err", err)
+    return nil, wrapErr(ctx, err)
+  }
+  defer rows.Close()
+
+  for rows.Next() {
+    item, err := scanBulkItem(rows)
+    if err != nil {
+      log.Error("error scanning bulk job item", "job_id", id, "err", err)
+      return nil, wrapErr(ctx, err)
+    }
+    job.Items = append(job.Items, *item)
+  }
+  return job, wrapErr(ctx, rows.Err())
+}
@@ -0,0 +1,115 @@
+package repositories
+
+import (
+  "context"
+  "database/sql"
+  "elysium-backend/internal/models"
+  "errors"
+  "net"
+  "testing"
+  "time"
+
+  "github.com/google/uuid"
+)
+
+func newBulkJob(peers ...*models.Peer) *models.BulkJob {
+  job := &models.BulkJob{
+    ID:        uuid.New(),
+    Status:    models.BulkJobStatusRunning,
+    CreatedAt: time.Now().UTC().Truncate(time.Microsecond),
+  }
+  for i, peer := range peers {
+    job.Items = append(job.Items, models.BulkJobItem{
+      Seq:        i + 1,
+      Name:       "peer-" + peer.AssignedIP.String(),
+      Target:     models.OSArch("x86_64-unknown-linux-musl"),
+      Tags:       []string{"team-a"},
+      PublicKey:  peer.PublicKey,
+      AssignedIP: peer.AssignedIP,
+      Status:     models.BulkItemStatusPending,
+    })
+  }
+  return job
+}
+
+func TestBulkJobs(t *testing.T) {
+  forEachDatabase(t, func(t *testing.T, store *SQLStore) {
+    ctx := context.Background()
+
+    first, second := newPeer("10.0.0.2", "pending"), newPeer("10.0.0.3", "pending")
+    first.Metadata = &map[string]interface{}{"name": "laptop", "tags": []any{"team-a"}}
+    job := newBulkJob(first, second)
+    if err := store.InsertBulkJob(ctx, job, []*models.Peer{first, second}); err != nil {
+      t.Fatalf("InsertBulkJob failed: %v", err)
+    }
+    if first.ID == nil || job.Items[1].PeerID == nil || *job.Items[1].PeerID != *second.ID {
+      t.Fatalf("expected the peer IDs to be set, got %v and %+v", first.ID, job.Items[1])
+    }
+
+    peer, err := store.GetPeer(ctx, *first.ID)
+    if err != nil {
+      t.Fatalf("GetPeer failed: %v", err)
+    }
+    if peer.Metadata == nil || (*peer.Metadata)["name"] != "laptop" {
+      t.Errorf("expected the peer metadata to be stored, got %v", peer.Metadata)
+    }
+
+    // One address of the batch is taken: none of its peers may be stored.
+    third := newPeer("10.0.0.4", "pending")
+    conflicting := newPeer("10.0.0.3", "pending")
+    if err := store.InsertBulkJob(ctx, newBulkJob(third, conflicting), []*models.Peer{third, conflicting}); err == nil {
+      t.Fatal("expected a batch reusing an address to fail")
+    }
+    if available, _ := store.IsIpAvailable(ctx, net.ParseIP("10.0.0.4")); !available {
+      t.Error("expected the failed batch to be rolled back")
+    }
+
+    buildID, artifactID := uuid.New(), uuid.New()
+    item := job.Items[0]
+    item.Status = models.BulkItemStatusSucceeded
+    item.BuildID = &buildID
+    item.ArtifactID = &artifactID
+    if err := store.UpdateBulkJobItem(ctx, job.ID, &item); err != nil {
+      t.Fatalf("UpdateBulkJobItem failed: %v", err)
+    }
+    failed := job.Items[1]
+    failed.Status = models.BulkItemStatusFailed
+    failed.Error = "exit status 101"
+    store.UpdateBulkJobItem(ctx, job.ID, &failed)
+
+    if ids, err := store.ListBulkJobIDs(ctx, models.BulkJobStatusRunning); err != nil || len(ids) != 1 || ids[0] != job.ID {
+      t.Fatalf("expected the running job, got %v (%v)", ids, err)
+    }
+
+    finishedAt := time.Now().UTC().Truncate(time.Microsecond)
+    job.Status = models.BulkJobStatusCompleted
+    job.FinishedAt = &finishedAt
+    if err := store.FinishBulkJob(ctx, job); err != nil {
+      t.Fatalf("FinishBulkJob failed: %v", err)
+    }
+
+    got, err := store.GetBulkJob(ctx, job.ID)
+    if err != nil {
+      t.Fatalf("GetBulkJob failed: %v", err)
+    }
+    if got.Status != models.BulkJobStatusCompleted || got.FinishedAt == nil || !got.FinishedAt.Equal(finishedAt) || len(got.Items) != 2 {
+      t.Fatalf("unexpected bulk job %+v", got)
+    }
+    if got.Items[0].ArtifactID == nil || *got.Items[0].ArtifactID != artifactID || got.Items[0].Tags[0] != "team-a" || !got.Items[0].AssignedIP.Equal(net.ParseIP("10.0.0.2")) {
+      t.Errorf("unexpected succeeded item %+v", got.Items[0])
+    }
+    if got.Items[1].Status != models.BulkItemStatusFailed || got.Items[1].Error != "exit status 101" || got.Items[1].BuildID != nil {
+      t.Errorf("unexpected failed item %+v", got.Items[1])
+    }
+
+    if ids, _ := store.ListBulkJobIDs(ctx, models.BulkJobStatusRunning); len(ids) != 0 {
+      t.Errorf("expected no running jobs once finished, got %v", ids)
+    }
+    if _, err := store.GetBulkJob(ctx, uuid.New()); !errors.Is(err, sql.ErrNoRows) {
+      t.Errorf("expected sql.ErrNoRows for an unknown job, got %v", err)
+    }
+    if err := store.UpdateBulkJobItem(ctx, job.ID, &models.BulkJobItem{Seq: 3, Status: models.BulkItemStatusFailed}); !errors.Is(err, sql.ErrNoRows) {
+      t.Errorf("expected sql.ErrNoRows for an unknown item, got %v", err)
+    }
+  })
+}
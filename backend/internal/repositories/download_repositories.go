@@ -0,0 +1,144 @@
+package repositories
+
+import (
+  "context"
+  "database/sql"
+  "elysium-backend/internal/models"
+  "elysium-backend/pkg/db"
+  "elysium-backend/pkg/logger"
+  "time"
+
+  "github.com/google/uuid"
+)
+
+const downloadLinkColumns = `id, peer_id, artifact_path, expires_at, max_uses, uses, created_at, revoked_at, resume_until`
+
+func scanDownloadLink(row rowScanner) (*models.DownloadLink, error) {
+  link := &models.DownloadLink{}
+  var expiresAt, createdAt, revokedAt, resumeUntil db.Timestamp
+
+  err := row.Scan(&link.ID, &link.PeerID, &link.ArtifactPath, &expiresAt, &link.MaxUses, &link.Uses, &createdAt, &revokedAt, &resumeUntil)
+  if err != nil {
+    return nil, err
+  }
+
+  link.ExpiresAt = expiresAt.Time
+  link.CreatedAt = createdAt.Time
+  link.RevokedAt = revokedAt.Ptr()
+  link.ResumeUntil = resumeUntil.Ptr()
+  return link, nil
+}
+
+func (s *SQLStore) InsertDownloadLink(ctx context.Context, link *models.DownloadLink) error {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("inserting download link", "peer_id", link.PeerID)
+
+  query := `
+  INSERT INTO download_links (id, peer_id, artifact_path, expires_at, max_uses, uses, created_at)
+  VALUES (?, ?, ?, ?, ?, ?, ?)
+  `
+
+  _, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), link.ID, link.PeerID, link.ArtifactPath,
+    s.dialect.Timestamp(link.ExpiresAt), link.MaxUses, link.Uses, s.dialect.Timestamp(link.CreatedAt))
+  if err != nil {
+    log.Error("error inserting download link", "peer_id", link.PeerID, "err", err)
+    return wrapErr(ctx, err)
+  }
+  return nil
+}
+
+// ConsumeDownloadLink counts one use of the link, lets the download be
+// resumed until resumeUntil and returns the link. The check and the
+// increment are a single statement, so concurrent downloads cannot exceed
+// the limit. It returns sql.ErrNoRows when the link does not exist, has
+// expired, has been revoked or is used up.
+func (s *SQLStore) ConsumeDownloadLink(ctx context.Context, id string, now, resumeUntil time.Time) (*models.DownloadLink, error) {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("consuming download link", "link_id", id)
+
+  query := `
+  UPDATE download_links SET uses = uses + 1, resume_until = ?
+  WHERE id = ? AND revoked_at IS NULL AND uses < max_uses AND expires_at > ?
+  RETURNING ` + downloadLinkColumns
+
+  link, err := scanDownloadLink(s.db.QueryRowContext(ctx, s.dialect.Rebind(query), s.dialect.Timestamp(resumeUntil), id, s.dialect.Timestamp(now)))
+  if err != nil {
+    if err != sql.ErrNoRows {
+      log.Error("error consuming download link", "link_id", id, "err", err)
+    }
+    return nil, wrapErr(ctx, err)
+  }
+  return link, nil
+}
+
+// FinishDownload closes the resume window of the link once a download
+// through it has finished, so resuming it counts as a new use.
+func (s *SQLStore) FinishDownload(ctx context.Context, id string) error {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("finishing download", "link_id", id)
+
+  query := `UPDATE download_links SET resume_until = NULL WHERE id = ?`
+
+  if _, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), id); err != nil {
+    log.Error("error finishing download", "link_id", id, "err", err)
+    return wrapErr(ctx, err)
+  }
+  return nil
+}
+
+func (s *SQLStore) GetDownloadLink(ctx context.Context, id string) (*models.DownloadLink, error) {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("retrieving download link", "link_id", id)
+
+  query := `SELECT ` + downloadLinkColumns + ` FROM download_links WHERE id = ?`
+
+  link, err := scanDownloadLink(s.db.QueryRowContext(ctx, s.dialect.Rebind(query), id))
+  if err != nil {
+    if err != sql.ErrNoRows {
+      log.Error("error retrieving download link", "link_id", id, "err", err)
+    }
+    return nil, wrapErr(ctx, err)
+  }
+  return link, nil
+}
+
+func (s *SQLStore) GetDownloadLinks(ctx context.Context, peerID uuid.UUID) ([]models.DownloadLink, error) {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("retrieving download links", "peer_id", peerID)
+
+  query := `SELECT ` + downloadLinkColumns + ` FROM download_links WHERE peer_id = ? ORDER BY created_at`
+
+  rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query), peerID)
+  if err != nil {
+    log.Error("error retrieving download links", "err", err)
+    return nil, wrapErr(ctx, err)
+  }
+  defer rows.Close()
+
+  var links []models.DownloadLink
+  for rows.Next() {
+    link, err := scanDownloadLink(rows)
+    if err != nil {
+      log.Error("error scanning download link", "err", err)
+      return nil, wrapErr(ctx, err)
+    }
+    links = append(links, *link)
+  }
+  return links, wrapErr(ctx, rows.Err())
+}
+
+func (s *SQLStore) revokeDownloadLinks(ctx context.Context, tx *sql.Tx, peerID uuid.UUID, now time.Time) error {
+  query := `UPDATE download_links SET revoked_at = ? WHERE peer_id = ? AND revoked_at IS NULL`
+  _, err := tx.ExecContext(ctx, s.dialect.Rebind(query), s.dialect.Timestamp(now), peerID)
+  return err
+}
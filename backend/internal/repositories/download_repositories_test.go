@@ -0,0 +1,104 @@
+package repositories
+
+import (
+  "context"
+  "database/sql"
+  "elysium-backend/internal/models"
+  "errors"
+  "testing"
+  "time"
+)
+
+func insertLink(t *testing.T, store *SQLStore, peer *models.Peer, id string, expiresAt time.Time, maxUses int) {
+  t.Helper()
+  link := &models.DownloadLink{
+    ID:           id,
+    PeerID:       *peer.ID,
+    ArtifactPath: "abc/elysium-client",
+    ExpiresAt:    expiresAt,
+    MaxUses:      maxUses,
+    CreatedAt:    time.Now().UTC(),
+  }
+  if err := store.InsertDownloadLink(context.Background(), link); err != nil {
+    t.Fatalf("InsertDownloadLink failed: %v", err)
+  }
+}
+
+func TestConsumeDownloadLink(t *testing.T) {
+  forEachDatabase(t, func(t *testing.T, store *SQLStore) {
+    ctx := context.Background()
+    now := time.Now().UTC()
+    peer := newPeer("10.0.0.2", "pending")
+    if err := store.InsertPeer(ctx, peer); err != nil {
+      t.Fatalf("InsertPeer failed: %v", err)
+    }
+    insertLink(t, store, peer, "twice", now.Add(time.Hour), 2)
+    insertLink(t, store, peer, "expired", now.Add(-time.Second), 1)
+
+    for use := 1; use <= 2; use++ {
+      link, err := store.ConsumeDownloadLink(ctx, "twice", now, now.Add(time.Minute))
+      if err != nil {
+        t.Fatalf("use %d: ConsumeDownloadLink failed: %v", use, err)
+      }
+      if link.Uses != use || link.PeerID != *peer.ID || link.ArtifactPath != "abc/elysium-client" {
+        t.Errorf("use %d: unexpected link %+v", use, link)
+      }
+      if link.ResumeUntil == nil || !link.ResumeUntil.Equal(now.Add(time.Minute).Truncate(time.Microsecond)) {
+        t.Errorf("use %d: expected the download to be resumable for a minute, got %v", use, link.ResumeUntil)
+      }
+    }
+
+    if err := store.FinishDownload(ctx, "twice"); err != nil {
+      t.Fatalf("FinishDownload failed: %v", err)
+    }
+    if link, _ := store.GetDownloadLink(ctx, "twice"); link.ResumeUntil != nil {
+      t.Errorf("expected a finished download not to be resumable, got %v", link.ResumeUntil)
+    }
+
+    for _, id := range []string{"twice", "expired", "missing"} {
+      if _, err := store.ConsumeDownloadLink(ctx, id, now, now.Add(time.Minute)); !errors.Is(err, sql.ErrNoRows) {
+        t.Errorf("%s: expected sql.ErrNoRows, got %v", id, err)
+      }
+    }
+  })
+}
+
+func TestDisablingAndDeletingPeerInvalidatesLinks(t *testing.T) {
+  forEachDatabase(t, func(t *testing.T, store *SQLStore) {
+    ctx := context.Background()
+    now := time.Now().UTC()
+    peer := newPeer("10.0.0.2", "pending")
+    if err := store.InsertPeer(ctx, peer); err != nil {
+      t.Fatalf("InsertPeer failed: %v", err)
+    }
+    insertLink(t, store, peer, "link", now.Add(time.Hour), 5)
+
+    if err := store.SetPeerStatus(ctx, *peer.ID, models.PeerStatusDisabled); err != nil {
+      t.Fatalf("SetPeerStatus failed: %v", err)
+    }
+    if _, err := store.ConsumeDownloadLink(ctx, "link", now, now.Add(time.Minute)); !errors.Is(err, sql.ErrNoRows) {
+      t.Errorf("expected the link of a disabled peer to be revoked, got %v", err)
+    }
+    links, err := store.GetDownloadLinks(ctx, *peer.ID)
+    if err != nil || len(links) != 1 || links[0].RevokedAt == nil {
+      t.Fatalf("expected one revoked link, got %+v (%v)", links, err)
+    }
+    got, _ := store.GetPeer(ctx, *peer.ID)
+    if got.Status != models.PeerStatusDisabled || !got.UpdatedOn.After(peer.CreatedOn) {
+      t.Errorf("unexpected peer after update %+v", got)
+    }
+
+    if err := store.DeletePeer(ctx, *peer.ID); err != nil {
+      t.Fatalf("DeletePeer failed: %v", err)
+    }
+    if links, _ := store.GetDownloadLinks(ctx, *peer.ID); len(links) != 0 {
+      t.Errorf("expected links to be deleted with the peer, got %+v", links)
+    }
+    if err := store.DeletePeer(ctx, *peer.ID); !errors.Is(err, sql.ErrNoRows) {
+      t.Errorf("expected sql.ErrNoRows deleting a missing peer, got %v", err)
+    }
+    if err := store.SetPeerStatus(ctx, *peer.ID, models.PeerStatusActive); !errors.Is(err, sql.ErrNoRows) {
+      t.Errorf("expected sql.ErrNoRows updating a missing peer, got %v", err)
+    }
+  })
+}
@@ -3,141 +3,437 @@ package repositories
 import (
   "context"
   "database/sql"
-  "elysium-backend/config"
   "elysium-backend/internal/models"
   "elysium-backend/pkg/db"
+  "elysium-backend/pkg/logger"
+  "encoding/json"
   "fmt"
-  "log"
   "net"
-  "strings"
   "time"
 
   "github.com/google/uuid"
 )
 
-func InsertPeer(peer *models.Peer) error {
-  if config.GetLogLevel() == "DEBUG" {
-    log.Println("repositories.InsertPeer -> called")
+// ipValue normalises addresses before they are written or compared, so an
+// IPv4 address is always stored in its 4 byte form regardless of how the
+// caller parsed it.
+func ipValue(ip net.IP) []byte {
+  if v4 := ip.To4(); v4 != nil {
+    return v4
   }
+  return ip
+}
 
-  query := `
-  INSERT INTO peers (public_key, assigned_ip, status, is_gateway, created_on)
-  VALUES ($1, $2, $3, $4, $5)
-  RETURNING id
-  `
-  ctx := context.Background()
+const peerColumns = `id, public_key, assigned_ip, status, is_gateway, metadata, created_on, updated_on, last_seen, preshared_key`
 
-  err := db.DBPool.QueryRowContext(ctx, query, peer.PublicKey, peer.AssignedIP, peer.Status, peer.IsGateway, peer.CreatedOn).Scan(&peer.ID)
+type rowScanner interface {
+  Scan(dest ...any) error
+}
+
+// scanPeer reads a row selected with peerColumns. Metadata is stored as
+// JSON. Timestamps go through
+// db.Timestamp so rows written in any of the formats the drivers have used
+// are read back, and NULLs become the zero time instead of an error.
+func scanPeer(row rowScanner) (*models.Peer, error) {
+  peer := &models.Peer{}
+  var metadata, presharedKey sql.NullString
+  var createdOn, updatedOn, lastSeen db.Timestamp
+
+  err := row.Scan(&peer.ID, &peer.PublicKey, &peer.AssignedIP, &peer.Status, &peer.IsGateway, &metadata, &createdOn, &updatedOn, &lastSeen, &presharedKey)
   if err != nil {
-    log.Println("repositories.InsertPeer -> Error inserting peer:", err)
-    return err
+    return nil, err
+  }
+
+  if metadata.Valid {
+    if err := json.Unmarshal([]byte(metadata.String), &peer.Metadata); err != nil {
+      return nil, err
+    }
   }
-  log.Println("repositories.InsertPeer -> peer:", peer.ID)
+
+  peer.CreatedOn = createdOn.Time
+  peer.UpdatedOn = updatedOn.Time
+  peer.LastSeen = lastSeen.Ptr()
+  peer.PresharedKey = presharedKey.String
+  return peer, nil
+}
+
+func (s *SQLStore) InsertPeer(ctx context.Context, peer *models.Peer) error {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("inserting peer", "public_key", peer.PublicKey)
+
+  if err := s.insertPeer(ctx, s.db, peer); err != nil {
+    log.Error("error inserting peer", "err", err)
+    return wrapErr(ctx, err)
+  }
+  log.Info("peer inserted", "peer_id", peer.ID)
   return nil
 }
 
-func IsIpAvailable(ip net.IP) (bool, error) {
-  if config.GetLogLevel() == "DEBUG" {
-    log.Println("repositories.IsIpAvailable -> called with ", ip.String())
+// queryRower is implemented by both *sql.DB and *sql.Tx.
+type queryRower interface {
+  QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// insertPeer inserts peer through q and sets its ID.
+func (s *SQLStore) insertPeer(ctx context.Context, q queryRower, peer *models.Peer) error {
+  query := `
+  INSERT INTO peers (public_key, assigned_ip, status, is_gateway, metadata, created_on, updated_on, preshared_key)
+  VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+  RETURNING id
+  `
+
+  if peer.UpdatedOn.IsZero() {
+    peer.UpdatedOn = peer.CreatedOn
+  }
+  var metadata []byte
+  if peer.Metadata != nil {
+    var err error
+    if metadata, err = json.Marshal(peer.Metadata); err != nil {
+      return err
+    }
   }
 
-  query := `SELECT 1 FROM peers WHERE assigned_ip = $1`
-  ctx := context.Background()
+  return q.QueryRowContext(ctx, s.dialect.Rebind(query), peer.PublicKey, ipValue(peer.AssignedIP), peer.Status, peer.IsGateway,
+    nullJSON(metadata), s.dialect.Timestamp(peer.CreatedOn), s.dialect.Timestamp(peer.UpdatedOn), nullString(peer.PresharedKey)).Scan(&peer.ID)
+}
+
+func (s *SQLStore) IsIpAvailable(ctx context.Context, ip net.IP) (bool, error) {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("checking IP availability", "ip", ip.String())
+
+  query := `SELECT 1 FROM peers WHERE assigned_ip = ?`
 
   var exists int
-  err := db.DBPool.QueryRowContext(ctx, query, ip).Scan(&exists)
+  err := s.db.QueryRowContext(ctx, s.dialect.Rebind(query), ipValue(ip)).Scan(&exists)
   if err == sql.ErrNoRows {
-    log.Println("IsIpAvailable -> Ip ", ip.String(), "is available")
+    log.Debug("IP is available", "ip", ip.String())
     return true, nil
   } else if err != nil {
-    log.Println("IsIpAvailable -> Error:", err)
-    return false, err
+    log.Error("error checking IP availability", "ip", ip.String(), "err", err)
+    return false, wrapErr(ctx, err)
   }
 
-  log.Println("IsIpAvailable -> Ip ", ip.String(), "is already taken")
+  log.Debug("IP is already taken", "ip", ip.String())
   return false, nil
 }
 
-func GetPeer(id uuid.UUID) (*models.Peer, error) {
-  if config.GetLogLevel() == "DEBUG" {
-    log.Println("repositories.GetPeer -> called")
+func (s *SQLStore) GetPeer(ctx context.Context, id uuid.UUID) (*models.Peer, error) {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("retrieving peer", "peer_id", id)
+
+  query := `SELECT ` + peerColumns + ` FROM peers WHERE id = ?`
+
+  peer, err := scanPeer(s.db.QueryRowContext(ctx, s.dialect.Rebind(query), id))
+  if err != nil {
+    log.Error("error retrieving peer", "peer_id", id, "err", err)
+    return nil, wrapErr(ctx, err)
   }
 
-  query := `
-  SELECT id, public_key, assigned_ip, status, is_gateway, metadata, created_on
-  FROM peers
-  WHERE id = $1
-  `
-  ctx := context.Background()
-  peer := &models.Peer{}
+  return peer, nil
+}
+
+func (s *SQLStore) GetAllPeer(ctx context.Context) ([]models.Peer, error) {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("retrieving all peers")
+
+  var results []models.Peer
 
-  var createdOnStr string
+  query := `SELECT ` + peerColumns + ` FROM peers`
 
-  row := db.DBPool.QueryRowContext(ctx, query, id)
-  err := row.Scan(&peer.ID, &peer.PublicKey, &peer.AssignedIP, &peer.Status, &peer.IsGateway, &peer.Metadata, &createdOnStr)
+  rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query))
   if err != nil {
-    log.Println("repositories.GetPeer -> Error retrieving peer:", err)
-    return nil, err
+    log.Error("error retrieving peers", "err", err)
+    return nil, wrapErr(ctx, err)
   }
+  defer rows.Close()
 
-  if createdOnStr == "" {
-    log.Println("repositories.GetPeer -> created_on is empty or null")
-    return nil, fmt.Errorf("created_on is empty or null")
+  for rows.Next() {
+    peer, err := scanPeer(rows)
+    if err != nil {
+      log.Error("error scanning peer", "err", err)
+      return nil, wrapErr(ctx, err)
+    }
+    results = append(results, *peer)
   }
 
-  peer.CreatedOn, err = time.Parse(time.RFC3339, strings.Replace(createdOnStr, " ", "T", 1))
+  return results, wrapErr(ctx, rows.Err())
+}
+
+func (s *SQLStore) GetAssignedIPs(ctx context.Context) ([]net.IP, error) {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("retrieving assigned IPs")
+
+  query := `SELECT assigned_ip FROM peers`
+
+  rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query))
   if err != nil {
-    log.Println("repositories.GetPeer -> Error parsing created_on:", err)
-    return nil, err
+    log.Error("error retrieving assigned IPs", "err", err)
+    return nil, wrapErr(ctx, err)
   }
+  defer rows.Close()
 
-  return peer, nil
-}
-
-func GetAllPeer() ([]models.Peer, error) {
-  if config.GetLogLevel() == "DEBUG" {
-    log.Println("repositories.GetAllPeer -> called")
+  var ips []net.IP
+  for rows.Next() {
+    var ip net.IP
+    if err := rows.Scan(&ip); err != nil {
+      log.Error("error scanning assigned IP", "err", err)
+      return nil, wrapErr(ctx, err)
+    }
+    ips = append(ips, ip)
   }
 
-  var results []models.Peer
+  return ips, wrapErr(ctx, rows.Err())
+}
 
-  query := `
-  SELECT id, public_key, assigned_ip, status, is_gateway, metadata, created_on
-  FROM peers
-  `
-  ctx := context.Background()
+func (s *SQLStore) CountPeersByStatus(ctx context.Context) (map[string]int, error) {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("counting peers by status")
+
+  query := `SELECT COALESCE(status, ''), COUNT(*) FROM peers GROUP BY status`
 
-  rows, err := db.DBPool.QueryContext(ctx, query)
+  rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query))
   if err != nil {
-    log.Println("repositories.GetAllPeer -> Error retrieving peers:", err)
-    return nil, err
+    log.Error("error counting peers", "err", err)
+    return nil, wrapErr(ctx, err)
   }
   defer rows.Close()
 
+  counts := make(map[string]int)
   for rows.Next() {
+    var status string
+    var count int
+    if err := rows.Scan(&status, &count); err != nil {
+      log.Error("error scanning peer count", "err", err)
+      return nil, wrapErr(ctx, err)
+    }
+    counts[status] = count
+  }
+
+  return counts, wrapErr(ctx, rows.Err())
+}
 
-    peer := &models.Peer{}
+// SetPeerStatus changes the status of a peer. Disabling a peer revokes its
+// download links in the same transaction. It returns sql.ErrNoRows when the
+// peer does not exist.
+func (s *SQLStore) SetPeerStatus(ctx context.Context, id uuid.UUID, status string) error {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("updating peer status", "peer_id", id, "status", status)
 
-    var createdOnStr string
-    err := rows.Scan(&peer.ID, &peer.PublicKey, &peer.AssignedIP, &peer.Status, &peer.IsGateway, &peer.Metadata, &createdOnStr)
+  now := time.Now().UTC()
+  err := s.inTx(ctx, func(tx *sql.Tx) error {
+    query := `UPDATE peers SET status = ?, updated_on = ? WHERE id = ?`
+    res, err := tx.ExecContext(ctx, s.dialect.Rebind(query), status, s.dialect.Timestamp(now), id)
     if err != nil {
-      log.Println("repositories.GetAllPeer -> Error retrieving peer:", err)
-      return nil, err
+      return err
+    }
+    if err := expectRows(res); err != nil {
+      return err
     }
 
-    if createdOnStr == "" {
-      log.Println("repositories.GetAllPeer -> created_on is empty or null")
-      return nil, fmt.Errorf("created_on is empty or null")
+    if status == models.PeerStatusDisabled {
+      return s.revokeDownloadLinks(ctx, tx, id, now)
     }
+    return nil
+  })
+  if err != nil {
+    log.Error("error updating peer status", "peer_id", id, "err", err)
+    return wrapErr(ctx, err)
+  }
+  return nil
+}
 
-    peer.CreatedOn, err = time.Parse(time.RFC3339, strings.Replace(createdOnStr, " ", "T", 1))
-    if err != nil {
-      log.Println("repositories.GetAllPeer -> Error parsing created_on:", err)
-      return nil, err
+// UpdatePeer stores the public key, address, status, gateway flag and
+// metadata of peer. Disabling a peer revokes its download links in the same
+// transaction, like SetPeerStatus. It returns sql.ErrNoRows when the peer
+// does not exist.
+func (s *SQLStore) UpdatePeer(ctx context.Context, peer *models.Peer) error {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("updating peer", "peer_id", peer.ID)
+
+  var metadata []byte
+  if peer.Metadata != nil {
+    var err error
+    if metadata, err = json.Marshal(peer.Metadata); err != nil {
+      return err
     }
+  }
 
-    results = append(results, *peer)
+  now := time.Now().UTC()
+  err := s.inTx(ctx, func(tx *sql.Tx) error {
+    return s.updatePeer(ctx, tx, peer, metadata, now)
+  })
+  if err != nil {
+    log.Error("error updating peer", "peer_id", peer.ID, "err", err)
+    return wrapErr(ctx, err)
   }
+  peer.UpdatedOn = now
+  log.Info("peer updated", "peer_id", peer.ID)
+  return nil
+}
 
-  return results, nil
+// updatePeer updates peer in tx with metadata, its encoded metadata.
+func (s *SQLStore) updatePeer(ctx context.Context, tx *sql.Tx, peer *models.Peer, metadata []byte, now time.Time) error {
+  query := `
+  UPDATE peers SET public_key = ?, assigned_ip = ?, status = ?, is_gateway = ?, metadata = ?, updated_on = ?
+  WHERE id = ?
+  `
+  res, err := tx.ExecContext(ctx, s.dialect.Rebind(query), peer.PublicKey, ipValue(peer.AssignedIP), peer.Status, peer.IsGateway,
+    nullJSON(metadata), s.dialect.Timestamp(now), peer.ID)
+  if err != nil {
+    return err
+  }
+  if err := expectRows(res); err != nil {
+    return err
+  }
+
+  if peer.Status == models.PeerStatusDisabled {
+    return s.revokeDownloadLinks(ctx, tx, *peer.ID, now)
+  }
+  return nil
+}
+
+// SetPeerPresharedKey replaces the sealed preshared key of a peer, removing
+// it when sealed is empty. It returns sql.ErrNoRows when the peer does not
+// exist.
+func (s *SQLStore) SetPeerPresharedKey(ctx context.Context, id uuid.UUID, sealed string) error {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("updating peer preshared key", "peer_id", id)
+
+  query := `UPDATE peers SET preshared_key = ?, updated_on = ? WHERE id = ?`
+
+  res, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), nullString(sealed), s.dialect.Timestamp(time.Now().UTC()), id)
+  if err == nil {
+    err = expectRows(res)
+  }
+  if err != nil {
+    log.Error("error updating peer preshared key", "peer_id", id, "err", err)
+    return wrapErr(ctx, err)
+  }
+  return nil
+}
+
+// SetPeersLastSeen records seen, the latest handshake by public key, as the
+// last_seen of the peers holding those keys. A peer is never moved back to
+// an earlier time, and its updated_on is left alone.
+func (s *SQLStore) SetPeersLastSeen(ctx context.Context, seen map[string]time.Time) error {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("recording peer handshakes", "peers", len(seen))
+
+  query := s.dialect.Rebind(`UPDATE peers SET last_seen = ? WHERE public_key = ? AND (last_seen IS NULL OR last_seen < ?)`)
+  err := s.inTx(ctx, func(tx *sql.Tx) error {
+    for key, at := range seen {
+      if key == "" {
+        continue
+      }
+      at := s.dialect.Timestamp(at.UTC())
+      if _, err := tx.ExecContext(ctx, query, at, key, at); err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+  if err != nil {
+    log.Error("error recording peer handshakes", "err", err)
+    return wrapErr(ctx, err)
+  }
+  return nil
+}
+
+// DeletePeer removes a peer together with its download links. It returns
+// sql.ErrNoRows when the peer does not exist.
+func (s *SQLStore) DeletePeer(ctx context.Context, id uuid.UUID) error {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("deleting peer", "peer_id", id)
+
+  err := s.inTx(ctx, func(tx *sql.Tx) error {
+    return s.deletePeer(ctx, tx, id)
+  })
+  if err != nil {
+    log.Error("error deleting peer", "peer_id", id, "err", err)
+    return wrapErr(ctx, err)
+  }
+  log.Info("peer deleted", "peer_id", id)
+  return nil
+}
+
+func (s *SQLStore) deletePeer(ctx context.Context, tx *sql.Tx, id uuid.UUID) error {
+  // SQLite only cascades when foreign keys are enabled on the connection,
+  // so the links are removed explicitly.
+  if _, err := tx.ExecContext(ctx, s.dialect.Rebind(`DELETE FROM download_links WHERE peer_id = ?`), id); err != nil {
+    return err
+  }
+  res, err := tx.ExecContext(ctx, s.dialect.Rebind(`DELETE FROM peers WHERE id = ?`), id)
+  if err != nil {
+    return err
+  }
+  return expectRows(res)
+}
+
+// ApplyPeerChanges deletes, updates and inserts peers, in that order, in one
+// transaction, so either all of the changes are stored or none is. Deletes
+// and updates behave like DeletePeer and UpdatePeer; the IDs of the inserted
+// peers are set on them.
+func (s *SQLStore) ApplyPeerChanges(ctx context.Context, deletes []uuid.UUID, updates, creates []*models.Peer) error {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("applying peer changes", "deletes", len(deletes), "updates", len(updates), "creates", len(creates))
+
+  now := time.Now().UTC()
+  err := s.inTx(ctx, func(tx *sql.Tx) error {
+    for _, id := range deletes {
+      if err := s.deletePeer(ctx, tx, id); err != nil {
+        return fmt.Errorf("deleting peer %s: %w", id, err)
+      }
+    }
+    for _, peer := range updates {
+      var metadata []byte
+      if peer.Metadata != nil {
+        var err error
+        if metadata, err = json.Marshal(peer.Metadata); err != nil {
+          return err
+        }
+      }
+      if err := s.updatePeer(ctx, tx, peer, metadata, now); err != nil {
+        return fmt.Errorf("updating peer %s: %w", peer.ID, err)
+      }
+    }
+    for _, peer := range creates {
+      if err := s.insertPeer(ctx, tx, peer); err != nil {
+        return fmt.Errorf("inserting peer %s: %w", peer.AssignedIP, err)
+      }
+    }
+    return nil
+  })
+  if err != nil {
+    log.Error("error applying peer changes", "err", err)
+    return wrapErr(ctx, err)
+  }
+  for _, peer := range updates {
+    peer.UpdatedOn = now
+  }
+  log.Info("peer changes applied", "deletes", len(deletes), "updates", len(updates), "creates", len(creates))
+  return nil
 }
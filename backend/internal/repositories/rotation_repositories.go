@@ -0,0 +1,200 @@
+package repositories
+
+import (
+  "context"
+  "database/sql"
+  "elysium-backend/internal/models"
+  "elysium-backend/pkg/db"
+  "elysium-backend/pkg/logger"
+  "errors"
+  "time"
+
+  "github.com/google/uuid"
+)
+
+const rotationColumns = `id, status, old_public_key, new_public_key, old_interface, old_port, new_interface, new_port, started_at, expires_at, finished_at`
+
+const rotationPeerColumns = `peer_id, public_key, assigned_ip, target, status, build_id, artifact_id, error, migrated_at`
+
+func scanRotationPeer(row rowScanner) (*models.KeyRotationPeer, error) {
+  peer := &models.KeyRotationPeer{}
+  var target, peerErr sql.NullString
+  var buildID, artifactID uuid.NullUUID
+  var migratedAt db.Timestamp
+
+  err := row.Scan(&peer.PeerID, &peer.PublicKey, &peer.AssignedIP, &target, &peer.Status, &buildID, &artifactID, &peerErr, &migratedAt)
+  if err != nil {
+    return nil, err
+  }
+
+  peer.Target = models.OSArch(target.String)
+  peer.Error = peerErr.String
+  peer.BuildID = nullUUIDPtr(buildID)
+  peer.ArtifactID = nullUUIDPtr(artifactID)
+  peer.MigratedAt = migratedAt.Ptr()
+  return peer, nil
+}
+
+func (s *SQLStore) timestampPtr(t *time.Time) any {
+  if t == nil {
+    return nil
+  }
+  return s.dialect.Timestamp(*t)
+}
+
+// InsertKeyRotation stores rotation together with its peers.
+func (s *SQLStore) InsertKeyRotation(ctx context.Context, rotation *models.KeyRotation) error {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("inserting key rotation", "rotation_id", rotation.ID, "peers", len(rotation.Peers))
+
+  err := s.inTx(ctx, func(tx *sql.Tx) error {
+    query := `
+    INSERT INTO key_rotations (` + rotationColumns + `)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `
+    if _, err := tx.ExecContext(ctx, s.dialect.Rebind(query), rotation.ID, rotation.Status, rotation.OldPublicKey, rotation.NewPublicKey,
+      rotation.OldInterface, rotation.OldPort, rotation.NewInterface, rotation.NewPort, s.dialect.Timestamp(rotation.StartedAt),
+      s.dialect.Timestamp(rotation.ExpiresAt), s.timestampPtr(rotation.FinishedAt)); err != nil {
+      return err
+    }
+
+    for i := range rotation.Peers {
+      if err := s.insertRotationPeer(ctx, tx, rotation.ID, &rotation.Peers[i]); err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+  if err != nil {
+    log.Error("error inserting key rotation", "rotation_id", rotation.ID, "err", err)
+    return wrapErr(ctx, err)
+  }
+  return nil
+}
+
+func (s *SQLStore) insertRotationPeer(ctx context.Context, tx *sql.Tx, rotationID uuid.UUID, peer *models.KeyRotationPeer) error {
+  query := `
+  INSERT INTO key_rotation_peers (rotation_id, ` + rotationPeerColumns + `)
+  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+  `
+  _, err := tx.ExecContext(ctx, s.dialect.Rebind(query), rotationID, peer.PeerID, peer.PublicKey, ipValue(peer.AssignedIP),
+    nullString(string(peer.Target)), peer.Status, nullUUID(peer.BuildID), nullUUID(peer.ArtifactID), nullString(peer.Error),
+    s.timestampPtr(peer.MigratedAt))
+  return err
+}
+
+// InsertKeyRotationPeer adds peer to the rotation rotationID.
+func (s *SQLStore) InsertKeyRotationPeer(ctx context.Context, rotationID uuid.UUID, peer *models.KeyRotationPeer) error {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("inserting key rotation peer", "rotation_id", rotationID, "peer_id", peer.PeerID, "status", peer.Status)
+
+  err := s.inTx(ctx, func(tx *sql.Tx) error {
+    return s.insertRotationPeer(ctx, tx, rotationID, peer)
+  })
+  if err != nil {
+    log.Error("error inserting key rotation peer", "rotation_id", rotationID, "peer_id", peer.PeerID, "err", err)
+    return wrapErr(ctx, err)
+  }
+  return nil
+}
+
+// UpdateKeyRotationPeer stores the progress of peer in rotation rotationID.
+// It returns sql.ErrNoRows when the peer is not part of the rotation.
+func (s *SQLStore) UpdateKeyRotationPeer(ctx context.Context, rotationID uuid.UUID, peer *models.KeyRotationPeer) error {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("updating key rotation peer", "rotation_id", rotationID, "peer_id", peer.PeerID, "status", peer.Status)
+
+  query := `
+  UPDATE key_rotation_peers SET target = ?, status = ?, build_id = ?, artifact_id = ?, error = ?, migrated_at = ?
+  WHERE rotation_id = ? AND peer_id = ?
+  `
+
+  res, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), nullString(string(peer.Target)), peer.Status, nullUUID(peer.BuildID),
+    nullUUID(peer.ArtifactID), nullString(peer.Error), s.timestampPtr(peer.MigratedAt), rotationID, peer.PeerID)
+  if err == nil {
+    err = expectRows(res)
+  }
+  if err != nil {
+    log.Error("error updating key rotation peer", "rotation_id", rotationID, "peer_id", peer.PeerID, "err", err)
+    return wrapErr(ctx, err)
+  }
+  return nil
+}
+
+// FinishKeyRotation stores the status and finish time of rotation. It
+// returns sql.ErrNoRows when the rotation does not exist.
+func (s *SQLStore) FinishKeyRotation(ctx context.Context, rotation *models.KeyRotation) error {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("finishing key rotation", "rotation_id", rotation.ID, "status", rotation.Status)
+
+  query := `UPDATE key_rotations SET status = ?, finished_at = ? WHERE id = ?`
+
+  res, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), rotation.Status, s.timestampPtr(rotation.FinishedAt), rotation.ID)
+  if err == nil {
+    err = expectRows(res)
+  }
+  if err != nil {
+    log.Error("error finishing key rotation", "rotation_id", rotation.ID, "err", err)
+    return wrapErr(ctx, err)
+  }
+  return nil
+}
+
+// GetKeyRotation returns a key rotation with its peers.
+func (s *SQLStore) GetKeyRotation(ctx context.Context, id uuid.UUID) (*models.KeyRotation, error) {
+  return s.getKeyRotation(ctx, `SELECT `+rotationColumns+` FROM key_rotations WHERE id = ?`, id)
+}
+
+// LatestKeyRotation returns the most recently started key rotation with its
+// peers, or sql.ErrNoRows when the key was never rotated.
+func (s *SQLStore) LatestKeyRotation(ctx context.Context) (*models.KeyRotation, error) {
+  return s.getKeyRotation(ctx, `SELECT `+rotationColumns+` FROM key_rotations ORDER BY started_at DESC LIMIT 1`)
+}
+
+func (s *SQLStore) getKeyRotation(ctx context.Context, query string, args ...any) (*models.KeyRotation, error) {
+  log := logger.FromContext(ctx)
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  log.Debug("retrieving key rotation")
+
+  rotation := &models.KeyRotation{}
+  var startedAt, expiresAt, finishedAt db.Timestamp
+  err := s.db.QueryRowContext(ctx, s.dialect.Rebind(query), args...).Scan(&rotation.ID, &rotation.Status, &rotation.OldPublicKey,
+    &rotation.NewPublicKey, &rotation.OldInterface, &rotation.OldPort, &rotation.NewInterface, &rotation.NewPort,
+    &startedAt, &expiresAt, &finishedAt)
+  if errors.Is(err, sql.ErrNoRows) {
+    return nil, err
+  } else if err != nil {
+    log.Error("error retrieving key rotation", "err", err)
+    return nil, wrapErr(ctx, err)
+  }
+  rotation.StartedAt = startedAt.Time
+  rotation.ExpiresAt = expiresAt.Time
+  rotation.FinishedAt = finishedAt.Ptr()
+
+  query = `SELECT ` + rotationPeerColumns + ` FROM key_rotation_peers WHERE rotation_id = ? ORDER BY assigned_ip`
+  rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query), rotation.ID)
+  if err != nil {
+    log.Error("error retrieving key rotation peers", "rotation_id", rotation.ID, "err", err)
+    return nil, wrapErr(ctx, err)
+  }
+  defer rows.Close()
+
+  for rows.Next() {
+    peer, err := scanRotationPeer(rows)
+    if err != nil {
+      log.Error("error scanning key rotation peer", "rotation_id", rotation.ID, "err", err)
+      return nil, wrapErr(ctx, err)
+    }
+    rotation.Peers = append(rotation.Peers, *peer)
+  }
+  return rotation, wrapErr(ctx, rows.Err())
+}
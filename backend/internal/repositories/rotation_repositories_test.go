@@ -0,0 +1,132 @@
+package repositories
+
+import (
+  "context"
+  "database/sql"
+  "elysium-backend/internal/models"
+  "errors"
+  "net"
+  "testing"
+  "time"
+
+  "github.com/google/uuid"
+)
+
+func newKeyRotation(startedAt time.Time, peers ...*models.Peer) *models.KeyRotation {
+  rotation := &models.KeyRotation{
+    ID:           uuid.New(),
+    Status:       models.KeyRotationStatusInProgress,
+    OldPublicKey: "old-key",
+    NewPublicKey: "new-key",
+    OldInterface: "wg0",
+    OldPort:      51820,
+    NewInterface: "wg0-alt",
+    NewPort:      51821,
+    StartedAt:    startedAt,
+    ExpiresAt:    startedAt.Add(time.Hour),
+  }
+  for _, peer := range peers {
+    rotation.Peers = append(rotation.Peers, models.KeyRotationPeer{
+      PeerID:     *peer.ID,
+      PublicKey:  peer.PublicKey,
+      AssignedIP: peer.AssignedIP,
+      Target:     models.OSArch("x86_64-unknown-linux-musl"),
+      Status:     models.RotationPeerStatusPending,
+    })
+  }
+  return rotation
+}
+
+func TestKeyRotations(t *testing.T) {
+  forEachDatabase(t, func(t *testing.T, store *SQLStore) {
+    ctx := context.Background()
+
+    if _, err := store.LatestKeyRotation(ctx); !errors.Is(err, sql.ErrNoRows) {
+      t.Fatalf("expected sql.ErrNoRows before any rotation, got %v", err)
+    }
+
+    first, second, third := newPeer("10.0.0.2", "active"), newPeer("10.0.0.3", "active"), newPeer("10.0.0.4", "active")
+    for _, peer := range []*models.Peer{first, second, third} {
+      if err := store.InsertPeer(ctx, peer); err != nil {
+        t.Fatalf("InsertPeer failed: %v", err)
+      }
+    }
+
+    now := time.Now().UTC().Truncate(time.Microsecond)
+    earlier := newKeyRotation(now.Add(-time.Hour))
+    earlier.Status = models.KeyRotationStatusCancelled
+    if err := store.InsertKeyRotation(ctx, earlier); err != nil {
+      t.Fatalf("InsertKeyRotation failed: %v", err)
+    }
+    rotation := newKeyRotation(now, second, first)
+    if err := store.InsertKeyRotation(ctx, rotation); err != nil {
+      t.Fatalf("InsertKeyRotation failed: %v", err)
+    }
+
+    buildID, artifactID := uuid.New(), uuid.New()
+    reissued := rotation.Peers[1]
+    reissued.Status = models.RotationPeerStatusReissued
+    reissued.BuildID = &buildID
+    reissued.ArtifactID = &artifactID
+    if err := store.UpdateKeyRotationPeer(ctx, rotation.ID, &reissued); err != nil {
+      t.Fatalf("UpdateKeyRotationPeer failed: %v", err)
+    }
+    migratedAt := now.Add(time.Minute)
+    migrated := rotation.Peers[0]
+    migrated.Status = models.RotationPeerStatusMigrated
+    migrated.MigratedAt = &migratedAt
+    store.UpdateKeyRotationPeer(ctx, rotation.ID, &migrated)
+
+    // A peer created during the rotation joins it.
+    joined := newKeyRotation(now, third).Peers[0]
+    joined.Status = models.RotationPeerStatusReissued
+    if err := store.InsertKeyRotationPeer(ctx, rotation.ID, &joined); err != nil {
+      t.Fatalf("InsertKeyRotationPeer failed: %v", err)
+    }
+
+    latest, err := store.LatestKeyRotation(ctx)
+    if err != nil {
+      t.Fatalf("LatestKeyRotation failed: %v", err)
+    }
+    if latest.ID != rotation.ID || latest.NewInterface != "wg0-alt" || latest.NewPort != 51821 || !latest.ExpiresAt.Equal(now.Add(time.Hour)) || latest.FinishedAt != nil {
+      t.Fatalf("unexpected latest rotation %+v", latest)
+    }
+    // Peers are ordered by address.
+    if len(latest.Peers) != 3 || !latest.Peers[0].AssignedIP.Equal(net.ParseIP("10.0.0.2")) {
+      t.Fatalf("unexpected rotation peers %+v", latest.Peers)
+    }
+    if peer := latest.Peers[0]; peer.Status != models.RotationPeerStatusReissued || peer.ArtifactID == nil || *peer.ArtifactID != artifactID {
+      t.Errorf("unexpected re-issued peer %+v", peer)
+    }
+    if peer := latest.Peers[1]; peer.Status != models.RotationPeerStatusMigrated || peer.MigratedAt == nil || !peer.MigratedAt.Equal(migratedAt) || peer.BuildID != nil {
+      t.Errorf("unexpected migrated peer %+v", peer)
+    }
+    if peer := latest.Peers[2]; peer.PeerID != *third.ID || peer.Status != models.RotationPeerStatusReissued {
+      t.Errorf("unexpected joined peer %+v", peer)
+    }
+
+    finishedAt := now.Add(2 * time.Minute)
+    rotation.Status = models.KeyRotationStatusCompleted
+    rotation.FinishedAt = &finishedAt
+    if err := store.FinishKeyRotation(ctx, rotation); err != nil {
+      t.Fatalf("FinishKeyRotation failed: %v", err)
+    }
+    got, err := store.GetKeyRotation(ctx, rotation.ID)
+    if err != nil {
+      t.Fatalf("GetKeyRotation failed: %v", err)
+    }
+    if got.Status != models.KeyRotationStatusCompleted || got.FinishedAt == nil || !got.FinishedAt.Equal(finishedAt) {
+      t.Errorf("expected the rotation to be finished, got %+v", got)
+    }
+
+    if _, err := store.GetKeyRotation(ctx, uuid.New()); !errors.Is(err, sql.ErrNoRows) {
+      t.Errorf("expected sql.ErrNoRows for an unknown rotation, got %v", err)
+    }
+    if err := store.UpdateKeyRotationPeer(ctx, earlier.ID, &reissued); !errors.Is(err, sql.ErrNoRows) {
+      t.Errorf("expected sql.ErrNoRows for a peer outside the rotation, got %v", err)
+    }
+    if err := store.FinishKeyRotation(ctx, &models.KeyRotation{ID: uuid.New()}); !errors.Is(err, sql.ErrNoRows) {
+      t.Errorf("expected sql.ErrNoRows for an unknown rotation, got %v", err)
+    }
+  })
+}
@@ -0,0 +1,79 @@
+package repositories
+
+import (
+  "context"
+  "database/sql"
+  "elysium-backend/pkg/db"
+  "fmt"
+  "time"
+)
+
+const defaultQueryTimeout = 5 * time.Second
+
+// SQLStore persists peers in the database behind db. It is safe for
+// concurrent use.
+type SQLStore struct {
+  db           *sql.DB
+  dialect      db.Dialect
+  queryTimeout time.Duration
+}
+
+// NewSQLStore returns a store using pool, bounding every query by
+// queryTimeout on top of the caller's deadline. A zero timeout uses the
+// default of five seconds.
+func NewSQLStore(pool *db.Pool, queryTimeout time.Duration) *SQLStore {
+  if queryTimeout <= 0 {
+    queryTimeout = defaultQueryTimeout
+  }
+  return &SQLStore{db: pool.DB, dialect: pool.Dialect, queryTimeout: queryTimeout}
+}
+
+func (s *SQLStore) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+  return context.WithTimeout(ctx, s.queryTimeout)
+}
+
+func (s *SQLStore) Ping(ctx context.Context) error {
+  ctx, cancel := s.withTimeout(ctx)
+  defer cancel()
+  return wrapErr(ctx, s.db.PingContext(ctx))
+}
+
+// inTx runs fn in a transaction that is committed when fn returns nil and
+// rolled back otherwise.
+func (s *SQLStore) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+  tx, err := s.db.BeginTx(ctx, nil)
+  if err != nil {
+    return err
+  }
+  if err := fn(tx); err != nil {
+    tx.Rollback()
+    return err
+  }
+  return tx.Commit()
+}
+
+// expectRows turns a statement that matched nothing into sql.ErrNoRows.
+func expectRows(res sql.Result) error {
+  n, err := res.RowsAffected()
+  if err != nil {
+    return err
+  }
+  if n == 0 {
+    return sql.ErrNoRows
+  }
+  return nil
+}
+
+// wrapErr makes cancellation visible to callers. Drivers report an aborted
+// query in their own words, so when the context is done its error is wrapped
+// alongside the driver error and errors.Is(err, context.DeadlineExceeded)
+// holds regardless of the database in use.
+func wrapErr(ctx context.Context, err error) error {
+  if err == nil {
+    return nil
+  }
+  if ctxErr := ctx.Err(); ctxErr != nil {
+    return fmt.Errorf("%w: %w", ctxErr, err)
+  }
+  return err
+}
@@ -0,0 +1,13 @@
+package routes
+
+import (
+  "elysium-backend/internal/handlers"
+  "net/http"
+
+  "github.com/gorilla/mux"
+)
+
+func ArtifactRoutes(router *mux.Router, app *handlers.App) {
+  router.HandleFunc("/artifacts", app.RequireAdmin(app.GetArtifactsHandler)).Methods(http.MethodGet)
+  router.HandleFunc("/artifacts/{id}", app.RequireAdmin(app.DeleteArtifactHandler)).Methods(http.MethodDelete)
+}
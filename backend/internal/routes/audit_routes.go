@@ -0,0 +1,12 @@
+package routes
+
+import (
+  "elysium-backend/internal/handlers"
+  "net/http"
+
+  "github.com/gorilla/mux"
+)
+
+func AuditRoutes(router *mux.Router, app *handlers.App) {
+  router.HandleFunc("/audit", app.RequireAdmin(app.GetAuditHandler)).Methods(http.MethodGet)
+}
@@ -0,0 +1,12 @@
+package routes
+
+import (
+  "elysium-backend/internal/handlers"
+  "net/http"
+
+  "github.com/gorilla/mux"
+)
+
+func BackupRoutes(router *mux.Router, app *handlers.App) {
+  router.HandleFunc("/backup", app.RequireAdmin(app.GetBackupHandler)).Methods(http.MethodGet)
+}
@@ -0,0 +1,14 @@
+package routes
+
+import (
+  "elysium-backend/internal/handlers"
+  "net/http"
+
+  "github.com/gorilla/mux"
+)
+
+func BuildRoutes(router *mux.Router, app *handlers.App) {
+  router.HandleFunc("/builds", app.RequireAdmin(app.GetBuildsHandler)).Methods(http.MethodGet)
+  router.HandleFunc("/builds/{id}", app.RequireAdmin(app.GetBuildHandler)).Methods(http.MethodGet)
+  router.HandleFunc("/builds/{id}/logs", app.RequireBuildToken(app.GetBuildLogsHandler)).Methods(http.MethodGet)
+}
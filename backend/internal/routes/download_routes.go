@@ -1,32 +1,23 @@
 package routes
 
 import (
-  "elysium-backend/config"
   "elysium-backend/internal/handlers"
-  "log"
   "net/http"
 
   "github.com/gorilla/mux"
 )
 
-func DownloadRoutes(router *mux.Router) {
-  if config.GetLogLevel() == "DEBUG" {
-    log.Println("routes.DownloadRoutes -> called")
-  }
-
-  router.HandleFunc("/downloads/{uniqueID}/{filename}", func(w http.ResponseWriter, r *http.Request) {
-    log.Println("------------------------------------------------------------------------------")
-    log.Println("routes.DownloadRoutes -> handling request for /downloads/{uniqueID}/{filename}")
-
+func DownloadRoutes(router *mux.Router, app *handlers.App) {
+  router.HandleFunc("/downloads/{linkID}/{filename}", func(w http.ResponseWriter, r *http.Request) {
     if r.Method != http.MethodGet {
       http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
       return
     }
 
     vars := mux.Vars(r)
-    uniqueID := vars["uniqueID"]
+    linkID := vars["linkID"]
     filename := vars["filename"]
 
-    handlers.DownloadHandler(w, r, uniqueID, filename)
+    app.DownloadHandler(w, r, linkID, filename)
   })
 }
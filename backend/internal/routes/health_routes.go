@@ -0,0 +1,14 @@
+package routes
+
+import (
+  "elysium-backend/internal/handlers"
+  "net/http"
+
+  "github.com/gorilla/mux"
+)
+
+func HealthRoutes(router *mux.Router, app *handlers.App) {
+  router.HandleFunc("/healthz", app.HealthzHandler).Methods(http.MethodGet)
+  router.HandleFunc("/readyz", app.ReadyzHandler).Methods(http.MethodGet)
+  router.HandleFunc("/debug/diagnostics", app.RequireAdmin(app.DiagnosticsHandler)).Methods(http.MethodGet)
+}
@@ -0,0 +1,21 @@
+package routes
+
+import (
+  "elysium-backend/internal/handlers"
+  "net/http"
+
+  "github.com/gorilla/mux"
+)
+
+func LogRoutes(router *mux.Router, app *handlers.App) {
+  router.HandleFunc("/loglevel", func(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+      app.GetLogLevelHandler(w, r)
+    case http.MethodPut:
+      app.RequireAdmin(app.PutLogLevelHandler)(w, r)
+    default:
+      http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+  })
+}
@@ -0,0 +1,12 @@
+package routes
+
+import (
+  "elysium-backend/internal/handlers"
+  "net/http"
+
+  "github.com/gorilla/mux"
+)
+
+func MetricsRoutes(router *mux.Router, app *handlers.App) {
+  router.Handle("/metrics", app.Metrics.Handler()).Methods(http.MethodGet)
+}
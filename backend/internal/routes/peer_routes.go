@@ -1,44 +1,43 @@
 package routes
 
 import (
-  "elysium-backend/config"
   "elysium-backend/internal/handlers"
-  "log"
   "net/http"
 
   "github.com/gorilla/mux"
 )
 
-func PeerRoutes(mux *mux.Router) {
-  if config.GetLogLevel() == "DEBUG" {
-    log.Println("routes.PeerRoutes -> called")
-  }
-
+func PeerRoutes(mux *mux.Router, app *handlers.App) {
   mux.HandleFunc("/peer", func(w http.ResponseWriter, r *http.Request) {
-    log.Println("------------------------------------------------------------------------------")
-    log.Println("routes.PeerRoutes -> handling request for /peer")
     if r.Method == http.MethodPost {
-      handlers.PostPeerHandler(w, r)
+      app.PostPeerHandler(w, r)
     } else {
       http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
     }
   })
 
   mux.HandleFunc("/peer/{id}", func(w http.ResponseWriter, r *http.Request) {
-    log.Println("------------------------------------------------------------------------------")
-    log.Println("routes.PeerRoutes -> handling request for /peer/{id}")
-    if r.Method == http.MethodGet {
-      handlers.GetPeerHandler(w, r)
-    } else {
+    switch r.Method {
+    case http.MethodGet:
+      app.GetPeerHandler(w, r)
+    case http.MethodPatch:
+      app.RequireAdmin(app.PatchPeerHandler)(w, r)
+    case http.MethodDelete:
+      app.RequireAdmin(app.DeletePeerHandler)(w, r)
+    default:
       http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
     }
   })
 
+  mux.HandleFunc("/peer/{id}/preshared-key", app.RequireAdmin(app.PostPeerPresharedKeyHandler)).Methods(http.MethodPost)
+
+  mux.HandleFunc("/peers/bulk", app.RequireAdmin(app.PostBulkPeersHandler)).Methods(http.MethodPost)
+  mux.HandleFunc("/peers/bulk/{id}", app.RequireAdmin(app.GetBulkJobHandler)).Methods(http.MethodGet)
+  mux.HandleFunc("/peers/bulk/{id}/bundle", app.RequireAdmin(app.GetBulkBundleHandler)).Methods(http.MethodGet)
+
   mux.HandleFunc("/peers", func(w http.ResponseWriter, r *http.Request) {
-    log.Println("------------------------------------------------------------------------------")
-    log.Println("routes.PeerRoutes -> handling request for /peers")
     if r.Method == http.MethodGet {
-      handlers.GetAllPeersHandler(w, r)
+      app.GetAllPeersHandler(w, r)
     } else {
       http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
     }
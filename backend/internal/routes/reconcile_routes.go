@@ -0,0 +1,12 @@
+package routes
+
+import (
+  "elysium-backend/internal/handlers"
+  "net/http"
+
+  "github.com/gorilla/mux"
+)
+
+func ReconcileRoutes(router *mux.Router, app *handlers.App) {
+  router.HandleFunc("/reconcile", app.RequireAdmin(app.PostReconcileHandler)).Methods(http.MethodPost)
+}
@@ -1,19 +1,46 @@
 package routes
 
 import (
+  "elysium-backend/internal/audit"
   "elysium-backend/internal/handlers"
+  "elysium-backend/pkg/logger"
 
   "github.com/gorilla/mux"
 )
 
-func SetupRoutes() *mux.Router {
+func SetupRoutes(app *handlers.App) *mux.Router {
   router := mux.NewRouter()
+  router.Use(logger.Middleware)
+  router.Use(app.Metrics.Middleware)
+  router.Use(audit.Middleware(app.Store))
 
-  router.HandleFunc("/", handlers.BaseHandler)
+  router.HandleFunc("/", app.BaseHandler)
 
-  PeerRoutes(router)
+  PeerRoutes(router, app)
 
-  DownloadRoutes(router)
+  DownloadRoutes(router, app)
+
+  MetricsRoutes(router, app)
+
+  LogRoutes(router, app)
+
+  HealthRoutes(router, app)
+
+  AuditRoutes(router, app)
+
+  ArtifactRoutes(router, app)
+
+  SigningRoutes(router, app)
+
+  TargetRoutes(router, app)
+
+  BuildRoutes(router, app)
+
+  ReconcileRoutes(router, app)
+
+  BackupRoutes(router, app)
+
+  RotationRoutes(router, app)
 
   return router
 }
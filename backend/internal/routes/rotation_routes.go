@@ -0,0 +1,16 @@
+package routes
+
+import (
+  "elysium-backend/internal/handlers"
+  "net/http"
+
+  "github.com/gorilla/mux"
+)
+
+func RotationRoutes(router *mux.Router, app *handlers.App) {
+  router.HandleFunc("/wireguard/rotations", app.RequireAdmin(app.PostRotationHandler)).Methods(http.MethodPost)
+  router.HandleFunc("/wireguard/rotations/latest", app.RequireAdmin(app.GetLatestRotationHandler)).Methods(http.MethodGet)
+  router.HandleFunc("/wireguard/rotations/{id}", app.RequireAdmin(app.GetRotationHandler)).Methods(http.MethodGet)
+  router.HandleFunc("/wireguard/rotations/{id}", app.RequireAdmin(app.DeleteRotationHandler)).Methods(http.MethodDelete)
+  router.HandleFunc("/wireguard/rotations/{id}/bundle", app.RequireAdmin(app.GetRotationBundleHandler)).Methods(http.MethodGet)
+}
@@ -0,0 +1,1428 @@
+package routes
+
+import (
+  "archive/zip"
+  "bytes"
+  "context"
+  "crypto/ed25519"
+  "crypto/sha256"
+  "elysium-backend/config"
+  "elysium-backend/internal/fakes"
+  "elysium-backend/internal/handlers"
+  "elysium-backend/internal/models"
+  "elysium-backend/internal/services"
+  "elysium-backend/pkg/backup"
+  "elysium-backend/pkg/keystore"
+  "elysium-backend/pkg/wgutil"
+  "encoding/base64"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "net"
+  "net/http"
+  "net/http/httptest"
+  "net/http/httptrace"
+  "net/textproto"
+  "net/url"
+  "os"
+  "path/filepath"
+  "slices"
+  "strings"
+  "testing"
+  "time"
+
+  "github.com/google/uuid"
+)
+
+type testApp struct {
+  app     *handlers.App
+  store   *fakes.Store
+  alloc   *fakes.Allocator
+  builder *fakes.Builder
+  wg      *fakes.WireGuard
+  server  *httptest.Server
+}
+
+// newTestApp wires an App to the fakes. configure, when given, adjusts the
+// configuration first.
+func newTestApp(t *testing.T, configure ...func(cfg *config.Config)) *testApp {
+  t.Helper()
+
+  outputDir := t.TempDir()
+  cfg := &config.Config{
+    Build: config.BuildConfig{
+      OutputDir: outputDir,
+      Targets: []config.TargetConfig{
+        {Triple: "x86_64-unknown-linux-musl", Enabled: true},
+        {Triple: "aarch64-unknown-linux-musl", Enabled: true},
+        {Triple: "x86_64-pc-windows-gnu", Suffix: ".exe"},
+      },
+    },
+    Artifacts:  config.ArtifactConfig{TTL: time.Hour},
+    Download:   config.DownloadConfig{SigningKey: []byte("signing-key"), LinkTTL: time.Hour, MaxUses: 1, ResumeWindow: time.Minute},
+    IPRanges:   []config.Ip_Range{{Start: net.ParseIP("10.0.0.1").To4(), End: net.ParseIP("10.0.0.254").To4()}},
+    AdminToken: "secret",
+  }
+  for _, fn := range configure {
+    fn(cfg)
+  }
+
+  ta := &testApp{
+    store:   fakes.NewStore(),
+    alloc:   fakes.NewAllocator(net.ParseIP("10.0.0.2")),
+    builder: fakes.NewBuilder(outputDir),
+    wg:      fakes.NewWireGuard("server-key"),
+  }
+  _, signingKey, _ := ed25519.GenerateKey(nil)
+  keys, err := keystore.New(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)), "")
+  if err != nil {
+    t.Fatalf("keystore.New failed: %v", err)
+  }
+  ta.app = handlers.NewApp(cfg, ta.store, ta.alloc, ta.wg, ta.builder, services.NewTargetRegistry(cfg.Build.Targets), signingKey, keys)
+  ta.server = httptest.NewServer(SetupRoutes(ta.app))
+  t.Cleanup(ta.server.Close)
+  return ta
+}
+
+func (ta *testApp) do(t *testing.T, method, path, body string, headers ...string) *http.Response {
+  t.Helper()
+
+  req, err := http.NewRequest(method, ta.server.URL+path, strings.NewReader(body))
+  if err != nil {
+    t.Fatalf("failed to build request: %v", err)
+  }
+  for i := 0; i+1 < len(headers); i += 2 {
+    req.Header.Set(headers[i], headers[i+1])
+  }
+
+  res, err := ta.server.Client().Do(req)
+  if err != nil {
+    t.Fatalf("%s %s failed: %v", method, path, err)
+  }
+  t.Cleanup(func() { res.Body.Close() })
+  return res
+}
+
+func decode(t *testing.T, res *http.Response, v any) {
+  t.Helper()
+  if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+    t.Fatalf("failed to decode response: %v", err)
+  }
+}
+
+func TestCreatePeerAndDownload(t *testing.T) {
+  ta := newTestApp(t)
+
+  res := ta.do(t, http.MethodPost, "/peer", `{"public_key": "client-key", "OS_Arch": "x86_64-unknown-linux-musl"}`)
+  if res.StatusCode != http.StatusOK {
+    t.Fatalf("expected 200, got %d", res.StatusCode)
+  }
+  var created map[string]string
+  decode(t, res, &created)
+
+  if len(ta.builder.Requests) != 1 || !ta.builder.Requests[0].Bundle.AssignedIP.Equal(net.ParseIP("10.0.0.2")) {
+    t.Fatalf("unexpected build requests: %+v", ta.builder.Requests)
+  }
+
+  download := ta.do(t, http.MethodGet, created["download_link"], "")
+  if download.StatusCode != http.StatusOK {
+    t.Fatalf("expected download to succeed, got %d", download.StatusCode)
+  }
+  content, _ := io.ReadAll(download.Body)
+  if expected := ta.builder.Content(ta.builder.Requests[0]); string(content) != string(expected) {
+    t.Errorf("expected artifact %q, got %q", expected, content)
+  }
+  if digest := sha256.Sum256(content); created["sha256"] != hex.EncodeToString(digest[:]) {
+    t.Errorf("expected the reported digest to match the artifact, got %s", created["sha256"])
+  }
+
+  var peers []models.Peer
+  decode(t, ta.do(t, http.MethodGet, "/peers", ""), &peers)
+  if len(peers) != 1 || peers[0].PublicKey != "client-key" || peers[0].Status != "pending" {
+    t.Fatalf("unexpected peers: %+v", peers)
+  }
+
+  var peer models.Peer
+  decode(t, ta.do(t, http.MethodGet, "/peer/"+peers[0].ID.String(), ""), &peer)
+  if !peer.AssignedIP.Equal(net.ParseIP("10.0.0.2")) {
+    t.Errorf("expected assigned IP 10.0.0.2, got %s", peer.AssignedIP)
+  }
+  if peer.LastSeen != nil {
+    t.Errorf("expected a peer that never connected to have no last_seen, got %s", peer.LastSeen)
+  }
+
+  // The handshakes of the interface are recorded as last_seen.
+  seen := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+  ta.wg.Handshake("client-key", seen)
+  if err := services.NewPeerActivity(ta.store, ta.wg).Record(context.Background()); err != nil {
+    t.Fatalf("Record failed: %v", err)
+  }
+  decode(t, ta.do(t, http.MethodGet, "/peer/"+peers[0].ID.String(), ""), &peer)
+  if peer.LastSeen == nil || !peer.LastSeen.Equal(seen) {
+    t.Errorf("expected last_seen %s, got %v", seen, peer.LastSeen)
+  }
+}
+
+func TestCreatePeerErrors(t *testing.T) {
+  tests := []struct {
+    name     string
+    body     string
+    setup    func(ta *testApp)
+    expected int
+  }{
+    {name: "malformed body", body: `{`, expected: http.StatusBadRequest},
+    {name: "allocation fails", body: `{"OS_Arch": "x86_64-unknown-linux-musl"}`, setup: func(ta *testApp) { ta.alloc.Err = errors.New("pool exhausted") }, expected: http.StatusInternalServerError},
+    {name: "invalid target", body: `{"OS_Arch": "sparc"}`, expected: http.StatusBadRequest},
+    {name: "disabled target", body: `{"OS_Arch": "x86_64-pc-windows-gnu"}`, expected: http.StatusBadRequest},
+    {name: "build times out", body: `{"OS_Arch": "x86_64-unknown-linux-musl"}`, setup: func(ta *testApp) { ta.builder.Err = context.DeadlineExceeded }, expected: http.StatusGatewayTimeout},
+    {name: "shutting down", body: `{"OS_Arch": "x86_64-unknown-linux-musl"}`, setup: func(ta *testApp) { ta.builder.Shutdown(context.Background()) }, expected: http.StatusServiceUnavailable},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      ta := newTestApp(t)
+      if tt.setup != nil {
+        tt.setup(ta)
+      }
+
+      res := ta.do(t, http.MethodPost, "/peer", tt.body)
+      if res.StatusCode != tt.expected {
+        t.Errorf("expected %d, got %d", tt.expected, res.StatusCode)
+      }
+      if peers, _ := ta.store.GetAllPeer(context.Background()); len(peers) != 0 {
+        t.Errorf("expected no peer to be stored, got %d", len(peers))
+      }
+    })
+  }
+}
+
+func TestCreatePeerWaitsForBulkAllocation(t *testing.T) {
+  ta := newTestApp(t)
+
+  // A bulk job allocating its addresses holds the allocator.
+  ta.alloc.Lock()
+  status := make(chan int)
+  go func() {
+    res, err := ta.server.Client().Post(ta.server.URL+"/peer", "application/json", strings.NewReader(`{"public_key": "client-key", "OS_Arch": "x86_64-unknown-linux-musl"}`))
+    if err != nil {
+      status <- 0
+      return
+    }
+    res.Body.Close()
+    status <- res.StatusCode
+  }()
+  time.Sleep(50 * time.Millisecond)
+  if ta.peerCount(t) != 0 {
+    t.Error("expected the peer to wait for the allocator")
+  }
+  ta.alloc.Unlock()
+  if code := <-status; code != http.StatusOK {
+    t.Fatalf("expected 200, got %d", code)
+  }
+  if ta.peerCount(t) != 1 {
+    t.Error("expected the peer to be created once the allocator is free")
+  }
+}
+
+func TestGetPeerErrors(t *testing.T) {
+  ta := newTestApp(t)
+
+  if res := ta.do(t, http.MethodGet, "/peer/not-a-uuid", ""); res.StatusCode != http.StatusBadRequest {
+    t.Errorf("expected 400 for a malformed ID, got %d", res.StatusCode)
+  }
+
+  ta.store.Err = errors.New("database unavailable")
+  if res := ta.do(t, http.MethodGet, "/peers", ""); res.StatusCode != http.StatusInternalServerError {
+    t.Errorf("expected 500 when the store fails, got %d", res.StatusCode)
+  }
+}
+
+func TestAdminRoutesRequireToken(t *testing.T) {
+  ta := newTestApp(t)
+
+  if res := ta.do(t, http.MethodPut, "/loglevel", `{"level": "DEBUG"}`); res.StatusCode != http.StatusUnauthorized {
+    t.Errorf("expected 401 without a token, got %d", res.StatusCode)
+  }
+
+  res := ta.do(t, http.MethodGet, "/debug/diagnostics", "", "Authorization", "Bearer secret")
+  if res.StatusCode != http.StatusOK {
+    t.Fatalf("expected 200 with the admin token, got %d", res.StatusCode)
+  }
+  var diag struct {
+    Pool struct {
+      Size int64 `json:"size"`
+    } `json:"pool"`
+  }
+  decode(t, res, &diag)
+  if diag.Pool.Size != 254 {
+    t.Errorf("expected pool size 254, got %d", diag.Pool.Size)
+  }
+}
+
+func TestAuditLog(t *testing.T) {
+  ta := newTestApp(t)
+
+  ta.do(t, http.MethodPost, "/peer", `{"public_key": "client-key", "OS_Arch": "x86_64-unknown-linux-musl"}`)
+  // Anonymous requests that are rejected are not recorded, those of an
+  // administrator are.
+  ta.do(t, http.MethodPut, "/loglevel", `{"level": "DEBUG"}`)
+  ta.do(t, http.MethodDelete, "/no-such-route", "")
+  ta.do(t, http.MethodPut, "/loglevel", `{"level": "VERBOSE"}`, "Authorization", "Bearer secret")
+
+  if res := ta.do(t, http.MethodGet, "/audit", ""); res.StatusCode != http.StatusUnauthorized {
+    t.Fatalf("expected 401 without a token, got %d", res.StatusCode)
+  }
+
+  var events []models.AuditEvent
+  decode(t, ta.do(t, http.MethodGet, "/audit", "", "Authorization", "Bearer secret"), &events)
+  if len(events) != 2 {
+    t.Fatalf("expected 2 events, got %+v", events)
+  }
+  rejected, created := events[0], events[1]
+  if created.Action != "peer.create" || created.Actor != "anonymous" || created.SourceIP != "127.0.0.1" || len(created.After) == 0 {
+    t.Errorf("unexpected peer event %+v", created)
+  }
+  if rejected.Action != "http.PUT" || rejected.Target != "/loglevel" || rejected.Actor != "admin-token" || !strings.Contains(string(rejected.After), `"status":400`) {
+    t.Errorf("unexpected rejected request event %+v", rejected)
+  }
+
+  var filtered []models.AuditEvent
+  decode(t, ta.do(t, http.MethodGet, "/audit?action=peer.create", "", "Authorization", "Bearer secret"), &filtered)
+  if len(filtered) != 1 || filtered[0].ID != created.ID {
+    t.Errorf("unexpected filtered events %+v", filtered)
+  }
+
+  if res := ta.do(t, http.MethodGet, "/audit?since=yesterday", "", "Authorization", "Bearer secret"); res.StatusCode != http.StatusBadRequest {
+    t.Errorf("expected 400 for an invalid since, got %d", res.StatusCode)
+  }
+
+  res := ta.do(t, http.MethodGet, "/audit?format=jsonl", "", "Authorization", "Bearer secret")
+  if res.Header.Get("Content-Type") != "application/x-ndjson" {
+    t.Errorf("unexpected content type %q", res.Header.Get("Content-Type"))
+  }
+  body, _ := io.ReadAll(res.Body)
+  lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+  // The admin GET requests are not mutating and are not recorded.
+  if len(lines) != 2 {
+    t.Fatalf("expected 2 lines, got %q", body)
+  }
+  var first models.AuditEvent
+  if err := json.Unmarshal([]byte(lines[0]), &first); err != nil || first.ID != created.ID {
+    t.Errorf("expected the export to start with the oldest event, got %s", lines[0])
+  }
+}
+
+func TestDownloadLinks(t *testing.T) {
+  ta := newTestApp(t)
+
+  createPeer := func() (link, peerID string) {
+    var created map[string]string
+    decode(t, ta.do(t, http.MethodPost, "/peer", `{"public_key": "client-key", "OS_Arch": "x86_64-unknown-linux-musl"}`), &created)
+    peers, _ := ta.store.GetAllPeer(context.Background())
+    return created["download_link"], peers[len(peers)-1].ID.String()
+  }
+
+  link, _ := createPeer()
+  if !strings.Contains(link, "signature=") || !strings.Contains(link, "expires=") {
+    t.Fatalf("expected a signed link, got %s", link)
+  }
+  if res := ta.do(t, http.MethodGet, strings.Replace(link, "signature=", "signature=x", 1), ""); res.StatusCode != http.StatusForbidden {
+    t.Errorf("expected 403 for a tampered signature, got %d", res.StatusCode)
+  }
+  // A download interrupted after two bytes.
+  res := ta.do(t, http.MethodGet, link, "", "Range", "bytes=0-1")
+  if res.StatusCode != http.StatusPartialContent || res.Header.Get("ETag") == "" {
+    t.Fatalf("expected the first download to succeed with a resume tag, got %d", res.StatusCode)
+  }
+  tag := res.Header.Get("ETag")
+  content := ta.builder.Content(ta.builder.Requests[0])
+
+  // The download is resumed with the tag it was served with, which does
+  // not count another use; a Range request without it does.
+  if res := ta.do(t, http.MethodGet, link, "", "Range", "bytes=2-", "If-Range", `"guessed"`); res.StatusCode != http.StatusGone {
+    t.Errorf("expected 410 for a Range request without the resume tag, got %d", res.StatusCode)
+  }
+  resumed := ta.do(t, http.MethodGet, link, "", "Range", "bytes=2-", "If-Range", tag)
+  rest, _ := io.ReadAll(resumed.Body)
+  if resumed.StatusCode != http.StatusPartialContent || string(rest) != string(content[2:]) {
+    t.Errorf("expected the download to resume, got %d %q", resumed.StatusCode, rest)
+  }
+
+  // Once it finished, the tag no longer fetches the artifact again.
+  if res := ta.do(t, http.MethodGet, link, "", "Range", "bytes=2-", "If-Range", tag); res.StatusCode != http.StatusGone {
+    t.Errorf("expected 410 resuming a finished download, got %d", res.StatusCode)
+  }
+  if res := ta.do(t, http.MethodGet, link, ""); res.StatusCode != http.StatusGone {
+    t.Errorf("expected 410 once the link is used up, got %d", res.StatusCode)
+  }
+
+  // A range from the first byte is a new download, resume tag or not.
+  link, _ = createPeer()
+  if res := ta.do(t, http.MethodGet, link, "", "Range", "bytes=0-1"); res.StatusCode != http.StatusPartialContent {
+    t.Fatalf("expected the first download to succeed, got %d", res.StatusCode)
+  }
+  if res := ta.do(t, http.MethodGet, link, "", "Range", "bytes=0-", "If-Range", res.Header.Get("ETag")); res.StatusCode != http.StatusGone {
+    t.Errorf("expected 410 for a used up link fetched again from the first byte, got %d", res.StatusCode)
+  }
+
+  // A link to an artifact that is gone is not used up by trying it.
+  link, peerID := createPeer()
+  os.Remove(filepath.Join(ta.app.Config.Build.OutputDir, fmt.Sprint(len(ta.builder.Requests)), "elysium-client"))
+  if res := ta.do(t, http.MethodGet, link, ""); res.StatusCode != http.StatusNotFound {
+    t.Errorf("expected 404 for a missing artifact, got %d", res.StatusCode)
+  }
+  links, _ := ta.store.GetDownloadLinks(context.Background(), uuid.MustParse(peerID))
+  if len(links) != 1 || links[0].Uses != 0 {
+    t.Errorf("expected the missing artifact not to use up the link, got %+v", links)
+  }
+
+  link, peerID = createPeer()
+  res = ta.do(t, http.MethodPatch, "/peer/"+peerID, `{"status": "disabled"}`, "Authorization", "Bearer secret")
+  if res.StatusCode != http.StatusOK {
+    t.Fatalf("expected 200 disabling the peer, got %d", res.StatusCode)
+  }
+  if res := ta.do(t, http.MethodGet, link, ""); res.StatusCode != http.StatusGone {
+    t.Errorf("expected 410 for a link of a disabled peer, got %d", res.StatusCode)
+  }
+
+  link, peerID = createPeer()
+  if res := ta.do(t, http.MethodDelete, "/peer/"+peerID, ""); res.StatusCode != http.StatusUnauthorized {
+    t.Errorf("expected 401 deleting without a token, got %d", res.StatusCode)
+  }
+  if res := ta.do(t, http.MethodDelete, "/peer/"+peerID, "", "Authorization", "Bearer secret"); res.StatusCode != http.StatusNoContent {
+    t.Fatalf("expected 204 deleting the peer, got %d", res.StatusCode)
+  }
+  if res := ta.do(t, http.MethodGet, link, ""); res.StatusCode != http.StatusGone {
+    t.Errorf("expected 410 for a link of a deleted peer, got %d", res.StatusCode)
+  }
+  if res := ta.do(t, http.MethodDelete, "/peer/"+peerID, "", "Authorization", "Bearer secret"); res.StatusCode != http.StatusNotFound {
+    t.Errorf("expected 404 deleting a missing peer, got %d", res.StatusCode)
+  }
+
+  var events []models.AuditEvent
+  decode(t, ta.do(t, http.MethodGet, "/audit?action=peer.update", "", "Authorization", "Bearer secret"), &events)
+  if len(events) != 1 || !strings.Contains(string(events[0].After), `"status":"disabled"`) {
+    t.Errorf("expected the status change to be audited, got %+v", events)
+  }
+}
+
+func TestArtifacts(t *testing.T) {
+  ta := newTestApp(t)
+  ta.do(t, http.MethodPost, "/peer", `{"public_key": "client-key", "OS_Arch": "x86_64-unknown-linux-musl"}`)
+
+  var artifacts []models.Artifact
+  decode(t, ta.do(t, http.MethodGet, "/artifacts", "", "Authorization", "Bearer secret"), &artifacts)
+  if len(artifacts) != 1 {
+    t.Fatalf("expected one artifact, got %+v", artifacts)
+  }
+  artifact := artifacts[0]
+  path := filepath.Join(ta.app.Config.Build.OutputDir, artifact.Path)
+  content, err := os.ReadFile(path)
+  if err != nil {
+    t.Fatalf("artifact file missing: %v", err)
+  }
+  sum := sha256.Sum256(content)
+  if artifact.Size != int64(len(content)) || artifact.SHA256 != hex.EncodeToString(sum[:]) || artifact.Target != models.OSArch("x86_64-unknown-linux-musl") {
+    t.Errorf("unexpected artifact %+v", artifact)
+  }
+
+  if res := ta.do(t, http.MethodDelete, "/artifacts/"+artifact.ID.String(), "", "Authorization", "Bearer secret"); res.StatusCode != http.StatusNoContent {
+    t.Fatalf("expected 204, got %d", res.StatusCode)
+  }
+  if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+    t.Errorf("expected the artifact file to be removed, got %v", err)
+  }
+  if res := ta.do(t, http.MethodDelete, "/artifacts/"+artifact.ID.String(), "", "Authorization", "Bearer secret"); res.StatusCode != http.StatusNotFound {
+    t.Errorf("expected 404 deleting twice, got %d", res.StatusCode)
+  }
+}
+
+func TestArtifactCollection(t *testing.T) {
+  ta := newTestApp(t)
+  outputDir := ta.app.Config.Build.OutputDir
+
+  ta.do(t, http.MethodPost, "/peer", `{"public_key": "kept", "OS_Arch": "x86_64-unknown-linux-musl"}`)
+  ta.do(t, http.MethodPost, "/peer", `{"public_key": "deleted", "OS_Arch": "x86_64-unknown-linux-musl"}`)
+  peers, _ := ta.store.GetAllPeer(context.Background())
+  ta.do(t, http.MethodDelete, "/peer/"+peers[1].ID.String(), "", "Authorization", "Bearer secret")
+
+  // A stale file no artifact refers to, and a fresh one that may still be
+  // about to be recorded.
+  stale := filepath.Join(outputDir, "stale", "elysium-client")
+  fresh := filepath.Join(outputDir, "fresh", "elysium-client")
+  for _, path := range []string{stale, fresh} {
+    os.MkdirAll(filepath.Dir(path), 0o755)
+    os.WriteFile(path, []byte("old build"), 0o644)
+  }
+  old := time.Now().Add(-2 * time.Hour)
+  os.Chtimes(stale, old, old)
+
+  removed, err := ta.app.Artifacts.Collect(context.Background())
+  if err != nil {
+    t.Fatalf("Collect failed: %v", err)
+  }
+  if removed != 2 {
+    t.Errorf("expected the deleted peer's artifact and the stale file to be removed, got %d", removed)
+  }
+  if _, err := os.Stat(filepath.Dir(stale)); !errors.Is(err, os.ErrNotExist) {
+    t.Errorf("expected the stale build directory to be removed")
+  }
+  if _, err := os.Stat(fresh); err != nil {
+    t.Errorf("expected the fresh file to be kept: %v", err)
+  }
+  remaining, _ := ta.store.ListArtifacts(context.Background(), nil)
+  if len(remaining) != 1 || *remaining[0].PeerID != *peers[0].ID {
+    t.Errorf("expected only the kept peer's artifact to remain, got %+v", remaining)
+  }
+}
+
+func TestArtifactSignatures(t *testing.T) {
+  ta := newTestApp(t)
+
+  var key struct {
+    Algorithm string `json:"algorithm"`
+    PublicKey []byte `json:"public_key"`
+  }
+  decode(t, ta.do(t, http.MethodGet, "/signing-key", ""), &key)
+  if key.Algorithm != "ed25519" || len(key.PublicKey) != ed25519.PublicKeySize {
+    t.Fatalf("unexpected signing key %+v", key)
+  }
+
+  var created map[string]string
+  decode(t, ta.do(t, http.MethodPost, "/peer", `{"public_key": "client-key", "OS_Arch": "x86_64-unknown-linux-musl"}`), &created)
+
+  res := ta.do(t, http.MethodGet, created["download_link"], "")
+  content, _ := io.ReadAll(res.Body)
+  sum := sha256.Sum256(content)
+  if digest := hex.EncodeToString(sum[:]); res.Header.Get("X-Checksum-Sha256") != digest || created["sha256"] != digest {
+    t.Errorf("expected digest %s, got header %q and response %q", digest, res.Header.Get("X-Checksum-Sha256"), created["sha256"])
+  }
+  if res.Header.Get("Repr-Digest") == "" {
+    t.Error("expected a Repr-Digest header")
+  }
+  headerSig, _ := base64.StdEncoding.DecodeString(res.Header.Get("X-Signature-Ed25519"))
+  if !ed25519.Verify(key.PublicKey, content, headerSig) {
+    t.Error("expected the signature header to verify against the public key")
+  }
+
+  // The signature stays available after the single download was used.
+  link, _ := url.Parse(created["download_link"])
+  link.Path += ".sig"
+  sigRes := ta.do(t, http.MethodGet, link.String(), "")
+  if sigRes.StatusCode != http.StatusOK {
+    t.Fatalf("expected 200 for the signature, got %d", sigRes.StatusCode)
+  }
+  fileSig, _ := io.ReadAll(sigRes.Body)
+  if !ed25519.Verify(key.PublicKey, content, fileSig) {
+    t.Error("expected the .sig file to verify against the public key")
+  }
+}
+
+func TestTargets(t *testing.T) {
+  ta := newTestApp(t)
+
+  var targets []models.Target
+  decode(t, ta.do(t, http.MethodGet, "/targets", ""), &targets)
+  if len(targets) != 2 || targets[0].Triple != "x86_64-unknown-linux-musl" || targets[1].Triple != "aarch64-unknown-linux-musl" {
+    t.Fatalf("expected the enabled targets in configuration order, got %+v", targets)
+  }
+  if !targets[0].Available || len(targets[0].Missing) != 0 {
+    t.Errorf("expected unchecked targets to be available, got %+v", targets[0])
+  }
+}
+
+func TestBuilds(t *testing.T) {
+  ta := newTestApp(t)
+
+  var created map[string]string
+  decode(t, ta.do(t, http.MethodPost, "/peer", `{"public_key": "client-key", "OS_Arch": "x86_64-unknown-linux-musl"}`), &created)
+  if created["build_id"] == "" || created["build_id"] != ta.builder.Requests[0].ID.String() {
+    t.Fatalf("expected the build ID passed to the builder, got %v", created)
+  }
+
+  if res := ta.do(t, http.MethodGet, "/builds/"+created["build_id"], ""); res.StatusCode != http.StatusUnauthorized {
+    t.Errorf("expected builds to require admin access, got %d", res.StatusCode)
+  }
+  var build models.Build
+  decode(t, ta.do(t, http.MethodGet, "/builds/"+created["build_id"], "", "Authorization", "Bearer secret"), &build)
+  if build.Status != models.BuildStatusSucceeded || build.SHA256 != created["sha256"] || build.FinishedAt == nil {
+    t.Errorf("unexpected build %+v", build)
+  }
+  if build.Provenance == nil || build.Provenance.Backend != "fake" || build.Provenance.Target != "x86_64-unknown-linux-musl" {
+    t.Errorf("expected the builder's provenance, got %+v", build.Provenance)
+  }
+
+  var artifacts []models.Artifact
+  decode(t, ta.do(t, http.MethodGet, "/artifacts", "", "Authorization", "Bearer secret"), &artifacts)
+  if len(artifacts) != 1 || artifacts[0].BuildID == nil || *artifacts[0].BuildID != build.ID {
+    t.Errorf("expected the artifact to reference its build, got %+v", artifacts)
+  }
+
+  ta.builder.Err = errors.New("exit status 101")
+  res := ta.do(t, http.MethodPost, "/peer", `{"public_key": "other-key", "OS_Arch": "x86_64-unknown-linux-musl"}`)
+  if res.StatusCode != http.StatusInternalServerError || res.Header.Get("X-Build-ID") == "" {
+    t.Fatalf("expected a failed build with its ID, got %d %v", res.StatusCode, res.Header)
+  }
+  var failed models.Build
+  decode(t, ta.do(t, http.MethodGet, "/builds/"+res.Header.Get("X-Build-ID"), "", "Authorization", "Bearer secret"), &failed)
+  if failed.Status != models.BuildStatusFailed || failed.Error != "exit status 101" || failed.Provenance != nil {
+    t.Errorf("expected the failure to be recorded, got %+v", failed)
+  }
+
+  if res := ta.do(t, http.MethodGet, "/builds/"+uuid.NewString(), "", "Authorization", "Bearer secret"); res.StatusCode != http.StatusNotFound {
+    t.Errorf("expected 404 for an unknown build, got %d", res.StatusCode)
+  }
+}
+
+func TestBuildLogs(t *testing.T) {
+  ta := newTestApp(t)
+
+  ta.builder.Err = errors.New("exit status 101")
+  var hints http.Header
+  trace := &httptrace.ClientTrace{
+    Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+      if code == http.StatusEarlyHints {
+        hints = http.Header(header)
+      }
+      return nil
+    },
+  }
+  req, _ := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodPost, ta.server.URL+"/peer", strings.NewReader(`{"public_key": "client-key", "OS_Arch": "x86_64-unknown-linux-musl"}`))
+  res, err := ta.server.Client().Do(req)
+  if err != nil {
+    t.Fatalf("POST /peer failed: %v", err)
+  }
+  res.Body.Close()
+  buildID := res.Header.Get("X-Build-ID")
+  if res.StatusCode != http.StatusInternalServerError || buildID == "" {
+    t.Fatalf("expected a failed build with its ID, got %d %v", res.StatusCode, res.Header)
+  }
+  token := hints.Get("X-Build-Token")
+  if hints.Get("X-Build-ID") != buildID || token == "" {
+    t.Fatalf("expected the build to be announced before compiling, got %v", hints)
+  }
+
+  if res := ta.do(t, http.MethodGet, "/builds/"+buildID+"/logs", ""); res.StatusCode != http.StatusUnauthorized {
+    t.Errorf("expected build logs to require admin access, got %d", res.StatusCode)
+  }
+  if res := ta.do(t, http.MethodGet, "/builds/"+uuid.NewString()+"/logs?token="+token, ""); res.StatusCode != http.StatusUnauthorized {
+    t.Errorf("expected the token to be bound to its build, got %d", res.StatusCode)
+  }
+  res = ta.do(t, http.MethodGet, "/builds/"+buildID+"/logs?token="+token, "")
+  if body, _ := io.ReadAll(res.Body); res.StatusCode != http.StatusOK || !strings.HasSuffix(string(body), "event: end\ndata: failed\n\n") {
+    t.Errorf("expected the requester to follow its build with the token, got %d %q", res.StatusCode, body)
+  }
+  if res := ta.do(t, http.MethodGet, "/builds/"+buildID, "", "X-Build-Token", token); res.StatusCode != http.StatusUnauthorized {
+    t.Errorf("expected the token to grant access to the logs only, got %d", res.StatusCode)
+  }
+
+  res = ta.do(t, http.MethodGet, "/builds/"+buildID+"/logs", "", "Authorization", "Bearer secret")
+  body, _ := io.ReadAll(res.Body)
+  res.Body.Close()
+  if res.Header.Get("Content-Type") != "text/event-stream" {
+    t.Errorf("expected an event stream, got %q", res.Header.Get("Content-Type"))
+  }
+  want := "id: 1\ndata: fake build for x86_64-unknown-linux-musl\n\nevent: end\ndata: failed\n\n"
+  if string(body) != want {
+    t.Errorf("expected the stored output of the failed build, got %q", body)
+  }
+
+  res = ta.do(t, http.MethodGet, "/builds/"+buildID+"/logs", "", "Authorization", "Bearer secret", "Last-Event-ID", "1")
+  body, _ = io.ReadAll(res.Body)
+  res.Body.Close()
+  if string(body) != "event: end\ndata: failed\n\n" {
+    t.Errorf("expected no output after the last event, got %q", body)
+  }
+
+  var builds []models.Build
+  decode(t, ta.do(t, http.MethodGet, "/builds?status=failed", "", "Authorization", "Bearer secret"), &builds)
+  if len(builds) != 1 || builds[0].ID.String() != buildID {
+    t.Errorf("expected the failed build, got %+v", builds)
+  }
+  if res := ta.do(t, http.MethodGet, "/builds?status=bogus", "", "Authorization", "Bearer secret"); res.StatusCode != http.StatusBadRequest {
+    t.Errorf("expected 400 for an unknown status, got %d", res.StatusCode)
+  }
+  if res := ta.do(t, http.MethodGet, "/builds/"+uuid.NewString()+"/logs", "", "Authorization", "Bearer secret"); res.StatusCode != http.StatusNotFound {
+    t.Errorf("expected 404 for an unknown build, got %d", res.StatusCode)
+  }
+}
+
+func (ta *testApp) peerCount(t *testing.T) int {
+  t.Helper()
+  peers, err := ta.store.GetAllPeer(context.Background())
+  if err != nil {
+    t.Fatalf("GetAllPeer failed: %v", err)
+  }
+  return len(peers)
+}
+
+// waitForBulkJob polls a bulk job until it completed.
+func (ta *testApp) waitForBulkJob(t *testing.T, id uuid.UUID) models.BulkJob {
+  t.Helper()
+  deadline := time.Now().Add(5 * time.Second)
+  for {
+    var job models.BulkJob
+    decode(t, ta.do(t, http.MethodGet, "/peers/bulk/"+id.String(), "", "Authorization", "Bearer secret"), &job)
+    if job.Status == models.BulkJobStatusCompleted {
+      return job
+    }
+    if time.Now().After(deadline) {
+      t.Fatalf("bulk job did not complete: %+v", job)
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+}
+
+func TestBulkPeers(t *testing.T) {
+  ta := newTestApp(t)
+
+  csv := "name,owner,target,tags,ip\n" +
+    "alice-laptop,alice,x86_64-unknown-linux-musl,dev;laptop,\n" +
+    "bob-pi,bob,aarch64-unknown-linux-musl,,10.0.0.2\n" +
+    "build-box,ops,x86_64-unknown-linux-musl,ci,\n"
+
+  if res := ta.do(t, http.MethodPost, "/peers/bulk", csv, "Content-Type", "text/csv"); res.StatusCode != http.StatusUnauthorized {
+    t.Errorf("expected bulk provisioning to require admin access, got %d", res.StatusCode)
+  }
+
+  res := ta.do(t, http.MethodPost, "/peers/bulk", csv, "Content-Type", "text/csv", "Authorization", "Bearer secret")
+  if res.StatusCode != http.StatusAccepted {
+    t.Fatalf("expected 202, got %d", res.StatusCode)
+  }
+  var created models.BulkJob
+  decode(t, res, &created)
+  if res.Header.Get("Location") != "/peers/bulk/"+created.ID.String() || len(created.Items) != 3 {
+    t.Fatalf("unexpected bulk job %+v", created)
+  }
+  // The static address is kept out of the allocation for the others.
+  if !created.Items[1].AssignedIP.Equal(net.ParseIP("10.0.0.2")) || !created.Items[0].AssignedIP.Equal(net.ParseIP("10.0.0.3")) || !created.Items[2].AssignedIP.Equal(net.ParseIP("10.0.0.4")) {
+    t.Errorf("unexpected addresses %v, %v and %v", created.Items[0].AssignedIP, created.Items[1].AssignedIP, created.Items[2].AssignedIP)
+  }
+
+  job := ta.waitForBulkJob(t, created.ID)
+  for _, item := range job.Items {
+    if item.Status != models.BulkItemStatusSucceeded || item.BuildID == nil || item.ArtifactID == nil {
+      t.Errorf("expected every peer to be provisioned, got %+v", item)
+    }
+  }
+
+  var peers []models.Peer
+  decode(t, ta.do(t, http.MethodGet, "/peers", ""), &peers)
+  if len(peers) != 3 || peers[0].Metadata == nil || (*peers[0].Metadata)["owner"] != "alice" {
+    t.Fatalf("expected the peers with their metadata, got %+v", peers)
+  }
+
+  res = ta.do(t, http.MethodGet, "/peers/bulk/"+job.ID.String()+"/bundle", "", "Authorization", "Bearer secret")
+  if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "application/zip" {
+    t.Fatalf("expected the bundle, got %d %q", res.StatusCode, res.Header.Get("Content-Type"))
+  }
+  data, _ := io.ReadAll(res.Body)
+  archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+  if err != nil {
+    t.Fatalf("expected a ZIP archive: %v", err)
+  }
+  files := make(map[string]*zip.File)
+  for _, file := range archive.File {
+    files[file.Name] = file
+  }
+  for _, name := range []string{"manifest.json", "alice-laptop/elysium-client", "alice-laptop/elysium-client.sig", "alice-laptop/peer.json", "bob-pi/peer.json", "build-box/elysium-client"} {
+    if files[name] == nil {
+      t.Errorf("expected %s in the bundle, got %d files", name, len(archive.File))
+    }
+  }
+  if file := files["bob-pi/peer.json"]; file != nil {
+    reader, _ := file.Open()
+    var config map[string]any
+    json.NewDecoder(reader).Decode(&config)
+    reader.Close()
+    if config["assigned_ip"] != "10.0.0.2" || config["sha256"] == "" || config["signature"] == "" {
+      t.Errorf("unexpected peer configuration %v", config)
+    }
+  }
+}
+
+func TestBulkPeersValidation(t *testing.T) {
+  ta := newTestApp(t)
+  ta.store.InsertPeer(context.Background(), &models.Peer{PublicKey: testKey(2), AssignedIP: net.ParseIP("10.0.0.9"), Status: models.PeerStatusActive})
+
+  body := `[
+    {"name": "ok", "target": "x86_64-unknown-linux-musl"},
+    {"name": "ok", "target": "x86_64-unknown-linux-musl"},
+    {"name": "../evil", "target": "x86_64-unknown-linux-musl"},
+    {"name": "unknown", "target": "sparc-sun-solaris"},
+    {"name": "outside", "target": "x86_64-unknown-linux-musl", "ip": "192.168.1.1"},
+    {"name": "bogus-ip", "target": "x86_64-unknown-linux-musl", "ip": "not-an-ip"},
+    {"name": "bogus-key", "target": "x86_64-unknown-linux-musl", "public_key": "not-a-key"},
+    {"name": "key", "target": "x86_64-unknown-linux-musl", "public_key": "` + testKey(1) + `"},
+    {"name": "same-key", "target": "x86_64-unknown-linux-musl", "public_key": "` + testKey(1) + `"},
+    {"name": "taken-key", "target": "x86_64-unknown-linux-musl", "public_key": "` + testKey(2) + `"}
+  ]`
+  res := ta.do(t, http.MethodPost, "/peers/bulk", body, "Content-Type", "application/json", "Authorization", "Bearer secret")
+  if res.StatusCode != http.StatusBadRequest {
+    t.Fatalf("expected 400, got %d", res.StatusCode)
+  }
+  var invalid struct {
+    Errors []models.BulkError `json:"errors"`
+  }
+  decode(t, res, &invalid)
+  rows := make(map[int]bool)
+  for _, e := range invalid.Errors {
+    rows[e.Row] = true
+  }
+  if len(invalid.Errors) != 8 || rows[1] || !rows[2] || !rows[6] || !rows[7] || rows[8] || !rows[9] || !rows[10] {
+    t.Errorf("expected an error for every invalid row, got %+v", invalid.Errors)
+  }
+  if ta.peerCount(t) != 1 || len(ta.builder.Requests) != 0 {
+    t.Error("expected nothing to be created for an invalid batch")
+  }
+
+  for _, tc := range []struct{ body, contentType string }{
+    {"[]", "application/json"},
+    {"name,colour\nx,red\n", "text/csv"},
+    {"name", "application/xml"},
+  } {
+    if res := ta.do(t, http.MethodPost, "/peers/bulk", tc.body, "Content-Type", tc.contentType, "Authorization", "Bearer secret"); res.StatusCode < 400 || res.StatusCode >= 500 {
+      t.Errorf("expected %q as %s to be rejected, got %d", tc.body, tc.contentType, res.StatusCode)
+    }
+  }
+}
+
+func TestBulkPeersFailedBuilds(t *testing.T) {
+  ta := newTestApp(t)
+  ta.builder.Err = errors.New("exit status 101")
+
+  res := ta.do(t, http.MethodPost, "/peers/bulk", `[{"name": "a", "target": "x86_64-unknown-linux-musl"}]`, "Authorization", "Bearer secret")
+  var created models.BulkJob
+  decode(t, res, &created)
+  job := ta.waitForBulkJob(t, created.ID)
+  if item := job.Items[0]; item.Status != models.BulkItemStatusFailed || item.Error != "exit status 101" || item.BuildID == nil {
+    t.Errorf("expected the failure to be recorded, got %+v", item)
+  }
+  if ta.peerCount(t) != 0 {
+    t.Error("expected the peer of the failed build to be removed")
+  }
+}
+
+func TestBulkPeersResume(t *testing.T) {
+  ta := newTestApp(t)
+  ctx := context.Background()
+
+  // A job left running by an earlier process, its first peer already built.
+  job, invalid, err := ta.app.Bulk.Create(ctx, []models.BulkPeer{
+    {Name: "a", Target: "x86_64-unknown-linux-musl"},
+    {Name: "b", Target: "x86_64-unknown-linux-musl"},
+  })
+  if err != nil || len(invalid) > 0 {
+    t.Fatalf("Create failed: %v %v", err, invalid)
+  }
+  done := job.Items[0]
+  done.Status = models.BulkItemStatusSucceeded
+  ta.store.UpdateBulkJobItem(ctx, job.ID, &done)
+
+  if err := ta.app.Bulk.Resume(ctx); err != nil {
+    t.Fatalf("Resume failed: %v", err)
+  }
+  resumed := ta.waitForBulkJob(t, job.ID)
+  if len(ta.builder.Requests) != 1 || resumed.Items[1].Status != models.BulkItemStatusSucceeded {
+    t.Errorf("expected only the unfinished peer to be built, got %d builds and %+v", len(ta.builder.Requests), resumed.Items)
+  }
+
+  if err := ta.app.Bulk.Shutdown(ctx); err != nil {
+    t.Fatalf("Shutdown failed: %v", err)
+  }
+  if err := ta.app.Bulk.Start(ctx, job); !errors.Is(err, services.ErrShuttingDown) {
+    t.Errorf("expected no job to start after shutdown, got %v", err)
+  }
+}
+
+// testKey returns a valid WireGuard key made of b.
+func testKey(b byte) string {
+  return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func (ta *testApp) reconcile(t *testing.T, state string, apply bool) (*http.Response, models.ReconcilePlan) {
+  t.Helper()
+
+  path := "/reconcile"
+  if apply {
+    path += "?apply=true"
+  }
+  res := ta.do(t, http.MethodPost, path, state, "Content-Type", "application/yaml", "Authorization", "Bearer secret")
+  var plan models.ReconcilePlan
+  if res.StatusCode == http.StatusOK || res.StatusCode == http.StatusConflict {
+    decode(t, res, &plan)
+  }
+  return res, plan
+}
+
+func TestReconcile(t *testing.T) {
+  ta := newTestApp(t)
+
+  // An existing peer is adopted by its public key; it is already on the
+  // interface since it was created.
+  ta.do(t, http.MethodPost, "/peer", `{"public_key": "`+testKey(1)+`", "OS_Arch": "x86_64-unknown-linux-musl"}`)
+
+  state := `
+pools:
+  - start: 10.0.0.10
+    end: 10.0.0.20
+peers:
+  - name: legacy
+    public_key: ` + testKey(1) + `
+  - name: alice
+    public_key: ` + testKey(2) + `
+    ip: 10.0.0.10
+    owner: alice@example.com
+    tags: [laptop]
+  - name: bob
+    public_key: ` + testKey(3) + `
+    status: pending
+gateways:
+  - name: office
+    public_key: ` + testKey(4) + `
+    routes: [192.168.10.0/24]
+`
+  if res := ta.do(t, http.MethodPost, "/reconcile", state); res.StatusCode != http.StatusUnauthorized {
+    t.Errorf("expected reconcile to require admin access, got %d", res.StatusCode)
+  }
+
+  res, plan := ta.reconcile(t, state, false)
+  if res.StatusCode != http.StatusOK || plan.Applied || len(plan.Conflicts) != 0 {
+    t.Fatalf("unexpected plan %d %+v", res.StatusCode, plan)
+  }
+  ops := make(map[string]int)
+  for _, action := range plan.Actions {
+    ops[action.Kind+" "+action.Op]++
+  }
+  if ops["peer update"] != 1 || ops["peer create"] != 2 || ops["gateway create"] != 1 || ops["device_peer create"] != 2 {
+    t.Errorf("unexpected actions %+v", plan.Actions)
+  }
+  if ta.peerCount(t) != 1 {
+    t.Fatal("expected a plan without apply to change nothing")
+  }
+
+  if res, plan = ta.reconcile(t, state, true); res.StatusCode != http.StatusOK || !plan.Applied {
+    t.Fatalf("expected the plan to be applied, got %d %+v", res.StatusCode, plan)
+  }
+  if ta.peerCount(t) != 4 {
+    t.Errorf("expected 4 peers, got %d", ta.peerCount(t))
+  }
+  devicePeers, _ := ta.wg.Peers(context.Background())
+  allowed := make(map[string][]string)
+  for _, peer := range devicePeers {
+    allowed[peer.PublicKey] = peer.AllowedIPs
+  }
+  if len(devicePeers) != 3 || strings.Join(allowed[testKey(2)], ",") != "10.0.0.10/32" ||
+    strings.Join(allowed[testKey(4)], ",") != "10.0.0.12/32,192.168.10.0/24" || allowed[testKey(3)] != nil {
+    t.Errorf("unexpected device peers %+v", devicePeers)
+  }
+
+  if _, plan = ta.reconcile(t, state, true); len(plan.Actions) != 0 || plan.Applied {
+    t.Errorf("expected reconciling again to be a no-op, got %+v", plan)
+  }
+
+  // Dropping a peer deletes it; disabling one takes it off the device.
+  state = strings.Replace(state, "    ip: 10.0.0.10\n", "    ip: 10.0.0.10\n    status: disabled\n", 1)
+  state = strings.Replace(state, "  - name: bob\n    public_key: "+testKey(3)+"\n    status: pending\n", "", 1)
+  if _, plan = ta.reconcile(t, state, true); !plan.Applied || len(plan.Actions) != 3 {
+    t.Fatalf("unexpected plan %+v", plan)
+  }
+  if ta.peerCount(t) != 3 {
+    t.Errorf("expected bob to be deleted, got %d peers", ta.peerCount(t))
+  }
+  if devicePeers, _ = ta.wg.Peers(context.Background()); len(devicePeers) != 2 {
+    t.Errorf("expected alice to be removed from the device, got %+v", devicePeers)
+  }
+  if _, plan = ta.reconcile(t, state, false); len(plan.Actions) != 0 {
+    t.Errorf("expected no further changes, got %+v", plan.Actions)
+  }
+}
+
+func TestReconcileConflictsAndErrors(t *testing.T) {
+  ta := newTestApp(t)
+
+  res, plan := ta.reconcile(t, "pools:\n  - {start: 192.168.0.1, end: 192.168.0.9}\npeers:\n  - name: a\n", true)
+  if res.StatusCode != http.StatusConflict || plan.Applied || len(plan.Conflicts) == 0 {
+    t.Errorf("expected a pool outside the network to conflict, got %d %+v", res.StatusCode, plan)
+  }
+
+  ta.do(t, http.MethodPost, "/peer", `{"public_key": "client-key", "OS_Arch": "x86_64-unknown-linux-musl"}`)
+  res, plan = ta.reconcile(t, `{"peers": [{"name": "a", "ip": "10.0.0.2"}]}`, true)
+  if res.StatusCode != http.StatusConflict || len(plan.Conflicts) != 1 {
+    t.Errorf("expected an address held by an unmanaged peer to conflict, got %d %+v", res.StatusCode, plan)
+  }
+
+  for _, state := range []string{
+    "",
+    "peers:\n  - name: a\n  - name: a\n",
+    "peers:\n  - name: a\n    colour: red\n",
+    "peers:\n  - name: a\n    public_key: not-a-key\n",
+    "peers:\n  - name: a\n    routes: [10.1.0.0/16]\n",
+    "peers:\n  - name: a\n    ip: 192.168.1.1\n",
+  } {
+    if res, _ := ta.reconcile(t, state, false); res.StatusCode != http.StatusBadRequest {
+      t.Errorf("expected %q to be rejected, got %d", state, res.StatusCode)
+    }
+  }
+  if ta.peerCount(t) != 1 {
+    t.Error("expected nothing to be created")
+  }
+
+  // Without pools of its own the state gets addresses from the allocator.
+  ta.alloc.Next = net.ParseIP("10.0.0.50").To4()
+  if res, plan = ta.reconcile(t, "peers:\n  - name: a\n", true); res.StatusCode != http.StatusOK || !plan.Applied {
+    t.Fatalf("expected the plan to be applied, got %d %+v", res.StatusCode, plan)
+  }
+  if plan.Actions[0].Changes[0] != "ip 10.0.0.50" {
+    t.Errorf("expected the allocated address, got %+v", plan.Actions[0])
+  }
+}
+
+// stubBackups writes a fixed archive.
+type stubBackups struct {
+  err error
+}
+
+func (b *stubBackups) Backup(ctx context.Context, w io.Writer) (*backup.Manifest, error) {
+  if b.err != nil {
+    return nil, b.err
+  }
+  io.WriteString(w, "archive")
+  return &backup.Manifest{FormatVersion: backup.FormatVersion, CreatedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}, nil
+}
+
+func (b *stubBackups) Encrypted() bool {
+  return false
+}
+
+func TestBackup(t *testing.T) {
+  ta := newTestApp(t)
+
+  if res := ta.do(t, http.MethodGet, "/backup", ""); res.StatusCode != http.StatusUnauthorized {
+    t.Errorf("expected backups to require admin access, got %d", res.StatusCode)
+  }
+  if res := ta.do(t, http.MethodGet, "/backup", "", "Authorization", "Bearer secret"); res.StatusCode != http.StatusNotImplemented {
+    t.Errorf("expected 501 without an online backup, got %d", res.StatusCode)
+  }
+
+  ta.app.Backups = &stubBackups{}
+  res := ta.do(t, http.MethodGet, "/backup", "", "Authorization", "Bearer secret")
+  body, _ := io.ReadAll(res.Body)
+  if res.StatusCode != http.StatusOK || string(body) != "archive" {
+    t.Fatalf("unexpected backup %d %q", res.StatusCode, body)
+  }
+  if disposition := res.Header.Get("Content-Disposition"); !strings.Contains(disposition, "elysium-backup-20240501T120000Z.tar.gz") {
+    t.Errorf("unexpected Content-Disposition %q", disposition)
+  }
+  events, _ := ta.store.ListAuditEvents(context.Background(), models.AuditFilter{Action: "backup.create"})
+  if len(events) != 1 {
+    t.Errorf("expected the backup to be audited, got %+v", events)
+  }
+
+  ta.app.Backups = &stubBackups{err: errors.New("disk full")}
+  if res := ta.do(t, http.MethodGet, "/backup", "", "Authorization", "Bearer secret"); res.StatusCode != http.StatusInternalServerError {
+    t.Errorf("expected a failed backup to be reported, got %d", res.StatusCode)
+  }
+}
+
+// waitForRotation polls a key rotation until no client is left to re-issue.
+func (ta *testApp) waitForRotation(t *testing.T, id uuid.UUID) models.KeyRotation {
+  t.Helper()
+  deadline := time.Now().Add(5 * time.Second)
+  for {
+    var rotation models.KeyRotation
+    decode(t, ta.do(t, http.MethodGet, "/wireguard/rotations/"+id.String(), "", "Authorization", "Bearer secret"), &rotation)
+    pending := false
+    for _, peer := range rotation.Peers {
+      pending = pending || peer.Status == models.RotationPeerStatusPending
+    }
+    if !pending {
+      return rotation
+    }
+    if time.Now().After(deadline) {
+      t.Fatalf("clients were not re-issued: %+v", rotation)
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+}
+
+func TestKeyRotation(t *testing.T) {
+  ctx := context.Background()
+  wg := config.WireGuardConfig{
+    Interface:     "wg0",
+    Port:          51820,
+    AltInterface:  "wg0-alt",
+    AltPort:       51821,
+    IP:            net.ParseIP("10.0.0.1"),
+    RotationGrace: time.Hour,
+  }
+  ta := newTestApp(t, func(cfg *config.Config) { cfg.WireGuard = wg })
+
+  ta.do(t, http.MethodPost, "/peer", `{"public_key": "alice-key", "OS_Arch": "x86_64-unknown-linux-musl"}`)
+  ta.do(t, http.MethodPost, "/peer", `{"public_key": "bob-key", "OS_Arch": "aarch64-unknown-linux-musl"}`)
+  for _, req := range ta.builder.Requests {
+    if req.Bundle.PublicKey != "server-key" || req.Bundle.ServerPort != 51820 {
+      t.Errorf("expected the client to connect to the key in use, got %+v", req.Bundle)
+    }
+  }
+  // carol has no artifact to take the target from; dave is disabled.
+  carol := &models.Peer{PublicKey: "carol-key", AssignedIP: net.ParseIP("10.0.0.4"), Status: models.PeerStatusActive}
+  dave := &models.Peer{PublicKey: "dave-key", AssignedIP: net.ParseIP("10.0.0.5"), Status: models.PeerStatusDisabled}
+  ta.store.InsertPeer(ctx, carol)
+  ta.store.InsertPeer(ctx, dave)
+
+  body := `{"grace_period": "1h", "target": "aarch64-unknown-linux-musl"}`
+  if res := ta.do(t, http.MethodPost, "/wireguard/rotations", body); res.StatusCode != http.StatusUnauthorized {
+    t.Errorf("expected key rotation to require admin access, got %d", res.StatusCode)
+  }
+  if res := ta.do(t, http.MethodPost, "/wireguard/rotations", `{"grace_period": "soon"}`, "Authorization", "Bearer secret"); res.StatusCode != http.StatusBadRequest {
+    t.Errorf("expected an invalid grace period to be rejected, got %d", res.StatusCode)
+  }
+
+  res := ta.do(t, http.MethodPost, "/wireguard/rotations", body, "Authorization", "Bearer secret")
+  if res.StatusCode != http.StatusAccepted {
+    t.Fatalf("expected 202, got %d", res.StatusCode)
+  }
+  var started models.KeyRotation
+  decode(t, res, &started)
+  if res.Header.Get("Location") != "/wireguard/rotations/"+started.ID.String() || started.OldPublicKey != "server-key" || started.NewPublicKey != "rotated-key" || started.NewInterface != "wg0-alt" || started.NewPort != 51821 || len(started.Peers) != 3 {
+    t.Fatalf("unexpected rotation %+v", started)
+  }
+  if ta.wg.Next == nil || ta.wg.Next.Interface != "wg0-alt" {
+    t.Errorf("expected the new key to be served on wg0-alt, got %+v", ta.wg.Next)
+  }
+  if res := ta.do(t, http.MethodPost, "/wireguard/rotations", "", "Authorization", "Bearer secret"); res.StatusCode != http.StatusConflict {
+    t.Errorf("expected a second rotation to conflict, got %d", res.StatusCode)
+  }
+
+  rotation := ta.waitForRotation(t, started.ID)
+  targets := map[string]models.OSArch{"alice-key": "x86_64-unknown-linux-musl", "bob-key": "aarch64-unknown-linux-musl", "carol-key": "aarch64-unknown-linux-musl"}
+  for _, peer := range rotation.Peers {
+    if peer.Status != models.RotationPeerStatusReissued || peer.ArtifactID == nil || peer.Target != targets[peer.PublicKey] {
+      t.Errorf("expected the client of %s to be re-issued, got %+v", peer.PublicKey, peer)
+    }
+  }
+
+  // erin joins during the rotation and is built against the new key.
+  ta.alloc.Next = net.ParseIP("10.0.0.6").To4()
+  ta.do(t, http.MethodPost, "/peer", `{"public_key": "erin-key", "OS_Arch": "x86_64-unknown-linux-musl"}`)
+  for _, req := range ta.builder.Requests[2:] {
+    if req.Bundle.PublicKey != "rotated-key" || req.Bundle.ServerPort != 51821 {
+      t.Errorf("expected the client to connect to the new key, got %+v", req.Bundle)
+    }
+  }
+  rotation = ta.waitForRotation(t, started.ID)
+  if len(rotation.Peers) != 4 || rotation.Peers[3].PublicKey != "erin-key" || rotation.Peers[3].Status != models.RotationPeerStatusReissued || rotation.Peers[3].ArtifactID == nil {
+    t.Fatalf("expected erin to be tracked by the rotation, got %+v", rotation.Peers)
+  }
+
+  res = ta.do(t, http.MethodGet, "/wireguard/rotations/"+started.ID.String()+"/bundle", "", "Authorization", "Bearer secret")
+  data, _ := io.ReadAll(res.Body)
+  archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+  if err != nil {
+    t.Fatalf("expected a ZIP archive: %v", err)
+  }
+  if len(archive.File) != 1+4*3 {
+    t.Errorf("expected the manifest and the clients of every peer, got %d files", len(archive.File))
+  }
+
+  // alice connects with the new key; bob and carol have not yet.
+  ta.wg.Handshake("alice-key", time.Now())
+  if _, err := ta.app.Rotations.Check(ctx); err != nil {
+    t.Fatalf("Check failed: %v", err)
+  }
+  rotation = ta.waitForRotation(t, started.ID)
+  if rotation.Status != models.KeyRotationStatusInProgress || rotation.Peers[0].Status != models.RotationPeerStatusMigrated || rotation.Peers[0].MigratedAt == nil {
+    t.Fatalf("expected alice to have migrated, got %+v", rotation)
+  }
+  if len(ta.wg.Routed) != 1 || !ta.wg.Routed[0].Equal(net.ParseIP("10.0.0.2")) {
+    t.Errorf("expected alice to be routed to the new key, got %v", ta.wg.Routed)
+  }
+
+  // carol is disabled in the meantime and no longer waited for.
+  carol.Status = models.PeerStatusDisabled
+  ta.store.UpdatePeer(ctx, carol)
+  ta.wg.Handshake("bob-key", time.Now())
+  ta.wg.Handshake("erin-key", time.Now())
+  ta.app.Rotations.Check(ctx)
+
+  var latest models.KeyRotation
+  decode(t, ta.do(t, http.MethodGet, "/wireguard/rotations/latest", "", "Authorization", "Bearer secret"), &latest)
+  if latest.ID != started.ID || latest.Status != models.KeyRotationStatusCompleted || latest.FinishedAt == nil {
+    t.Fatalf("expected the rotation to complete, got %+v", latest)
+  }
+  if ta.wg.Key != "rotated-key" || ta.wg.Next != nil {
+    t.Errorf("expected the old key to be retired, got %q", ta.wg.Key)
+  }
+  if endpoint, _ := services.CurrentEndpoint(ctx, ta.store, wg); endpoint.Interface != "wg0-alt" {
+    t.Errorf("expected wg0-alt to serve the key after the rotation, got %+v", endpoint)
+  }
+  events, _ := ta.store.ListAuditEvents(ctx, models.AuditFilter{Action: "wireguard.rotation.finish"})
+  if len(events) != 1 {
+    t.Errorf("expected the rotation to be audited, got %+v", events)
+  }
+  if res := ta.do(t, http.MethodDelete, "/wireguard/rotations/"+started.ID.String(), "", "Authorization", "Bearer secret"); res.StatusCode != http.StatusConflict {
+    t.Errorf("expected a finished rotation not to be cancelled, got %d", res.StatusCode)
+  }
+
+  // The next rotation moves back to wg0 and is cancelled.
+  res = ta.do(t, http.MethodPost, "/wireguard/rotations", "", "Authorization", "Bearer secret")
+  decode(t, res, &started)
+  if started.OldPublicKey != "rotated-key" || started.NewInterface != "wg0" || len(started.Peers) != 3 {
+    t.Fatalf("unexpected rotation %+v", started)
+  }
+  ta.waitForRotation(t, started.ID)
+  var cancelled models.KeyRotation
+  decode(t, ta.do(t, http.MethodDelete, "/wireguard/rotations/"+started.ID.String(), "", "Authorization", "Bearer secret"), &cancelled)
+  if cancelled.Status != models.KeyRotationStatusCancelled || ta.wg.Next != nil || ta.wg.Key != "rotated-key" {
+    t.Errorf("expected the new key to be discarded, got %+v", cancelled)
+  }
+  if res := ta.do(t, http.MethodDelete, "/wireguard/rotations/"+uuid.NewString(), "", "Authorization", "Bearer secret"); res.StatusCode != http.StatusNotFound {
+    t.Errorf("expected 404 for an unknown rotation, got %d", res.StatusCode)
+  }
+}
+
+func TestKeyRotationWithoutPresharedKeys(t *testing.T) {
+  ta := newTestApp(t, func(cfg *config.Config) {
+    cfg.WireGuard = config.WireGuardConfig{Interface: "wg0", Port: 51820, AltInterface: "wg0-alt", AltPort: 51821, RotationGrace: time.Hour}
+  })
+  ctx := context.Background()
+
+  // Without preshared keys the peer is still put on the interface, so its
+  // handshake with the new key is seen.
+  ta.do(t, http.MethodPost, "/peer", `{"public_key": "client-key", "OS_Arch": "x86_64-unknown-linux-musl"}`)
+  if peers, _ := ta.wg.Peers(ctx); len(peers) != 1 || peers[0].PublicKey != "client-key" || peers[0].PresharedKey != "" {
+    t.Fatalf("expected the peer to be configured without a preshared key, got %+v", peers)
+  }
+
+  var started models.KeyRotation
+  decode(t, ta.do(t, http.MethodPost, "/wireguard/rotations", "", "Authorization", "Bearer secret"), &started)
+  ta.waitForRotation(t, started.ID)
+  ta.wg.Handshake("client-key", time.Now())
+  if _, err := ta.app.Rotations.Check(ctx); err != nil {
+    t.Fatalf("Check failed: %v", err)
+  }
+  rotation := ta.waitForRotation(t, started.ID)
+  if rotation.Status != models.KeyRotationStatusCompleted || rotation.Peers[0].Status != models.RotationPeerStatusMigrated || ta.wg.Key != "rotated-key" {
+    t.Errorf("expected the peer to migrate and the rotation to complete, got %+v", rotation)
+  }
+}
+
+func TestKeyRotationDuringBuild(t *testing.T) {
+  ta := newTestApp(t, func(cfg *config.Config) {
+    cfg.WireGuard = config.WireGuardConfig{Interface: "wg0", Port: 51820, AltInterface: "wg0-alt", AltPort: 51821, RotationGrace: time.Hour}
+  })
+  ctx := context.Background()
+
+  ta.do(t, http.MethodPost, "/peer", `{"public_key": "client-key", "OS_Arch": "x86_64-unknown-linux-musl"}`)
+  peers, _ := ta.store.GetAllPeer(ctx)
+  tracked := models.KeyRotationPeer{PeerID: *peers[0].ID, PublicKey: "client-key", AssignedIP: peers[0].AssignedIP, Target: "x86_64-unknown-linux-musl"}
+
+  // A client built against the old key while a rotation starts is re-issued
+  // for the new one.
+  old, err := ta.app.Endpoints.Resolve(ctx)
+  if err != nil || old.PublicKey != "server-key" {
+    t.Fatalf("unexpected endpoint %+v: %v", old, err)
+  }
+  var started models.KeyRotation
+  decode(t, ta.do(t, http.MethodPost, "/wireguard/rotations", "", "Authorization", "Bearer secret"), &started)
+  ta.waitForRotation(t, started.ID)
+  builds := len(ta.builder.Requests)
+  if err := ta.app.Endpoints.Track(ctx, old, tracked); err != nil {
+    t.Fatalf("Track failed: %v", err)
+  }
+  rotation := ta.waitForRotation(t, started.ID)
+  if len(ta.builder.Requests) != builds+1 || ta.builder.Requests[builds].Bundle.PublicKey != "rotated-key" || rotation.Peers[0].Status != models.RotationPeerStatusReissued {
+    t.Errorf("expected the client to be re-issued for the new key, got %+v", rotation.Peers)
+  }
+
+  // A client built against a key discarded by a cancelled rotation has to
+  // be built again.
+  next, _ := ta.app.Endpoints.Resolve(ctx)
+  ta.do(t, http.MethodDelete, "/wireguard/rotations/"+started.ID.String(), "", "Authorization", "Bearer secret")
+  if err := ta.app.Endpoints.Track(ctx, next, tracked); !errors.Is(err, services.ErrEndpointChanged) {
+    t.Errorf("expected ErrEndpointChanged, got %v", err)
+  }
+  if err := ta.app.Endpoints.Track(ctx, old, tracked); err != nil {
+    t.Errorf("expected a client for the key in use to be kept, got %v", err)
+  }
+}
+
+func TestKeyRotationResume(t *testing.T) {
+  ta := newTestApp(t, func(cfg *config.Config) {
+    cfg.WireGuard = config.WireGuardConfig{Interface: "wg0", Port: 51820, AltInterface: "wg0-alt", AltPort: 51821, RotationGrace: time.Hour}
+  })
+  ctx := context.Background()
+
+  // A rotation left in progress by an earlier process, its first client
+  // already re-issued.
+  ta.store.InsertPeer(ctx, &models.Peer{PublicKey: "alice-key", AssignedIP: net.ParseIP("10.0.0.2"), Status: models.PeerStatusActive})
+  ta.store.InsertPeer(ctx, &models.Peer{PublicKey: "bob-key", AssignedIP: net.ParseIP("10.0.0.3"), Status: models.PeerStatusActive})
+  started, err := ta.app.Rotations.Start(ctx, 0, "x86_64-unknown-linux-musl")
+  if err != nil {
+    t.Fatalf("Start failed: %v", err)
+  }
+  done := started.Peers[0]
+  done.Status = models.RotationPeerStatusReissued
+  ta.store.UpdateKeyRotationPeer(ctx, started.ID, &done)
+
+  rotation, err := ta.app.Rotations.Resume(ctx)
+  if err != nil || rotation == nil {
+    t.Fatalf("Resume failed: %v", err)
+  }
+  if err := ta.app.Rotations.StartReissue(ctx, rotation); err != nil {
+    t.Fatalf("StartReissue failed: %v", err)
+  }
+  resumed := ta.waitForRotation(t, started.ID)
+  if len(ta.builder.Requests) != 1 || resumed.Peers[1].Status != models.RotationPeerStatusReissued {
+    t.Errorf("expected only the pending client to be re-issued, got %d builds and %+v", len(ta.builder.Requests), resumed.Peers)
+  }
+
+  if err := ta.app.Rotations.Shutdown(ctx); err != nil {
+    t.Fatalf("Shutdown failed: %v", err)
+  }
+  if err := ta.app.Rotations.StartReissue(ctx, rotation); !errors.Is(err, services.ErrShuttingDown) {
+    t.Errorf("expected no re-issue to start after shutdown, got %v", err)
+  }
+}
+
+func TestPresharedKeys(t *testing.T) {
+  ta := newTestApp(t, func(cfg *config.Config) { cfg.WireGuard.PresharedKeys = true })
+  ctx := context.Background()
+
+  var created map[string]string
+  decode(t, ta.do(t, http.MethodPost, "/peer", `{"public_key": "client-key", "OS_Arch": "x86_64-unknown-linux-musl"}`), &created)
+  first := ta.builder.Requests[0].Bundle.PresharedKey
+  if first == "" {
+    t.Fatalf("expected the client to embed a preshared key")
+  }
+  peers, _ := ta.store.GetAllPeer(ctx)
+  peer := peers[0]
+  if peer.PresharedKey == "" || peer.PresharedKey == first {
+    t.Fatalf("expected the preshared key to be stored sealed, got %q", peer.PresharedKey)
+  }
+  if key, err := ta.app.PSKs.Open(&peer); err != nil || key != first {
+    t.Errorf("expected the stored key to open to the embedded one, got %q: %v", key, err)
+  }
+  if devicePeers, _ := ta.wg.Peers(ctx); len(devicePeers) != 1 || devicePeers[0].PresharedKey != first || devicePeers[0].AllowedIPs[0] != "10.0.0.2/32" {
+    t.Errorf("expected the new peer to be configured with its preshared key, got %+v", devicePeers)
+  }
+
+  ta.wg.ConfigurePeers(ctx, []wgutil.DevicePeer{{PublicKey: "client-key", AllowedIPs: []string{"10.0.0.2/32", "192.168.1.0/24"}, PresharedKey: first}}, nil)
+
+  path := "/peer/" + peer.ID.String() + "/preshared-key"
+  if res := ta.do(t, http.MethodPost, path, ""); res.StatusCode != http.StatusUnauthorized {
+    t.Errorf("expected preshared key rotation to require admin access, got %d", res.StatusCode)
+  }
+  res := ta.do(t, http.MethodPost, path, "", "Authorization", "Bearer secret")
+  if res.StatusCode != http.StatusOK {
+    t.Fatalf("expected 200, got %d", res.StatusCode)
+  }
+  var rotated map[string]string
+  decode(t, res, &rotated)
+  req := ta.builder.Requests[1]
+  if rotated["build_id"] != req.ID.String() || req.Target != "x86_64-unknown-linux-musl" || req.Bundle.PresharedKey == "" || req.Bundle.PresharedKey == first {
+    t.Fatalf("expected a client with a new preshared key, got %+v", req)
+  }
+  devicePeers, _ := ta.wg.Peers(ctx)
+  if len(devicePeers) != 1 || devicePeers[0].PresharedKey != req.Bundle.PresharedKey || len(devicePeers[0].AllowedIPs) != 2 {
+    t.Errorf("expected the new key on the interface with the allowed IPs kept, got %+v", devicePeers)
+  }
+  if key, _ := ta.app.PSKs.Lookup(ctx, *peer.ID); key != req.Bundle.PresharedKey {
+    t.Errorf("expected the new key to be stored, got %q", key)
+  }
+  if download := ta.do(t, http.MethodGet, rotated["download_link"], ""); download.StatusCode != http.StatusOK {
+    t.Errorf("expected the new client to be downloadable, got %d", download.StatusCode)
+  }
+  events, _ := ta.store.ListAuditEvents(ctx, models.AuditFilter{Action: "peer.preshared_key.rotate"})
+  if len(events) != 1 || events[0].Target != peer.ID.String() {
+    t.Errorf("expected the rotation to be audited, got %+v", events)
+  }
+
+  // A peer without artifacts needs a target, a disabled peer is refused.
+  bare := &models.Peer{PublicKey: "bare-key", AssignedIP: net.ParseIP("10.0.0.3"), Status: models.PeerStatusActive}
+  disabled := &models.Peer{PublicKey: "disabled-key", AssignedIP: net.ParseIP("10.0.0.4"), Status: models.PeerStatusDisabled}
+  ta.store.InsertPeer(ctx, bare)
+  ta.store.InsertPeer(ctx, disabled)
+  if res := ta.do(t, http.MethodPost, "/peer/"+bare.ID.String()+"/preshared-key", "", "Authorization", "Bearer secret"); res.StatusCode != http.StatusBadRequest {
+    t.Errorf("expected 400 for a peer without artifacts, got %d", res.StatusCode)
+  }
+  if res := ta.do(t, http.MethodPost, "/peer/"+bare.ID.String()+"/preshared-key", `{"OS_Arch": "aarch64-unknown-linux-musl"}`, "Authorization", "Bearer secret"); res.StatusCode != http.StatusOK {
+    t.Errorf("expected a peer without a preshared key to get one, got %d", res.StatusCode)
+  }
+  if res := ta.do(t, http.MethodPost, "/peer/"+disabled.ID.String()+"/preshared-key", "", "Authorization", "Bearer secret"); res.StatusCode != http.StatusConflict {
+    t.Errorf("expected 409 for a disabled peer, got %d", res.StatusCode)
+  }
+  if res := ta.do(t, http.MethodPost, "/peer/"+uuid.NewString()+"/preshared-key", "", "Authorization", "Bearer secret"); res.StatusCode != http.StatusNotFound {
+    t.Errorf("expected 404 for an unknown peer, got %d", res.StatusCode)
+  }
+
+  // The stored key stays in step with the interface when it cannot be updated.
+  ta.wg.ConfigureErr = errors.New("device busy")
+  builds := len(ta.builder.Requests)
+  if res := ta.do(t, http.MethodPost, path, "", "Authorization", "Bearer secret"); res.StatusCode != http.StatusInternalServerError {
+    t.Errorf("expected 500 when the interface cannot be updated, got %d", res.StatusCode)
+  }
+  ta.wg.ConfigureErr = nil
+  if len(ta.builder.Requests) != builds+1 {
+    t.Fatalf("expected the client to be built before the key is replaced")
+  }
+  if key, _ := ta.app.PSKs.Lookup(ctx, *peer.ID); key != req.Bundle.PresharedKey {
+    t.Errorf("expected the previous key to be stored back, got %q", key)
+  }
+
+  // Without key encryption preshared keys would be stored in plaintext.
+  plain, _ := keystore.New("", "")
+  psks := ta.app.PSKs
+  ta.app.PSKs = services.NewPresharedKeys(ta.store, ta.wg, plain, true)
+  if res := ta.do(t, http.MethodPost, "/peer/"+bare.ID.String()+"/preshared-key", "", "Authorization", "Bearer secret"); res.StatusCode != http.StatusNotImplemented {
+    t.Errorf("expected preshared keys to be refused without key encryption, got %d", res.StatusCode)
+  }
+  ta.app.PSKs = psks
+
+  // Bulk peers get their key on the interface too.
+  ta.alloc.Next = net.ParseIP("10.0.0.20").To4()
+  job, invalid, err := ta.app.Bulk.Create(ctx, []models.BulkPeer{{Name: "bulk", Target: "x86_64-unknown-linux-musl", PublicKey: testKey(5)}})
+  if err != nil || len(invalid) > 0 {
+    t.Fatalf("Create failed: %v %v", err, invalid)
+  }
+  ta.app.Bulk.Run(ctx, job)
+  bulkPeer, _ := ta.store.GetPeer(ctx, *job.Items[0].PeerID)
+  bulkKey, _ := ta.app.PSKs.Open(bulkPeer)
+  devicePeers, _ = ta.wg.Peers(ctx)
+  if bulkKey == "" || !slices.ContainsFunc(devicePeers, func(peer wgutil.DevicePeer) bool { return peer.PublicKey == testKey(5) && peer.PresharedKey == bulkKey }) {
+    t.Errorf("expected the bulk peer to be configured with its preshared key, got %+v", devicePeers)
+  }
+
+  // Reconciling restores a preshared key changed on the device.
+  state := "peers:\n  - name: bulk\n    public_key: " + testKey(5) + "\n    ip: " + bulkPeer.AssignedIP.String() + "\n"
+  ta.reconcile(t, state, true)
+  ta.wg.ConfigurePeers(ctx, []wgutil.DevicePeer{{PublicKey: testKey(5), AllowedIPs: []string{bulkPeer.AssignedIP.String() + "/32"}, PresharedKey: testKey(6)}}, nil)
+  _, plan := ta.reconcile(t, state, true)
+  if len(plan.Actions) != 1 || plan.Actions[0].Op != models.ReconcileOpUpdate || strings.Join(plan.Actions[0].Changes, ",") != "preshared_key" {
+    t.Fatalf("expected the preshared key to be updated on the device, got %+v", plan.Actions)
+  }
+  devicePeers, _ = ta.wg.Peers(ctx)
+  if !slices.ContainsFunc(devicePeers, func(peer wgutil.DevicePeer) bool { return peer.PublicKey == testKey(5) && peer.PresharedKey == bulkKey }) {
+    t.Errorf("expected the stored preshared key back on the device, got %+v", devicePeers)
+  }
+  // Peers created by a reconcile get a key, even on the address of a peer
+  // deleted by the same plan.
+  ta.reconcile(t, state+"  - name: old\n    public_key: "+testKey(7)+"\n    ip: 10.0.0.30\n", true)
+  if _, plan = ta.reconcile(t, state+"  - name: new\n    public_key: "+testKey(8)+"\n    ip: 10.0.0.30\n", true); !plan.Applied {
+    t.Fatalf("expected the plan to be applied, got %+v", plan)
+  }
+  peers, _ = ta.store.GetAllPeer(ctx)
+  var newKey string
+  for i := range peers {
+    if peers[i].PublicKey == testKey(8) {
+      newKey, _ = ta.app.PSKs.Open(&peers[i])
+    }
+  }
+  devicePeers, _ = ta.wg.Peers(ctx)
+  if newKey == "" || !slices.ContainsFunc(devicePeers, func(peer wgutil.DevicePeer) bool { return peer.PublicKey == testKey(8) && peer.PresharedKey == newKey }) {
+    t.Errorf("expected the created peer to be configured with its own preshared key %q, got %+v", newKey, devicePeers)
+  }
+}
@@ -0,0 +1,12 @@
+package routes
+
+import (
+  "elysium-backend/internal/handlers"
+  "net/http"
+
+  "github.com/gorilla/mux"
+)
+
+func SigningRoutes(router *mux.Router, app *handlers.App) {
+  router.HandleFunc("/signing-key", app.SigningKeyHandler).Methods(http.MethodGet)
+}
@@ -0,0 +1,12 @@
+package routes
+
+import (
+  "elysium-backend/internal/handlers"
+  "net/http"
+
+  "github.com/gorilla/mux"
+)
+
+func TargetRoutes(router *mux.Router, app *handlers.App) {
+  router.HandleFunc("/targets", app.GetTargetsHandler).Methods(http.MethodGet)
+}
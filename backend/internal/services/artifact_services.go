@@ -0,0 +1,230 @@
+package services
+
+import (
+  "context"
+  "crypto/ed25519"
+  "crypto/sha256"
+  "elysium-backend/internal/audit"
+  "elysium-backend/internal/models"
+  "elysium-backend/pkg/logger"
+  "encoding/base64"
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "os"
+  "path/filepath"
+  "strings"
+  "time"
+
+  "github.com/google/uuid"
+)
+
+// orphanGrace is how old a file under the output directory without an
+// artifact record must be before it is collected. It covers the time
+// between a build finishing and its artifact being recorded.
+const orphanGrace = time.Hour
+
+// SignatureSuffix is appended to an artifact's path to name the file holding
+// its raw Ed25519 signature.
+const SignatureSuffix = ".sig"
+
+// ArtifactStore records the binaries builds leave under the output
+// directory, signs them, and removes them once they expire or their peer is
+// gone.
+type ArtifactStore struct {
+  store Store
+  dir   string
+  ttl   time.Duration
+  key   ed25519.PrivateKey
+}
+
+func NewArtifactStore(store Store, outputDir string, ttl time.Duration, signingKey ed25519.PrivateKey) *ArtifactStore {
+  return &ArtifactStore{store: store, dir: outputDir, ttl: ttl, key: signingKey}
+}
+
+// PublicKey returns the key artifact signatures verify against.
+func (s *ArtifactStore) PublicKey() ed25519.PublicKey {
+  return s.key.Public().(ed25519.PublicKey)
+}
+
+// Path returns where the file of artifact is stored.
+func (s *ArtifactStore) Path(artifact *models.Artifact) string {
+  return filepath.Join(s.dir, artifact.Path)
+}
+
+// Record signs the artifact produced by build, writes the signature next to
+// it and stores it for peerID. It fails when the file no longer matches the
+// digest the build recorded.
+func (s *ArtifactStore) Record(ctx context.Context, peerID uuid.UUID, build *models.Build) (*models.Artifact, error) {
+  relPath := build.ArtifactPath
+  path := filepath.Join(s.dir, relPath)
+  content, err := os.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  digest := sha256.Sum256(content)
+  if build.SHA256 != "" && build.SHA256 != hex.EncodeToString(digest[:]) {
+    return nil, fmt.Errorf("artifact %s does not match the digest recorded for build %s", relPath, build.ID)
+  }
+  signature := ed25519.Sign(s.key, content)
+  if err := os.WriteFile(path+SignatureSuffix, signature, 0o644); err != nil {
+    return nil, err
+  }
+
+  now := time.Now().UTC()
+  artifact := &models.Artifact{
+    ID:        uuid.New(),
+    PeerID:    &peerID,
+    BuildID:   &build.ID,
+    Target:    build.Target,
+    Path:      relPath,
+    Size:      int64(len(content)),
+    SHA256:    hex.EncodeToString(digest[:]),
+    Signature: base64.StdEncoding.EncodeToString(signature),
+    CreatedAt: now,
+    ExpiresAt: now.Add(s.ttl),
+  }
+  if err := s.store.InsertArtifact(ctx, artifact); err != nil {
+    return nil, err
+  }
+  logger.FromContext(ctx).Info("artifact recorded", "artifact_id", artifact.ID.String(), "path", relPath, "size", artifact.Size, "sha256", artifact.SHA256)
+  return artifact, nil
+}
+
+// LatestTarget returns the target of the latest artifact of the peer
+// peerID, empty when it has none left.
+func (s *ArtifactStore) LatestTarget(ctx context.Context, peerID uuid.UUID) (models.OSArch, error) {
+  artifacts, err := s.store.ListArtifacts(ctx, &peerID)
+  if err != nil || len(artifacts) == 0 {
+    return "", err
+  }
+  latest := artifacts[0]
+  for _, artifact := range artifacts[1:] {
+    if artifact.CreatedAt.After(latest.CreatedAt) {
+      latest = artifact
+    }
+  }
+  return latest.Target, nil
+}
+
+// Delete removes the record of artifact and then its file. A file that
+// cannot be removed is left for the next collection as an orphan.
+func (s *ArtifactStore) Delete(ctx context.Context, artifact *models.Artifact) error {
+  if err := s.store.DeleteArtifact(ctx, artifact.ID); err != nil {
+    return err
+  }
+  s.removeFile(ctx, artifact.Path)
+  return nil
+}
+
+func (s *ArtifactStore) removeFile(ctx context.Context, relPath string) {
+  path := filepath.Join(s.dir, relPath)
+  if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+    logger.FromContext(ctx).Warn("failed to remove artifact file", "path", path, "err", err)
+    return
+  }
+  if !strings.HasSuffix(path, SignatureSuffix) {
+    os.Remove(path + SignatureSuffix)
+  }
+  // Every build gets its own directory; drop it once it is empty.
+  if dir := filepath.Dir(path); dir != filepath.Clean(s.dir) {
+    os.Remove(dir)
+  }
+}
+
+// Collect deletes expired artifacts, artifacts of deleted peers and files
+// in the output directory that no artifact refers to. It returns the number
+// of files removed.
+func (s *ArtifactStore) Collect(ctx context.Context) (int, error) {
+  log := logger.FromContext(ctx)
+  removed := 0
+
+  collectable, err := s.store.ListCollectableArtifacts(ctx, time.Now().UTC())
+  if err != nil {
+    return 0, err
+  }
+  for i := range collectable {
+    artifact := &collectable[i]
+    if err := s.Delete(ctx, artifact); err != nil {
+      return removed, err
+    }
+    log.Info("artifact collected", "artifact_id", artifact.ID.String(), "path", artifact.Path, "expires_at", artifact.ExpiresAt)
+    audit.Record(ctx, s.store, "artifact.collect", artifact.ID.String(), artifact, nil)
+    removed++
+  }
+
+  known, err := s.store.ListArtifacts(ctx, nil)
+  if err != nil {
+    return removed, err
+  }
+  paths := make(map[string]bool, len(known))
+  for _, artifact := range known {
+    paths[filepath.Clean(artifact.Path)] = true
+    paths[filepath.Clean(artifact.Path)+SignatureSuffix] = true
+  }
+
+  orphans, err := s.orphans(paths, time.Now().Add(-orphanGrace))
+  if err != nil {
+    return removed, err
+  }
+  for _, relPath := range orphans {
+    log.Info("orphaned artifact file collected", "path", relPath)
+    s.removeFile(ctx, relPath)
+    removed++
+  }
+  return removed, nil
+}
+
+// orphans lists the files in the build directories below the output
+// directory that are not in known and were last modified before cutoff.
+func (s *ArtifactStore) orphans(known map[string]bool, cutoff time.Time) ([]string, error) {
+  dirs, err := os.ReadDir(s.dir)
+  if errors.Is(err, os.ErrNotExist) {
+    return nil, nil
+  } else if err != nil {
+    return nil, err
+  }
+
+  var orphans []string
+  for _, dir := range dirs {
+    // Hidden directories such as the build cache are not artifacts.
+    if !dir.IsDir() || strings.HasPrefix(dir.Name(), ".") {
+      continue
+    }
+    files, err := os.ReadDir(filepath.Join(s.dir, dir.Name()))
+    if err != nil {
+      return nil, err
+    }
+    for _, file := range files {
+      relPath := filepath.Join(dir.Name(), file.Name())
+      info, err := file.Info()
+      if err != nil || file.IsDir() || known[relPath] || info.ModTime().After(cutoff) {
+        continue
+      }
+      orphans = append(orphans, relPath)
+    }
+  }
+  return orphans, nil
+}
+
+// RunGC collects artifacts every interval until ctx is cancelled.
+func (s *ArtifactStore) RunGC(ctx context.Context, interval time.Duration) {
+  log := logger.FromContext(ctx)
+  ticker := time.NewTicker(interval)
+  defer ticker.Stop()
+
+  for {
+    removed, err := s.Collect(ctx)
+    if err != nil && ctx.Err() == nil {
+      log.Error("artifact collection failed", "err", err)
+    } else if removed > 0 {
+      log.Info("artifact collection finished", "removed", removed)
+    }
+
+    select {
+    case <-ctx.Done():
+      return
+    case <-ticker.C:
+    }
+  }
+}
@@ -0,0 +1,122 @@
+package services
+
+import (
+  "crypto/ed25519"
+  "crypto/sha256"
+  "elysium-backend/config"
+  "encoding/hex"
+  "io"
+  "io/fs"
+  "os"
+  "path/filepath"
+  "strings"
+)
+
+// cacheDirName is the directory below the output directory holding one
+// compiled client per target and cache key.
+const cacheDirName = ".cache"
+
+// cacheKey identifies a compiled client: it changes whenever the client
+// sources, the target or its configuration, the compile arguments or the key
+// the client verifies its configuration with change.
+// It also returns the hex encoded hash of the sources alone.
+func (b *CargoBuilder) cacheKey(target config.TargetConfig) (key string, sourceHash string, err error) {
+  sources, err := hashClientDir(b.cfg.ClientDir)
+  if err != nil {
+    return "", "", err
+  }
+
+  h := sha256.New()
+  h.Write(sources)
+  h.Write([]byte("\x00" + target.Triple + "\x00" + strings.Join(targetEnv(target), "\x00") + "\x00" + strings.Join(b.cfg.CompileArgs, "\x00") + "\x00"))
+  h.Write(b.signingKey.Public().(ed25519.PublicKey))
+  return hex.EncodeToString(h.Sum(nil))[:16], hex.EncodeToString(sources), nil
+}
+
+// hashClientDir hashes the names and contents of the files under dir,
+// skipping cargo's target directory and hidden entries such as .git.
+func hashClientDir(dir string) ([]byte, error) {
+  h := sha256.New()
+  err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+    if err != nil {
+      return err
+    }
+    rel, _ := filepath.Rel(dir, path)
+    if rel == "." {
+      return nil
+    }
+    if strings.HasPrefix(entry.Name(), ".") || (entry.IsDir() && rel == "target") {
+      if entry.IsDir() {
+        return filepath.SkipDir
+      }
+      return nil
+    }
+    if !entry.Type().IsRegular() {
+      return nil
+    }
+
+    file, err := os.Open(path)
+    if err != nil {
+      return err
+    }
+    defer file.Close()
+
+    h.Write([]byte(filepath.ToSlash(rel) + "\x00"))
+    if _, err := io.Copy(h, file); err != nil {
+      return err
+    }
+    h.Write([]byte{0})
+    return nil
+  })
+  if err != nil {
+    return nil, err
+  }
+  return h.Sum(nil), nil
+}
+
+// pruneCache removes the builds in targetDir other than the one for keep.
+func pruneCache(targetDir, keep string) {
+  entries, err := os.ReadDir(targetDir)
+  if err != nil {
+    return
+  }
+  for _, entry := range entries {
+    if entry.Name() != keep {
+      os.RemoveAll(filepath.Join(targetDir, entry.Name()))
+    }
+  }
+}
+
+// copyFile copies the file at src to the new file dst.
+func copyFile(dst, src string, mode os.FileMode) error {
+  in, err := os.Open(src)
+  if err != nil {
+    return err
+  }
+  defer in.Close()
+
+  out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+  if err != nil {
+    return err
+  }
+  if _, err := io.Copy(out, in); err != nil {
+    out.Close()
+    return err
+  }
+  return out.Close()
+}
+
+// hashFile returns the hex encoded SHA-256 digest of the file at path.
+func hashFile(path string) (string, error) {
+  file, err := os.Open(path)
+  if err != nil {
+    return "", err
+  }
+  defer file.Close()
+
+  h := sha256.New()
+  if _, err := io.Copy(h, file); err != nil {
+    return "", err
+  }
+  return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,73 @@
+package services
+
+import (
+  "context"
+  "elysium-backend/internal/models"
+  "elysium-backend/pkg/logger"
+  "time"
+
+  "github.com/google/uuid"
+)
+
+// BuildHistory runs builds and records each one, with its outcome and
+// provenance, so delivered binaries can be traced back to how they were
+// built. The compiler output of each build goes to logs.
+type BuildHistory struct {
+  store   Store
+  builder Builder
+  logs    *BuildLogs
+}
+
+func NewBuildHistory(store Store, builder Builder, logs *BuildLogs) *BuildHistory {
+  return &BuildHistory{store: store, builder: builder, logs: logs}
+}
+
+// Run assigns req an ID, builds it and records the build. The returned build
+// is recorded even when the build itself fails, in which case its error is
+// returned as well. Its output can be followed while it runs and is stored
+// once it finished.
+func (h *BuildHistory) Run(ctx context.Context, req BuildRequest) (*models.Build, *BuildResult, error) {
+  req.ID = uuid.New()
+  log := logger.FromContext(ctx).With("build_id", req.ID.String())
+
+  build := &models.Build{
+    ID:        req.ID,
+    Target:    req.Target,
+    Status:    models.BuildStatusRunning,
+    StartedAt: time.Now().UTC(),
+  }
+  if err := h.store.InsertBuild(ctx, build); err != nil {
+    return nil, nil, err
+  }
+
+  h.logs.Start(req.ID)
+  req.Output = func(line string) { h.logs.Append(req.ID, line) }
+  if req.Started != nil {
+    req.Started(build)
+  }
+  result, buildErr := h.builder.Build(logger.WithContext(ctx, log), req)
+
+  finishedAt := time.Now().UTC()
+  build.FinishedAt = &finishedAt
+  if buildErr != nil {
+    build.Status = models.BuildStatusFailed
+    build.Error = buildErr.Error()
+  } else {
+    build.Status = models.BuildStatusSucceeded
+    build.ArtifactPath = result.ArtifactPath
+    build.SHA256 = result.SHA256
+    build.Provenance = result.Provenance
+  }
+
+  // The outcome is stored even when the request was cancelled.
+  // Followers read the outcome once the output ends, so it is stored first.
+  finishErr := h.store.FinishBuild(context.WithoutCancel(ctx), build)
+  if finishErr != nil {
+    log.Error("failed to record build outcome", "err", finishErr)
+  }
+  h.logs.Finish(logger.WithContext(context.WithoutCancel(ctx), log), req.ID)
+  if finishErr != nil && buildErr == nil {
+    return build, result, finishErr
+  }
+  return build, result, buildErr
+}
@@ -0,0 +1,155 @@
+package services
+
+import (
+  "context"
+  "elysium-backend/internal/models"
+  "elysium-backend/pkg/logger"
+  "sync"
+  "time"
+
+  "github.com/google/uuid"
+)
+
+// BuildLogs collects the output of running builds in memory, fans it out to
+// followers as it is produced and stores it once the build has finished, so
+// it can still be read afterwards.
+type BuildLogs struct {
+  store Store
+
+  mu   sync.Mutex
+  live map[uuid.UUID]*buildLog
+}
+
+// buildLog is the output of a running build. changed is closed and replaced
+// whenever a line is added and when the build finishes.
+type buildLog struct {
+  lines   []models.BuildLogLine
+  changed chan struct{}
+  done    bool
+}
+
+func NewBuildLogs(store Store) *BuildLogs {
+  return &BuildLogs{store: store, live: make(map[uuid.UUID]*buildLog)}
+}
+
+// Start begins collecting the output of build id.
+func (l *BuildLogs) Start(id uuid.UUID) {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  l.live[id] = &buildLog{changed: make(chan struct{})}
+}
+
+// Append adds a line to the output of build id. Lines for builds that are
+// not running are dropped.
+func (l *BuildLogs) Append(id uuid.UUID, line string) {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+
+  build, ok := l.live[id]
+  if !ok || build.done {
+    return
+  }
+  build.lines = append(build.lines, models.BuildLogLine{
+    Seq:  len(build.lines) + 1,
+    Line: line,
+    Time: time.Now().UTC(),
+  })
+  close(build.changed)
+  build.changed = make(chan struct{})
+}
+
+// Finish stores the output of build id and ends it for its followers. The
+// output is kept in memory until it is stored, so followers joining in the
+// meantime still see all of it.
+func (l *BuildLogs) Finish(ctx context.Context, id uuid.UUID) error {
+  l.mu.Lock()
+  build, ok := l.live[id]
+  var lines []models.BuildLogLine
+  if ok {
+    lines = build.lines
+  }
+  l.mu.Unlock()
+  if !ok {
+    return nil
+  }
+
+  var err error
+  if len(lines) > 0 {
+    err = l.store.InsertBuildLogs(ctx, id, lines)
+    if err != nil {
+      logger.FromContext(ctx).Error("failed to store build output", "build_id", id.String(), "err", err)
+    }
+  }
+
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  build.done = true
+  close(build.changed)
+  delete(l.live, id)
+  return err
+}
+
+// Follow returns the output of build id after line afterSeq. For a running
+// build the channel receives new lines as they are produced and is closed
+// once the build finished; otherwise it holds the stored output and is
+// closed straight away. It is also closed when ctx is cancelled.
+func (l *BuildLogs) Follow(ctx context.Context, id uuid.UUID, afterSeq int) (<-chan models.BuildLogLine, error) {
+  l.mu.Lock()
+  build, ok := l.live[id]
+  l.mu.Unlock()
+
+  if !ok {
+    lines, err := l.store.ListBuildLogs(ctx, id, afterSeq)
+    if err != nil {
+      return nil, err
+    }
+    ch := make(chan models.BuildLogLine, len(lines))
+    for _, line := range lines {
+      ch <- line
+    }
+    close(ch)
+    return ch, nil
+  }
+
+  ch := make(chan models.BuildLogLine)
+  go func() {
+    defer close(ch)
+    next := afterSeq
+    for {
+      lines, changed, done := l.since(build, next)
+      for _, line := range lines {
+        select {
+        case ch <- line:
+          next = line.Seq
+        case <-ctx.Done():
+          return
+        }
+      }
+      if done {
+        return
+      }
+      select {
+      case <-changed:
+      case <-ctx.Done():
+        return
+      }
+    }
+  }()
+  return ch, nil
+}
+
+// since returns the lines of build after afterSeq, the channel closed on the
+// next change and whether the build has finished.
+func (l *BuildLogs) since(build *buildLog, afterSeq int) ([]models.BuildLogLine, <-chan struct{}, bool) {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+
+  var lines []models.BuildLogLine
+  if afterSeq < 0 {
+    afterSeq = 0
+  }
+  if afterSeq < len(build.lines) {
+    lines = build.lines[afterSeq:]
+  }
+  return lines, build.changed, build.done
+}
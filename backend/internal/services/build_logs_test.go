@@ -0,0 +1,104 @@
+package services
+
+import (
+  "context"
+  "elysium-backend/internal/models"
+  "testing"
+  "time"
+
+  "github.com/google/uuid"
+)
+
+// logStore only implements the build output methods of Store.
+type logStore struct {
+  Store
+  lines map[uuid.UUID][]models.BuildLogLine
+}
+
+func (s *logStore) InsertBuildLogs(ctx context.Context, buildID uuid.UUID, lines []models.BuildLogLine) error {
+  s.lines[buildID] = append(s.lines[buildID], lines...)
+  return nil
+}
+
+func (s *logStore) ListBuildLogs(ctx context.Context, buildID uuid.UUID, afterSeq int) ([]models.BuildLogLine, error) {
+  var lines []models.BuildLogLine
+  for _, line := range s.lines[buildID] {
+    if line.Seq > afterSeq {
+      lines = append(lines, line)
+    }
+  }
+  return lines, nil
+}
+
+func collect(t *testing.T, ch <-chan models.BuildLogLine) []string {
+  t.Helper()
+  var lines []string
+  timeout := time.After(time.Second)
+  for {
+    select {
+    case line, ok := <-ch:
+      if !ok {
+        return lines
+      }
+      lines = append(lines, line.Line)
+    case <-timeout:
+      t.Fatalf("build output did not end, got %q so far", lines)
+    }
+  }
+}
+
+func TestBuildLogsReplayAndFollow(t *testing.T) {
+  store := &logStore{lines: make(map[uuid.UUID][]models.BuildLogLine)}
+  logs := NewBuildLogs(store)
+  id := uuid.New()
+  ctx := context.Background()
+
+  logs.Start(id)
+  logs.Append(id, "Compiling a")
+
+  early, err := logs.Follow(ctx, id, 0)
+  if err != nil {
+    t.Fatalf("Follow failed: %v", err)
+  }
+  logs.Append(id, "Compiling b")
+  late, _ := logs.Follow(ctx, id, 0)
+  resumed, _ := logs.Follow(ctx, id, 1)
+  logs.Append(id, "Finished")
+
+  if err := logs.Finish(ctx, id); err != nil {
+    t.Fatalf("Finish failed: %v", err)
+  }
+  want := []string{"Compiling a", "Compiling b", "Finished"}
+  for name, ch := range map[string]<-chan models.BuildLogLine{"early": early, "late": late} {
+    if got := collect(t, ch); len(got) != 3 || got[0] != want[0] || got[2] != want[2] {
+      t.Errorf("expected the %s follower to see %q, got %q", name, want, got)
+    }
+  }
+  if got := collect(t, resumed); len(got) != 2 || got[0] != "Compiling b" {
+    t.Errorf("expected the output after line 1, got %q", got)
+  }
+
+  if stored := store.lines[id]; len(stored) != 3 || stored[2].Seq != 3 {
+    t.Errorf("expected the output to be stored, got %+v", stored)
+  }
+  after, _ := logs.Follow(ctx, id, 0)
+  if got := collect(t, after); len(got) != 3 {
+    t.Errorf("expected the stored output after the build, got %q", got)
+  }
+
+  logs.Append(id, "too late")
+  if len(store.lines[id]) != 3 {
+    t.Error("expected output of a finished build to be dropped")
+  }
+}
+
+func TestBuildLogsFollowStopsWithContext(t *testing.T) {
+  logs := NewBuildLogs(&logStore{lines: make(map[uuid.UUID][]models.BuildLogLine)})
+  id := uuid.New()
+  logs.Start(id)
+
+  ctx, cancel := context.WithCancel(context.Background())
+  ch, _ := logs.Follow(ctx, id, 0)
+  cancel()
+  collect(t, ch)
+}
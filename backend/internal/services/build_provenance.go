@@ -0,0 +1,124 @@
+package services
+
+import (
+  "context"
+  "elysium-backend/config"
+  "elysium-backend/internal/models"
+  "elysium-backend/pkg/logger"
+  "encoding/json"
+  "os"
+  "os/exec"
+  "strings"
+  "time"
+)
+
+// provenanceFile is stored next to each cached client and describes how it
+// was compiled.
+const provenanceFile = "provenance.json"
+
+// provenance describes the compilation of target from the sources hashed
+// to sourceHash. Information that cannot be determined, such as the git
+// state of sources outside a repository, is left empty.
+func (b *CargoBuilder) provenance(ctx context.Context, target config.TargetConfig, key, sourceHash string) *models.BuildProvenance {
+  env := b.compileEnv(target)
+  provenance := &models.BuildProvenance{
+    CacheKey:     key,
+    SourceSHA256: sourceHash,
+    Target:       models.OSArch(target.Triple),
+    CompileArgs:  b.cfg.CompileArgs,
+    Features:     cargoFeatures(b.cfg.CompileArgs),
+    Env:          redactEnv(append(b.toolchain.environ(), env...)),
+    CompiledAt:   time.Now().UTC(),
+  }
+  provenance.Backend, provenance.Image = b.toolchain.describe()
+  provenance.GitCommit, provenance.GitTree, provenance.GitDirty = gitState(ctx, b.cfg.ClientDir)
+
+  // Both versions come from a single invocation, since in a container each
+  // one is a container start. Output is kept even when one of them fails.
+  out, err := b.toolchain.command(ctx, env, "sh", "-c", "cargo --version; rustc --version").Output()
+  if err != nil {
+    logger.FromContext(ctx).Warn("unable to determine toolchain versions", "err", err)
+  }
+  for _, line := range strings.Split(string(out), "\n") {
+    switch {
+    case strings.HasPrefix(line, "cargo "):
+      provenance.CargoVersion = line
+    case strings.HasPrefix(line, "rustc "):
+      provenance.RustcVersion = line
+    }
+  }
+  return provenance
+}
+
+// gitState returns the commit checked out in the repository containing dir,
+// the hash of the tree for dir in that commit, and whether dir has
+// uncommitted changes.
+func gitState(ctx context.Context, dir string) (commit, tree string, dirty bool) {
+  git := func(args ...string) string {
+    out, err := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...).Output()
+    if err != nil {
+      return ""
+    }
+    return strings.TrimSpace(string(out))
+  }
+
+  commit = git("rev-parse", "HEAD")
+  if commit == "" {
+    return "", "", false
+  }
+  tree = git("rev-parse", "HEAD:./")
+  dirty = git("status", "--porcelain", "--", ".") != ""
+  return commit, tree, dirty
+}
+
+// cargoFeatures returns the feature selection in cargo arguments.
+func cargoFeatures(args []string) []string {
+  var features []string
+  add := func(list string) {
+    for _, feature := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ' ' }) {
+      features = append(features, feature)
+    }
+  }
+
+  for i, arg := range args {
+    switch {
+    case (arg == "--features" || arg == "-F") && i+1 < len(args):
+      add(args[i+1])
+    case strings.HasPrefix(arg, "--features="):
+      add(strings.TrimPrefix(arg, "--features="))
+    case arg == "--all-features" || arg == "--no-default-features":
+      features = append(features, arg)
+    }
+  }
+  return features
+}
+
+// redactEnv turns KEY=VALUE pairs into a map, hiding the values of secrets.
+func redactEnv(env []string) map[string]string {
+  redacted := make(map[string]string)
+  for _, entry := range env {
+    key, value, _ := strings.Cut(entry, "=")
+    redacted[key] = config.Redact(key, value)
+  }
+  return redacted
+}
+
+func readProvenance(path string) (*models.BuildProvenance, error) {
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  provenance := &models.BuildProvenance{}
+  if err := json.Unmarshal(data, provenance); err != nil {
+    return nil, err
+  }
+  return provenance, nil
+}
+
+func writeProvenance(path string, provenance *models.BuildProvenance) error {
+  data, err := json.MarshalIndent(provenance, "", "  ")
+  if err != nil {
+    return err
+  }
+  return os.WriteFile(path, data, 0o644)
+}
@@ -0,0 +1,314 @@
+package services
+
+import (
+  "bufio"
+  "context"
+  "crypto/ed25519"
+  "elysium-backend/config"
+  "elysium-backend/internal/metrics"
+  "elysium-backend/internal/models"
+  "elysium-backend/pkg/clientconfig"
+  "elysium-backend/pkg/logger"
+  "encoding/hex"
+  "fmt"
+  "net"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+
+  "github.com/google/uuid"
+)
+
+const (
+  defaultBuildTimeout = 15 * time.Minute
+  buildWaitDelay      = 5 * time.Second
+)
+
+// CargoBuilder compiles the Rust client with cargo once per target and
+// source revision, and packages a copy of the cached binary for each peer
+// with the peer's configuration appended as a signed payload. cargo runs on
+// the host or inside a container depending on the toolchain.
+type CargoBuilder struct {
+  cfg        config.BuildConfig
+  serverIP   net.IP
+  signingKey ed25519.PrivateKey
+  toolchain  toolchain
+  targets    *TargetRegistry
+  builds     *buildTracker
+  metrics    *metrics.Metrics
+
+  mu          sync.Mutex
+  targetLocks map[models.OSArch]*sync.Mutex
+}
+
+// NewBuilder returns the builder selected by cfg.Backend, recording its
+// builds in m.
+func NewBuilder(cfg config.BuildConfig, serverIP net.IP, signingKey ed25519.PrivateKey, targets *TargetRegistry, m *metrics.Metrics) Builder {
+  if cfg.Backend == config.BuildBackendContainer {
+    return NewContainerBuilder(cfg, serverIP, signingKey, targets, m)
+  }
+  return NewCargoBuilder(cfg, serverIP, signingKey, targets, m)
+}
+
+// NewCargoBuilder returns a builder running the cargo installed on the host
+// for the targets in the registry. The packaged configuration is signed with
+// signingKey; its public half is compiled into the client.
+func NewCargoBuilder(cfg config.BuildConfig, serverIP net.IP, signingKey ed25519.PrivateKey, targets *TargetRegistry, m *metrics.Metrics) *CargoBuilder {
+  return newCargoBuilder(cfg, serverIP, signingKey, targets, m, hostToolchain{clientDir: cfg.ClientDir})
+}
+
+// NewContainerBuilder returns a builder like NewCargoBuilder that runs cargo
+// inside cfg.ContainerImage, so the host only needs the container runtime.
+func NewContainerBuilder(cfg config.BuildConfig, serverIP net.IP, signingKey ed25519.PrivateKey, targets *TargetRegistry, m *metrics.Metrics) *CargoBuilder {
+  return newCargoBuilder(cfg, serverIP, signingKey, targets, m, containerToolchain{
+    runtime:   cfg.ContainerRuntime,
+    image:     cfg.ContainerImage,
+    clientDir: cfg.ClientDir,
+  })
+}
+
+func newCargoBuilder(cfg config.BuildConfig, serverIP net.IP, signingKey ed25519.PrivateKey, targets *TargetRegistry, m *metrics.Metrics, tc toolchain) *CargoBuilder {
+  if cfg.Timeout <= 0 {
+    cfg.Timeout = defaultBuildTimeout
+  }
+  return &CargoBuilder{
+    cfg:         cfg,
+    serverIP:    serverIP,
+    signingKey:  signingKey,
+    toolchain:   tc,
+    targets:     targets,
+    builds:      newBuildTracker(),
+    metrics:     m,
+    targetLocks: make(map[models.OSArch]*sync.Mutex),
+  }
+}
+
+// Shutdown stops new builds from starting and waits for running ones to
+// complete. Builds still running when ctx expires are killed.
+func (b *CargoBuilder) Shutdown(ctx context.Context) error {
+  return b.builds.shutdown(ctx)
+}
+
+func (b *CargoBuilder) binaryName(target config.TargetConfig) string {
+  return b.cfg.BinaryName + target.Suffix
+}
+
+// Build packages the client for req.Target, compiling it first when no
+// binary for the current client sources is cached. A compilation is
+// cancelled when ctx is, when it runs longer than the configured timeout, or
+// when shutdown gives up on it; the returned error then wraps
+// context.Canceled, context.DeadlineExceeded or ErrShuttingDown
+// respectively.
+func (b *CargoBuilder) Build(ctx context.Context, req BuildRequest) (*BuildResult, error) {
+  if req.ID == uuid.Nil {
+    req.ID = uuid.New()
+  }
+  log := logger.FromContext(ctx).With("build_id", req.ID.String(), "os_arch", string(req.Target))
+
+  target, err := b.targets.Lookup(req.Target)
+  if err != nil {
+    log.Error("invalid target", "err", err)
+    return nil, err
+  }
+
+  cached, provenance, logs, err := b.cachedBinary(logger.WithContext(ctx, log), target, req.Output)
+  if err != nil {
+    return nil, err
+  }
+
+  // The directory name is random so artifact paths cannot be guessed.
+  destPath := filepath.Join(b.cfg.OutputDir, uuid.NewString(), b.binaryName(target))
+  if err := os.MkdirAll(filepath.Dir(destPath), 0o755); err != nil {
+    log.Error("failed to create output directory", "err", err)
+    return nil, err
+  }
+  if err := copyFile(destPath, cached, 0o755); err != nil {
+    log.Error("failed to copy cached client", "err", err)
+    return nil, err
+  }
+  if err := clientconfig.Append(destPath, b.clientConfig(req), b.signingKey); err != nil {
+    log.Error("failed to append client configuration", "err", err)
+    os.RemoveAll(filepath.Dir(destPath))
+    return nil, err
+  }
+  digest, err := hashFile(destPath)
+  if err != nil {
+    log.Error("failed to hash client", "err", err)
+    os.RemoveAll(filepath.Dir(destPath))
+    return nil, err
+  }
+
+  relativePath, _ := filepath.Rel(b.cfg.OutputDir, destPath)
+  log.Info("client packaged", "artifact", relativePath, "sha256", digest)
+  return &BuildResult{ArtifactPath: relativePath, Logs: logs, SHA256: digest, Provenance: provenance}, nil
+}
+
+// clientConfig is the configuration appended to the client for req, under
+// the names the client's build script accepts as well, plus the build ID.
+func (b *CargoBuilder) clientConfig(req BuildRequest) map[string]string {
+  port := req.Bundle.ServerPort
+  if port == 0 {
+    port = 51820
+  }
+  values := map[string]string{
+    "ADDR":           req.Bundle.AssignedIP.String(),
+    "CIDR":           fmt.Sprint(24),
+    "SERVERPUB":      req.Bundle.PublicKey,
+    "SERVERENDPOINT": net.JoinHostPort("192.168.0.1", strconv.Itoa(port)),
+    "SERVERIP":       b.serverIP.String(),
+    "BUILDID":        req.ID.String(),
+  }
+  if req.Bundle.PresharedKey != "" {
+    values["PRESHAREDKEY"] = req.Bundle.PresharedKey
+  }
+  return values
+}
+
+func (b *CargoBuilder) targetLock(target config.TargetConfig) *sync.Mutex {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+
+  triple := models.OSArch(target.Triple)
+  lock, ok := b.targetLocks[triple]
+  if !ok {
+    lock = &sync.Mutex{}
+    b.targetLocks[triple] = lock
+  }
+  return lock
+}
+
+// cachedBinary returns the path and provenance of the cached client for
+// target, compiling it when the client sources changed since the last build,
+// along with the compiler output if it did. Concurrent requests for the same
+// target wait for a single compilation, whose output only goes to the
+// request that started it.
+func (b *CargoBuilder) cachedBinary(ctx context.Context, target config.TargetConfig, output func(string)) (string, *models.BuildProvenance, []string, error) {
+  log := logger.FromContext(ctx)
+
+  lock := b.targetLock(target)
+  lock.Lock()
+  defer lock.Unlock()
+
+  key, sources, err := b.cacheKey(target)
+  if err != nil {
+    log.Error("failed to hash client sources", "err", err)
+    return "", nil, nil, err
+  }
+
+  targetDir := filepath.Join(b.cfg.OutputDir, cacheDirName, target.Triple)
+  cachePath := filepath.Join(targetDir, key, b.binaryName(target))
+  provenancePath := filepath.Join(targetDir, key, provenanceFile)
+  if _, err := os.Stat(cachePath); err == nil {
+    if provenance, err := readProvenance(provenancePath); err == nil {
+      log.Info("using cached client build", "cache_key", key)
+      b.metrics.BuildCacheHit(target.Triple)
+      provenance.Cached = true
+      return cachePath, provenance, nil, nil
+    }
+  }
+
+  log.Info("no cached client build, compiling", "cache_key", key)
+  provenance := b.provenance(ctx, target, key, sources)
+  sourcePath, logs, err := b.compile(ctx, target, output)
+  if err != nil {
+    return "", nil, logs, err
+  }
+
+  if err := os.MkdirAll(filepath.Dir(cachePath), 0o755); err != nil {
+    log.Error("failed to create cache directory", "err", err)
+    return "", nil, logs, err
+  }
+  if err := os.Rename(sourcePath, cachePath); err != nil {
+    log.Error("failed to move executable", "err", err)
+    return "", nil, logs, err
+  }
+  if err := writeProvenance(provenancePath, provenance); err != nil {
+    log.Warn("failed to store build provenance, the build will not be reused", "err", err)
+  }
+  pruneCache(targetDir, key)
+  return cachePath, provenance, logs, nil
+}
+
+// compile runs cargo for target and returns the path of the binary it
+// produced together with cargo's output, which is also passed to output line
+// by line unless it is nil.
+func (b *CargoBuilder) compile(ctx context.Context, target config.TargetConfig, output func(string)) (sourcePath string, logs []string, err error) {
+  log := logger.FromContext(ctx)
+  log.Info("build started")
+  buildDone := b.metrics.BuildStarted(target.Triple)
+  defer func() { buildDone(err) }()
+
+  buildCtx, finished, err := b.builds.start(ctx)
+  if err != nil {
+    log.Warn("refusing to start build", "err", err)
+    return "", nil, err
+  }
+  defer finished()
+
+  buildCtx, cancel := context.WithTimeout(buildCtx, b.cfg.Timeout)
+  defer cancel()
+
+  args := append([]string{"build", "--release", "--target", target.Triple}, b.cfg.CompileArgs...)
+  cmd := b.toolchain.command(buildCtx, b.compileEnv(target), "cargo", args...)
+  // Stop waiting on pipes inherited by processes that survive the build.
+  cmd.WaitDelay = buildWaitDelay
+
+  stderr, _ := cmd.StderrPipe()
+  if err := cmd.Start(); err != nil {
+    log.Error("build command failed to start", "err", err)
+    return "", nil, err
+  }
+
+  scanner := bufio.NewScanner(stderr)
+  for scanner.Scan() {
+    logs = append(logs, scanner.Text())
+    log.Info("build output", "stream", "stderr", "line", scanner.Text())
+    if output != nil {
+      output(scanner.Text())
+    }
+  }
+
+  if err := cmd.Wait(); err != nil {
+    if cause := context.Cause(buildCtx); cause != nil {
+      log.Warn("build aborted", "cause", cause)
+      return "", logs, fmt.Errorf("build aborted: %w", cause)
+    }
+    log.Error("build command failed", "err", err)
+    return "", logs, err
+  }
+
+  log.Info("build finished")
+  return filepath.Join(b.cfg.ClientDir, "target", target.Triple, "release", b.binaryName(target)), logs, nil
+}
+
+// compileEnv returns the environment added to cargo's for target.
+func (b *CargoBuilder) compileEnv(target config.TargetConfig) []string {
+  return append(targetEnv(target), "CONFIGPUB="+hex.EncodeToString(b.signingKey.Public().(ed25519.PublicKey)))
+}
+
+// targetEnv returns the environment cargo needs for target: its extra
+// variables, sorted so the environment is stable, and RUSTFLAGS combining
+// the linker with the configured flags.
+func targetEnv(target config.TargetConfig) []string {
+  var env []string
+  for key, value := range target.Env {
+    env = append(env, key+"="+value)
+  }
+  sort.Strings(env)
+
+  var rustFlags []string
+  if target.Linker != "" {
+    rustFlags = append(rustFlags, "-C linker="+target.Linker)
+  }
+  if target.RustFlags != "" {
+    rustFlags = append(rustFlags, target.RustFlags)
+  }
+  if len(rustFlags) > 0 {
+    env = append(env, "RUSTFLAGS="+strings.Join(rustFlags, " "))
+  }
+  return env
+}
@@ -0,0 +1,318 @@
+package services
+
+import (
+  "context"
+  "crypto/ed25519"
+  "crypto/sha256"
+  "elysium-backend/config"
+  "elysium-backend/internal/metrics"
+  "elysium-backend/internal/models"
+  "elysium-backend/pkg/clientconfig"
+  "encoding/hex"
+  "net"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+// fakeCargo puts a cargo on PATH that records each run in the returned log
+// and writes a placeholder binary where cargo would.
+func fakeCargo(t *testing.T) (logPath string) {
+  t.Helper()
+  bin := t.TempDir()
+  logPath = filepath.Join(bin, "runs.log")
+  script := `#!/bin/sh
+if [ "$1" = --version ]; then
+  echo "cargo 1.0.0 (fake)"
+  exit 0
+fi
+echo "$4" >> "` + logPath + `"
+echo "   Compiling elysium-client ($4)" >&2
+mkdir -p "target/$4/release"
+env > "target/$4/env"
+printf 'client built with %s' "$CONFIGPUB" > "target/$4/release/elysium-client"
+`
+  if err := os.WriteFile(filepath.Join(bin, "cargo"), []byte(script), 0o755); err != nil {
+    t.Fatalf("failed to write fake cargo: %v", err)
+  }
+  t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+  return logPath
+}
+
+func TestCargoBuilderCachesBuildsAndAppendsConfig(t *testing.T) {
+  runs := fakeCargo(t)
+  clientDir, outputDir := t.TempDir(), t.TempDir()
+  os.WriteFile(filepath.Join(clientDir, "main.rs"), []byte("fn main() {}"), 0o644)
+
+  public, private, _ := ed25519.GenerateKey(nil)
+  builder := NewCargoBuilder(config.BuildConfig{
+    ClientDir:   clientDir,
+    BinaryName:  "elysium-client",
+    OutputDir:   outputDir,
+    CompileArgs: []string{"--features", "tun,metrics"},
+  }, net.ParseIP("10.0.0.1"), private, NewTargetRegistry([]config.TargetConfig{
+    {Triple: "aarch64-unknown-linux-musl", Env: map[string]string{"REGISTRY_TOKEN": "hunter2"}, Enabled: true},
+  }), metrics.New())
+
+  var results []*BuildResult
+  var output []string
+  build := func(ip string) string {
+    t.Helper()
+    result, err := builder.Build(context.Background(), BuildRequest{
+      Target: models.OSArch("aarch64-unknown-linux-musl"),
+      Bundle: ClientBundle{PublicKey: "server-key", AssignedIP: net.ParseIP(ip)},
+      Output: func(line string) { output = append(output, line) },
+    })
+    if err != nil {
+      t.Fatalf("Build failed: %v", err)
+    }
+    results = append(results, result)
+    return filepath.Join(outputDir, result.ArtifactPath)
+  }
+  cargoRuns := func() int {
+    data, _ := os.ReadFile(runs)
+    return strings.Count(string(data), "\n")
+  }
+
+  first, second := build("10.0.0.2"), build("10.0.0.3")
+  if cargoRuns() != 1 {
+    t.Fatalf("expected a single compilation for two peers, got %d", cargoRuns())
+  }
+  if first == second {
+    t.Fatal("expected every peer to get its own artifact")
+  }
+  if len(results[0].Logs) != 1 || !strings.Contains(results[0].Logs[0], "Compiling") || results[1].Logs != nil {
+    t.Errorf("expected compiler output for the compiling build only, got %q and %q", results[0].Logs, results[1].Logs)
+  }
+  if len(output) != 1 || output[0] != results[0].Logs[0] {
+    t.Errorf("expected the compiler output to be passed on as it was produced, got %q", output)
+  }
+  compiled, reused := results[0].Provenance, results[1].Provenance
+  if compiled.Cached || !reused.Cached || compiled.CacheKey != reused.CacheKey || !compiled.CompiledAt.Equal(reused.CompiledAt) {
+    t.Errorf("expected the second build to reuse the first compilation, got %+v and %+v", compiled, reused)
+  }
+  if compiled.CargoVersion != "cargo 1.0.0 (fake)" || compiled.Backend != config.BuildBackendCargo || len(compiled.SourceSHA256) != 64 {
+    t.Errorf("unexpected provenance %+v", compiled)
+  }
+  if len(compiled.Features) != 2 || compiled.Features[1] != "metrics" {
+    t.Errorf("expected the features from the compile arguments, got %q", compiled.Features)
+  }
+  if compiled.Env["REGISTRY_TOKEN"] != "[REDACTED]" || compiled.Env["CONFIGPUB"] == "" {
+    t.Errorf("expected the build environment with secrets redacted, got %v", compiled.Env)
+  }
+
+  data, _ := os.ReadFile(second)
+  values, err := clientconfig.Extract(data, public)
+  if err != nil {
+    t.Fatalf("expected a signed configuration payload: %v", err)
+  }
+  if values["ADDR"] != "10.0.0.3" || values["SERVERIP"] != "10.0.0.1" || values["SERVERPUB"] != "server-key" || values["BUILDID"] == "" {
+    t.Errorf("unexpected configuration %v", values)
+  }
+  if !strings.HasPrefix(string(data), "client built with ") {
+    t.Errorf("expected the cached binary to be copied, got %q", data)
+  }
+  if digest := sha256.Sum256(data); results[1].SHA256 != hex.EncodeToString(digest[:]) {
+    t.Errorf("expected the digest of the packaged artifact, got %s", results[1].SHA256)
+  }
+
+  os.WriteFile(filepath.Join(clientDir, "main.rs"), []byte("fn main() { println!(); }"), 0o644)
+  build("10.0.0.4")
+  if cargoRuns() != 2 {
+    t.Errorf("expected a source change to trigger a rebuild, got %d compilations", cargoRuns())
+  }
+  cached, _ := os.ReadDir(filepath.Join(outputDir, cacheDirName, string(models.OSArch("aarch64-unknown-linux-musl"))))
+  if len(cached) != 1 {
+    t.Errorf("expected the outdated build to be pruned, got %d cache entries", len(cached))
+  }
+}
+
+// fakeRuntime returns a container runtime that runs the command on the host
+// in the mounted directory with the passed environment, recording the image
+// and command line in the returned log.
+func fakeRuntime(t *testing.T) (runtime, logPath string) {
+  t.Helper()
+  bin := t.TempDir()
+  logPath = filepath.Join(bin, "containers.log")
+  script := `#!/bin/sh
+[ "$1" = run ] || exit 1
+shift
+while [ $# -gt 0 ]; do
+  case "$1" in
+    --rm|--userns=*) shift ;;
+    --name|-w|--user) shift 2 ;;
+    -v) dir="${2%:/src}"; shift 2 ;;
+    -e) export "$2"; shift 2 ;;
+    *) break ;;
+  esac
+done
+echo "$*" >> "` + logPath + `"
+shift
+cd "$dir" && exec "$@"
+`
+  runtime = filepath.Join(bin, "docker")
+  if err := os.WriteFile(runtime, []byte(script), 0o755); err != nil {
+    t.Fatalf("failed to write fake runtime: %v", err)
+  }
+  return runtime, logPath
+}
+
+func TestContainerBuilderRunsCargoInImage(t *testing.T) {
+  fakeCargo(t)
+  runtime, containers := fakeRuntime(t)
+  clientDir, outputDir := t.TempDir(), t.TempDir()
+  os.WriteFile(filepath.Join(clientDir, "main.rs"), []byte("fn main() {}"), 0o644)
+
+  public, private, _ := ed25519.GenerateKey(nil)
+  builder := NewContainerBuilder(config.BuildConfig{
+    ClientDir:        clientDir,
+    BinaryName:       "elysium-client",
+    OutputDir:        outputDir,
+    ContainerRuntime: runtime,
+    ContainerImage:   "elysium-builder:test",
+  }, net.ParseIP("10.0.0.1"), private, NewTargetRegistry([]config.TargetConfig{
+    {Triple: "x86_64-unknown-linux-musl", Linker: "musl-gcc", RustFlags: "-C target-feature=+crt-static", Env: map[string]string{"CC": "musl-gcc"}, Enabled: true},
+  }), metrics.New())
+
+  result, err := builder.Build(context.Background(), BuildRequest{
+    Target: "x86_64-unknown-linux-musl",
+    Bundle: ClientBundle{PublicKey: "server-key", AssignedIP: net.ParseIP("10.0.0.2")},
+  })
+  if err != nil {
+    t.Fatalf("Build failed: %v", err)
+  }
+
+  runs, _ := os.ReadFile(containers)
+  if string(runs) != "elysium-builder:test sh -c cargo --version; rustc --version\nelysium-builder:test cargo build --release --target x86_64-unknown-linux-musl\n" {
+    t.Errorf("unexpected container runs %q", runs)
+  }
+  if env, _ := os.ReadFile(filepath.Join(clientDir, "target", "x86_64-unknown-linux-musl", "env")); !strings.Contains(string(env), "RUSTFLAGS=-C linker=musl-gcc -C target-feature=+crt-static") || !strings.Contains(string(env), "CC=musl-gcc") {
+    t.Errorf("expected the target environment to reach cargo, got %q", env)
+  }
+  data, _ := os.ReadFile(filepath.Join(outputDir, result.ArtifactPath))
+  if !strings.HasPrefix(string(data), "client built with "+hex.EncodeToString(public)) {
+    t.Errorf("expected the configuration key to be passed into the container, got %q", data)
+  }
+  if _, err := clientconfig.Extract(data, public); err != nil {
+    t.Errorf("expected a signed configuration payload: %v", err)
+  }
+  if len(result.Logs) != 1 {
+    t.Errorf("expected the compiler output from the container, got %q", result.Logs)
+  }
+  if result.Provenance.Backend != config.BuildBackendContainer || result.Provenance.Image != "elysium-builder:test" || result.Provenance.CargoVersion != "cargo 1.0.0 (fake)" {
+    t.Errorf("unexpected provenance %+v", result.Provenance)
+  }
+}
+
+func TestCheckToolchainMarksUnavailableTargets(t *testing.T) {
+  fakeCargo(t)
+  bin := t.TempDir()
+  rustup := "#!/bin/sh\necho aarch64-unknown-linux-musl\n"
+  os.WriteFile(filepath.Join(bin, "rustup"), []byte(rustup), 0o755)
+  t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+  targets := NewTargetRegistry([]config.TargetConfig{
+    {Triple: "aarch64-unknown-linux-musl", Enabled: true},
+    {Triple: "x86_64-unknown-linux-musl", Linker: "no-such-linker", Enabled: true},
+    {Triple: "x86_64-pc-windows-gnu"},
+  })
+  _, private, _ := ed25519.GenerateKey(nil)
+  builder := NewCargoBuilder(config.BuildConfig{ClientDir: t.TempDir()}, net.ParseIP("10.0.0.1"), private, targets, metrics.New())
+
+  if err := builder.CheckToolchain(context.Background()); err == nil {
+    t.Fatal("expected the missing target to be reported")
+  }
+  list := targets.List()
+  if len(list) != 2 || !list[0].Available || list[1].Available || len(list[1].Missing) != 2 {
+    t.Fatalf("unexpected targets %+v", list)
+  }
+  if _, err := targets.Lookup("x86_64-unknown-linux-musl"); err != ErrTargetUnavailable {
+    t.Errorf("expected an unavailable target, got %v", err)
+  }
+  if _, err := targets.Lookup("x86_64-pc-windows-gnu"); err != ErrUnknownTarget {
+    t.Errorf("expected a disabled target to be unknown, got %v", err)
+  }
+}
+
+func TestCheckToolchainMarksTargetsUnavailableWhenInspectFails(t *testing.T) {
+  fakeCargo(t)
+  bin := t.TempDir()
+  os.WriteFile(filepath.Join(bin, "rustup"), []byte("#!/bin/sh\necho broken >&2\nexit 1\n"), 0o755)
+  t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+  targets := NewTargetRegistry([]config.TargetConfig{
+    {Triple: "aarch64-unknown-linux-musl", Enabled: true},
+    {Triple: "x86_64-unknown-linux-musl", Enabled: true},
+  })
+  _, private, _ := ed25519.GenerateKey(nil)
+  builder := NewCargoBuilder(config.BuildConfig{ClientDir: t.TempDir()}, net.ParseIP("10.0.0.1"), private, targets, metrics.New())
+
+  if err := builder.CheckToolchain(context.Background()); err == nil {
+    t.Fatal("expected the failed inspection to be reported")
+  }
+  for _, target := range targets.List() {
+    if target.Available || len(target.Missing) != 1 || !strings.HasPrefix(target.Missing[0], "toolchain: ") {
+      t.Errorf("expected %s to be unavailable, got %+v", target.Triple, target)
+    }
+  }
+  if _, err := targets.Lookup("x86_64-unknown-linux-musl"); err != ErrTargetUnavailable {
+    t.Errorf("expected an unavailable target, got %v", err)
+  }
+}
+
+func TestGitState(t *testing.T) {
+  if _, err := exec.LookPath("git"); err != nil {
+    t.Skip("git is not installed")
+  }
+  repo := t.TempDir()
+  client := filepath.Join(repo, "client")
+  os.MkdirAll(client, 0o755)
+  os.WriteFile(filepath.Join(client, "main.rs"), []byte("fn main() {}"), 0o644)
+  for _, args := range [][]string{
+    {"init", "-q"},
+    {"add", "."},
+    {"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "initial"},
+  } {
+    if out, err := exec.Command("git", append([]string{"-C", repo}, args...)...).CombinedOutput(); err != nil {
+      t.Fatalf("git %v failed: %v: %s", args, err, out)
+    }
+  }
+
+  commit, tree, dirty := gitState(context.Background(), client)
+  if len(commit) != 40 || len(tree) != 40 || commit == tree || dirty {
+    t.Fatalf("unexpected git state %q %q %v", commit, tree, dirty)
+  }
+
+  os.WriteFile(filepath.Join(client, "main.rs"), []byte("fn main() { println!(); }"), 0o644)
+  if _, _, dirty := gitState(context.Background(), client); !dirty {
+    t.Error("expected uncommitted changes to be reported")
+  }
+  if commit, _, _ := gitState(context.Background(), t.TempDir()); commit != "" {
+    t.Errorf("expected no commit outside a repository, got %q", commit)
+  }
+}
+
+func TestHashClientDirIgnoresBuildOutput(t *testing.T) {
+  dir := t.TempDir()
+  os.WriteFile(filepath.Join(dir, "Cargo.toml"), []byte("[package]"), 0o644)
+  before, err := hashClientDir(dir)
+  if err != nil {
+    t.Fatalf("hashClientDir failed: %v", err)
+  }
+
+  os.MkdirAll(filepath.Join(dir, "target", "release"), 0o755)
+  os.WriteFile(filepath.Join(dir, "target", "release", "elysium-client"), []byte("binary"), 0o755)
+  os.MkdirAll(filepath.Join(dir, ".git"), 0o755)
+  os.WriteFile(filepath.Join(dir, ".git", "HEAD"), []byte("ref"), 0o644)
+  after, _ := hashClientDir(dir)
+  if string(before) != string(after) {
+    t.Error("expected target and hidden directories to be ignored")
+  }
+
+  os.WriteFile(filepath.Join(dir, "build.rs"), []byte("fn main() {}"), 0o644)
+  if changed, _ := hashClientDir(dir); string(changed) == string(before) {
+    t.Error("expected a new source file to change the hash")
+  }
+}
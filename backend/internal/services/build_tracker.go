@@ -0,0 +1,80 @@
+package services
+
+import (
+  "context"
+  "errors"
+  "log/slog"
+  "sync"
+)
+
+var ErrShuttingDown = errors.New("server is shutting down")
+
+// buildTracker keeps count of running builds, or of the jobs running them,
+// so shutdown can wait for them to finish, and owns the context their
+// subprocesses are bound to so they can be killed once the shutdown deadline
+// passes.
+type buildTracker struct {
+  mu       sync.Mutex
+  wg       sync.WaitGroup
+  ctx      context.Context
+  cancel   context.CancelCauseFunc
+  draining bool
+}
+
+func newBuildTracker() *buildTracker {
+  ctx, cancel := context.WithCancelCause(context.Background())
+  return &buildTracker{ctx: ctx, cancel: cancel}
+}
+
+// start registers a new build bound to parent. The returned context is
+// cancelled when parent is, or when shutdown has to abort running builds, in
+// which case context.Cause reports ErrShuttingDown. done must be called once
+// the build has finished.
+func (t *buildTracker) start(parent context.Context) (context.Context, func(), error) {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+
+  if t.draining {
+    return nil, nil, ErrShuttingDown
+  }
+  t.wg.Add(1)
+
+  ctx, cancel := context.WithCancelCause(parent)
+  stop := context.AfterFunc(t.ctx, func() { cancel(context.Cause(t.ctx)) })
+  done := func() {
+    stop()
+    cancel(nil)
+    t.wg.Done()
+  }
+  return ctx, done, nil
+}
+
+// stopping reports whether shutdown has begun, so long running jobs can stop
+// before starting their next build.
+func (t *buildTracker) stopping() bool {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  return t.draining
+}
+
+func (t *buildTracker) shutdown(ctx context.Context) error {
+  t.mu.Lock()
+  t.draining = true
+  t.mu.Unlock()
+
+  done := make(chan struct{})
+  go func() {
+    t.wg.Wait()
+    close(done)
+  }()
+
+  select {
+  case <-done:
+    return nil
+  case <-ctx.Done():
+    slog.Warn("shutdown deadline reached, cancelling running builds")
+    t.cancel(ErrShuttingDown)
+    <-done
+    return ctx.Err()
+  }
+}
@@ -0,0 +1,74 @@
+package services
+
+import (
+  "context"
+  "errors"
+  "testing"
+  "time"
+)
+
+func TestBuildTrackerWaitsForRunningBuilds(t *testing.T) {
+  tracker := newBuildTracker()
+
+  buildCtx, done, err := tracker.start(context.Background())
+  if err != nil {
+    t.Fatalf("start failed: %v", err)
+  }
+
+  go func() {
+    time.Sleep(20 * time.Millisecond)
+    done()
+  }()
+
+  if err := tracker.shutdown(context.Background()); err != nil {
+    t.Fatalf("expected clean shutdown, got %v", err)
+  }
+  if errors.Is(context.Cause(buildCtx), ErrShuttingDown) {
+    t.Error("expected finished build not to be cancelled by shutdown")
+  }
+
+  if _, _, err := tracker.start(context.Background()); !errors.Is(err, ErrShuttingDown) {
+    t.Errorf("expected ErrShuttingDown after shutdown, got %v", err)
+  }
+}
+
+func TestBuildTrackerCancelsAfterDeadline(t *testing.T) {
+  tracker := newBuildTracker()
+
+  buildCtx, done, err := tracker.start(context.Background())
+  if err != nil {
+    t.Fatalf("start failed: %v", err)
+  }
+
+  go func() {
+    <-buildCtx.Done()
+    done()
+  }()
+
+  ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+  defer cancel()
+
+  if err := tracker.shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+    t.Fatalf("expected deadline exceeded, got %v", err)
+  }
+  if !errors.Is(context.Cause(buildCtx), ErrShuttingDown) {
+    t.Errorf("expected running build to be cancelled with ErrShuttingDown, got %v", context.Cause(buildCtx))
+  }
+}
+
+func TestBuildTrackerFollowsParentContext(t *testing.T) {
+  tracker := newBuildTracker()
+
+  parent, cancel := context.WithCancel(context.Background())
+  buildCtx, done, err := tracker.start(parent)
+  if err != nil {
+    t.Fatalf("start failed: %v", err)
+  }
+  defer done()
+
+  cancel()
+  <-buildCtx.Done()
+  if !errors.Is(buildCtx.Err(), context.Canceled) {
+    t.Errorf("expected build to be cancelled with its parent, got %v", buildCtx.Err())
+  }
+}
@@ -0,0 +1,578 @@
+package services
+
+import (
+  "archive/zip"
+  "context"
+  "database/sql"
+  "elysium-backend/config"
+  "elysium-backend/internal/audit"
+  "elysium-backend/internal/models"
+  "elysium-backend/pkg/logger"
+  "elysium-backend/pkg/wgutil"
+  "encoding/csv"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "net"
+  "os"
+  "path"
+  "path/filepath"
+  "regexp"
+  "strings"
+  "time"
+
+  "github.com/google/uuid"
+)
+
+// MaxBulkPeers is the largest number of peers a single bulk request may
+// provision.
+const MaxBulkPeers = 500
+
+// bulkCSVColumns are the columns a bulk CSV may have. name and target are
+// required.
+var bulkCSVColumns = map[string]bool{"name": true, "owner": true, "target": true, "tags": true, "ip": true, "public_key": true}
+
+// bulkNamePattern restricts peer names to what is safe as a directory name
+// in the bundle.
+var bulkNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// ParseBulkCSV reads peers from CSV whose header row names the columns:
+// name, owner, target, tags, ip and public_key. Tags are separated by
+// semicolons.
+func ParseBulkCSV(r io.Reader) ([]models.BulkPeer, error) {
+  reader := csv.NewReader(r)
+  reader.TrimLeadingSpace = true
+
+  header, err := reader.Read()
+  if errors.Is(err, io.EOF) {
+    return nil, nil
+  } else if err != nil {
+    return nil, err
+  }
+  columns := make(map[string]int, len(header))
+  for i, name := range header {
+    name = strings.ToLower(strings.TrimSpace(name))
+    if !bulkCSVColumns[name] {
+      return nil, fmt.Errorf("unknown column %q", name)
+    }
+    columns[name] = i
+  }
+  for _, required := range []string{"name", "target"} {
+    if _, ok := columns[required]; !ok {
+      return nil, fmt.Errorf("missing column %q", required)
+    }
+  }
+
+  var peers []models.BulkPeer
+  for {
+    record, err := reader.Read()
+    if errors.Is(err, io.EOF) {
+      return peers, nil
+    } else if err != nil {
+      return nil, err
+    }
+    field := func(name string) string {
+      if i, ok := columns[name]; ok {
+        return strings.TrimSpace(record[i])
+      }
+      return ""
+    }
+    peers = append(peers, models.BulkPeer{
+      Name:      field("name"),
+      Owner:     field("owner"),
+      Target:    models.OSArch(field("target")),
+      Tags:      strings.Split(field("tags"), ";"),
+      IP:        field("ip"),
+      PublicKey: field("public_key"),
+    })
+  }
+}
+
+// BulkProvisioner creates peers in batches: the whole batch is validated and
+// its addresses taken at once, then a client is built for each peer in turn.
+type BulkProvisioner struct {
+  store     Store
+  allocator Allocator
+  targets   *TargetRegistry
+  ranges    []config.Ip_Range
+  builds    *BuildHistory
+  artifacts *ArtifactStore
+  psks      *PresharedKeys
+  devices   *DevicePeers
+  endpoints *ClientEndpoints
+  jobs      *buildTracker
+}
+
+func NewBulkProvisioner(store Store, allocator Allocator, targets *TargetRegistry, ranges []config.Ip_Range, builds *BuildHistory, artifacts *ArtifactStore, psks *PresharedKeys, devices *DevicePeers, endpoints *ClientEndpoints) *BulkProvisioner {
+  return &BulkProvisioner{
+    store:     store,
+    allocator: allocator,
+    targets:   targets,
+    ranges:    ranges,
+    builds:    builds,
+    artifacts: artifacts,
+    psks:      psks,
+    devices:   devices,
+    endpoints: endpoints,
+    jobs:      newBuildTracker(),
+  }
+}
+
+// Create validates peers as a whole and, when every entry is valid, stores
+// them with their addresses and a job with one item per peer. Invalid
+// entries are reported in the returned errors and nothing is stored. The
+// job still has to be run.
+func (p *BulkProvisioner) Create(ctx context.Context, peers []models.BulkPeer) (*models.BulkJob, []models.BulkError, error) {
+  log := logger.FromContext(ctx)
+
+  if len(peers) == 0 {
+    return nil, []models.BulkError{{Error: "no peers given"}}, nil
+  }
+  if len(peers) > MaxBulkPeers {
+    return nil, []models.BulkError{{Error: fmt.Sprintf("at most %d peers can be provisioned at once", MaxBulkPeers)}}, nil
+  }
+
+  // The addresses checked and allocated here stay free until the batch is
+  // stored.
+  p.allocator.Lock()
+  defer p.allocator.Unlock()
+
+  invalid, err := p.validate(ctx, peers)
+  if err != nil || len(invalid) > 0 {
+    return nil, invalid, err
+  }
+
+  now := time.Now().UTC()
+  job := &models.BulkJob{ID: uuid.New(), Status: models.BulkJobStatusRunning, CreatedAt: now}
+  newPeers := make([]*models.Peer, len(peers))
+  taken := make(map[string]bool)
+  for _, peer := range peers {
+    if peer.IP != "" {
+      taken[net.ParseIP(peer.IP).To4().String()] = true
+    }
+  }
+
+  for i, peer := range peers {
+    newPeer := &models.Peer{
+      PublicKey: peer.PublicKey,
+      Status:    models.PeerStatusPending,
+      // Distinct creation times keep the hash allocator from proposing the
+      // same address for every peer of the batch.
+      CreatedOn: now.Add(time.Duration(i) * time.Microsecond),
+      Metadata:  &map[string]interface{}{"name": peer.Name, "owner": peer.Owner, "tags": peer.Tags, "bulk_job_id": job.ID.String()},
+    }
+    if peer.IP != "" {
+      newPeer.AssignedIP = net.ParseIP(peer.IP).To4()
+    } else if err := p.allocate(ctx, newPeer, taken); err != nil {
+      log.Error("unable to assign IP", "err", err)
+      return nil, nil, err
+    }
+    if _, err := p.psks.ForNewPeer(newPeer); err != nil {
+      return nil, nil, err
+    }
+    newPeers[i] = newPeer
+
+    job.Items = append(job.Items, models.BulkJobItem{
+      Seq:        i + 1,
+      Name:       peer.Name,
+      Owner:      peer.Owner,
+      Target:     peer.Target,
+      Tags:       peer.Tags,
+      PublicKey:  peer.PublicKey,
+      AssignedIP: newPeer.AssignedIP,
+      Status:     models.BulkItemStatusPending,
+    })
+  }
+
+  if err := p.store.InsertBulkJob(ctx, job, newPeers); err != nil {
+    return nil, nil, err
+  }
+  log.Info("bulk job created", "job_id", job.ID.String(), "peers", len(newPeers))
+  for _, peer := range newPeers {
+    audit.Record(ctx, p.store, "peer.create", peer.ID.String(), nil, peer)
+  }
+  return job, nil, nil
+}
+
+// validate checks every entry and normalises its tags.
+func (p *BulkProvisioner) validate(ctx context.Context, peers []models.BulkPeer) ([]models.BulkError, error) {
+  var invalid []models.BulkError
+  names := make(map[string]int)
+  keys := make(map[string]int)
+  ips := make(map[string]int)
+  // assigned holds the public keys of the existing peers, loaded when the
+  // first row with a key is checked.
+  var assigned map[string]bool
+
+  for i := range peers {
+    peer := &peers[i]
+    row := i + 1
+    fail := func(format string, args ...any) {
+      invalid = append(invalid, models.BulkError{Row: row, Error: fmt.Sprintf(format, args...)})
+    }
+
+    var tags []string
+    for _, tag := range peer.Tags {
+      if tag = strings.TrimSpace(tag); tag != "" {
+        tags = append(tags, tag)
+      }
+    }
+    peer.Tags = tags
+
+    if !bulkNamePattern.MatchString(peer.Name) {
+      fail("name must be 1 to 64 letters, digits, dots, dashes or underscores")
+    } else if first, ok := names[peer.Name]; ok {
+      fail("name %q is already used in row %d", peer.Name, first)
+    } else {
+      names[peer.Name] = row
+    }
+
+    if _, err := p.targets.Lookup(peer.Target); err != nil {
+      fail("%v", err)
+    }
+
+    if peer.PublicKey != "" {
+      if assigned == nil {
+        existing, err := p.store.GetAllPeer(ctx)
+        if err != nil {
+          return nil, err
+        }
+        assigned = make(map[string]bool, len(existing))
+        for _, peer := range existing {
+          assigned[peer.PublicKey] = true
+        }
+      }
+      if err := wgutil.ValidateKey(peer.PublicKey); err != nil {
+        fail("public_key is not a WireGuard key")
+      } else if first, ok := keys[peer.PublicKey]; ok {
+        fail("public_key is already used in row %d", first)
+      } else if assigned[peer.PublicKey] {
+        fail("public_key is already assigned to a peer")
+      } else {
+        keys[peer.PublicKey] = row
+      }
+    }
+
+    if peer.IP == "" {
+      continue
+    }
+    ip := net.ParseIP(peer.IP).To4()
+    if ip == nil {
+      fail("ip %q is not an IPv4 address", peer.IP)
+      continue
+    }
+    if first, ok := ips[ip.String()]; ok {
+      fail("ip %s is already used in row %d", ip, first)
+      continue
+    }
+    ips[ip.String()] = row
+    if !p.inRange(ip) {
+      fail("ip %s is outside the configured ranges", ip)
+      continue
+    }
+    available, err := p.store.IsIpAvailable(ctx, ip)
+    if err != nil {
+      return nil, err
+    }
+    if !available {
+      fail("ip %s is already assigned", ip)
+    }
+  }
+  return invalid, nil
+}
+
+func (p *BulkProvisioner) inRange(ip net.IP) bool {
+  for _, r := range p.ranges {
+    if r.Contains(ip) {
+      return true
+    }
+  }
+  return false
+}
+
+// allocate picks an address for peer that is neither assigned nor in taken,
+// and adds it to taken.
+func (p *BulkProvisioner) allocate(ctx context.Context, peer *models.Peer, taken map[string]bool) error {
+  for retry := 0; retry < 100; retry++ {
+    if err := p.allocator.Allocate(ctx, peer); err != nil {
+      return err
+    }
+    if ip := peer.AssignedIP.String(); !taken[ip] {
+      taken[ip] = true
+      return nil
+    }
+    peer.CreatedOn = peer.CreatedOn.Add(time.Millisecond)
+  }
+  return fmt.Errorf("no available IP for the batch after 100 retries")
+}
+
+// Start runs job in the background, detached from ctx, until it completes
+// or Shutdown interrupts it. It fails with ErrShuttingDown once Shutdown has
+// been called; the job is then left running and resumed on the next start.
+func (p *BulkProvisioner) Start(ctx context.Context, job *models.BulkJob) error {
+  runCtx, done, err := p.jobs.start(context.WithoutCancel(ctx))
+  if err != nil {
+    return err
+  }
+  go func() {
+    defer done()
+    p.Run(runCtx, job)
+  }()
+  return nil
+}
+
+// Resume starts the jobs left running by an earlier process, building the
+// items that did not finish.
+func (p *BulkProvisioner) Resume(ctx context.Context) error {
+  ids, err := p.store.ListBulkJobIDs(ctx, models.BulkJobStatusRunning)
+  if err != nil {
+    return err
+  }
+  for _, id := range ids {
+    job, err := p.store.GetBulkJob(ctx, id)
+    if err != nil {
+      return err
+    }
+    logger.FromContext(ctx).Info("resuming bulk job", "job_id", id.String())
+    if err := p.Start(ctx, job); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// Shutdown stops running jobs after their current item and waits for them
+// until ctx expires, when their builds are cancelled. Interrupted jobs stay
+// running and are resumed on the next start.
+func (p *BulkProvisioner) Shutdown(ctx context.Context) error {
+  return p.jobs.shutdown(ctx)
+}
+
+// Run builds a client for every unfinished item of job in turn and records
+// the outcome. The peer of an item whose build fails is deleted again,
+// freeing its address.
+func (p *BulkProvisioner) Run(ctx context.Context, job *models.BulkJob) {
+  log := logger.FromContext(ctx).With("job_id", job.ID.String())
+
+  for i := range job.Items {
+    item := &job.Items[i]
+    if item.Status == models.BulkItemStatusSucceeded || item.Status == models.BulkItemStatusFailed {
+      continue
+    }
+    if p.jobs.stopping() || ctx.Err() != nil {
+      log.Info("bulk job interrupted", "next_seq", item.Seq)
+      return
+    }
+    p.runItem(logger.WithContext(ctx, log.With("seq", item.Seq)), job.ID, item)
+  }
+
+  finishedAt := time.Now().UTC()
+  job.Status = models.BulkJobStatusCompleted
+  job.FinishedAt = &finishedAt
+  if err := p.store.FinishBulkJob(ctx, job); err != nil {
+    log.Error("failed to record bulk job outcome", "err", err)
+    return
+  }
+  log.Info("bulk job completed")
+}
+
+func (p *BulkProvisioner) runItem(ctx context.Context, jobID uuid.UUID, item *models.BulkJobItem) {
+  log := logger.FromContext(ctx)
+
+  item.Status = models.BulkItemStatusRunning
+  if err := p.store.UpdateBulkJobItem(ctx, jobID, item); err != nil {
+    log.Error("failed to record bulk job progress", "err", err)
+  }
+
+  err := p.build(ctx, item)
+  if err != nil && ctx.Err() != nil {
+    // Cancelled by shutdown: the item is built again when the job resumes.
+    log.Warn("bulk peer interrupted", "peer_id", item.PeerID.String(), "err", err)
+    item.Status = models.BulkItemStatusPending
+    if err := p.store.UpdateBulkJobItem(context.WithoutCancel(ctx), jobID, item); err != nil {
+      log.Error("failed to record bulk job progress", "err", err)
+    }
+    return
+  }
+  if err != nil {
+    log.Error("bulk peer failed", "peer_id", item.PeerID.String(), "err", err)
+    item.Status = models.BulkItemStatusFailed
+    item.Error = err.Error()
+    p.removePeer(ctx, *item.PeerID)
+  } else {
+    log.Info("bulk peer provisioned", "peer_id", item.PeerID.String())
+    item.Status = models.BulkItemStatusSucceeded
+  }
+
+  if err := p.store.UpdateBulkJobItem(ctx, jobID, item); err != nil {
+    log.Error("failed to record bulk job progress", "err", err)
+  }
+}
+
+func (p *BulkProvisioner) build(ctx context.Context, item *models.BulkJobItem) error {
+  presharedKey, err := p.psks.Lookup(ctx, *item.PeerID)
+  if err != nil {
+    return err
+  }
+  // The client is built again when the server key it was built for is
+  // discarded meanwhile.
+  for {
+    endpoint, err := p.endpoints.Resolve(ctx)
+    if err != nil {
+      return err
+    }
+
+    build, _, err := p.builds.Run(ctx, BuildRequest{
+      Target: item.Target,
+      Bundle: ClientBundle{PublicKey: endpoint.PublicKey, AssignedIP: item.AssignedIP, ServerPort: endpoint.Port, PresharedKey: presharedKey},
+    })
+    if build != nil {
+      item.BuildID = &build.ID
+    }
+    if err != nil {
+      return err
+    }
+
+    artifact, err := p.artifacts.Record(ctx, *item.PeerID, build)
+    if err != nil {
+      return err
+    }
+    item.ArtifactID = &artifact.ID
+
+    if err := p.devices.Add(ctx, &models.Peer{ID: item.PeerID, PublicKey: item.PublicKey, AssignedIP: item.AssignedIP}, presharedKey); err != nil {
+      return err
+    }
+    err = p.endpoints.Track(ctx, endpoint, models.KeyRotationPeer{
+      PeerID:     *item.PeerID,
+      PublicKey:  item.PublicKey,
+      AssignedIP: item.AssignedIP,
+      Target:     item.Target,
+      BuildID:    item.BuildID,
+      ArtifactID: item.ArtifactID,
+    })
+    if !errors.Is(err, ErrEndpointChanged) {
+      return err
+    }
+  }
+}
+
+func (p *BulkProvisioner) removePeer(ctx context.Context, id uuid.UUID) {
+  before, err := p.store.GetPeer(ctx, id)
+  if err == nil {
+    err = p.store.DeletePeer(ctx, id)
+  }
+  if err != nil {
+    logger.FromContext(ctx).Error("failed to remove peer of failed build", "peer_id", id.String(), "err", err)
+    return
+  }
+  audit.Record(ctx, p.store, "peer.delete", id.String(), before, nil)
+}
+
+// bulkPeerConfig is the description of a provisioned peer in the bundle.
+type bulkPeerConfig struct {
+  PeerID     uuid.UUID     `json:"peer_id"`
+  Name       string        `json:"name"`
+  Owner      string        `json:"owner,omitempty"`
+  Tags       []string      `json:"tags,omitempty"`
+  AssignedIP net.IP        `json:"assigned_ip"`
+  Target     models.OSArch `json:"target"`
+  BuildID    uuid.UUID     `json:"build_id"`
+  Binary     string        `json:"binary"`
+  SHA256     string        `json:"sha256"`
+  Signature  string        `json:"signature"`
+}
+
+// WriteBundle writes a ZIP archive of the peers job provisioned to w: the
+// job itself as manifest.json and, in a directory per peer named after it,
+// the client binary, its detached signature and the peer's configuration as
+// peer.json. Peers whose artifact has been collected in the meantime are
+// only listed in the manifest.
+func (p *BulkProvisioner) WriteBundle(ctx context.Context, w io.Writer, job *models.BulkJob) error {
+  log := logger.FromContext(ctx).With("job_id", job.ID.String())
+  archive := zip.NewWriter(w)
+
+  manifest, err := archive.Create("manifest.json")
+  if err != nil {
+    return err
+  }
+  encoder := json.NewEncoder(manifest)
+  encoder.SetIndent("", "  ")
+  if err := encoder.Encode(job); err != nil {
+    return err
+  }
+
+  for _, item := range job.Items {
+    if item.Status != models.BulkItemStatusSucceeded || item.ArtifactID == nil {
+      continue
+    }
+    artifact, err := p.store.GetArtifact(ctx, *item.ArtifactID)
+    if errors.Is(err, sql.ErrNoRows) {
+      log.Warn("artifact of bulk peer is gone, leaving it out of the bundle", "seq", item.Seq)
+      continue
+    } else if err != nil {
+      return err
+    }
+
+    binary := filepath.Base(artifact.Path)
+    files := []struct{ name, path string }{
+      {binary, p.artifacts.Path(artifact)},
+      {binary + SignatureSuffix, p.artifacts.Path(artifact) + SignatureSuffix},
+    }
+    for _, file := range files {
+      if err := addFile(archive, path.Join(item.Name, file.name), file.path); err != nil {
+        return err
+      }
+    }
+
+    config, err := archive.Create(path.Join(item.Name, "peer.json"))
+    if err != nil {
+      return err
+    }
+    encoder := json.NewEncoder(config)
+    encoder.SetIndent("", "  ")
+    if err := encoder.Encode(bulkPeerConfig{
+      PeerID:     *item.PeerID,
+      Name:       item.Name,
+      Owner:      item.Owner,
+      Tags:       item.Tags,
+      AssignedIP: item.AssignedIP,
+      Target:     item.Target,
+      BuildID:    *item.BuildID,
+      Binary:     binary,
+      SHA256:     artifact.SHA256,
+      Signature:  artifact.Signature,
+    }); err != nil {
+      return err
+    }
+  }
+  return archive.Close()
+}
+
+// addFile copies the file at src into archive as name, keeping its mode so
+// binaries stay executable once extracted.
+func addFile(archive *zip.Writer, name, src string) error {
+  file, err := os.Open(src)
+  if err != nil {
+    return err
+  }
+  defer file.Close()
+
+  info, err := file.Stat()
+  if err != nil {
+    return err
+  }
+  header, err := zip.FileInfoHeader(info)
+  if err != nil {
+    return err
+  }
+  header.Name = name
+  header.Method = zip.Deflate
+
+  dest, err := archive.CreateHeader(header)
+  if err != nil {
+    return err
+  }
+  _, err = io.Copy(dest, file)
+  return err
+}
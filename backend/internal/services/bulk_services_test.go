@@ -0,0 +1,22 @@
+package services
+
+import (
+  "strings"
+  "testing"
+)
+
+func TestParseBulkCSV(t *testing.T) {
+  peers, err := ParseBulkCSV(strings.NewReader("Target, name, tags\nx86_64-unknown-linux-musl, laptop, dev; ops\n"))
+  if err != nil {
+    t.Fatalf("ParseBulkCSV failed: %v", err)
+  }
+  if len(peers) != 1 || peers[0].Name != "laptop" || peers[0].Target != "x86_64-unknown-linux-musl" || len(peers[0].Tags) != 2 {
+    t.Errorf("unexpected peers %+v", peers)
+  }
+
+  for _, input := range []string{"name,colour\nx,red\n", "owner\nalice\n", "name,target\n\"unterminated\n"} {
+    if _, err := ParseBulkCSV(strings.NewReader(input)); err == nil {
+      t.Errorf("expected %q to be rejected", input)
+    }
+  }
+}
@@ -0,0 +1,109 @@
+package services
+
+import (
+  "context"
+  "elysium-backend/config"
+  "fmt"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "strings"
+  "syscall"
+  "time"
+
+  "github.com/google/uuid"
+)
+
+// containerMountPath is where the client sources are mounted inside the
+// build container. Output lands in the mounted target directory, so the
+// compiled client ends up at the same host path as a host build.
+const containerMountPath = "/src"
+
+// containerKillTimeout bounds how long killing a cancelled build container
+// may take.
+const containerKillTimeout = 10 * time.Second
+
+// containerToolchain runs cargo and rustup inside image through a docker
+// compatible runtime such as docker or podman.
+type containerToolchain struct {
+  runtime   string
+  image     string
+  clientDir string
+}
+
+// runArgs returns the arguments to the runtime for running name in a
+// container called container.
+func (c containerToolchain) runArgs(container string, env []string, name string, args []string) []string {
+  clientDir, err := filepath.Abs(c.clientDir)
+  if err != nil {
+    clientDir = c.clientDir
+  }
+
+  runArgs := []string{"run", "--rm", "--name", container,
+    "-v", clientDir + ":" + containerMountPath, "-w", containerMountPath,
+    // Keep downloaded crates between builds; the target directory is not
+    // part of the source hash.
+    "-e", "CARGO_HOME=" + containerMountPath + "/target/cargo-home",
+  }
+  // Files written to the mount must belong to the backend's user so they
+  // can be moved into the cache.
+  if filepath.Base(c.runtime) == "podman" {
+    runArgs = append(runArgs, "--userns=keep-id")
+  } else {
+    runArgs = append(runArgs, "--user", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()))
+  }
+  for _, e := range env {
+    runArgs = append(runArgs, "-e", e)
+  }
+  runArgs = append(runArgs, c.image, name)
+  return append(runArgs, args...)
+}
+
+func (c containerToolchain) command(ctx context.Context, env []string, name string, args ...string) *exec.Cmd {
+  container := "elysium-build-" + uuid.NewString()
+  cmd := exec.CommandContext(ctx, c.runtime, c.runArgs(container, env, name, args)...)
+  cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+  // Killing the runtime client leaves the container running, so it is
+  // stopped through the runtime first.
+  cmd.Cancel = func() error {
+    killCtx, cancel := context.WithTimeout(context.Background(), containerKillTimeout)
+    defer cancel()
+    exec.CommandContext(killCtx, c.runtime, "kill", container).Run()
+    return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+  }
+  return cmd
+}
+
+// environ is empty: only the variables passed explicitly reach the
+// container.
+func (c containerToolchain) environ() []string {
+  return nil
+}
+
+func (c containerToolchain) describe() (string, string) {
+  return config.BuildBackendContainer, c.image
+}
+
+// inspect checks everything in a single container, since starting one is
+// the expensive part.
+func (c containerToolchain) inspect(ctx context.Context, programs []string) ([]string, []string, error) {
+  if _, err := exec.LookPath(c.runtime); err != nil {
+    return nil, nil, fmt.Errorf("container runtime not found: %w", err)
+  }
+
+  script := `for p in "$@"; do command -v "$p" >/dev/null || echo "missing:$p"; done; rustup target list --installed`
+  out, err := c.command(ctx, nil, "sh", append([]string{"-c", script, "sh"}, programs...)...).Output()
+  if err != nil {
+    return nil, nil, fmt.Errorf("unable to inspect build image %s: %w", c.image, err)
+  }
+
+  var targets, missing []string
+  for _, line := range strings.Fields(string(out)) {
+    if program, ok := strings.CutPrefix(line, "missing:"); ok {
+      missing = append(missing, program)
+    } else {
+      targets = append(targets, line)
+    }
+  }
+  return targets, missing, nil
+}
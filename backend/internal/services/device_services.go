@@ -0,0 +1,52 @@
+package services
+
+import (
+  "context"
+  "elysium-backend/internal/models"
+  "elysium-backend/pkg/logger"
+  "elysium-backend/pkg/wgutil"
+)
+
+// DevicePeers puts peers on the WireGuard interface as they are created, so
+// their clients connect right away rather than after the next reconcile.
+type DevicePeers struct {
+  wireGuard WireGuard
+}
+
+// NewDevicePeers returns the device peers manager. wireGuard may be nil
+// when the interface is not managed by this server; nothing is configured
+// then.
+func NewDevicePeers(wireGuard WireGuard) *DevicePeers {
+  return &DevicePeers{wireGuard: wireGuard}
+}
+
+// Add configures peer on the interface with its address and presharedKey,
+// its preshared key in plaintext or empty when it has none. A peer already
+// on the interface keeps its allowed IPs. During a key rotation the peer is
+// configured for the new key as well, so its migration can be seen. It does
+// nothing for a peer without a public key.
+func (d *DevicePeers) Add(ctx context.Context, peer *models.Peer, presharedKey string) error {
+  if d.wireGuard == nil || peer.PublicKey == "" {
+    return nil
+  }
+  log := logger.FromContext(ctx).With("peer_id", peer.ID.String())
+
+  current, err := d.wireGuard.Peers(ctx)
+  if err != nil {
+    log.Error("unable to list the peers of the interface", "err", err)
+    return err
+  }
+  added := wgutil.DevicePeer{PublicKey: peer.PublicKey, AllowedIPs: []string{peer.AssignedIP.String() + "/32"}, PresharedKey: presharedKey}
+  for _, have := range current {
+    if have.PublicKey == peer.PublicKey {
+      added.AllowedIPs = have.AllowedIPs
+      break
+    }
+  }
+  if err := d.wireGuard.ConfigurePeers(ctx, []wgutil.DevicePeer{added}, nil); err != nil {
+    log.Error("unable to add the peer to the interface", "err", err)
+    return err
+  }
+  log.Info("peer added to the interface", "preshared_key", presharedKey != "")
+  return nil
+}
@@ -0,0 +1,110 @@
+package services
+
+import (
+  "context"
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha256"
+  "elysium-backend/config"
+  "elysium-backend/internal/models"
+  "encoding/base64"
+  "encoding/hex"
+  "net/url"
+  "path"
+  "strconv"
+  "time"
+
+  "github.com/google/uuid"
+)
+
+// LinkSigner signs download URLs with HMAC-SHA256, so a link cannot be
+// forged or have its expiry extended without the server's key.
+type LinkSigner struct {
+  key []byte
+}
+
+// NewLinkSigner returns a signer using key. An empty key is replaced with a
+// random one, which invalidates all links when the process restarts.
+func NewLinkSigner(key []byte) *LinkSigner {
+  if len(key) == 0 {
+    key = make([]byte, 32)
+    if _, err := rand.Read(key); err != nil {
+      panic("reading random signing key: " + err.Error())
+    }
+  }
+  return &LinkSigner{key: key}
+}
+
+func (s *LinkSigner) mac(linkID, filename string, expires int64) []byte {
+  h := hmac.New(sha256.New, s.key)
+  h.Write([]byte(linkID + "\n" + filename + "\n" + strconv.FormatInt(expires, 10)))
+  return h.Sum(nil)
+}
+
+// Sign returns the signature for downloading filename through linkID until
+// expires.
+func (s *LinkSigner) Sign(linkID, filename string, expires time.Time) string {
+  return base64.RawURLEncoding.EncodeToString(s.mac(linkID, filename, expires.Unix()))
+}
+
+// ResumeTag returns the entity tag served with downloads through linkID.
+// Only a client that made a counted download has it, so a Range request
+// sending it back in If-Range continues that download rather than starting
+// a new one, as long as the link's resume window is open.
+func (s *LinkSigner) ResumeTag(linkID string) string {
+  h := hmac.New(sha256.New, s.key)
+  h.Write([]byte("resume\n" + linkID))
+  return `"` + base64.RawURLEncoding.EncodeToString(h.Sum(nil)) + `"`
+}
+
+// BuildToken returns the token that lets whoever requested the build id
+// follow its output without admin credentials.
+func (s *LinkSigner) BuildToken(id uuid.UUID) string {
+  h := hmac.New(sha256.New, s.key)
+  h.Write([]byte("build\n" + id.String()))
+  return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// VerifyBuildToken reports whether token was returned by BuildToken for id.
+func (s *LinkSigner) VerifyBuildToken(id uuid.UUID, token string) bool {
+  return hmac.Equal([]byte(token), []byte(s.BuildToken(id)))
+}
+
+// Verify reports whether signature was produced by Sign for the same link,
+// filename and expiry.
+func (s *LinkSigner) Verify(linkID, filename string, expires int64, signature string) bool {
+  sig, err := base64.RawURLEncoding.DecodeString(signature)
+  if err != nil {
+    return false
+  }
+  return hmac.Equal(sig, s.mac(linkID, filename, expires))
+}
+
+// IssueDownloadLink records a link to the artifact at artifactPath for
+// peerID, valid for cfg.LinkTTL and cfg.MaxUses downloads, and returns the
+// signed URL path it is served under.
+func IssueDownloadLink(ctx context.Context, store Store, signer *LinkSigner, cfg config.DownloadConfig, peerID uuid.UUID, artifactPath string) (string, *models.DownloadLink, error) {
+  id := make([]byte, 16)
+  if _, err := rand.Read(id); err != nil {
+    return "", nil, err
+  }
+
+  now := time.Now().UTC()
+  link := &models.DownloadLink{
+    ID:           hex.EncodeToString(id),
+    PeerID:       peerID,
+    ArtifactPath: artifactPath,
+    ExpiresAt:    now.Add(cfg.LinkTTL).Truncate(time.Second),
+    MaxUses:      cfg.MaxUses,
+    CreatedAt:    now,
+  }
+  if err := store.InsertDownloadLink(ctx, link); err != nil {
+    return "", nil, err
+  }
+
+  filename := path.Base(artifactPath)
+  query := url.Values{}
+  query.Set("expires", strconv.FormatInt(link.ExpiresAt.Unix(), 10))
+  query.Set("signature", signer.Sign(link.ID, filename, link.ExpiresAt))
+  return "/downloads/" + link.ID + "/" + url.PathEscape(filename) + "?" + query.Encode(), link, nil
+}
@@ -0,0 +1,37 @@
+package services
+
+import (
+  "testing"
+  "time"
+)
+
+func TestLinkSigner(t *testing.T) {
+  signer := NewLinkSigner([]byte("secret"))
+  expires := time.Unix(1700000000, 0)
+  signature := signer.Sign("link", "elysium-client", expires)
+
+  if !signer.Verify("link", "elysium-client", expires.Unix(), signature) {
+    t.Fatal("expected signature to verify")
+  }
+
+  tests := []struct {
+    name      string
+    signer    *LinkSigner
+    linkID    string
+    filename  string
+    expires   int64
+    signature string
+  }{
+    {"other link", signer, "other", "elysium-client", expires.Unix(), signature},
+    {"other file", signer, "link", "elysium-client.exe", expires.Unix(), signature},
+    {"extended expiry", signer, "link", "elysium-client", expires.Unix() + 3600, signature},
+    {"malformed signature", signer, "link", "elysium-client", expires.Unix(), "%%%"},
+    {"other key", NewLinkSigner([]byte("other")), "link", "elysium-client", expires.Unix(), signature},
+    {"random key", NewLinkSigner(nil), "link", "elysium-client", expires.Unix(), signature},
+  }
+  for _, tt := range tests {
+    if tt.signer.Verify(tt.linkID, tt.filename, tt.expires, tt.signature) {
+      t.Errorf("%s: expected signature to be rejected", tt.name)
+    }
+  }
+}
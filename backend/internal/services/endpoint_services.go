@@ -0,0 +1,75 @@
+package services
+
+import (
+  "context"
+  "elysium-backend/config"
+  "elysium-backend/internal/models"
+  "errors"
+)
+
+// ErrServerKeyUnknown is returned when a client has to be built while the
+// interface is not managed here and no server peer has been registered.
+var ErrServerKeyUnknown = errors.New("the server key is unknown")
+
+// ErrEndpointChanged is returned by Track when the server key a client was
+// built for is no longer served, because the key rotation it belonged to
+// was cancelled during the build. The client has to be built again.
+var ErrEndpointChanged = errors.New("the server key changed during the build")
+
+// ClientEndpoint is the server a client is built to connect to.
+type ClientEndpoint struct {
+  PublicKey string
+  Port      int
+}
+
+// ClientEndpoints resolves the server clients are built against: the key in
+// use and the port serving it or, while a key rotation is in progress, its
+// new key and port, so the client keeps working once the old key is retired.
+type ClientEndpoints struct {
+  store     Store
+  cfg       config.WireGuardConfig
+  // rotations is nil when the interface is not managed here.
+  rotations *KeyRotator
+}
+
+func NewClientEndpoints(store Store, cfg config.WireGuardConfig, rotations *KeyRotator) *ClientEndpoints {
+  return &ClientEndpoints{store: store, cfg: cfg, rotations: rotations}
+}
+
+// Resolve returns the endpoint to build a client against. Once the client
+// is recorded it has to be passed to Track, which checks that the key is
+// still served. When the interface is not managed here the key registered
+// for the server peer is used.
+func (e *ClientEndpoints) Resolve(ctx context.Context) (*ClientEndpoint, error) {
+  if e.rotations != nil {
+    return e.rotations.clientEndpoint(ctx)
+  }
+
+  current, err := CurrentEndpoint(ctx, e.store, e.cfg)
+  if err != nil {
+    return nil, err
+  }
+  peers, err := e.store.GetAllPeer(ctx)
+  if err != nil {
+    return nil, err
+  }
+  for _, peer := range peers {
+    if peer.AssignedIP.Equal(e.cfg.IP) && peer.PublicKey != "" {
+      return &ClientEndpoint{PublicKey: peer.PublicKey, Port: current.Port}, nil
+    }
+  }
+  return nil, ErrServerKeyUnknown
+}
+
+// Track adds peer, whose client was built against endpoint, to the key
+// rotation in progress, so its traffic moves to the new key once it
+// connects with it; a client built for the old key while the rotation
+// started is re-issued. It fails with ErrEndpointChanged when the key of
+// endpoint was discarded meanwhile, and does nothing when the interface is
+// not managed here.
+func (e *ClientEndpoints) Track(ctx context.Context, endpoint *ClientEndpoint, peer models.KeyRotationPeer) error {
+  if e.rotations == nil {
+    return nil
+  }
+  return e.rotations.track(ctx, endpoint, peer)
+}
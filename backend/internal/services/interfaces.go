@@ -0,0 +1,155 @@
+package services
+
+import (
+  "context"
+  "elysium-backend/internal/models"
+  "elysium-backend/pkg/backup"
+  "elysium-backend/pkg/wgutil"
+  "io"
+  "net"
+  "time"
+
+  "github.com/google/uuid"
+)
+
+// Store persists peers. repositories.SQLStore is the production
+// implementation.
+type Store interface {
+  InsertPeer(ctx context.Context, peer *models.Peer) error
+  IsIpAvailable(ctx context.Context, ip net.IP) (bool, error)
+  GetPeer(ctx context.Context, id uuid.UUID) (*models.Peer, error)
+  GetAllPeer(ctx context.Context) ([]models.Peer, error)
+  GetAssignedIPs(ctx context.Context) ([]net.IP, error)
+  CountPeersByStatus(ctx context.Context) (map[string]int, error)
+  SetPeerStatus(ctx context.Context, id uuid.UUID, status string) error
+  UpdatePeer(ctx context.Context, peer *models.Peer) error
+  ApplyPeerChanges(ctx context.Context, deletes []uuid.UUID, updates, creates []*models.Peer) error
+  SetPeerPresharedKey(ctx context.Context, id uuid.UUID, sealed string) error
+  SetPeersLastSeen(ctx context.Context, seen map[string]time.Time) error
+  DeletePeer(ctx context.Context, id uuid.UUID) error
+  InsertDownloadLink(ctx context.Context, link *models.DownloadLink) error
+  ConsumeDownloadLink(ctx context.Context, id string, now, resumeUntil time.Time) (*models.DownloadLink, error)
+  FinishDownload(ctx context.Context, id string) error
+  GetDownloadLink(ctx context.Context, id string) (*models.DownloadLink, error)
+  GetDownloadLinks(ctx context.Context, peerID uuid.UUID) ([]models.DownloadLink, error)
+  InsertArtifact(ctx context.Context, artifact *models.Artifact) error
+  GetArtifact(ctx context.Context, id uuid.UUID) (*models.Artifact, error)
+  GetArtifactByPath(ctx context.Context, path string) (*models.Artifact, error)
+  ListArtifacts(ctx context.Context, peerID *uuid.UUID) ([]models.Artifact, error)
+  ListCollectableArtifacts(ctx context.Context, now time.Time) ([]models.Artifact, error)
+  DeleteArtifact(ctx context.Context, id uuid.UUID) error
+  InsertBuild(ctx context.Context, build *models.Build) error
+  FinishBuild(ctx context.Context, build *models.Build) error
+  GetBuild(ctx context.Context, id uuid.UUID) (*models.Build, error)
+  ListBuilds(ctx context.Context, status string, limit int) ([]models.Build, error)
+  InsertBuildLogs(ctx context.Context, buildID uuid.UUID, lines []models.BuildLogLine) error
+  ListBuildLogs(ctx context.Context, buildID uuid.UUID, afterSeq int) ([]models.BuildLogLine, error)
+  InsertBulkJob(ctx context.Context, job *models.BulkJob, peers []*models.Peer) error
+  UpdateBulkJobItem(ctx context.Context, jobID uuid.UUID, item *models.BulkJobItem) error
+  FinishBulkJob(ctx context.Context, job *models.BulkJob) error
+  GetBulkJob(ctx context.Context, id uuid.UUID) (*models.BulkJob, error)
+  ListBulkJobIDs(ctx context.Context, status string) ([]uuid.UUID, error)
+  InsertKeyRotation(ctx context.Context, rotation *models.KeyRotation) error
+  InsertKeyRotationPeer(ctx context.Context, rotationID uuid.UUID, peer *models.KeyRotationPeer) error
+  UpdateKeyRotationPeer(ctx context.Context, rotationID uuid.UUID, peer *models.KeyRotationPeer) error
+  FinishKeyRotation(ctx context.Context, rotation *models.KeyRotation) error
+  GetKeyRotation(ctx context.Context, id uuid.UUID) (*models.KeyRotation, error)
+  LatestKeyRotation(ctx context.Context) (*models.KeyRotation, error)
+  InsertAuditEvent(ctx context.Context, event *models.AuditEvent) error
+  ListAuditEvents(ctx context.Context, filter models.AuditFilter) ([]models.AuditEvent, error)
+  Ping(ctx context.Context) error
+}
+
+// Allocator picks a free tunnel address for a new peer and sets it on
+// peer.AssignedIP.
+//
+// Lock and Unlock are held from allocating addresses until their peers are
+// stored, by single peers and batches alike, so two callers cannot be
+// handed the same free address.
+type Allocator interface {
+  Allocate(ctx context.Context, peer *models.Peer) error
+  Lock()
+  Unlock()
+}
+
+// WireGuard controls the server side WireGuard interface.
+type WireGuard interface {
+  // Init creates and configures the interface and returns the public key
+  // of the server.
+  Init(ctx context.Context) (publicKey string, err error)
+  PublicKey() (string, error)
+  // Check reports whether the live interface matches the configuration.
+  Check(ctx context.Context) error
+  // Peers lists the peers configured on the live interface.
+  Peers(ctx context.Context) ([]wgutil.DevicePeer, error)
+  // Handshakes returns the latest handshake of every peer that connected
+  // to the server with either key, by public key.
+  Handshakes(ctx context.Context) (map[string]time.Time, error)
+  // ConfigurePeers sets the allowed IPs of the peers in set and removes
+  // the peers with the public keys in remove.
+  ConfigurePeers(ctx context.Context, set []wgutil.DevicePeer, remove []string) error
+  // BeginRotation brings up next with a new key, or the one saved when the
+  // rotation started if resume is set, and returns its public key. Until
+  // EndRotation peers are configured on both interfaces.
+  BeginRotation(ctx context.Context, next wgutil.Endpoint, resume bool) (publicKey string, err error)
+  // RotationHandshakes returns the latest handshake of every peer that
+  // connected with the new key, by public key.
+  RotationHandshakes(ctx context.Context) (map[string]time.Time, error)
+  // RoutePeers sends the traffic for ips through the new interface.
+  RoutePeers(ctx context.Context, ips []net.IP) error
+  // EndRotation retires the old key and interface when promote is set and
+  // discards the new ones otherwise.
+  EndRotation(ctx context.Context, promote bool) error
+  Teardown() error
+}
+
+// Backuper archives the control-plane state. backup.Archiver is the
+// production implementation.
+type Backuper interface {
+  Backup(ctx context.Context, w io.Writer) (*backup.Manifest, error)
+  // Encrypted reports whether the archives are encrypted.
+  Encrypted() bool
+}
+
+// ClientBundle is the per-peer configuration packaged with the client.
+// ServerPort is the port the client connects to, the default WireGuard port
+// when 0. PresharedKey is the plaintext preshared key of the peer, empty
+// when it has none.
+type ClientBundle struct {
+  PublicKey    string
+  AssignedIP   net.IP
+  ServerPort   int
+  PresharedKey string
+}
+
+// BuildRequest describes a client build for a single peer. ID is embedded
+// in the packaged client. Output, when set, receives each line of compiler
+// output as it is produced.
+type BuildRequest struct {
+  ID     uuid.UUID
+  Target models.OSArch
+  Bundle ClientBundle
+  Output func(line string)
+  // Started, when set, is called by BuildHistory once the build is
+  // recorded and its output can be followed, before anything is compiled.
+  Started func(build *models.Build)
+}
+
+// BuildResult describes a packaged client. ArtifactPath is relative to the
+// output directory served under /downloads, Logs holds the compiler output
+// of the build, if it compiled anything, SHA256 is the hex digest of the
+// artifact and Provenance describes what it was compiled from.
+type BuildResult struct {
+  ArtifactPath string
+  Logs         []string
+  SHA256       string
+  Provenance   *models.BuildProvenance
+}
+
+// Builder produces client binaries.
+type Builder interface {
+  Build(ctx context.Context, req BuildRequest) (*BuildResult, error)
+  CheckToolchain(ctx context.Context) error
+  // Shutdown stops new builds and waits for running ones until ctx expires.
+  Shutdown(ctx context.Context) error
+}
@@ -0,0 +1,49 @@
+package services
+
+import (
+  "context"
+  "elysium-backend/pkg/logger"
+  "time"
+)
+
+// PeerActivity records when peers were last seen on the tunnel from the
+// handshakes of the interface.
+type PeerActivity struct {
+  store     Store
+  wireGuard WireGuard
+}
+
+func NewPeerActivity(store Store, wireGuard WireGuard) *PeerActivity {
+  return &PeerActivity{store: store, wireGuard: wireGuard}
+}
+
+// Record stores the latest handshake of every peer as its last_seen.
+func (a *PeerActivity) Record(ctx context.Context) error {
+  handshakes, err := a.wireGuard.Handshakes(ctx)
+  if err != nil {
+    return err
+  }
+  if len(handshakes) == 0 {
+    return nil
+  }
+  return a.store.SetPeersLastSeen(ctx, handshakes)
+}
+
+// Run records handshakes every interval until ctx is cancelled.
+func (a *PeerActivity) Run(ctx context.Context, interval time.Duration) {
+  log := logger.FromContext(ctx)
+  ticker := time.NewTicker(interval)
+  defer ticker.Stop()
+
+  for {
+    if err := a.Record(ctx); err != nil && ctx.Err() == nil {
+      log.Error("recording peer handshakes failed", "err", err)
+    }
+
+    select {
+    case <-ctx.Done():
+      return
+    case <-ticker.C:
+    }
+  }
+}
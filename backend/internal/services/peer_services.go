@@ -1,44 +1,77 @@
 package services
 
 import (
-  "bufio"
+  "context"
   "crypto/sha256"
   "elysium-backend/config"
   "elysium-backend/internal/models"
-  "elysium-backend/internal/repositories"
+  "elysium-backend/pkg/logger"
   "encoding/binary"
   "fmt"
-  "log"
   "math/big"
   "net"
-  "os"
-  "os/exec"
-  "path/filepath"
-  "strings"
+  "sync"
   "time"
-
-  "github.com/google/uuid"
 )
 
-func InsertPeer(newPeer *models.Peer) error {
-  if config.GetLogLevel() == "DEBUG" {
-    log.Println("services.InsertPeer -> called")
-  }
+// RegisterServerPeer records the backend itself as an active peer holding
+// the server address, so that address is never handed out to clients. When
+// it is already recorded only its key is updated, to follow key rotations.
+func RegisterServerPeer(ctx context.Context, store Store, publicKey string, serverIP net.IP) error {
+  log := logger.FromContext(ctx)
 
-  if err := repositories.InsertPeer(newPeer); err != nil {
-    log.Println("services.InsertPeer -> Error inserting peer:", err)
+  peers, err := store.GetAllPeer(ctx)
+  if err != nil {
+    log.Error("error retrieving peers", "err", err)
     return err
   }
+  for i := range peers {
+    if !peers[i].AssignedIP.Equal(serverIP) {
+      continue
+    }
+    if peers[i].PublicKey == publicKey {
+      return nil
+    }
+    peers[i].PublicKey = publicKey
+    if err := store.UpdatePeer(ctx, &peers[i]); err != nil {
+      log.Error("error updating backend server in peer table", "err", err)
+      return err
+    }
+    return nil
+  }
+
+  backend_server := models.Peer{
+    PublicKey:  publicKey,
+    AssignedIP: serverIP,
+    Status:     models.PeerStatusActive,
+    IsGateway:  false,
+    CreatedOn:  time.Now().UTC(),
+  }
 
+  if err := store.InsertPeer(ctx, &backend_server); err != nil {
+    log.Error("error saving backend server in peer table", "err", err)
+    return err
+  }
   return nil
 }
 
-func timeToIp(time *time.Time) net.IP {
+// HashAllocator derives addresses from a hash of the peer's creation time,
+// probing nearby timestamps when the first candidate is already taken.
+type HashAllocator struct {
+  // Mutex is held by callers allocating a batch of addresses.
+  sync.Mutex
+  store  Store
+  ranges []config.Ip_Range
+}
+
+func NewHashAllocator(store Store, ranges []config.Ip_Range) *HashAllocator {
+  return &HashAllocator{store: store, ranges: ranges}
+}
+
+func timeToIp(time *time.Time, ip_ranges []config.Ip_Range) net.IP {
   hash := sha256.Sum256([]byte(time.String()))
   hash_int := new(big.Int).SetBytes(hash[:])
 
-  ip_ranges := config.GetIpRanges()
-
   index := new(big.Int).
     Mod(hash_int, big.NewInt(int64(len(ip_ranges)))).
     Int64()
@@ -59,17 +92,23 @@ func timeToIp(time *time.Time) net.IP {
   return allocatedIP
 }
 
-func AssignNewIP(newPeer *models.Peer) error {
-  if config.GetLogLevel() == "DEBUG" {
-    log.Println("services.assignNewIP -> called")
+func (a *HashAllocator) Allocate(ctx context.Context, newPeer *models.Peer) error {
+  log := logger.FromContext(ctx)
+  log.Debug("assigning new IP")
+
+  if len(a.ranges) == 0 {
+    return fmt.Errorf("no IP ranges configured")
   }
 
-  allocatedIP := timeToIp(&newPeer.CreatedOn)
+  allocatedIP := timeToIp(&newPeer.CreatedOn, a.ranges)
 
-  is_avail, _ := repositories.IsIpAvailable(allocatedIP)
+  is_avail, err := a.store.IsIpAvailable(ctx, allocatedIP)
+  if err != nil {
+    return err
+  }
 
   if is_avail {
-    log.Println("services.assignNewIP -> IP Allocated")
+    log.Info("IP allocated", "ip", allocatedIP.String())
     newPeer.AssignedIP = allocatedIP
     return nil
   } else {
@@ -77,109 +116,18 @@ func AssignNewIP(newPeer *models.Peer) error {
     for retry < 100 {
       retry++
       adjustedTime := newPeer.CreatedOn.Add(time.Duration(retry) * time.Millisecond)
-      allocatedIP = timeToIp(&adjustedTime)
+      allocatedIP = timeToIp(&adjustedTime, a.ranges)
 
-      is_avail, _ = repositories.IsIpAvailable(allocatedIP)
+      is_avail, err = a.store.IsIpAvailable(ctx, allocatedIP)
+      if err != nil {
+        return err
+      }
       if is_avail {
-        log.Println("services.assignNewIP -> IP Allocated")
+        log.Info("IP allocated", "ip", allocatedIP.String(), "retries", retry)
         newPeer.AssignedIP = allocatedIP
         return nil
       }
     }
-    return fmt.Errorf("services.assignNewIP -> Error no available IP after 100 retries")
-  }
-}
-
-func GetPeer(peerID *uuid.UUID) (*models.Peer, error) {
-  if config.GetLogLevel() == "DEBUG" {
-    log.Println("services.GetPeer -> called")
-  }
-
-  peer, err := repositories.GetPeer(*peerID)
-  if err != nil {
-    log.Println("services.GetPeer -> Error retrieving peer:", err)
-    return nil, err
-  }
-  return peer, nil
-}
-
-func GetAllPeer() ([]models.Peer, error) {
-  if config.GetLogLevel() == "DEBUG" {
-    log.Println("services.GetAllPeer -> called")
-  }
-
-  peers, err := repositories.GetAllPeer()
-  if err != nil {
-    log.Println("services.GetAllPeer -> Error retrieving peers:", err)
-    return nil, err
+    return fmt.Errorf("no available IP after 100 retries")
   }
-  log.Printf("services.GetAllPeer -> retrived %d peers\n", len(peers))
-
-  return peers, nil
-}
-
-func CompileClient(pubKey string, target models.OSArch, assignedIp net.IP) (string, error) {
-  if config.GetLogLevel() == "DEBUG" {
-    log.Println("services.CompileClient -> called")
-  }
-  serverIp := config.GetEnv("BACKEND_WG_IP", "10.0.0.1")
-
-  if err := target.Validate(); err != nil {
-    log.Println("services.CompileClient -> invalid target:", err)
-    return "", err
-  }
-
-  clientDir := config.GetEnv("CLIENT_DIR", "./client")
-  binaryName := config.GetEnv("BINARY_NAME", "elysium-client")
-  if target == "x86_64-pc-windows-gnu" {
-    binaryName += ".exe"
-  }
-  outputDir := config.GetEnv("OUTPUT_DIR", "./compiled_binaries")
-  compileArgs := strings.Fields(config.GetEnv("COMPILE_ARGS", ""))
-
-  args := append([]string{"build", "--release", "--target", string(target)}, compileArgs...)
-  cmd := exec.Command("cargo", args...)
-  cmd.Dir = clientDir
-  cmd.Env = append(
-    os.Environ(),
-    "ADDR="+assignedIp.String(),
-    "CIDR="+fmt.Sprint(24),
-    "SERVERPUB="+pubKey,
-    "SERVERENDPOINT=192.168.0.1:51820",
-    "SERVERIP="+serverIp,
-    )
-  if target == models.OSArchx86_64Linux {
-    cmd.Env = append(cmd.Env, "RUSTFLAGS=-C linker=x86_64-linux-gnu-gcc")
-  }
-
-  stderr, _ := cmd.StderrPipe()
-  if err := cmd.Start(); err != nil {
-    log.Println("services.CompileClient -> command start failed:", err)
-    return "", err
-  }
-
-  scanner := bufio.NewScanner(stderr)
-  for scanner.Scan() {
-    log.Println("services.CompileClient -> build output:", scanner.Text())
-  }
-
-  if err := cmd.Wait(); err != nil {
-    log.Println("services.CompileClient -> command execution failed:", err)
-    return "", err
-  }
-
-  destPath := filepath.Join(outputDir, fmt.Sprintf("%d", time.Now().UnixNano()), binaryName)
-  if err := os.MkdirAll(filepath.Dir(destPath), os.ModePerm); err != nil {
-    log.Println("services.CompileClient -> failed to create directory:", err)
-    return "", err
-  }
-
-  sourcePath := filepath.Join(clientDir, "target", string(target), "release", binaryName)
-  if err := os.Rename(sourcePath, destPath); err != nil {
-    log.Println("services.CompileClient -> failed to move executable:", err)
-    return "", err
-  }
-
-  relativePath, _ := filepath.Rel(outputDir, destPath)
-  return relativePath, nil
 }
@@ -0,0 +1,38 @@
+package services
+
+import (
+  "context"
+  "elysium-backend/config"
+  "elysium-backend/pkg/logger"
+)
+
+type PoolUsage struct {
+  Size int64 `json:"size"`
+  Used int64 `json:"used"`
+  Free int64 `json:"free"`
+}
+
+func GetPoolUsage(ctx context.Context, store Store, ranges []config.Ip_Range) (*PoolUsage, error) {
+  usage := &PoolUsage{}
+  for _, r := range ranges {
+    usage.Size += r.Size()
+  }
+
+  assigned, err := store.GetAssignedIPs(ctx)
+  if err != nil {
+    logger.FromContext(ctx).Error("error retrieving assigned IPs", "err", err)
+    return nil, err
+  }
+
+  for _, ip := range assigned {
+    for _, r := range ranges {
+      if r.Contains(ip) {
+        usage.Used++
+        break
+      }
+    }
+  }
+  usage.Free = usage.Size - usage.Used
+
+  return usage, nil
+}
@@ -0,0 +1,147 @@
+package services
+
+import (
+  "context"
+  "elysium-backend/internal/audit"
+  "elysium-backend/internal/models"
+  "elysium-backend/pkg/keystore"
+  "elysium-backend/pkg/logger"
+  "elysium-backend/pkg/wgutil"
+  "errors"
+  "fmt"
+
+  "github.com/google/uuid"
+)
+
+// ErrKeysNotEncrypted is returned when a preshared key would be stored
+// while no key encryption key or passphrase is configured to seal it.
+var ErrKeysNotEncrypted = errors.New("preshared keys are only stored sealed, set KEY_ENCRYPTION_KEY, KEY_ENCRYPTION_KEY_FILE or KEY_PASSPHRASE")
+
+// PresharedKeys manages the WireGuard preshared keys of peers. A preshared
+// key is mixed into every handshake on top of the Curve25519 exchange, so
+// recorded traffic stays confidential even if that exchange is broken later,
+// e.g. by a quantum computer. Keys are sealed with the keystore the server
+// keys are saved through before they are stored.
+type PresharedKeys struct {
+  store     Store
+  wireGuard WireGuard
+  keys      *keystore.Keystore
+  enabled   bool
+}
+
+// NewPresharedKeys returns the preshared keys manager. enabled controls
+// whether new peers get a preshared key; wireGuard may be nil when the
+// interface is not managed by this server.
+func NewPresharedKeys(store Store, wireGuard WireGuard, keys *keystore.Keystore, enabled bool) *PresharedKeys {
+  return &PresharedKeys{store: store, wireGuard: wireGuard, keys: keys, enabled: enabled}
+}
+
+// Enabled reports whether new peers get a preshared key.
+func (p *PresharedKeys) Enabled() bool {
+  return p.enabled
+}
+
+// Generate returns a new preshared key and its sealed form for storage. It
+// fails with ErrKeysNotEncrypted when the keystore would store it in
+// plaintext.
+func (p *PresharedKeys) Generate() (key, sealed string, err error) {
+  if !p.keys.Encrypted() {
+    return "", "", ErrKeysNotEncrypted
+  }
+  key, err = wgutil.GeneratePresharedKey()
+  if err != nil {
+    return "", "", err
+  }
+  data, err := p.keys.Seal([]byte(key))
+  if err != nil {
+    return "", "", fmt.Errorf("sealing preshared key: %w", err)
+  }
+  return key, string(data), nil
+}
+
+// ForNewPeer sets a sealed preshared key on peer when preshared keys are
+// enabled and returns it in plaintext, or returns an empty key.
+func (p *PresharedKeys) ForNewPeer(peer *models.Peer) (string, error) {
+  if !p.enabled {
+    return "", nil
+  }
+  key, sealed, err := p.Generate()
+  if err != nil {
+    return "", err
+  }
+  peer.PresharedKey = sealed
+  return key, nil
+}
+
+// Open returns the preshared key of peer in plaintext, empty when it has
+// none.
+func (p *PresharedKeys) Open(peer *models.Peer) (string, error) {
+  if peer.PresharedKey == "" {
+    return "", nil
+  }
+  key, err := p.keys.Open([]byte(peer.PresharedKey))
+  if err != nil {
+    return "", fmt.Errorf("opening preshared key of peer %s: %w", peer.ID, err)
+  }
+  return string(key), nil
+}
+
+// Lookup returns the preshared key of the peer id in plaintext, empty when
+// it has none.
+func (p *PresharedKeys) Lookup(ctx context.Context, id uuid.UUID) (string, error) {
+  peer, err := p.store.GetPeer(ctx, id)
+  if err != nil {
+    return "", err
+  }
+  return p.Open(peer)
+}
+
+// Replace stores key, sealed as sealed, as the preshared key of peer,
+// whether or not it had one. When the peer is configured on the interface
+// its key is replaced there at once, so a client holding the old key cannot
+// connect until it is re-issued with the new one. When the interface
+// cannot be updated the previous key is stored back.
+func (p *PresharedKeys) Replace(ctx context.Context, peer *models.Peer, key, sealed string) error {
+  log := logger.FromContext(ctx).With("peer_id", peer.ID.String())
+
+  previous := peer.PresharedKey
+  if err := p.store.SetPeerPresharedKey(ctx, *peer.ID, sealed); err != nil {
+    return err
+  }
+
+  configured := false
+  if p.wireGuard != nil && peer.PublicKey != "" {
+    var err error
+    if configured, err = p.configure(ctx, peer.PublicKey, key); err != nil {
+      log.Error("unable to set the preshared key on the interface", "err", err)
+      // The interface still holds the previous key; keep storing it.
+      if rollbackErr := p.store.SetPeerPresharedKey(ctx, *peer.ID, previous); rollbackErr != nil {
+        log.Error("unable to restore the previous preshared key", "err", rollbackErr)
+      }
+      return err
+    }
+  }
+  peer.PresharedKey = sealed
+
+  log.Info("preshared key replaced", "configured", configured)
+  audit.Record(ctx, p.store, "peer.preshared_key.rotate", peer.ID.String(),
+    map[string]any{"preshared_key": previous != ""}, map[string]any{"preshared_key": true, "configured": configured})
+  return nil
+}
+
+// configure replaces the preshared key of the device peer holding
+// publicKey, keeping its allowed IPs. It reports whether the peer was on
+// the device; one that is not is left to DevicePeers.
+func (p *PresharedKeys) configure(ctx context.Context, publicKey, key string) (bool, error) {
+  peers, err := p.wireGuard.Peers(ctx)
+  if err != nil {
+    return false, err
+  }
+  for _, peer := range peers {
+    if peer.PublicKey == publicKey {
+      peer.PresharedKey = key
+      return true, p.wireGuard.ConfigurePeers(ctx, []wgutil.DevicePeer{peer}, nil)
+    }
+  }
+  return false, nil
+}
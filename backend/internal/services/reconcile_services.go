@@ -0,0 +1,717 @@
+package services
+
+import (
+  "context"
+  "elysium-backend/config"
+  "elysium-backend/internal/audit"
+  "elysium-backend/internal/models"
+  "elysium-backend/pkg/logger"
+  "elysium-backend/pkg/wgutil"
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "io"
+  "net"
+  "slices"
+  "sort"
+  "strings"
+  "time"
+
+  "github.com/google/uuid"
+  "gopkg.in/yaml.v3"
+)
+
+// ErrInvalidState is returned for a desired state file that cannot be
+// reconciled at all, such as one with duplicate names or malformed keys.
+var ErrInvalidState = errors.New("invalid desired state")
+
+// ManagedByReconcile is stored as the managed_by metadata of the peers the
+// reconciler owns. Only those are deleted when they are missing from the
+// desired state.
+const ManagedByReconcile = "reconcile"
+
+// ParseDesiredState reads a desired state in YAML or JSON. Unknown fields
+// are rejected so a typo does not silently drop part of the file.
+func ParseDesiredState(r io.Reader) (*models.DesiredState, error) {
+  dec := yaml.NewDecoder(r)
+  dec.KnownFields(true)
+
+  var state models.DesiredState
+  if err := dec.Decode(&state); errors.Is(err, io.EOF) {
+    return nil, fmt.Errorf("%w: empty document", ErrInvalidState)
+  } else if err != nil {
+    return nil, fmt.Errorf("%w: %v", ErrInvalidState, err)
+  }
+  return &state, nil
+}
+
+// Reconciler brings the peers table and the peers of the WireGuard device
+// in line with a desired state.
+type Reconciler struct {
+  store     Store
+  allocator Allocator
+  wireGuard WireGuard
+  cfg       *config.Config
+  psks      *PresharedKeys
+}
+
+// NewReconciler returns a Reconciler. allocator assigns the addresses of
+// new peers in the configured ranges; wireGuard may be nil, in which case
+// only the database is reconciled; psks opens the preshared keys put on the
+// device with their peers.
+func NewReconciler(store Store, allocator Allocator, wireGuard WireGuard, cfg *config.Config, psks *PresharedKeys) *Reconciler {
+  return &Reconciler{store: store, allocator: allocator, wireGuard: wireGuard, cfg: cfg, psks: psks}
+}
+
+// desiredPeer is a validated entry of the desired state. ip is nil when an
+// address has to be allocated. diffPeers sets resolved, the address the
+// peer ends up with, and peer, the existing peer it matched or the one
+// created for it.
+type desiredPeer struct {
+  models.DesiredPeer
+  gateway  bool
+  ip       net.IP
+  resolved net.IP
+  peer     *models.Peer
+}
+
+func (d *desiredPeer) kind() string {
+  if d.gateway {
+    return models.ReconcileKindGateway
+  }
+  return models.ReconcileKindPeer
+}
+
+// reconcileStep is a database change of a plan.
+type reconcileStep struct {
+  action models.ReconcileAction
+  before *models.Peer
+  after  *models.Peer
+}
+
+// Reconcile computes the plan that brings the database and the device to
+// state and, when apply is set and the plan has no conflicts, carries it
+// out: the deletes, updates and creates in one transaction, then the device
+// peers once it committed. Applying holds the allocator's lock from reading
+// the peers to the commit, so no other batch takes the addresses planned
+// for new peers. Reconciling the same state again yields an empty plan.
+func (r *Reconciler) Reconcile(ctx context.Context, state *models.DesiredState, apply bool) (*models.ReconcilePlan, error) {
+  log := logger.FromContext(ctx)
+  plan := &models.ReconcilePlan{Actions: []models.ReconcileAction{}}
+
+  if apply {
+    r.allocator.Lock()
+    defer r.allocator.Unlock()
+  }
+
+  pools, conflicts, err := r.checkNetwork(state)
+  if err != nil {
+    return nil, err
+  }
+  plan.Conflicts = append(plan.Conflicts, conflicts...)
+
+  desired, err := r.validate(state, pools)
+  if err != nil {
+    return nil, err
+  }
+
+  existing, err := r.store.GetAllPeer(ctx)
+  if err != nil {
+    return nil, err
+  }
+
+  steps, conflicts, err := r.diffPeers(ctx, desired, existing, pools, len(state.Pools) > 0)
+  if err != nil {
+    return nil, err
+  }
+  plan.Conflicts = append(plan.Conflicts, conflicts...)
+  for _, step := range steps {
+    plan.Actions = append(plan.Actions, step.action)
+  }
+
+  var set []wgutil.DevicePeer
+  var remove []string
+  if r.wireGuard != nil {
+    var actions []models.ReconcileAction
+    set, remove, actions, err = r.diffDevice(ctx, desired, existing)
+    if err != nil {
+      return nil, err
+    }
+    plan.Actions = append(plan.Actions, actions...)
+  }
+
+  if !apply || len(plan.Conflicts) > 0 || len(plan.Actions) == 0 {
+    return plan, nil
+  }
+
+  if err := r.applySteps(ctx, steps); err != nil {
+    return nil, fmt.Errorf("unable to apply the peer changes: %w", err)
+  }
+  if len(set) > 0 || len(remove) > 0 {
+    if err := r.wireGuard.ConfigurePeers(ctx, set, remove); err != nil {
+      return nil, fmt.Errorf("unable to configure device peers: %w", err)
+    }
+  }
+  plan.Applied = true
+  log.Info("desired state applied", "actions", len(plan.Actions))
+  audit.Record(ctx, r.store, "reconcile.apply", "", nil, plan)
+  return plan, nil
+}
+
+// checkNetwork compares the network of state with the server configuration
+// and returns the pools addresses are allocated from: those of state, or
+// the configured ranges when state has none.
+func (r *Reconciler) checkNetwork(state *models.DesiredState) ([]config.Ip_Range, []string, error) {
+  var conflicts []string
+  wg := r.cfg.WireGuard
+
+  if network := state.Network; network != nil {
+    if network.Interface != "" && network.Interface != wg.Interface {
+      conflicts = append(conflicts, fmt.Sprintf("network interface is %s, not %s", wg.Interface, network.Interface))
+    }
+    if network.Port != 0 && network.Port != wg.Port {
+      conflicts = append(conflicts, fmt.Sprintf("network port is %d, not %d", wg.Port, network.Port))
+    }
+    if network.Address != "" {
+      if ip := net.ParseIP(network.Address); ip == nil {
+        return nil, nil, fmt.Errorf("%w: invalid network address %q", ErrInvalidState, network.Address)
+      } else if !ip.Equal(wg.IP) {
+        conflicts = append(conflicts, fmt.Sprintf("network address is %s, not %s", wg.IP, network.Address))
+      }
+    }
+    if network.Mask != "" && strings.TrimPrefix(network.Mask, "/") != strings.TrimPrefix(wg.NetworkMask, "/") {
+      conflicts = append(conflicts, fmt.Sprintf("network mask is %s, not %s", wg.NetworkMask, network.Mask))
+    }
+  }
+
+  if len(state.Pools) == 0 {
+    return r.cfg.IPRanges, conflicts, nil
+  }
+  pools := make([]config.Ip_Range, 0, len(state.Pools))
+  for _, pool := range state.Pools {
+    start, end := net.ParseIP(pool.Start).To4(), net.ParseIP(pool.End).To4()
+    if start == nil || end == nil || ipToUint32(start) > ipToUint32(end) {
+      return nil, nil, fmt.Errorf("%w: invalid pool %s-%s", ErrInvalidState, pool.Start, pool.End)
+    }
+    pools = append(pools, config.Ip_Range{Start: start, End: end})
+  }
+  for _, pool := range pools {
+    inside := false
+    for _, configured := range r.cfg.IPRanges {
+      if configured.Contains(pool.Start) && configured.Contains(pool.End) {
+        inside = true
+        break
+      }
+    }
+    if !inside {
+      conflicts = append(conflicts, fmt.Sprintf("pool %s-%s is outside the configured network", pool.Start, pool.End))
+    }
+  }
+  return pools, conflicts, nil
+}
+
+// validate checks the peers and gateways of state and normalises them.
+// Every problem found is reported in the returned error.
+func (r *Reconciler) validate(state *models.DesiredState, pools []config.Ip_Range) ([]*desiredPeer, error) {
+  var problems []string
+  names := make(map[string]bool)
+  keys := make(map[string]string)
+  ips := make(map[string]string)
+  var desired []*desiredPeer
+
+  entries := make([]*desiredPeer, 0, len(state.Peers)+len(state.Gateways))
+  for _, peer := range state.Peers {
+    entries = append(entries, &desiredPeer{DesiredPeer: peer})
+  }
+  for _, gateway := range state.Gateways {
+    entries = append(entries, &desiredPeer{DesiredPeer: gateway, gateway: true})
+  }
+
+  for _, entry := range entries {
+    fail := func(format string, args ...any) {
+      problems = append(problems, fmt.Sprintf("%s %q: %s", entry.kind(), entry.Name, fmt.Sprintf(format, args...)))
+    }
+
+    if !bulkNamePattern.MatchString(entry.Name) {
+      fail("name must be 1 to 64 letters, digits, dots, dashes or underscores")
+    } else if names[entry.Name] {
+      fail("duplicate name")
+    }
+    names[entry.Name] = true
+
+    if entry.PublicKey != "" {
+      if err := wgutil.ValidateKey(entry.PublicKey); err != nil {
+        fail("invalid public key")
+      } else if other, ok := keys[entry.PublicKey]; ok {
+        fail("public key is also used by %s", other)
+      }
+      keys[entry.PublicKey] = entry.Name
+    }
+
+    if entry.Status == "" {
+      entry.Status = models.PeerStatusActive
+    } else if !models.ValidPeerStatus(entry.Status) {
+      fail("invalid status %q", entry.Status)
+    }
+
+    if entry.IP != "" {
+      ip := net.ParseIP(entry.IP).To4()
+      switch {
+      case ip == nil:
+        fail("invalid IPv4 address %q", entry.IP)
+      case ip.Equal(r.cfg.WireGuard.IP):
+        fail("%s is the server address", ip)
+      case !inRanges(ip, pools):
+        fail("%s is outside the pools", ip)
+      case ips[ip.String()] != "":
+        fail("%s is also assigned to %s", ip, ips[ip.String()])
+      default:
+        entry.ip = ip
+        ips[ip.String()] = entry.Name
+      }
+    }
+
+    if len(entry.Routes) > 0 && !entry.gateway {
+      fail("only gateways can have routes")
+    }
+    routes := make([]string, 0, len(entry.Routes))
+    for _, route := range entry.Routes {
+      _, ipNet, err := net.ParseCIDR(strings.TrimSpace(route))
+      if err != nil {
+        fail("invalid route %q", route)
+        continue
+      }
+      routes = append(routes, ipNet.String())
+    }
+    sort.Strings(routes)
+    entry.Routes = routes
+
+    entry.Tags = normaliseTags(entry.Tags)
+    desired = append(desired, entry)
+  }
+
+  if len(problems) > 0 {
+    return nil, fmt.Errorf("%w: %s", ErrInvalidState, strings.Join(problems, "; "))
+  }
+  return desired, nil
+}
+
+// diffPeers matches the desired peers with the existing ones, by name among
+// the peers the reconciler manages and by public key among the others, and
+// returns the database changes in the order they are applied. ownPools is
+// set when pools come from the state rather than the configuration.
+func (r *Reconciler) diffPeers(ctx context.Context, desired []*desiredPeer, existing []models.Peer, pools []config.Ip_Range, ownPools bool) ([]reconcileStep, []string, error) {
+  var conflicts []string
+  managed := make(map[string]*models.Peer)
+  unmanaged := make(map[string]*models.Peer)
+  holders := make(map[string]*models.Peer)
+  taken := map[string]bool{r.cfg.WireGuard.IP.To4().String(): true}
+
+  for i := range existing {
+    peer := &existing[i]
+    taken[peer.AssignedIP.To4().String()] = true
+    if peer.AssignedIP.Equal(r.cfg.WireGuard.IP) {
+      continue
+    }
+    holders[peer.AssignedIP.To4().String()] = peer
+    if isManaged(peer) {
+      managed[metaString(peer, "name")] = peer
+    } else if peer.PublicKey != "" {
+      unmanaged[peer.PublicKey] = peer
+    }
+  }
+  names := make(map[string]bool, len(desired))
+  for _, entry := range desired {
+    names[entry.Name] = true
+    if entry.ip != nil {
+      taken[entry.ip.String()] = true
+    }
+  }
+  // deleted reports whether peer is removed before the address it holds
+  // is given to another peer.
+  deleted := func(peer *models.Peer) bool {
+    return isManaged(peer) && !names[metaString(peer, "name")]
+  }
+
+  matched := make(map[*models.Peer]bool)
+  var updates, creates []reconcileStep
+  for _, entry := range desired {
+    current := managed[entry.Name]
+    if current == nil && entry.PublicKey != "" {
+      current = unmanaged[entry.PublicKey]
+    }
+    if current != nil {
+      matched[current] = true
+    }
+
+    ip := entry.ip
+    if ip == nil && current != nil {
+      ip = current.AssignedIP.To4()
+    }
+    createdOn := time.Now().UTC()
+    if ip == nil {
+      var err error
+      if ip, err = r.allocate(ctx, &createdOn, pools, ownPools, taken); err != nil {
+        return nil, nil, err
+      }
+      if ip == nil {
+        conflicts = append(conflicts, fmt.Sprintf("no free address for %s %s", entry.kind(), entry.Name))
+        continue
+      }
+      taken[ip.String()] = true
+    }
+    if holder := holders[ip.String()]; holder != nil && holder != current && !deleted(holder) {
+      conflicts = append(conflicts, fmt.Sprintf("%s of %s %s is assigned to peer %s", ip, entry.kind(), entry.Name, peerName(holder)))
+      continue
+    }
+    entry.resolved = ip
+
+    after := &models.Peer{
+      PublicKey:  entry.PublicKey,
+      AssignedIP: ip,
+      Status:     entry.Status,
+      IsGateway:  entry.gateway,
+      Metadata:   desiredMetadata(current, entry),
+    }
+    if current == nil {
+      after.CreatedOn = createdOn
+      if r.psks != nil {
+        if _, err := r.psks.ForNewPeer(after); err != nil {
+          return nil, nil, err
+        }
+      }
+      entry.peer = after
+      creates = append(creates, reconcileStep{
+        action: models.ReconcileAction{Op: models.ReconcileOpCreate, Kind: entry.kind(), Name: entry.Name, Changes: []string{"ip " + ip.String()}},
+        after:  after,
+      })
+      continue
+    }
+
+    entry.peer = current
+    changes := peerChanges(current, after, entry)
+    if len(changes) == 0 {
+      continue
+    }
+    after.ID = current.ID
+    after.CreatedOn = current.CreatedOn
+    after.LastSeen = current.LastSeen
+    updates = append(updates, reconcileStep{
+      action: models.ReconcileAction{Op: models.ReconcileOpUpdate, Kind: entry.kind(), Name: entry.Name, PeerID: current.ID, Changes: changes},
+      before: current,
+      after:  after,
+    })
+  }
+
+  var deletes []reconcileStep
+  for name, peer := range managed {
+    if matched[peer] {
+      continue
+    }
+    kind := models.ReconcileKindPeer
+    if peer.IsGateway {
+      kind = models.ReconcileKindGateway
+    }
+    deletes = append(deletes, reconcileStep{
+      action: models.ReconcileAction{Op: models.ReconcileOpDelete, Kind: kind, Name: name, PeerID: peer.ID},
+      before: peer,
+    })
+  }
+  sort.Slice(deletes, func(i, j int) bool { return deletes[i].action.Name < deletes[j].action.Name })
+
+  return append(append(deletes, updates...), creates...), conflicts, nil
+}
+
+// allocate picks a free address for a peer created at createdOn. Addresses
+// in the configured ranges come from the allocator, retried with later
+// creation times while they are taken by the plan; pools of the state's own
+// are not known to the allocator, so their lowest free address is used. It
+// returns nil when no address is free.
+func (r *Reconciler) allocate(ctx context.Context, createdOn *time.Time, pools []config.Ip_Range, ownPools bool, taken map[string]bool) (net.IP, error) {
+  if ownPools {
+    return allocateFrom(pools, taken), nil
+  }
+  peer := &models.Peer{CreatedOn: *createdOn}
+  for retry := 0; retry < 100; retry++ {
+    if err := r.allocator.Allocate(ctx, peer); err != nil {
+      return nil, err
+    }
+    if ip := peer.AssignedIP.To4(); !taken[ip.String()] {
+      *createdOn = peer.CreatedOn
+      return ip, nil
+    }
+    peer.CreatedOn = peer.CreatedOn.Add(time.Millisecond)
+  }
+  return nil, nil
+}
+
+// diffDevice compares the peers of the device, their allowed IPs and
+// preshared keys, with the active desired peers that have a public key. Device peers belonging to peers the
+// reconciler does not manage are left alone.
+func (r *Reconciler) diffDevice(ctx context.Context, desired []*desiredPeer, existing []models.Peer) ([]wgutil.DevicePeer, []string, []models.ReconcileAction, error) {
+  current, err := r.wireGuard.Peers(ctx)
+  if err != nil {
+    return nil, nil, nil, fmt.Errorf("unable to list device peers: %w", err)
+  }
+  onDevice := make(map[string]wgutil.DevicePeer, len(current))
+  for _, peer := range current {
+    onDevice[peer.PublicKey] = peer
+  }
+
+  wanted := make(map[string]bool)
+  var set []wgutil.DevicePeer
+  var actions []models.ReconcileAction
+  for _, entry := range desired {
+    if entry.PublicKey == "" || entry.Status != models.PeerStatusActive {
+      continue
+    }
+    if entry.resolved == nil {
+      // The peer has a conflict and is left out of the plan.
+      continue
+    }
+    wanted[entry.PublicKey] = true
+
+    allowed := append([]string{entry.resolved.String() + "/32"}, entry.Routes...)
+    sort.Strings(allowed)
+    devicePeer := wgutil.DevicePeer{PublicKey: entry.PublicKey, AllowedIPs: allowed}
+    if r.psks != nil {
+      if devicePeer.PresharedKey, err = r.psks.Open(entry.peer); err != nil {
+        return nil, nil, nil, err
+      }
+    }
+
+    have, ok := onDevice[entry.PublicKey]
+    allowedChanged := !ok || !slices.Equal(have.AllowedIPs, allowed)
+    // A key missing from the device is set; one the peer lacks is left.
+    keyChanged := devicePeer.PresharedKey != "" && have.PresharedKey != devicePeer.PresharedKey
+    if !allowedChanged && !keyChanged {
+      continue
+    }
+    action := models.ReconcileAction{Op: models.ReconcileOpCreate, Kind: models.ReconcileKindDevicePeer, Name: entry.Name,
+      Changes: []string{"allowed_ips " + strings.Join(allowed, ",")}}
+    if ok {
+      action.Op = models.ReconcileOpUpdate
+      action.Changes = nil
+      if allowedChanged {
+        action.Changes = append(action.Changes, fmt.Sprintf("allowed_ips %s -> %s", strings.Join(have.AllowedIPs, ","), strings.Join(allowed, ",")))
+      }
+      if keyChanged {
+        action.Changes = append(action.Changes, "preshared_key")
+      }
+    }
+    actions = append(actions, action)
+    set = append(set, devicePeer)
+  }
+
+  keep := make(map[string]bool)
+  for i := range existing {
+    if !isManaged(&existing[i]) {
+      keep[existing[i].PublicKey] = true
+    }
+  }
+  var remove []string
+  for _, peer := range current {
+    if wanted[peer.PublicKey] || keep[peer.PublicKey] {
+      continue
+    }
+    remove = append(remove, peer.PublicKey)
+    actions = append(actions, models.ReconcileAction{Op: models.ReconcileOpDelete, Kind: models.ReconcileKindDevicePeer, Name: peer.PublicKey})
+  }
+  return set, remove, actions, nil
+}
+
+// applySteps stores the database changes of a plan in one transaction and
+// records them in the audit log once it committed.
+func (r *Reconciler) applySteps(ctx context.Context, steps []reconcileStep) error {
+  var deletes []uuid.UUID
+  var updates, creates []*models.Peer
+  for _, step := range steps {
+    switch step.action.Op {
+    case models.ReconcileOpDelete:
+      deletes = append(deletes, *step.before.ID)
+    case models.ReconcileOpUpdate:
+      updates = append(updates, step.after)
+    case models.ReconcileOpCreate:
+      creates = append(creates, step.after)
+    }
+  }
+  if err := r.store.ApplyPeerChanges(ctx, deletes, updates, creates); err != nil {
+    return err
+  }
+
+  for _, step := range steps {
+    switch step.action.Op {
+    case models.ReconcileOpDelete:
+      audit.Record(ctx, r.store, "peer.delete", step.before.ID.String(), step.before, nil)
+    case models.ReconcileOpUpdate:
+      audit.Record(ctx, r.store, "peer.update", step.after.ID.String(), step.before, step.after)
+    case models.ReconcileOpCreate:
+      audit.Record(ctx, r.store, "peer.create", step.after.ID.String(), nil, step.after)
+    }
+  }
+  return nil
+}
+
+// WritePlan prints plan for humans, one action per line.
+func WritePlan(w io.Writer, plan *models.ReconcilePlan) error {
+  symbols := map[string]string{models.ReconcileOpCreate: "+", models.ReconcileOpUpdate: "~", models.ReconcileOpDelete: "-"}
+  var b strings.Builder
+  for _, action := range plan.Actions {
+    fmt.Fprintf(&b, "%s %s %s", symbols[action.Op], action.Kind, action.Name)
+    if len(action.Changes) > 0 {
+      fmt.Fprintf(&b, ": %s", strings.Join(action.Changes, ", "))
+    }
+    b.WriteString("\n")
+  }
+  for _, conflict := range plan.Conflicts {
+    fmt.Fprintf(&b, "! %s\n", conflict)
+  }
+  switch {
+  case len(plan.Conflicts) > 0:
+    b.WriteString("Plan has conflicts and cannot be applied.\n")
+  case len(plan.Actions) == 0:
+    b.WriteString("No changes.\n")
+  case plan.Applied:
+    fmt.Fprintf(&b, "Applied %d changes.\n", len(plan.Actions))
+  default:
+    fmt.Fprintf(&b, "%d changes to apply.\n", len(plan.Actions))
+  }
+  _, err := io.WriteString(w, b.String())
+  return err
+}
+
+// peerChanges describes how after differs from current.
+func peerChanges(current, after *models.Peer, entry *desiredPeer) []string {
+  var changes []string
+  if name := metaString(current, "name"); name != entry.Name {
+    changes = append(changes, fmt.Sprintf("name %q -> %q", name, entry.Name))
+  }
+  if !isManaged(current) {
+    changes = append(changes, "managed")
+  }
+  if current.PublicKey != after.PublicKey {
+    changes = append(changes, "public_key")
+  }
+  if !current.AssignedIP.Equal(after.AssignedIP) {
+    changes = append(changes, fmt.Sprintf("ip %s -> %s", current.AssignedIP, after.AssignedIP))
+  }
+  if current.Status != after.Status {
+    changes = append(changes, fmt.Sprintf("status %s -> %s", current.Status, after.Status))
+  }
+  if current.IsGateway != after.IsGateway {
+    changes = append(changes, fmt.Sprintf("gateway %t -> %t", current.IsGateway, after.IsGateway))
+  }
+  if owner := metaString(current, "owner"); owner != entry.Owner {
+    changes = append(changes, fmt.Sprintf("owner %q -> %q", owner, entry.Owner))
+  }
+  if tags := metaStrings(current, "tags"); !slices.Equal(tags, entry.Tags) {
+    changes = append(changes, fmt.Sprintf("tags [%s] -> [%s]", strings.Join(tags, ","), strings.Join(entry.Tags, ",")))
+  }
+  if routes := metaStrings(current, "routes"); !slices.Equal(routes, entry.Routes) {
+    changes = append(changes, fmt.Sprintf("routes [%s] -> [%s]", strings.Join(routes, ","), strings.Join(entry.Routes, ",")))
+  }
+  return changes
+}
+
+// desiredMetadata returns the metadata of current, if any, with the fields
+// described by entry replaced.
+func desiredMetadata(current *models.Peer, entry *desiredPeer) *map[string]interface{} {
+  metadata := make(map[string]interface{})
+  if current != nil && current.Metadata != nil {
+    for key, value := range *current.Metadata {
+      metadata[key] = value
+    }
+  }
+  metadata["name"] = entry.Name
+  metadata["managed_by"] = ManagedByReconcile
+  setMeta(metadata, "owner", entry.Owner, entry.Owner != "")
+  setMeta(metadata, "tags", entry.Tags, len(entry.Tags) > 0)
+  setMeta(metadata, "routes", entry.Routes, len(entry.Routes) > 0)
+  return &metadata
+}
+
+func setMeta(metadata map[string]interface{}, key string, value any, set bool) {
+  if set {
+    metadata[key] = value
+  } else {
+    delete(metadata, key)
+  }
+}
+
+func isManaged(peer *models.Peer) bool {
+  return metaString(peer, "managed_by") == ManagedByReconcile
+}
+
+func metaString(peer *models.Peer, key string) string {
+  if peer.Metadata == nil {
+    return ""
+  }
+  value, _ := (*peer.Metadata)[key].(string)
+  return value
+}
+
+// metaStrings reads a list of strings from the metadata of peer, which is
+// []interface{} once it went through JSON.
+func metaStrings(peer *models.Peer, key string) []string {
+  if peer.Metadata == nil {
+    return nil
+  }
+  switch value := (*peer.Metadata)[key].(type) {
+  case []string:
+    return value
+  case []interface{}:
+    values := make([]string, 0, len(value))
+    for _, v := range value {
+      if s, ok := v.(string); ok {
+        values = append(values, s)
+      }
+    }
+    return values
+  }
+  return nil
+}
+
+func peerName(peer *models.Peer) string {
+  if name := metaString(peer, "name"); name != "" {
+    return name
+  }
+  return peer.ID.String()
+}
+
+func normaliseTags(tags []string) []string {
+  var normalised []string
+  for _, tag := range tags {
+    if tag = strings.TrimSpace(tag); tag != "" {
+      normalised = append(normalised, tag)
+    }
+  }
+  return normalised
+}
+
+func inRanges(ip net.IP, ranges []config.Ip_Range) bool {
+  for _, r := range ranges {
+    if r.Contains(ip) {
+      return true
+    }
+  }
+  return false
+}
+
+// allocateFrom returns the lowest address of pools that is not taken, nil
+// when they are full.
+func allocateFrom(pools []config.Ip_Range, taken map[string]bool) net.IP {
+  for _, pool := range pools {
+    for n := ipToUint32(pool.Start); n <= ipToUint32(pool.End) && n >= ipToUint32(pool.Start); n++ {
+      ip := make(net.IP, 4)
+      binary.BigEndian.PutUint32(ip, n)
+      if !taken[ip.String()] {
+        return ip
+      }
+    }
+  }
+  return nil
+}
+
+func ipToUint32(ip net.IP) uint32 {
+  return binary.BigEndian.Uint32(ip.To4())
+}
@@ -0,0 +1,52 @@
+package services
+
+import (
+  "elysium-backend/internal/models"
+  "errors"
+  "strings"
+  "testing"
+)
+
+func TestParseDesiredState(t *testing.T) {
+  for _, input := range []string{
+    "peers:\n  - name: a\n    tags: [x]\n",
+    `{"peers": [{"name": "a", "tags": ["x"]}]}`,
+  } {
+    state, err := ParseDesiredState(strings.NewReader(input))
+    if err != nil {
+      t.Fatalf("ParseDesiredState(%q) failed: %v", input, err)
+    }
+    if len(state.Peers) != 1 || state.Peers[0].Name != "a" || len(state.Peers[0].Tags) != 1 {
+      t.Errorf("unexpected state %+v", state)
+    }
+  }
+
+  for _, input := range []string{"", "peers: [", "nodes: []\n"} {
+    if _, err := ParseDesiredState(strings.NewReader(input)); !errors.Is(err, ErrInvalidState) {
+      t.Errorf("expected %q to be rejected, got %v", input, err)
+    }
+  }
+}
+
+func TestWritePlan(t *testing.T) {
+  plan := &models.ReconcilePlan{Actions: []models.ReconcileAction{
+    {Op: models.ReconcileOpDelete, Kind: models.ReconcileKindPeer, Name: "old"},
+    {Op: models.ReconcileOpUpdate, Kind: models.ReconcileKindPeer, Name: "bob", Changes: []string{"status pending -> active"}},
+    {Op: models.ReconcileOpCreate, Kind: models.ReconcileKindGateway, Name: "office", Changes: []string{"ip 10.0.0.3"}},
+  }}
+
+  var b strings.Builder
+  if err := WritePlan(&b, plan); err != nil {
+    t.Fatalf("WritePlan failed: %v", err)
+  }
+  expected := "- peer old\n~ peer bob: status pending -> active\n+ gateway office: ip 10.0.0.3\n3 changes to apply.\n"
+  if b.String() != expected {
+    t.Errorf("expected %q, got %q", expected, b.String())
+  }
+
+  b.Reset()
+  WritePlan(&b, &models.ReconcilePlan{})
+  if b.String() != "No changes.\n" {
+    t.Errorf("unexpected empty plan %q", b.String())
+  }
+}
@@ -0,0 +1,696 @@
+package services
+
+import (
+  "archive/zip"
+  "context"
+  "database/sql"
+  "elysium-backend/config"
+  "elysium-backend/internal/audit"
+  "elysium-backend/internal/models"
+  "elysium-backend/pkg/logger"
+  "elysium-backend/pkg/wgutil"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "net"
+  "path"
+  "path/filepath"
+  "sync"
+  "time"
+
+  "github.com/google/uuid"
+)
+
+var (
+  ErrRotationInProgress = errors.New("a key rotation is already in progress")
+  ErrRotationFinished   = errors.New("the key rotation has already finished")
+)
+
+// rotationEndpoints returns the two endpoints key rotations alternate
+// between: the configured interface and the alternate one.
+func rotationEndpoints(cfg config.WireGuardConfig) (wgutil.Endpoint, wgutil.Endpoint) {
+  return wgutil.Endpoint{Interface: cfg.Interface, Port: cfg.Port, KeyFile: wgutil.ServerKeyFile},
+    wgutil.Endpoint{Interface: cfg.AltInterface, Port: cfg.AltPort, KeyFile: wgutil.AltServerKeyFile}
+}
+
+// endpointFor returns the endpoint of cfg named iface, the configured one
+// when neither is.
+func endpointFor(cfg config.WireGuardConfig, iface string) wgutil.Endpoint {
+  primary, alt := rotationEndpoints(cfg)
+  if iface == alt.Interface {
+    return alt
+  }
+  return primary
+}
+
+// CurrentEndpoint returns the endpoint serving the key in use: the
+// configured interface until a rotation completes, then the one the latest
+// rotation switched to.
+func CurrentEndpoint(ctx context.Context, store Store, cfg config.WireGuardConfig) (wgutil.Endpoint, error) {
+  latest, err := store.LatestKeyRotation(ctx)
+  if errors.Is(err, sql.ErrNoRows) {
+    return endpointFor(cfg, cfg.Interface), nil
+  } else if err != nil {
+    return wgutil.Endpoint{}, err
+  }
+
+  switch latest.Status {
+  case models.KeyRotationStatusInProgress, models.KeyRotationStatusCancelled:
+    return endpointFor(cfg, latest.OldInterface), nil
+  }
+  return endpointFor(cfg, latest.NewInterface), nil
+}
+
+// KeyRotator replaces the server key without cutting off clients. The new
+// key is served on the endpoint not in use next to the old one, a client
+// connecting to it is built for every peer, and peers are tracked until they
+// connect with the new key. The old key is retired once all of them have, or
+// when the grace period runs out.
+type KeyRotator struct {
+  store     Store
+  wireGuard WireGuard
+  cfg       config.WireGuardConfig
+  builds    *BuildHistory
+  artifacts *ArtifactStore
+  psks      *PresharedKeys
+  reissues  *buildTracker
+
+  // mu serialises changes to the rotation in progress.
+  mu sync.Mutex
+}
+
+func NewKeyRotator(store Store, wireGuard WireGuard, cfg config.WireGuardConfig, builds *BuildHistory, artifacts *ArtifactStore, psks *PresharedKeys) *KeyRotator {
+  return &KeyRotator{store: store, wireGuard: wireGuard, cfg: cfg, builds: builds, artifacts: artifacts, psks: psks, reissues: newBuildTracker()}
+}
+
+// inProgress returns the rotation in progress, nil if there is none.
+func (r *KeyRotator) inProgress(ctx context.Context) (*models.KeyRotation, error) {
+  latest, err := r.store.LatestKeyRotation(ctx)
+  if errors.Is(err, sql.ErrNoRows) {
+    return nil, nil
+  } else if err != nil {
+    return nil, err
+  }
+  if latest.Status != models.KeyRotationStatusInProgress {
+    return nil, nil
+  }
+  return latest, nil
+}
+
+// Start generates a new key, brings it up on the endpoint not in use and
+// records a rotation tracking every peer that is not disabled. grace
+// defaults to WG_ROTATION_GRACE when 0. Peers are re-issued for the target
+// of their latest artifact, or fallback when they have none. The clients
+// still have to be built with StartReissue. Clients being built against the old
+// key meanwhile are re-issued once they are tracked.
+func (r *KeyRotator) Start(ctx context.Context, grace time.Duration, fallback models.OSArch) (*models.KeyRotation, error) {
+  log := logger.FromContext(ctx)
+  r.mu.Lock()
+  defer r.mu.Unlock()
+
+  if current, err := r.inProgress(ctx); err != nil {
+    return nil, err
+  } else if current != nil {
+    return nil, ErrRotationInProgress
+  }
+  if grace <= 0 {
+    grace = r.cfg.RotationGrace
+  }
+
+  current, err := CurrentEndpoint(ctx, r.store, r.cfg)
+  if err != nil {
+    return nil, err
+  }
+  primary, alt := rotationEndpoints(r.cfg)
+  next := alt
+  if current.Interface == alt.Interface {
+    next = primary
+  }
+
+  oldKey, err := r.wireGuard.PublicKey()
+  if err != nil {
+    return nil, err
+  }
+  peers, err := r.store.GetAllPeer(ctx)
+  if err != nil {
+    return nil, err
+  }
+  var tracked []models.KeyRotationPeer
+  for _, peer := range peers {
+    if peer.Status == models.PeerStatusDisabled || peer.PublicKey == "" || peer.AssignedIP.Equal(r.cfg.IP) {
+      continue
+    }
+    target, err := r.artifacts.LatestTarget(ctx, *peer.ID)
+    if err != nil {
+      return nil, err
+    }
+    if target == "" {
+      target = fallback
+    }
+    tracked = append(tracked, models.KeyRotationPeer{
+      PeerID:     *peer.ID,
+      PublicKey:  peer.PublicKey,
+      AssignedIP: peer.AssignedIP,
+      Target:     target,
+      Status:     models.RotationPeerStatusPending,
+    })
+  }
+
+  newKey, err := r.wireGuard.BeginRotation(ctx, next, false)
+  if err != nil {
+    log.Error("unable to bring up the new key", "interface", next.Interface, "err", err)
+    return nil, err
+  }
+
+  now := time.Now().UTC()
+  rotation := &models.KeyRotation{
+    ID:           uuid.New(),
+    Status:       models.KeyRotationStatusInProgress,
+    OldPublicKey: oldKey,
+    NewPublicKey: newKey,
+    OldInterface: current.Interface,
+    OldPort:      current.Port,
+    NewInterface: next.Interface,
+    NewPort:      next.Port,
+    StartedAt:    now,
+    ExpiresAt:    now.Add(grace),
+    Peers:        tracked,
+  }
+  if err := r.store.InsertKeyRotation(ctx, rotation); err != nil {
+    if endErr := r.wireGuard.EndRotation(ctx, false); endErr != nil {
+      log.Error("unable to discard the new key", "err", endErr)
+    }
+    return nil, err
+  }
+
+  log.Info("key rotation started", "rotation_id", rotation.ID.String(), "interface", next.Interface, "port", next.Port, "peers", len(tracked))
+  audit.Record(ctx, r.store, "wireguard.rotation.start", rotation.ID.String(), nil, rotationSummary(rotation))
+  return rotation, nil
+}
+
+// rotationSummary is rotation as recorded in the audit log, without its
+// peers.
+func rotationSummary(rotation *models.KeyRotation) map[string]any {
+  return map[string]any{
+    "status":         rotation.Status,
+    "old_public_key": rotation.OldPublicKey,
+    "new_public_key": rotation.NewPublicKey,
+    "new_interface":  rotation.NewInterface,
+    "new_port":       rotation.NewPort,
+    "expires_at":     rotation.ExpiresAt,
+    "peers":          len(rotation.Peers),
+  }
+}
+
+// StartReissue runs Reissue for rotation in the background, detached from
+// ctx, until it is done or Shutdown interrupts it. It fails with
+// ErrShuttingDown once Shutdown has been called; the clients left pending
+// are then re-issued when the rotation is resumed on the next start.
+func (r *KeyRotator) StartReissue(ctx context.Context, rotation *models.KeyRotation) error {
+  runCtx, done, err := r.reissues.start(context.WithoutCancel(ctx))
+  if err != nil {
+    return err
+  }
+  go func() {
+    defer done()
+    r.Reissue(runCtx, rotation)
+  }()
+  return nil
+}
+
+// Shutdown stops re-issuing clients after the current one and waits until
+// ctx expires, when the running build is cancelled. Interrupted peers stay
+// pending.
+func (r *KeyRotator) Shutdown(ctx context.Context) error {
+  return r.reissues.shutdown(ctx)
+}
+
+// Reissue builds a client connecting to the new key for every peer of
+// rotation still pending, in turn. It stops early when the rotation is no
+// longer in progress or Shutdown was called.
+func (r *KeyRotator) Reissue(ctx context.Context, rotation *models.KeyRotation) {
+  log := logger.FromContext(ctx).With("rotation_id", rotation.ID.String())
+
+  for _, peer := range rotation.Peers {
+    if peer.Status != models.RotationPeerStatusPending {
+      continue
+    }
+    if r.reissues.stopping() || ctx.Err() != nil {
+      log.Info("re-issuing clients interrupted", "peer_id", peer.PeerID.String())
+      return
+    }
+    current, err := r.store.GetKeyRotation(ctx, rotation.ID)
+    if err != nil {
+      log.Error("unable to retrieve key rotation", "err", err)
+      return
+    }
+    if current.Status != models.KeyRotationStatusInProgress {
+      log.Info("key rotation finished before every client was re-issued", "status", current.Status)
+      return
+    }
+    // The peer may have been given a client for the new key since.
+    if tracked := current.Peer(peer.PeerID); tracked == nil || tracked.Status != models.RotationPeerStatusPending {
+      continue
+    }
+
+    peerLog := log.With("peer_id", peer.PeerID.String())
+    buildID, artifactID, err := r.reissue(logger.WithContext(ctx, peerLog), rotation, peer)
+    if err != nil && ctx.Err() != nil {
+      // Cancelled by shutdown: the peer stays pending until the rotation is
+      // resumed.
+      peerLog.Warn("client re-issue interrupted", "err", err)
+      return
+    }
+    if err != nil {
+      peerLog.Error("unable to re-issue client", "err", err)
+    } else {
+      peerLog.Info("client re-issued", "artifact_id", artifactID.String())
+    }
+
+    r.updatePeer(ctx, rotation.ID, peer.PeerID, func(tracked *models.KeyRotationPeer) {
+      tracked.BuildID, tracked.ArtifactID = buildID, artifactID
+      // A peer may have connected with a client built by other means.
+      if tracked.Status == models.RotationPeerStatusMigrated {
+        return
+      }
+      if err != nil {
+        tracked.Status = models.RotationPeerStatusFailed
+        tracked.Error = err.Error()
+      } else {
+        tracked.Status = models.RotationPeerStatusReissued
+      }
+    })
+  }
+}
+
+func (r *KeyRotator) reissue(ctx context.Context, rotation *models.KeyRotation, peer models.KeyRotationPeer) (*uuid.UUID, *uuid.UUID, error) {
+  if peer.Target == "" {
+    return nil, nil, errors.New("the peer has no artifact to take the target from and no fallback target was given")
+  }
+
+  presharedKey, err := r.psks.Lookup(ctx, peer.PeerID)
+  if err != nil {
+    return nil, nil, err
+  }
+
+  build, _, err := r.builds.Run(ctx, BuildRequest{
+    Target: peer.Target,
+    Bundle: ClientBundle{PublicKey: rotation.NewPublicKey, AssignedIP: peer.AssignedIP, ServerPort: rotation.NewPort, PresharedKey: presharedKey},
+  })
+  var buildID *uuid.UUID
+  if build != nil {
+    buildID = &build.ID
+  }
+  if err != nil {
+    return buildID, nil, err
+  }
+
+  artifact, err := r.artifacts.Record(ctx, peer.PeerID, build)
+  if err != nil {
+    return buildID, nil, err
+  }
+  return buildID, &artifact.ID, nil
+}
+
+// clientEndpoint returns the new key and port of the rotation in progress,
+// the key in use and the port serving it otherwise. A rotation may start or
+// be cancelled while the client is built; track finds out.
+func (r *KeyRotator) clientEndpoint(ctx context.Context) (*ClientEndpoint, error) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+
+  rotation, err := r.inProgress(ctx)
+  if err != nil {
+    return nil, err
+  }
+  if rotation != nil {
+    return &ClientEndpoint{PublicKey: rotation.NewPublicKey, Port: rotation.NewPort}, nil
+  }
+
+  current, err := CurrentEndpoint(ctx, r.store, r.cfg)
+  if err != nil {
+    return nil, err
+  }
+  key, err := r.wireGuard.PublicKey()
+  if err != nil {
+    return nil, err
+  }
+  return &ClientEndpoint{PublicKey: key, Port: current.Port}, nil
+}
+
+// track checks that the key of endpoint, which peer was given a client
+// for, is still served. A client for the new key of the rotation in
+// progress has peer tracked by it as re-issued, adding it when it joined
+// after the start. A client for the old key, built while the rotation
+// started, has peer tracked as pending and a client for the new key
+// re-issued in the background. It fails with ErrEndpointChanged when the
+// key was discarded by a cancelled rotation. Peers without a public key
+// cannot be told apart by their handshakes and are left out, as in Start,
+// and so are peers that migrated already.
+func (r *KeyRotator) track(ctx context.Context, endpoint *ClientEndpoint, peer models.KeyRotationPeer) error {
+  log := logger.FromContext(ctx).With("peer_id", peer.PeerID.String())
+  r.mu.Lock()
+  defer r.mu.Unlock()
+
+  rotation, err := r.inProgress(ctx)
+  if err != nil {
+    log.Error("failed to record key rotation progress", "err", err)
+    return nil
+  }
+  if rotation == nil {
+    key, err := r.wireGuard.PublicKey()
+    if err != nil {
+      log.Error("unable to check the key in use", "err", err)
+      return nil
+    }
+    if endpoint.PublicKey != key {
+      log.Warn("the server key the client was built for was discarded")
+      return ErrEndpointChanged
+    }
+    return nil
+  }
+
+  switch endpoint.PublicKey {
+  case rotation.NewPublicKey:
+    peer.Status = models.RotationPeerStatusReissued
+  case rotation.OldPublicKey:
+    peer.Status, peer.BuildID, peer.ArtifactID = models.RotationPeerStatusPending, nil, nil
+  default:
+    log.Warn("the server key the client was built for was discarded")
+    return ErrEndpointChanged
+  }
+  if peer.PublicKey == "" {
+    return nil
+  }
+
+  log = log.With("rotation_id", rotation.ID.String())
+  tracked := rotation.Peer(peer.PeerID)
+  switch {
+  case tracked == nil:
+    err = r.store.InsertKeyRotationPeer(ctx, rotation.ID, &peer)
+  case tracked.Status != models.RotationPeerStatusMigrated:
+    err = r.store.UpdateKeyRotationPeer(ctx, rotation.ID, &peer)
+  default:
+    return nil
+  }
+  if err != nil {
+    log.Error("failed to record key rotation progress", "err", err)
+    return nil
+  }
+  log.Info("peer tracked by key rotation", "status", peer.Status)
+
+  if peer.Status == models.RotationPeerStatusPending {
+    // Left pending when shutting down, to be re-issued on the next start.
+    reissue := *rotation
+    reissue.Peers = []models.KeyRotationPeer{peer}
+    if err := r.StartReissue(ctx, &reissue); err != nil {
+      log.Warn("unable to re-issue client", "err", err)
+    }
+  }
+  return nil
+}
+
+// updatePeer applies update to the stored progress of peerID in rotation
+// rotationID.
+func (r *KeyRotator) updatePeer(ctx context.Context, rotationID, peerID uuid.UUID, update func(*models.KeyRotationPeer)) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+
+  rotation, err := r.store.GetKeyRotation(ctx, rotationID)
+  if err != nil {
+    logger.FromContext(ctx).Error("failed to record key rotation progress", "rotation_id", rotationID.String(), "err", err)
+    return
+  }
+  for i := range rotation.Peers {
+    if rotation.Peers[i].PeerID == peerID {
+      update(&rotation.Peers[i])
+      if err := r.store.UpdateKeyRotationPeer(ctx, rotationID, &rotation.Peers[i]); err != nil {
+        logger.FromContext(ctx).Error("failed to record key rotation progress", "rotation_id", rotationID.String(), "err", err)
+      }
+      return
+    }
+  }
+}
+
+// Check marks the peers that have connected with the new key as migrated
+// and routes their traffic to it. It retires the old key once every peer
+// that still exists and is not disabled has migrated, or when the rotation
+// expired. It returns the rotation in progress, nil when there is none.
+func (r *KeyRotator) Check(ctx context.Context) (*models.KeyRotation, error) {
+  log := logger.FromContext(ctx)
+  r.mu.Lock()
+  defer r.mu.Unlock()
+
+  rotation, err := r.inProgress(ctx)
+  if err != nil || rotation == nil {
+    return nil, err
+  }
+  log = log.With("rotation_id", rotation.ID.String())
+
+  handshakes, err := r.wireGuard.RotationHandshakes(ctx)
+  if err != nil {
+    return nil, err
+  }
+  var migrated []*models.KeyRotationPeer
+  var ips []net.IP
+  for i := range rotation.Peers {
+    peer := &rotation.Peers[i]
+    if handshake, ok := handshakes[peer.PublicKey]; ok && peer.Status != models.RotationPeerStatusMigrated {
+      handshake = handshake.UTC()
+      peer.Status = models.RotationPeerStatusMigrated
+      peer.MigratedAt = &handshake
+      migrated = append(migrated, peer)
+      ips = append(ips, peer.AssignedIP)
+    }
+  }
+  if len(migrated) > 0 {
+    if err := r.wireGuard.RoutePeers(ctx, ips); err != nil {
+      return nil, err
+    }
+    for _, peer := range migrated {
+      if err := r.store.UpdateKeyRotationPeer(ctx, rotation.ID, peer); err != nil {
+        return nil, err
+      }
+      log.Info("peer migrated to the new key", "peer_id", peer.PeerID.String())
+    }
+  }
+
+  outstanding, err := r.outstanding(ctx, rotation)
+  if err != nil {
+    return nil, err
+  }
+  if outstanding == 0 {
+    return rotation, r.finish(ctx, rotation, models.KeyRotationStatusCompleted)
+  }
+  if !time.Now().Before(rotation.ExpiresAt) {
+    log.Warn("key rotation expired before every peer migrated", "outstanding", outstanding)
+    return rotation, r.finish(ctx, rotation, models.KeyRotationStatusExpired)
+  }
+  return rotation, nil
+}
+
+// outstanding counts the peers of rotation that have not migrated yet and
+// still need to: peers removed or disabled since are not waited for.
+func (r *KeyRotator) outstanding(ctx context.Context, rotation *models.KeyRotation) (int, error) {
+  peers, err := r.store.GetAllPeer(ctx)
+  if err != nil {
+    return 0, err
+  }
+  waiting := make(map[uuid.UUID]bool, len(peers))
+  for _, peer := range peers {
+    waiting[*peer.ID] = peer.Status != models.PeerStatusDisabled
+  }
+
+  count := 0
+  for _, peer := range rotation.Peers {
+    if peer.Status != models.RotationPeerStatusMigrated && waiting[peer.PeerID] {
+      count++
+    }
+  }
+  return count, nil
+}
+
+// finish retires the old key and records rotation as finished with status.
+func (r *KeyRotator) finish(ctx context.Context, rotation *models.KeyRotation, status string) error {
+  log := logger.FromContext(ctx)
+
+  if err := r.wireGuard.EndRotation(ctx, true); err != nil {
+    log.Error("unable to retire the old key", "err", err)
+    return err
+  }
+  if err := RegisterServerPeer(ctx, r.store, rotation.NewPublicKey, r.cfg.IP); err != nil {
+    log.Error("unable to record the new server key", "err", err)
+  }
+
+  before := rotationSummary(rotation)
+  finishedAt := time.Now().UTC()
+  rotation.Status = status
+  rotation.FinishedAt = &finishedAt
+  if err := r.store.FinishKeyRotation(ctx, rotation); err != nil {
+    return err
+  }
+  log.Info("key rotation finished, old key retired", "status", status)
+  audit.Record(ctx, r.store, "wireguard.rotation.finish", rotation.ID.String(), before, rotationSummary(rotation))
+  return nil
+}
+
+// Cancel discards the new key of the rotation id while it is in progress.
+// Peers keep using the old key; clients re-issued for the new one stop
+// working.
+func (r *KeyRotator) Cancel(ctx context.Context, id uuid.UUID) (*models.KeyRotation, error) {
+  log := logger.FromContext(ctx)
+  r.mu.Lock()
+  defer r.mu.Unlock()
+
+  rotation, err := r.store.GetKeyRotation(ctx, id)
+  if err != nil {
+    return nil, err
+  }
+  if rotation.Status != models.KeyRotationStatusInProgress {
+    return nil, ErrRotationFinished
+  }
+
+  if err := r.wireGuard.EndRotation(ctx, false); err != nil {
+    log.Error("unable to discard the new key", "err", err)
+    return nil, err
+  }
+  before := rotationSummary(rotation)
+  finishedAt := time.Now().UTC()
+  rotation.Status = models.KeyRotationStatusCancelled
+  rotation.FinishedAt = &finishedAt
+  if err := r.store.FinishKeyRotation(ctx, rotation); err != nil {
+    return nil, err
+  }
+  log.Info("key rotation cancelled", "rotation_id", id.String())
+  audit.Record(ctx, r.store, "wireguard.rotation.cancel", id.String(), before, rotationSummary(rotation))
+  return rotation, nil
+}
+
+// Resume brings the new key of a rotation in progress back up after a
+// restart, with the routes of the peers that migrated already. It returns
+// the rotation, nil when there is none.
+func (r *KeyRotator) Resume(ctx context.Context) (*models.KeyRotation, error) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+
+  rotation, err := r.inProgress(ctx)
+  if err != nil || rotation == nil {
+    return nil, err
+  }
+  if _, err := r.wireGuard.BeginRotation(ctx, endpointFor(r.cfg, rotation.NewInterface), true); err != nil {
+    return nil, err
+  }
+
+  var ips []net.IP
+  for _, peer := range rotation.Peers {
+    if peer.Status == models.RotationPeerStatusMigrated {
+      ips = append(ips, peer.AssignedIP)
+    }
+  }
+  if len(ips) > 0 {
+    if err := r.wireGuard.RoutePeers(ctx, ips); err != nil {
+      return nil, err
+    }
+  }
+  logger.FromContext(ctx).Info("key rotation resumed", "rotation_id", rotation.ID.String(), "interface", rotation.NewInterface)
+  return rotation, nil
+}
+
+// Run checks the rotation in progress every interval until ctx is
+// cancelled.
+func (r *KeyRotator) Run(ctx context.Context, interval time.Duration) {
+  log := logger.FromContext(ctx)
+  ticker := time.NewTicker(interval)
+  defer ticker.Stop()
+
+  for {
+    if _, err := r.Check(ctx); err != nil && ctx.Err() == nil {
+      log.Error("key rotation check failed", "err", err)
+    }
+
+    select {
+    case <-ctx.Done():
+      return
+    case <-ticker.C:
+    }
+  }
+}
+
+// rotationPeerConfig is the description of a re-issued client in the
+// bundle.
+type rotationPeerConfig struct {
+  PeerID          uuid.UUID     `json:"peer_id"`
+  AssignedIP      net.IP        `json:"assigned_ip"`
+  Target          models.OSArch `json:"target"`
+  ServerPublicKey string        `json:"server_public_key"`
+  ServerPort      int           `json:"server_port"`
+  BuildID         *uuid.UUID    `json:"build_id"`
+  Binary          string        `json:"binary"`
+  SHA256          string        `json:"sha256"`
+  Signature       string        `json:"signature"`
+}
+
+// WriteBundle writes a ZIP archive of the clients re-issued for rotation to
+// w: the rotation as manifest.json and, in a directory per peer named after
+// its ID, the client binary, its detached signature and peer.json.
+func (r *KeyRotator) WriteBundle(ctx context.Context, w io.Writer, rotation *models.KeyRotation) error {
+  log := logger.FromContext(ctx).With("rotation_id", rotation.ID.String())
+  archive := zip.NewWriter(w)
+
+  manifest, err := archive.Create("manifest.json")
+  if err != nil {
+    return err
+  }
+  encoder := json.NewEncoder(manifest)
+  encoder.SetIndent("", "  ")
+  if err := encoder.Encode(rotation); err != nil {
+    return err
+  }
+
+  for _, peer := range rotation.Peers {
+    if peer.ArtifactID == nil {
+      continue
+    }
+    artifact, err := r.store.GetArtifact(ctx, *peer.ArtifactID)
+    if errors.Is(err, sql.ErrNoRows) {
+      log.Warn("re-issued artifact is gone, leaving it out of the bundle", "peer_id", peer.PeerID.String())
+      continue
+    } else if err != nil {
+      return err
+    }
+
+    dir := peer.PeerID.String()
+    binary := filepath.Base(artifact.Path)
+    files := []struct{ name, path string }{
+      {binary, r.artifacts.Path(artifact)},
+      {binary + SignatureSuffix, r.artifacts.Path(artifact) + SignatureSuffix},
+    }
+    for _, file := range files {
+      if err := addFile(archive, path.Join(dir, file.name), file.path); err != nil {
+        return fmt.Errorf("adding %s: %w", file.name, err)
+      }
+    }
+
+    config, err := archive.Create(path.Join(dir, "peer.json"))
+    if err != nil {
+      return err
+    }
+    encoder := json.NewEncoder(config)
+    encoder.SetIndent("", "  ")
+    if err := encoder.Encode(rotationPeerConfig{
+      PeerID:          peer.PeerID,
+      AssignedIP:      peer.AssignedIP,
+      Target:          peer.Target,
+      ServerPublicKey: rotation.NewPublicKey,
+      ServerPort:      rotation.NewPort,
+      BuildID:         peer.BuildID,
+      Binary:          binary,
+      SHA256:          artifact.SHA256,
+      Signature:       artifact.Signature,
+    }); err != nil {
+      return err
+    }
+  }
+  return archive.Close()
+}
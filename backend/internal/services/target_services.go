@@ -0,0 +1,82 @@
+package services
+
+import (
+  "elysium-backend/config"
+  "elysium-backend/internal/models"
+  "errors"
+  "sync"
+)
+
+var (
+  ErrUnknownTarget     = errors.New("unknown or disabled target")
+  ErrTargetUnavailable = errors.New("target is not installed in the build toolchain")
+)
+
+// TargetRegistry holds the enabled build targets from the configuration and
+// what the toolchain lacks to build each of them, as found by the last
+// toolchain check. Targets are assumed buildable until a check says
+// otherwise.
+type TargetRegistry struct {
+  mu      sync.RWMutex
+  targets []config.TargetConfig
+  missing map[models.OSArch][]string
+}
+
+func NewTargetRegistry(targets []config.TargetConfig) *TargetRegistry {
+  r := &TargetRegistry{missing: make(map[models.OSArch][]string)}
+  for _, target := range targets {
+    if target.Enabled {
+      r.targets = append(r.targets, target)
+    }
+  }
+  return r
+}
+
+// Enabled returns the configuration of the enabled targets.
+func (r *TargetRegistry) Enabled() []config.TargetConfig {
+  return r.targets
+}
+
+// Lookup returns the configuration of triple. It fails with
+// ErrUnknownTarget when the target is not enabled and with
+// ErrTargetUnavailable when the toolchain cannot build it.
+func (r *TargetRegistry) Lookup(triple models.OSArch) (config.TargetConfig, error) {
+  r.mu.RLock()
+  defer r.mu.RUnlock()
+
+  for _, target := range r.targets {
+    if target.Triple == string(triple) {
+      if len(r.missing[triple]) > 0 {
+        return target, ErrTargetUnavailable
+      }
+      return target, nil
+    }
+  }
+  return config.TargetConfig{}, ErrUnknownTarget
+}
+
+// List returns the enabled targets in configuration order.
+func (r *TargetRegistry) List() []models.Target {
+  r.mu.RLock()
+  defer r.mu.RUnlock()
+
+  list := make([]models.Target, 0, len(r.targets))
+  for _, target := range r.targets {
+    triple := models.OSArch(target.Triple)
+    list = append(list, models.Target{
+      Triple:    triple,
+      Suffix:    target.Suffix,
+      Available: len(r.missing[triple]) == 0,
+      Missing:   r.missing[triple],
+    })
+  }
+  return list
+}
+
+// setMissing records what the toolchain lacks for each target; targets
+// absent from missing are buildable.
+func (r *TargetRegistry) setMissing(missing map[models.OSArch][]string) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  r.missing = missing
+}
@@ -0,0 +1,139 @@
+package services
+
+import (
+  "context"
+  "elysium-backend/config"
+  "elysium-backend/internal/models"
+  "fmt"
+  "os"
+  "os/exec"
+  "strings"
+  "syscall"
+)
+
+// toolchain runs the programs a build needs, either on the host or inside a
+// container.
+type toolchain interface {
+  // command returns a command running name with args in the client
+  // directory, with env added to its environment. Cancelling ctx kills the
+  // program and everything it spawned.
+  command(ctx context.Context, env []string, name string, args ...string) *exec.Cmd
+  // inspect returns the installed rustup targets and the programs that
+  // cannot be found.
+  inspect(ctx context.Context, programs []string) (targets []string, missing []string, err error)
+  // environ returns the variables of the backend's own environment that
+  // reach cargo and affect the build.
+  environ() []string
+  // describe names the build backend and, for containers, the image.
+  describe() (backend, image string)
+}
+
+// hostToolchain runs cargo and rustup installed on the host.
+type hostToolchain struct {
+  clientDir string
+}
+
+func (h hostToolchain) command(ctx context.Context, env []string, name string, args ...string) *exec.Cmd {
+  cmd := exec.CommandContext(ctx, name, args...)
+  cmd.Dir = h.clientDir
+  cmd.Env = append(os.Environ(), env...)
+  // cargo spawns rustc and linker processes of its own; run it in its own
+  // process group so cancelling it takes the whole tree down.
+  cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+  cmd.Cancel = func() error {
+    return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+  }
+  return cmd
+}
+
+func (h hostToolchain) inspect(ctx context.Context, programs []string) ([]string, []string, error) {
+  var missing []string
+  for _, program := range programs {
+    if _, err := exec.LookPath(program); err != nil {
+      missing = append(missing, program)
+    }
+  }
+
+  out, err := h.command(ctx, nil, "rustup", "target", "list", "--installed").Output()
+  if err != nil {
+    return nil, nil, fmt.Errorf("unable to list installed rustup targets: %w", err)
+  }
+  return strings.Fields(string(out)), missing, nil
+}
+
+func (h hostToolchain) environ() []string {
+  var env []string
+  for _, entry := range os.Environ() {
+    if strings.HasPrefix(entry, "CARGO") || strings.HasPrefix(entry, "RUST") {
+      env = append(env, entry)
+    }
+  }
+  return env
+}
+
+func (h hostToolchain) describe() (string, string) {
+  return config.BuildBackendCargo, ""
+}
+
+// CheckToolchain verifies that cargo is available and that every enabled
+// target is installed through rustup along with its linker. It records what
+// each target lacks in the target registry, so targets become buildable
+// once the toolchain is fixed.
+func (b *CargoBuilder) CheckToolchain(ctx context.Context) error {
+  programs := []string{"cargo"}
+  for _, target := range b.targets.Enabled() {
+    if target.Linker != "" {
+      programs = append(programs, target.Linker)
+    }
+  }
+
+  installedTargets, missingPrograms, err := b.toolchain.inspect(ctx, programs)
+  if err != nil {
+    // Nothing is known about the toolchain, so no target can be assumed
+    // buildable.
+    byTarget := make(map[models.OSArch][]string)
+    for _, target := range b.targets.Enabled() {
+      byTarget[models.OSArch(target.Triple)] = []string{"toolchain: " + err.Error()}
+    }
+    b.targets.setMissing(byTarget)
+    return err
+  }
+
+  installed := make(map[string]bool)
+  for _, target := range installedTargets {
+    installed[target] = true
+  }
+  absent := make(map[string]bool)
+  for _, program := range missingPrograms {
+    absent[program] = true
+  }
+
+  var missing []string
+  if absent["cargo"] {
+    missing = append(missing, "cargo")
+  }
+  byTarget := make(map[models.OSArch][]string)
+  for _, target := range b.targets.Enabled() {
+    var lacking []string
+    if absent["cargo"] {
+      lacking = append(lacking, "cargo")
+    }
+    if !installed[target.Triple] {
+      lacking = append(lacking, "target "+target.Triple)
+      missing = append(missing, "target "+target.Triple)
+    }
+    if target.Linker != "" && absent[target.Linker] {
+      lacking = append(lacking, "linker "+target.Linker)
+      missing = append(missing, "linker "+target.Linker)
+    }
+    if len(lacking) > 0 {
+      byTarget[models.OSArch(target.Triple)] = lacking
+    }
+  }
+  b.targets.setMissing(byTarget)
+
+  if len(missing) > 0 {
+    return fmt.Errorf("missing build toolchain components: %s", strings.Join(missing, ", "))
+  }
+  return nil
+}
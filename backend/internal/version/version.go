@@ -0,0 +1,36 @@
+package version
+
+import (
+  "runtime"
+  "runtime/debug"
+)
+
+// Version and Commit are set at build time with
+// -ldflags "-X elysium-backend/internal/version.Version=... -X elysium-backend/internal/version.Commit=...".
+var (
+  Version = "dev"
+  Commit  = ""
+)
+
+type Info struct {
+  Version   string `json:"version"`
+  Commit    string `json:"commit,omitempty"`
+  GoVersion string `json:"go_version"`
+}
+
+// Get returns the build information, falling back to the VCS revision
+// recorded by the Go toolchain when Commit was not set explicitly.
+func Get() Info {
+  info := Info{Version: Version, Commit: Commit, GoVersion: runtime.Version()}
+
+  if info.Commit == "" {
+    if build, ok := debug.ReadBuildInfo(); ok {
+      for _, setting := range build.Settings {
+        if setting.Key == "vcs.revision" {
+          info.Commit = setting.Value
+        }
+      }
+    }
+  }
+  return info
+}
@@ -1,79 +1,396 @@
 package main
 
 import (
+  "context"
+  "crypto/tls"
+  "errors"
   "flag"
-  "log"
-  "net"
+  "fmt"
+  "log/slog"
   "net/http"
-  "strconv"
+  "os"
+  "os/signal"
+  "syscall"
+  "time"
 
   "elysium-backend/config"
+  "elysium-backend/internal/audit"
+  "elysium-backend/internal/handlers"
+  "elysium-backend/internal/health"
+  "elysium-backend/internal/metrics"
+  "elysium-backend/internal/repositories"
   "elysium-backend/internal/routes"
+  "elysium-backend/internal/services"
+  "elysium-backend/pkg/backup"
   "elysium-backend/pkg/db"
+  "elysium-backend/pkg/keystore"
+  "elysium-backend/pkg/signing"
+  "elysium-backend/pkg/tlsutil"
   "elysium-backend/pkg/wgutil"
 )
 
 func main() {
+  os.Exit(run())
+}
 
+// run wires everything up and blocks until the server stops. It returns the
+// process exit code so deferred cleanup runs before main exits.
+func run() int {
   envFilePath := flag.String("env", "../local.env", "Path to the env file")
   setupWg := flag.Bool("setupWg", true, "Setup wireguard network")
+  flag.Usage = func() {
+    fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] [migrate <command> | reconcile [-apply] <file> | backup [-o <file>] | restore <file>]\n", os.Args[0])
+    flag.PrintDefaults()
+  }
   flag.Parse()
-  config.LoadEnv(*envFilePath)
-  log.Println("main.setupConfig -> configuration loaded")
+  logLevel := config.LoadEnv(*envFilePath)
+  slog.Info("configuration loaded", "env", *envFilePath)
+
+  switch flag.Arg(0) {
+  case "migrate":
+    return runMigrate(flag.Args()[1:])
+  case "reconcile":
+    return runReconcile(flag.Args()[1:], *setupWg)
+  case "backup":
+    return runBackup(flag.Args()[1:])
+  case "restore":
+    return runRestore(flag.Args()[1:])
+  }
+
+  cfg, err := config.Load()
+  if err != nil {
+    slog.Error("invalid configuration", "err", err)
+    return 1
+  }
+
+  ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+  defer stop()
+
+  pool, err := setupDatabase(cfg)
+  if err != nil {
+    slog.Error("database setup failed", "err", err)
+    return 1
+  }
+  defer func() {
+    pool.Close()
+    slog.Info("database connection closed")
+  }()
+  store := repositories.NewSQLStore(pool, cfg.DBQueryTimeout)
+
+  keys, err := openKeystore(cfg)
+  if err != nil {
+    slog.Error("invalid key encryption configuration", "err", err)
+    return 1
+  }
+
+  // wireGuard stays a nil interface when the interface is not managed here.
+  var wireGuard services.WireGuard
+  var controller *wgutil.Controller
+  wgInterface := func() string { return cfg.WireGuard.Interface }
+  if *setupWg {
+    endpoint, err := services.CurrentEndpoint(ctx, store, cfg.WireGuard)
+    if err != nil {
+      slog.Error("failed to look up the interface serving the server key", "err", err)
+      return 1
+    }
+    controller = &wgutil.Controller{
+      Interface:   endpoint.Interface,
+      Port:        endpoint.Port,
+      KeyFile:     endpoint.KeyFile,
+      IP:          cfg.WireGuard.IP,
+      NetworkMask: cfg.WireGuard.NetworkMask,
+      Keys:        keys,
+    }
+    if err := setupWireGuard(ctx, controller, store, cfg); err != nil {
+      slog.Error("failed to set up WireGuard network", "err", err)
+      return 1
+    }
+    wireGuard = controller
+    wgInterface = func() string { return controller.Endpoint().Interface }
+    if cfg.WireGuard.TeardownOnExit {
+      defer teardownWireGuard(controller, store, cfg)
+    }
+  } else {
+    slog.Info("skipping WireGuard interface setup")
+  }
+
+  if len(cfg.Download.SigningKey) == 0 {
+    slog.Warn("DOWNLOAD_SIGNING_KEY is not set, download links will not survive a restart")
+  }
+
+  signingKey, err := signing.LoadOrCreateKey(keys, cfg.Artifacts.SigningKeyFile)
+  if err != nil {
+    slog.Error("failed to load the artifact signing key", "path", cfg.Artifacts.SigningKeyFile, "err", err)
+    return 1
+  }
+
+  appMetrics := metrics.New()
+  targets := services.NewTargetRegistry(cfg.Build.Targets)
+  builder := services.NewBuilder(cfg.Build, cfg.WireGuard.IP, signingKey, targets, appMetrics)
+  checkTargets(ctx, builder, targets)
+
+  app := handlers.NewApp(
+    cfg,
+    store,
+    services.NewHashAllocator(store, cfg.IPRanges),
+    wireGuard,
+    builder,
+    targets,
+    signingKey,
+    keys,
+    )
+
+  app.Metrics = appMetrics
+  app.LogLevel = logLevel
+  app.Metrics.RegisterCollectors(store, cfg.IPRanges, wgInterface)
+  if database, err := sqlitePath(cfg.Database); err == nil {
+    app.Backups = backup.NewArchiver(pool, backupPaths(cfg, database), cfg.Backup.Passphrase)
+  }
+  app.Health = healthChecks(app, pool)
+  go app.Artifacts.RunGC(ctx, cfg.Artifacts.GCInterval)
+  if err := app.Bulk.Resume(ctx); err != nil {
+    slog.Error("failed to resume the bulk jobs in progress", "err", err)
+    return 1
+  }
+  if app.Rotations != nil {
+    if err := resumeKeyRotation(ctx, app.Rotations); err != nil {
+      slog.Error("failed to resume the key rotation in progress", "err", err)
+      return 1
+    }
+    go app.Rotations.Run(ctx, cfg.WireGuard.RotationCheckInterval)
+  }
+  if wireGuard != nil {
+    go services.NewPeerActivity(store, wireGuard).Run(ctx, cfg.WireGuard.LastSeenInterval)
+  }
 
-  setupDatabase()
-  setupWireGuard(setupWg)
-  startServer()
+  if err := startServer(ctx, app); err != nil {
+    slog.Error("server stopped with error", "err", err)
+    return 1
+  }
+  return 0
 }
 
-func setupDatabase() {
-  if config.GetLogLevel() == "DEBUG" {
-    log.Println("main.setupDatabase -> called")
+// openKeystore returns the keystore private keys are saved through, sealing
+// them when KEY_ENCRYPTION_KEY, KEY_ENCRYPTION_KEY_FILE or KEY_PASSPHRASE is
+// set. Preshared keys cannot be enabled without one of them.
+func openKeystore(cfg *config.Config) (*keystore.Keystore, error) {
+  keys, err := keystore.New(cfg.Keys.EncryptionKey, cfg.Keys.Passphrase)
+  if err != nil {
+    return nil, err
   }
-  db.DBPool = db.InitializeDatabaseConnection()
-  migrationDir := config.GetEnv("MIGRATION_PATH", "migrations")
+  if !keys.Encrypted() {
+    if cfg.WireGuard.PresharedKeys {
+      return nil, fmt.Errorf("WG_PRESHARED_KEYS: %w", services.ErrKeysNotEncrypted)
+    }
+    slog.Warn("no key encryption key or passphrase is set, private keys are stored unencrypted")
+  }
+  return keys, nil
+}
+
+// checkTargets validates the configured targets against the toolchain, so
+// targets it cannot build are reported as unavailable instead of failing on
+// the first request. The server still starts; the toolchain health check
+// marks targets buildable once they are installed.
+func checkTargets(ctx context.Context, builder services.Builder, targets *services.TargetRegistry) {
+  checkCtx, cancel := context.WithTimeout(ctx, time.Minute)
+  defer cancel()
 
-  if err := db.RunMigrations(migrationDir); err != nil {
-    log.Fatalf("main.setupDatabase -> migrations failed: %v", err)
+  if err := builder.CheckToolchain(checkCtx); err != nil {
+    slog.Warn("build toolchain is incomplete", "err", err)
+  }
+  for _, target := range targets.List() {
+    if target.Available {
+      slog.Info("build target available", "target", string(target.Triple))
+    } else {
+      slog.Warn("build target unavailable", "target", string(target.Triple), "missing", target.Missing)
+    }
   }
-  log.Println("main.setupDatabase -> database setup complete")
 }
 
-func setupWireGuard(setupWg *bool) {
-  if config.GetLogLevel() == "DEBUG" {
-    log.Println("main.setupWireGuard -> called")
+func setupDatabase(cfg *config.Config) (*db.Pool, error) {
+  slog.Debug("setting up database")
+
+  pool, err := db.InitializeDatabaseConnection(cfg.Database)
+  if err != nil {
+    return nil, err
   }
 
-  if !*setupWg {
-    log.Println("main.setupWireGuard -> Skipping wireguard interface setup")
-    return
+  if err := db.RunMigrations(pool, cfg.MigrationPath); err != nil {
+    pool.Close()
+    return nil, fmt.Errorf("migrations failed: %w", err)
+  }
+  slog.Info("database setup complete")
+  return pool, nil
+}
+
+func setupWireGuard(ctx context.Context, wireGuard *wgutil.Controller, store services.Store, cfg *config.Config) error {
+  slog.Debug("setting up WireGuard")
+
+  publicKey, err := wireGuard.Init(ctx)
+  if err != nil {
+    return err
+  }
+
+  endpoint := wireGuard.Endpoint()
+  audit.Record(ctx, store, "wireguard.init", endpoint.Interface, nil, map[string]any{
+    "interface":  endpoint.Interface,
+    "port":       endpoint.Port,
+    "address":    cfg.WireGuard.IP.String(),
+    "public_key": publicKey,
+  })
+
+  if err := services.RegisterServerPeer(ctx, store, publicKey, cfg.WireGuard.IP); err != nil {
+    return fmt.Errorf("registering the server peer: %w", err)
+  }
+  slog.Info("WireGuard setup complete", "interface", endpoint.Interface, "port", endpoint.Port)
+  return nil
+}
+
+// resumeKeyRotation brings back the new key of a rotation interrupted by a
+// restart and finishes re-issuing its clients.
+func resumeKeyRotation(ctx context.Context, rotations *services.KeyRotator) error {
+  rotation, err := rotations.Resume(ctx)
+  if err != nil {
+    return err
+  }
+  if rotation != nil {
+    return rotations.StartReissue(ctx, rotation)
+  }
+  return nil
+}
+
+// healthChecks returns the registry of the dependencies reported by
+// /readyz.
+func healthChecks(app *handlers.App, pool *db.Pool) *health.Registry {
+  checks := health.NewRegistry()
+  checks.Register("database", app.Store.Ping)
+  checks.Register("migrations", func(ctx context.Context) error {
+    pending, err := db.PendingMigrations(ctx, pool, app.Config.MigrationPath)
+    if err != nil {
+      return err
+    }
+    if len(pending) > 0 {
+      return fmt.Errorf("pending migrations: %v", pending)
+    }
+    return nil
+  })
+  checks.Register("toolchain", app.Builder.CheckToolchain)
+
+  if app.WireGuard != nil {
+    checks.Register("wireguard", app.WireGuard.Check)
+  }
+  return checks
+}
+
+// setupTLS builds the server TLS configuration from the configured
+// certificate, or from a generated development certificate in development
+// mode. It returns nil when TLS is not configured. The certificate is
+// reloaded from disk whenever the files change.
+func setupTLS(ctx context.Context, cfg config.TLSConfig) (*tls.Config, error) {
+  certFile, keyFile := cfg.CertFile, cfg.KeyFile
+
+  if cfg.DevMode && certFile == "" && keyFile == "" {
+    paths, err := tlsutil.EnsureDevCertificates(cfg.DevDir, cfg.DevHosts)
+    if err != nil {
+      return nil, fmt.Errorf("generating development certificates: %w", err)
+    }
+    certFile, keyFile = paths.ServerCert, paths.ServerKey
+  }
+
+  if certFile == "" && keyFile == "" {
+    return nil, nil
   }
-  serverInterface := config.GetEnv("BACKEND_WG_INTERFACE", "wg0")
-  serverPort, err := strconv.Atoi(config.GetEnv("BACKEND_WG_PORT", "51820"))
+
+  reloader, err := tlsutil.NewCertReloader(certFile, keyFile)
   if err != nil {
-    log.Fatalf("main.setupWireGuard -> invalid port provided: %v", err)
+    return nil, err
+  }
+
+  go reloader.Watch(ctx, cfg.ReloadInterval)
+
+  tlsConfig := &tls.Config{
+    MinVersion:     tls.VersionTLS12,
+    GetCertificate: reloader.GetCertificate,
+  }
+
+  if cfg.ClientCAFile != "" {
+    pool, err := tlsutil.LoadCertPool(cfg.ClientCAFile)
+    if err != nil {
+      return nil, fmt.Errorf("loading client CA: %w", err)
+    }
+    tlsConfig.ClientCAs = pool
+    tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
   }
 
-  serverIP := config.GetEnv("BACKEND_WG_IP", "10.0.0.1")
-  networkMask := config.GetEnv("WG_NETWORK_MASK", "/24")
+  return tlsConfig, nil
+}
 
-  if err := wgutil.InitWireGuardInterface(serverInterface, serverPort, net.ParseIP(serverIP), networkMask); err != nil {
-    log.Fatalf("main.setupWireGuard -> failed to set up WireGuard network: %v", err)
+func teardownWireGuard(wireGuard services.WireGuard, store services.Store, cfg *config.Config) {
+  if err := wireGuard.Teardown(); err != nil {
+    slog.Error("failed to tear down WireGuard interface", "err", err)
+    return
   }
-  log.Println("main.setupWireGuard -> WireGuard setup complete")
+  audit.Record(context.Background(), store, "wireguard.teardown", cfg.WireGuard.Interface, nil, nil)
 }
 
-func startServer() {
-  if config.GetLogLevel() == "DEBUG" {
-    log.Println("main.startServer -> called")
+// startServer serves HTTP until ctx is cancelled, then stops accepting new
+// connections and gives in-flight requests and builds SHUTDOWN_TIMEOUT to
+// finish before running builds are killed. Bulk jobs stop after their
+// current peer.
+func startServer(ctx context.Context, app *handlers.App) error {
+  port := ":" + app.Config.Port
+  server := &http.Server{Addr: port, Handler: routes.SetupRoutes(app)}
+  shutdownTimeout := app.Config.ShutdownTimeout
+
+  tlsConfig, err := setupTLS(ctx, app.Config.TLS)
+  if err != nil {
+    slog.Error("invalid TLS configuration", "err", err)
+    return err
+  }
+  server.TLSConfig = tlsConfig
+
+  serveErr := make(chan error, 1)
+  go func() {
+    if tlsConfig != nil {
+      slog.Info("starting server with TLS", "addr", port, "client_auth", tlsConfig.ClientCAs != nil)
+      serveErr <- server.ListenAndServeTLS("", "")
+      return
+    }
+    slog.Info("starting server", "addr", port)
+    serveErr <- server.ListenAndServe()
+  }()
+
+  select {
+  case err := <-serveErr:
+    if !errors.Is(err, http.ErrServerClosed) {
+      slog.Error("failed to listen and serve", "err", err)
+      return err
+    }
+  case <-ctx.Done():
+    slog.Info("shutdown signal received, draining requests", "timeout", shutdownTimeout)
+  }
+
+  shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+  defer cancel()
+
+  if err := server.Shutdown(shutdownCtx); err != nil {
+    slog.Warn("server did not drain before deadline", "err", err)
+  }
+
+  if err := app.Bulk.Shutdown(shutdownCtx); err != nil {
+    slog.Warn("running bulk jobs were interrupted", "err", err)
+  }
+
+  if app.Rotations != nil {
+    if err := app.Rotations.Shutdown(shutdownCtx); err != nil {
+      slog.Warn("re-issuing clients was interrupted", "err", err)
+    }
   }
-  port := ":" + config.GetEnv("PORT", "8080")
-  server := &http.Server{Addr: port, Handler: routes.SetupRoutes()}
 
-  if err := server.ListenAndServe(); err != nil {
-    log.Fatalf("main.startServer -> failed to listen and serve: %v", err)
+  if err := app.Builder.Shutdown(shutdownCtx); err != nil {
+    slog.Warn("running builds were cancelled", "err", err)
   }
 
-  defer db.CloseDatabaseConnection()
-  log.Println("main.startServer -> server shutdown gracefully")
+  slog.Info("server shutdown gracefully")
+  return nil
 }
@@ -0,0 +1,97 @@
+package main
+
+import (
+  "context"
+  "fmt"
+  "log/slog"
+  "os"
+  "strconv"
+  "text/tabwriter"
+
+  "elysium-backend/config"
+  "elysium-backend/pkg/db"
+)
+
+const migrateUsage = `usage: main [flags] migrate <command>
+
+commands:
+  status     list migrations and whether they are applied
+  up         apply all pending migrations
+  down [N]   roll back the last N applied migrations (default 1)
+  to N       migrate up or down until version N is the latest applied`
+
+// runMigrate implements the migrate subcommand and returns the exit code.
+func runMigrate(args []string) int {
+  if len(args) == 0 {
+    fmt.Fprintln(os.Stderr, migrateUsage)
+    return 2
+  }
+
+  pool, err := db.InitializeDatabaseConnection(config.LoadDatabase())
+  if err != nil {
+    slog.Error("unable to connect to the database", "err", err)
+    return 1
+  }
+  defer pool.Close()
+
+  ctx := context.Background()
+  migrationDir := config.GetEnv("MIGRATION_PATH", "migrations")
+
+  switch args[0] {
+  case "status":
+    err = printMigrationStatus(ctx, pool, migrationDir)
+  case "up":
+    err = db.MigrateUp(ctx, pool, migrationDir)
+  case "down":
+    steps := 1
+    if len(args) > 1 {
+      if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+        fmt.Fprintln(os.Stderr, "down expects a positive number of steps")
+        return 2
+      }
+    }
+    err = db.MigrateDown(ctx, pool, migrationDir, steps)
+  case "to":
+    if len(args) < 2 {
+      fmt.Fprintln(os.Stderr, migrateUsage)
+      return 2
+    }
+    version, convErr := strconv.Atoi(args[1])
+    if convErr != nil || version < 0 {
+      fmt.Fprintln(os.Stderr, "to expects a migration version")
+      return 2
+    }
+    err = db.MigrateTo(ctx, pool, migrationDir, version)
+  default:
+    fmt.Fprintln(os.Stderr, migrateUsage)
+    return 2
+  }
+
+  if err != nil {
+    slog.Error("migrate failed", "command", args[0], "err", err)
+    return 1
+  }
+  return 0
+}
+
+func printMigrationStatus(ctx context.Context, pool *db.Pool, migrationDir string) error {
+  statuses, err := db.MigrationStatuses(ctx, pool, migrationDir)
+  if err != nil {
+    return err
+  }
+
+  w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+  fmt.Fprintln(w, "VERSION\tMIGRATION\tSTATE\tAPPLIED AT\tDOWN")
+  for _, status := range statuses {
+    appliedAt := "-"
+    if status.AppliedAt != nil {
+      appliedAt = status.AppliedAt.UTC().Format("2006-01-02 15:04:05")
+    }
+    down := "no"
+    if status.Reversible {
+      down = "yes"
+    }
+    fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", status.Version, status.Filename, status.State, appliedAt, down)
+  }
+  return w.Flush()
+}
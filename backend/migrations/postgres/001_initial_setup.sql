@@ -0,0 +1,34 @@
+CREATE TABLE IF NOT EXISTS users (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    username TEXT UNIQUE NOT NULL,
+    password_hash TEXT NOT NULL,
+    api_key TEXT,
+    api_key_expiry TEXT
+);
+
+CREATE TABLE IF NOT EXISTS peers (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    public_key TEXT NOT NULL,
+    assigned_ip BYTEA NOT NULL UNIQUE,
+    status TEXT,
+    is_gateway BOOLEAN DEFAULT FALSE,
+    metadata TEXT,
+    created_on TIMESTAMPTZ DEFAULT NULL
+);
+
+CREATE TABLE IF NOT EXISTS tokens (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    requesting_peer_id UUID REFERENCES peers(id),
+    target_peer_id UUID REFERENCES peers(id),
+    token TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    expired_at TEXT NOT NULL,
+    is_valid BOOLEAN DEFAULT TRUE
+);
+
+INSERT INTO users (username, password_hash)
+VALUES (
+    'hades',
+    md5(random()::text || clock_timestamp()::text)
+)
+ON CONFLICT (username) DO NOTHING;
@@ -0,0 +1,2 @@
+ALTER TABLE peers DROP COLUMN IF EXISTS last_seen;
+ALTER TABLE peers DROP COLUMN IF EXISTS updated_on;
@@ -0,0 +1,4 @@
+ALTER TABLE peers ADD COLUMN IF NOT EXISTS updated_on TIMESTAMPTZ DEFAULT NULL;
+ALTER TABLE peers ADD COLUMN IF NOT EXISTS last_seen TIMESTAMPTZ DEFAULT NULL;
+
+UPDATE peers SET updated_on = created_on WHERE updated_on IS NULL;
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS download_links (
+    id TEXT PRIMARY KEY,
+    peer_id UUID NOT NULL REFERENCES peers(id) ON DELETE CASCADE,
+    artifact_path TEXT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    max_uses INTEGER NOT NULL,
+    uses INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL,
+    revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS download_links_peer_id ON download_links (peer_id);
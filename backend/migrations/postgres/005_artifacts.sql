@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS artifacts (
+    id UUID PRIMARY KEY,
+    peer_id UUID REFERENCES peers(id) ON DELETE SET NULL,
+    target TEXT NOT NULL,
+    path TEXT NOT NULL UNIQUE,
+    size_bytes BIGINT NOT NULL,
+    sha256 TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS artifacts_peer_id ON artifacts (peer_id);
+CREATE INDEX IF NOT EXISTS artifacts_expires_at ON artifacts (expires_at);
@@ -0,0 +1,2 @@
+-- Base64 encoded Ed25519 signature over the artifact file.
+ALTER TABLE artifacts ADD COLUMN signature TEXT;
@@ -0,0 +1,2 @@
+ALTER TABLE artifacts DROP COLUMN build_id;
+DROP TABLE IF EXISTS builds;
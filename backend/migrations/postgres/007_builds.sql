@@ -0,0 +1,17 @@
+-- One row per client build. provenance holds the JSON encoded description
+-- of what the client was compiled from.
+CREATE TABLE IF NOT EXISTS builds (
+    id UUID PRIMARY KEY,
+    target TEXT NOT NULL,
+    status TEXT NOT NULL,
+    artifact_path TEXT,
+    sha256 TEXT,
+    error TEXT,
+    provenance TEXT,
+    started_at TIMESTAMPTZ NOT NULL,
+    finished_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS builds_started_at ON builds (started_at);
+
+ALTER TABLE artifacts ADD COLUMN build_id UUID REFERENCES builds(id) ON DELETE SET NULL;
@@ -0,0 +1,10 @@
+-- Output of each build, one row per line in the order it was produced.
+CREATE TABLE IF NOT EXISTS build_logs (
+    build_id UUID NOT NULL REFERENCES builds(id) ON DELETE CASCADE,
+    seq INTEGER NOT NULL,
+    line TEXT NOT NULL,
+    logged_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (build_id, seq)
+);
+
+CREATE INDEX IF NOT EXISTS builds_status ON builds (status);
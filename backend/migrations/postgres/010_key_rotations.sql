@@ -0,0 +1,32 @@
+-- Server key rotations and the progress of every peer through them. The
+-- peer, build and artifact columns have no REFERENCES clause, so removing
+-- a peer or collecting an artifact keeps the history of the rotation.
+CREATE TABLE IF NOT EXISTS key_rotations (
+    id UUID PRIMARY KEY,
+    status TEXT NOT NULL,
+    old_public_key TEXT NOT NULL,
+    new_public_key TEXT NOT NULL,
+    old_interface TEXT NOT NULL,
+    old_port INTEGER NOT NULL,
+    new_interface TEXT NOT NULL,
+    new_port INTEGER NOT NULL,
+    started_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    finished_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS key_rotations_started_at ON key_rotations (started_at);
+
+CREATE TABLE IF NOT EXISTS key_rotation_peers (
+    rotation_id UUID NOT NULL REFERENCES key_rotations(id) ON DELETE CASCADE,
+    peer_id UUID NOT NULL,
+    public_key TEXT NOT NULL,
+    assigned_ip BYTEA NOT NULL,
+    target TEXT,
+    status TEXT NOT NULL,
+    build_id UUID,
+    artifact_id UUID,
+    error TEXT,
+    migrated_at TIMESTAMPTZ,
+    PRIMARY KEY (rotation_id, peer_id)
+);
@@ -0,0 +1,2 @@
+ALTER TABLE peers DROP COLUMN last_seen;
+ALTER TABLE peers DROP COLUMN updated_on;
@@ -0,0 +1,40 @@
+-- Timestamps are stored as UTC text in a fixed-width layout
+-- (2006-01-02T15:04:05.000000Z) so they sort and compare as strings.
+ALTER TABLE peers ADD COLUMN updated_on TEXT DEFAULT NULL;
+ALTER TABLE peers ADD COLUMN last_seen TEXT DEFAULT NULL;
+
+UPDATE peers SET created_on = NULL WHERE trim(created_on) = '';
+
+-- time.Time.String output ends with the monotonic clock reading.
+UPDATE peers
+SET created_on = rtrim(substr(created_on, 1, instr(created_on, ' m=') - 1))
+WHERE instr(created_on, ' m=') > 0;
+
+-- "2006-01-02 15:04:05 -0700 MST" becomes "2006-01-02 15:04:05-07:00".
+UPDATE peers
+SET created_on = substr(created_on, 1, 10 + instr(substr(created_on, 12), ' '))
+  || substr(created_on, 12 + instr(substr(created_on, 12), ' '), 3) || ':'
+  || substr(created_on, 15 + instr(substr(created_on, 12), ' '), 2)
+WHERE created_on GLOB '????-??-?? ??:??:??* [+-][0-9][0-9][0-9][0-9]*';
+
+-- Everything left is "date[ T]time[.fraction][Z|+hh:mm]". strftime applies
+-- the offset; the fraction is carried over separately because strftime
+-- only keeps milliseconds. Values that cannot be parsed are left alone.
+UPDATE peers
+SET created_on = COALESCE((
+  SELECT strftime('%Y-%m-%dT%H:%M:%S', substr(v, 1, 19) || tz) || '.' || substr(frac || '000000', 1, 6) || 'Z'
+  FROM (
+    SELECT v, tz, CASE WHEN substr(v, 20, 1) = '.' THEN substr(v, 21, length(v) - 20 - length(tz)) ELSE '' END AS frac
+    FROM (
+      SELECT v, CASE
+        WHEN v LIKE '%Z' THEN 'Z'
+        WHEN substr(v, -6, 1) IN ('+', '-') AND substr(v, -3, 1) = ':' THEN substr(v, -6)
+        ELSE ''
+      END AS tz
+      FROM (SELECT peers.created_on AS v)
+    )
+  )
+), created_on)
+WHERE created_on IS NOT NULL;
+
+UPDATE peers SET updated_on = created_on WHERE updated_on IS NULL;
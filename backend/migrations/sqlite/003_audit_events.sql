@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS audit_events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    occurred_at TEXT NOT NULL,
+    actor TEXT NOT NULL,
+    action TEXT NOT NULL,
+    target TEXT,
+    before_state TEXT,
+    after_state TEXT,
+    source_ip TEXT,
+    request_id TEXT
+);
+
+CREATE INDEX IF NOT EXISTS audit_events_occurred_at ON audit_events (occurred_at);
+CREATE INDEX IF NOT EXISTS audit_events_action ON audit_events (action);
+
+-- The audit log is append-only.
+CREATE TRIGGER IF NOT EXISTS audit_events_no_update BEFORE UPDATE ON audit_events
+BEGIN
+    SELECT RAISE(ABORT, 'audit_events is append-only');
+END;
+
+CREATE TRIGGER IF NOT EXISTS audit_events_no_delete BEFORE DELETE ON audit_events
+BEGIN
+    SELECT RAISE(ABORT, 'audit_events is append-only');
+END;
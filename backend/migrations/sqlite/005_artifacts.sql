@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS artifacts (
+    id TEXT PRIMARY KEY,
+    peer_id TEXT REFERENCES peers(id) ON DELETE SET NULL,
+    target TEXT NOT NULL,
+    path TEXT NOT NULL UNIQUE,
+    size_bytes INTEGER NOT NULL,
+    sha256 TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    expires_at TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS artifacts_peer_id ON artifacts (peer_id);
+CREATE INDEX IF NOT EXISTS artifacts_expires_at ON artifacts (expires_at);
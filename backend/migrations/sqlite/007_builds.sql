@@ -0,0 +1,19 @@
+-- One row per client build. provenance holds the JSON encoded description
+-- of what the client was compiled from.
+CREATE TABLE IF NOT EXISTS builds (
+    id TEXT PRIMARY KEY,
+    target TEXT NOT NULL,
+    status TEXT NOT NULL,
+    artifact_path TEXT,
+    sha256 TEXT,
+    error TEXT,
+    provenance TEXT,
+    started_at TEXT NOT NULL,
+    finished_at TEXT
+);
+
+CREATE INDEX IF NOT EXISTS builds_started_at ON builds (started_at);
+
+-- No REFERENCES clause: SQLite cannot drop a column used by a foreign key,
+-- which the down migration needs.
+ALTER TABLE artifacts ADD COLUMN build_id TEXT;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS builds_status;
+DROP TABLE IF EXISTS build_logs;
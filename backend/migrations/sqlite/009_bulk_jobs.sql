@@ -0,0 +1,26 @@
+-- Bulk provisioning jobs and the job of each peer in them. The peer, build
+-- and artifact columns have no REFERENCES clause: failed peers are deleted
+-- and artifacts collected while the job is kept for reference.
+CREATE TABLE IF NOT EXISTS bulk_jobs (
+    id TEXT PRIMARY KEY,
+    status TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    finished_at TEXT
+);
+
+CREATE TABLE IF NOT EXISTS bulk_job_items (
+    job_id TEXT NOT NULL REFERENCES bulk_jobs(id) ON DELETE CASCADE,
+    seq INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    owner TEXT,
+    target TEXT NOT NULL,
+    tags TEXT,
+    public_key TEXT,
+    peer_id TEXT,
+    assigned_ip BLOB NOT NULL,
+    status TEXT NOT NULL,
+    build_id TEXT,
+    artifact_id TEXT,
+    error TEXT,
+    PRIMARY KEY (job_id, seq)
+);
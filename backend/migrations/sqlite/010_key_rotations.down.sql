@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS key_rotation_peers;
+DROP TABLE IF EXISTS key_rotations;
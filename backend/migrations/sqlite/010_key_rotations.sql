@@ -0,0 +1,32 @@
+-- Server key rotations and the progress of every peer through them. The
+-- peer, build and artifact columns have no REFERENCES clause, so removing
+-- a peer or collecting an artifact keeps the history of the rotation.
+CREATE TABLE IF NOT EXISTS key_rotations (
+    id TEXT PRIMARY KEY,
+    status TEXT NOT NULL,
+    old_public_key TEXT NOT NULL,
+    new_public_key TEXT NOT NULL,
+    old_interface TEXT NOT NULL,
+    old_port INTEGER NOT NULL,
+    new_interface TEXT NOT NULL,
+    new_port INTEGER NOT NULL,
+    started_at TEXT NOT NULL,
+    expires_at TEXT NOT NULL,
+    finished_at TEXT
+);
+
+CREATE INDEX IF NOT EXISTS key_rotations_started_at ON key_rotations (started_at);
+
+CREATE TABLE IF NOT EXISTS key_rotation_peers (
+    rotation_id TEXT NOT NULL REFERENCES key_rotations(id) ON DELETE CASCADE,
+    peer_id TEXT NOT NULL,
+    public_key TEXT NOT NULL,
+    assigned_ip BLOB NOT NULL,
+    target TEXT,
+    status TEXT NOT NULL,
+    build_id TEXT,
+    artifact_id TEXT,
+    error TEXT,
+    migrated_at TEXT,
+    PRIMARY KEY (rotation_id, peer_id)
+);
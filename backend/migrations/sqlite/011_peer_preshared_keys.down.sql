@@ -0,0 +1 @@
+ALTER TABLE peers DROP COLUMN preshared_key;
@@ -0,0 +1,3 @@
+-- The WireGuard preshared key of the peer, sealed like the server keys on
+-- disk; NULL when the peer has none.
+ALTER TABLE peers ADD COLUMN preshared_key TEXT DEFAULT NULL;
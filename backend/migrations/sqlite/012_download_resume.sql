@@ -0,0 +1,3 @@
+-- Until when a download through the link may be resumed without counting
+-- another use; NULL once the download finished or before the first one.
+ALTER TABLE download_links ADD COLUMN resume_until TEXT DEFAULT NULL;
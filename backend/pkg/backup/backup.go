@@ -0,0 +1,584 @@
+// Package backup archives and restores the control-plane state: a snapshot
+// of the SQLite database, the key files and the artifacts under the output
+// directory. Archives are gzipped tar files, optionally encrypted with a
+// passphrase, and start with a manifest so a restore can refuse an
+// incompatible archive before it touches anything.
+package backup
+
+import (
+  "archive/tar"
+  "compress/gzip"
+  "context"
+  "crypto/sha256"
+  "elysium-backend/internal/version"
+  "elysium-backend/pkg/db"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "io/fs"
+  "log/slog"
+  "os"
+  "path"
+  "path/filepath"
+  "strings"
+  "time"
+)
+
+// FormatVersion is the version of the archive layout written by Create.
+const FormatVersion = 1
+
+const (
+  manifestName  = "manifest.json"
+  checksumsName = "checksums.json"
+  databaseName  = "database.sqlite"
+  keysDir       = "keys"
+  outputDir     = "output"
+)
+
+// skippedOutputDirs are not archived: the build cache is recreated on
+// demand.
+var skippedOutputDirs = map[string]bool{".cache": true}
+
+// ErrIncompatible is returned by Restore for an archive this version of the
+// backend cannot restore.
+var ErrIncompatible = errors.New("incompatible backup")
+
+// PreRestoreSuffix is appended to the database, key files and output
+// directory Restore replaces to keep their previous versions. The previous
+// database and keys are left there for a manual rollback.
+const PreRestoreSuffix = ".pre-restore"
+
+// ReplaceError is returned by Restore when replacing the state failed after
+// the archive was verified. What had been replaced is put back from its
+// PreRestoreSuffix copy; RollbackErr is set when that failed as well, in
+// which case the state is mixed and the copies are all that is left of it.
+type ReplaceError struct {
+  Err         error
+  RollbackErr error
+}
+
+func (e *ReplaceError) Error() string {
+  if e.RollbackErr != nil {
+    return fmt.Sprintf("replacing the state failed: %v; putting back the previous state failed too, it is kept in the %s files: %v", e.Err, PreRestoreSuffix, e.RollbackErr)
+  }
+  return fmt.Sprintf("replacing the state failed, the previous state was put back: %v", e.Err)
+}
+
+func (e *ReplaceError) Unwrap() error {
+  return e.Err
+}
+
+// Manifest describes an archive. SchemaVersion is the latest migration
+// applied to the archived database.
+type Manifest struct {
+  FormatVersion int       `json:"format_version"`
+  CreatedAt     time.Time `json:"created_at"`
+  AppVersion    string    `json:"app_version"`
+  Driver        string    `json:"driver"`
+  SchemaVersion int       `json:"schema_version"`
+  Encrypted     bool      `json:"encrypted"`
+}
+
+// FileSum is the size and SHA-256 of a file in an archive.
+type FileSum struct {
+  Path   string `json:"path"`
+  Size   int64  `json:"size"`
+  SHA256 string `json:"sha256"`
+}
+
+// Paths locates the state on disk. Keys are archived by their base name,
+// so they must be distinct.
+type Paths struct {
+  Database  string
+  Keys      []string
+  OutputDir string
+}
+
+// Archiver writes backups of a running server.
+type Archiver struct {
+  pool       *db.Pool
+  paths      Paths
+  passphrase string
+}
+
+// NewArchiver returns an Archiver for the database behind pool and the
+// files in paths. Archives are encrypted when passphrase is not empty.
+func NewArchiver(pool *db.Pool, paths Paths, passphrase string) *Archiver {
+  return &Archiver{pool: pool, paths: paths, passphrase: passphrase}
+}
+
+// Encrypted reports whether the archives written are encrypted.
+func (a *Archiver) Encrypted() bool {
+  return a.passphrase != ""
+}
+
+// Backup writes an archive to w.
+func (a *Archiver) Backup(ctx context.Context, w io.Writer) (*Manifest, error) {
+  return Create(ctx, w, a.pool, a.paths, a.passphrase)
+}
+
+// Create writes an archive of the database behind pool, taken with the
+// online backup API, and of the files in paths to w. Missing key files and
+// a missing output directory are skipped.
+func Create(ctx context.Context, w io.Writer, pool *db.Pool, paths Paths, passphrase string) (*Manifest, error) {
+  tmpDir, err := os.MkdirTemp("", "elysium-backup-")
+  if err != nil {
+    return nil, err
+  }
+  defer os.RemoveAll(tmpDir)
+
+  snapshot := filepath.Join(tmpDir, databaseName)
+  if err := db.BackupSQLite(ctx, pool, snapshot); err != nil {
+    return nil, fmt.Errorf("unable to snapshot the database: %w", err)
+  }
+  schemaVersion, err := db.InspectSQLite(ctx, snapshot)
+  if err != nil {
+    return nil, err
+  }
+
+  manifest := &Manifest{
+    FormatVersion: FormatVersion,
+    CreatedAt:     time.Now().UTC(),
+    AppVersion:    version.Get().Version,
+    Driver:        string(db.SQLite),
+    SchemaVersion: schemaVersion,
+    Encrypted:     passphrase != "",
+  }
+  if passphrase == "" {
+    slog.Warn("writing an unencrypted backup, it contains the private keys")
+  }
+
+  out := w
+  var enc io.WriteCloser
+  if passphrase != "" {
+    if enc, err = NewEncryptWriter(w, passphrase); err != nil {
+      return nil, err
+    }
+    out = enc
+  }
+  gz := gzip.NewWriter(out)
+  tw := tar.NewWriter(gz)
+
+  if err := writeJSON(tw, manifestName, manifest); err != nil {
+    return nil, err
+  }
+
+  var sums []FileSum
+  add := func(name, source string) error {
+    sum, err := writeFile(ctx, tw, name, source)
+    if err != nil {
+      return fmt.Errorf("unable to archive %s: %w", source, err)
+    }
+    sums = append(sums, sum)
+    return nil
+  }
+
+  if err := add(databaseName, snapshot); err != nil {
+    return nil, err
+  }
+  for _, key := range paths.Keys {
+    if _, err := os.Stat(key); errors.Is(err, fs.ErrNotExist) {
+      slog.Warn("key file not found, not included in the backup", "path", key)
+      continue
+    }
+    if err := add(path.Join(keysDir, filepath.Base(key)), key); err != nil {
+      return nil, err
+    }
+  }
+  if paths.OutputDir != "" {
+    err := filepath.WalkDir(paths.OutputDir, func(file string, entry fs.DirEntry, err error) error {
+      if errors.Is(err, fs.ErrNotExist) && file == paths.OutputDir {
+        return filepath.SkipDir
+      } else if err != nil {
+        return err
+      }
+      rel, _ := filepath.Rel(paths.OutputDir, file)
+      if entry.IsDir() && skippedOutputDirs[rel] {
+        return filepath.SkipDir
+      }
+      if !entry.Type().IsRegular() {
+        return nil
+      }
+      return add(path.Join(outputDir, filepath.ToSlash(rel)), file)
+    })
+    if err != nil {
+      return nil, err
+    }
+  }
+
+  if err := writeJSON(tw, checksumsName, sums); err != nil {
+    return nil, err
+  }
+  if err := tw.Close(); err != nil {
+    return nil, err
+  }
+  if err := gz.Close(); err != nil {
+    return nil, err
+  }
+  if enc != nil {
+    if err := enc.Close(); err != nil {
+      return nil, err
+    }
+  }
+  slog.Info("backup written", "files", len(sums), "schema_version", schemaVersion, "encrypted", manifest.Encrypted)
+  return manifest, nil
+}
+
+func writeJSON(tw *tar.Writer, name string, v any) error {
+  data, err := json.MarshalIndent(v, "", "  ")
+  if err != nil {
+    return err
+  }
+  header := &tar.Header{Name: name, Mode: 0o600, Size: int64(len(data)), ModTime: time.Now().UTC(), Typeflag: tar.TypeReg}
+  if err := tw.WriteHeader(header); err != nil {
+    return err
+  }
+  _, err = tw.Write(data)
+  return err
+}
+
+func writeFile(ctx context.Context, tw *tar.Writer, name, source string) (FileSum, error) {
+  if err := ctx.Err(); err != nil {
+    return FileSum{}, err
+  }
+  file, err := os.Open(source)
+  if err != nil {
+    return FileSum{}, err
+  }
+  defer file.Close()
+  info, err := file.Stat()
+  if err != nil {
+    return FileSum{}, err
+  }
+
+  header := &tar.Header{Name: name, Mode: 0o600, Size: info.Size(), ModTime: info.ModTime(), Typeflag: tar.TypeReg}
+  if err := tw.WriteHeader(header); err != nil {
+    return FileSum{}, err
+  }
+  // Only the size recorded in the header is copied, in case the file grows
+  // while it is archived.
+  h := sha256.New()
+  n, err := io.Copy(io.MultiWriter(tw, h), io.LimitReader(file, info.Size()))
+  if err != nil {
+    return FileSum{}, err
+  }
+  if n != info.Size() {
+    return FileSum{}, fmt.Errorf("file shrank while it was archived")
+  }
+  return FileSum{Path: name, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// ReadManifest returns the manifest of the archive in r without reading
+// the rest of it.
+func ReadManifest(r io.Reader, passphrase string) (*Manifest, error) {
+  plain, _, err := openArchive(r, passphrase)
+  if err != nil {
+    return nil, err
+  }
+  gz, err := gzip.NewReader(plain)
+  if errors.Is(err, ErrDecrypt) {
+    return nil, err
+  } else if err != nil {
+    return nil, fmt.Errorf("%w: not a backup archive", ErrIncompatible)
+  }
+  return readManifest(tar.NewReader(gz))
+}
+
+func readManifest(tr *tar.Reader) (*Manifest, error) {
+  header, err := tr.Next()
+  if err != nil || header.Name != manifestName {
+    return nil, fmt.Errorf("%w: archive does not start with a manifest", ErrIncompatible)
+  }
+  var manifest Manifest
+  if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+    return nil, fmt.Errorf("%w: invalid manifest: %v", ErrIncompatible, err)
+  }
+  return &manifest, nil
+}
+
+// Restore replaces the state in paths with the archive in r. The manifest
+// is checked first: the archive must have a known format, hold an SQLite
+// database and a schema no newer than latestSchema, the newest migration
+// this backend knows. Every file is then extracted next to its target and
+// verified against its checksum, and the database checked for integrity,
+// before anything is replaced. The database must not be open: Restore holds
+// an exclusive db.LockSQLite lock throughout and fails with
+// db.ErrDatabaseInUse while a server or another command uses it. Failures
+// while replacing the state are returned as a *ReplaceError.
+func Restore(ctx context.Context, r io.Reader, paths Paths, latestSchema int, passphrase string) (*Manifest, error) {
+  unlock, err := db.LockSQLite(paths.Database, true)
+  if err != nil {
+    return nil, err
+  }
+  defer unlock()
+
+  plain, encrypted, err := openArchive(r, passphrase)
+  if err != nil {
+    return nil, err
+  }
+  gz, err := gzip.NewReader(plain)
+  if errors.Is(err, ErrDecrypt) {
+    return nil, err
+  } else if err != nil {
+    return nil, fmt.Errorf("%w: not a backup archive", ErrIncompatible)
+  }
+  tr := tar.NewReader(gz)
+
+  manifest, err := readManifest(tr)
+  if err != nil {
+    return nil, err
+  }
+  switch {
+  case manifest.FormatVersion != FormatVersion:
+    return nil, fmt.Errorf("%w: archive format %d, expected %d", ErrIncompatible, manifest.FormatVersion, FormatVersion)
+  case manifest.Driver != string(db.SQLite):
+    return nil, fmt.Errorf("%w: archive holds a %s database", ErrIncompatible, manifest.Driver)
+  case manifest.SchemaVersion > latestSchema:
+    return nil, fmt.Errorf("%w: archive schema version %d is newer than %d, the latest this backend knows", ErrIncompatible, manifest.SchemaVersion, latestSchema)
+  case manifest.Encrypted != encrypted:
+    return nil, fmt.Errorf("%w: manifest does not match the archive encryption", ErrIncompatible)
+  }
+
+  keyTargets := make(map[string]string, len(paths.Keys))
+  for _, key := range paths.Keys {
+    keyTargets[path.Join(keysDir, filepath.Base(key))] = key
+  }
+
+  // Files are staged next to their targets, so they can be renamed into
+  // place.
+  staging, err := os.MkdirTemp(filepath.Dir(paths.Database), ".elysium-restore-")
+  if err != nil {
+    return nil, err
+  }
+  defer os.RemoveAll(staging)
+  stagedOutput := filepath.Join(staging, outputDir)
+  if paths.OutputDir != "" {
+    if stagedOutput, err = os.MkdirTemp(filepath.Dir(filepath.Clean(paths.OutputDir)), ".elysium-restore-output-"); err != nil {
+      return nil, err
+    }
+    defer os.RemoveAll(stagedOutput)
+  }
+  stage := func(name string) string {
+    if rel, ok := strings.CutPrefix(name, outputDir+"/"); ok {
+      return filepath.Join(stagedOutput, filepath.FromSlash(rel))
+    }
+    return filepath.Join(staging, filepath.FromSlash(name))
+  }
+
+  extracted := make(map[string]FileSum)
+  var sums []FileSum
+  for {
+    header, err := tr.Next()
+    if errors.Is(err, io.EOF) {
+      break
+    } else if err != nil {
+      return nil, fmt.Errorf("%w: %v", ErrIncompatible, err)
+    }
+    if err := ctx.Err(); err != nil {
+      return nil, err
+    }
+
+    name := header.Name
+    if name == checksumsName {
+      if err := json.NewDecoder(tr).Decode(&sums); err != nil {
+        return nil, fmt.Errorf("%w: invalid checksums: %v", ErrIncompatible, err)
+      }
+      continue
+    }
+    switch {
+    case header.Typeflag != tar.TypeReg || name != path.Clean(name) || path.IsAbs(name) || strings.HasPrefix(name, ".."):
+      return nil, fmt.Errorf("%w: unexpected entry %q", ErrIncompatible, name)
+    case name == databaseName, strings.HasPrefix(name, outputDir+"/"):
+    case strings.HasPrefix(name, keysDir+"/"):
+      if keyTargets[name] == "" {
+        return nil, fmt.Errorf("%w: archive holds key %s which is not configured here", ErrIncompatible, name)
+      }
+    default:
+      return nil, fmt.Errorf("%w: unexpected entry %q", ErrIncompatible, name)
+    }
+
+    sum, err := extract(tr, stage(name))
+    if err != nil {
+      return nil, err
+    }
+    sum.Path = name
+    extracted[name] = sum
+  }
+
+  if sums == nil {
+    return nil, fmt.Errorf("%w: archive has no checksums", ErrIncompatible)
+  }
+  if len(sums) != len(extracted) {
+    return nil, fmt.Errorf("%w: archive holds %d files, checksums list %d", ErrIncompatible, len(extracted), len(sums))
+  }
+  for _, sum := range sums {
+    if extracted[sum.Path] != sum {
+      return nil, fmt.Errorf("%w: checksum mismatch for %s", ErrIncompatible, sum.Path)
+    }
+  }
+
+  stagedDB := filepath.Join(staging, databaseName)
+  if _, ok := extracted[databaseName]; !ok {
+    return nil, fmt.Errorf("%w: archive holds no database", ErrIncompatible)
+  }
+  schemaVersion, err := db.InspectSQLite(ctx, stagedDB)
+  if err != nil {
+    return nil, fmt.Errorf("%w: archived database: %v", ErrIncompatible, err)
+  }
+  if schemaVersion != manifest.SchemaVersion {
+    return nil, fmt.Errorf("%w: archived database has schema version %d, manifest says %d", ErrIncompatible, schemaVersion, manifest.SchemaVersion)
+  }
+
+  // Everything checked out; from here on the state is replaced.
+  var c commit
+  if err := c.replaceState(paths, stagedDB, stagedOutput, extracted, keyTargets, stage); err != nil {
+    return nil, &ReplaceError{Err: err, RollbackErr: c.undo()}
+  }
+  if paths.OutputDir != "" {
+    // Unlike the database and keys, the previous artifacts can be large.
+    if err := os.RemoveAll(paths.OutputDir + PreRestoreSuffix); err != nil {
+      slog.Warn("unable to remove the previous output directory", "path", paths.OutputDir+PreRestoreSuffix, "err", err)
+    }
+  }
+
+  slog.Info("backup restored", "files", len(extracted), "schema_version", manifest.SchemaVersion, "created_at", manifest.CreatedAt)
+  return manifest, nil
+}
+
+func extract(r io.Reader, target string) (FileSum, error) {
+  if err := os.MkdirAll(filepath.Dir(target), 0o700); err != nil {
+    return FileSum{}, err
+  }
+  file, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+  if err != nil {
+    return FileSum{}, err
+  }
+  defer file.Close()
+
+  h := sha256.New()
+  n, err := io.Copy(io.MultiWriter(file, h), r)
+  if err != nil {
+    return FileSum{}, err
+  }
+  return FileSum{Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, file.Close()
+}
+
+// commit replaces the state and remembers what it set aside, so a failed
+// restore can be undone.
+type commit struct {
+  done []movedAside
+}
+
+// movedAside is a file or directory moved from target to previous. existed
+// is false when there was nothing at target.
+type movedAside struct {
+  target   string
+  previous string
+  existed  bool
+}
+
+// replaceState sets aside the database with its journal files, the keys
+// in the archive and the output directory, and moves the staged versions
+// into their place.
+func (c *commit) replaceState(paths Paths, stagedDB, stagedOutput string, extracted map[string]FileSum, keyTargets map[string]string, stage func(string) string) error {
+  // The journal files are kept with the database they belong to, so the
+  // previous copy opens with everything that was committed to it.
+  for _, suffix := range []string{"", "-wal", "-shm", "-journal"} {
+    if err := c.setAside(paths.Database+suffix, paths.Database+PreRestoreSuffix+suffix); err != nil {
+      return err
+    }
+  }
+  if err := move(stagedDB, paths.Database); err != nil {
+    return fmt.Errorf("unable to restore the database: %w", err)
+  }
+
+  for name := range extracted {
+    target, ok := keyTargets[name]
+    if !ok {
+      continue
+    }
+    if err := os.MkdirAll(filepath.Dir(target), 0o700); err != nil {
+      return err
+    }
+    if err := c.setAside(target, target+PreRestoreSuffix); err != nil {
+      return err
+    }
+    if err := move(stage(name), target); err != nil {
+      return fmt.Errorf("unable to restore key %s: %w", target, err)
+    }
+  }
+
+  if paths.OutputDir != "" {
+    if err := os.Chmod(stagedOutput, 0o755); err != nil {
+      return err
+    }
+    if err := c.setAside(paths.OutputDir, paths.OutputDir+PreRestoreSuffix); err != nil {
+      return err
+    }
+    if err := os.Rename(stagedOutput, paths.OutputDir); err != nil {
+      return fmt.Errorf("unable to restore %s: %w", paths.OutputDir, err)
+    }
+  }
+  return nil
+}
+
+// setAside moves target to previous, replacing an older copy there.
+func (c *commit) setAside(target, previous string) error {
+  if err := os.RemoveAll(previous); err != nil {
+    return err
+  }
+  err := os.Rename(target, previous)
+  if err != nil && !errors.Is(err, fs.ErrNotExist) {
+    return err
+  }
+  c.done = append(c.done, movedAside{target: target, previous: previous, existed: err == nil})
+  return nil
+}
+
+// undo removes what was moved into place and puts back what was set aside,
+// newest first.
+func (c *commit) undo() error {
+  var errs []error
+  for i := len(c.done) - 1; i >= 0; i-- {
+    entry := c.done[i]
+    if err := os.RemoveAll(entry.target); err != nil {
+      errs = append(errs, err)
+      continue
+    }
+    if entry.existed {
+      if err := os.Rename(entry.previous, entry.target); err != nil {
+        errs = append(errs, err)
+      }
+    }
+  }
+  return errors.Join(errs...)
+}
+
+// move renames the file src to dst, copying it when they are on different
+// file systems.
+func move(src, dst string) error {
+  if err := os.Rename(src, dst); err == nil {
+    return nil
+  }
+
+  in, err := os.Open(src)
+  if err != nil {
+    return err
+  }
+  defer in.Close()
+  tmp := dst + ".tmp"
+  out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+  if err != nil {
+    return err
+  }
+  if _, err := io.Copy(out, in); err != nil {
+    out.Close()
+    return err
+  }
+  if err := out.Close(); err != nil {
+    return err
+  }
+  return os.Rename(tmp, dst)
+}
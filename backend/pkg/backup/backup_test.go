@@ -0,0 +1,307 @@
+package backup
+
+import (
+  "bytes"
+  "context"
+  "crypto/rand"
+  "database/sql"
+  "elysium-backend/pkg/db"
+  "errors"
+  "io"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+type testState struct {
+  pool  *db.Pool
+  paths Paths
+}
+
+func newTestState(t *testing.T) *testState {
+  t.Helper()
+
+  root := t.TempDir()
+  migrations := filepath.Join(root, "migrations")
+  if err := os.MkdirAll(filepath.Join(migrations, string(db.SQLite)), 0o755); err != nil {
+    t.Fatal(err)
+  }
+  writeTestFile(t, filepath.Join(migrations, string(db.SQLite), "001_peers.sql"), "CREATE TABLE peers (name TEXT);")
+
+  paths := Paths{
+    Database:  filepath.Join(root, "elysium.db"),
+    Keys:      []string{filepath.Join(root, "keys", "server_private.key"), filepath.Join(root, "keys", "signing.pem")},
+    OutputDir: filepath.Join(root, "out"),
+  }
+  pool, err := db.Open(db.SQLite, paths.Database)
+  if err != nil {
+    t.Fatalf("failed to open database: %v", err)
+  }
+  t.Cleanup(func() { pool.Close() })
+  if err := db.RunMigrations(pool, migrations); err != nil {
+    t.Fatalf("migrations failed: %v", err)
+  }
+  if _, err := pool.Exec(`INSERT INTO peers (name) VALUES ('alice')`); err != nil {
+    t.Fatal(err)
+  }
+
+  writeTestFile(t, paths.Keys[0], "server-key")
+  writeTestFile(t, paths.Keys[1], "signing-key")
+  writeTestFile(t, filepath.Join(paths.OutputDir, "1", "elysium-client"), "binary")
+  writeTestFile(t, filepath.Join(paths.OutputDir, ".cache", "abc", "elysium-client"), "cached")
+  return &testState{pool: pool, paths: paths}
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+  t.Helper()
+  if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+    t.Fatal(err)
+  }
+  if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+    t.Fatal(err)
+  }
+}
+
+func readFile(t *testing.T, path string) string {
+  t.Helper()
+  content, err := os.ReadFile(path)
+  if err != nil {
+    return ""
+  }
+  return string(content)
+}
+
+// change alters every part of the state after a backup was taken. The pool
+// is closed, as the server is stopped for a restore.
+func (s *testState) change(t *testing.T) {
+  t.Helper()
+  if _, err := s.pool.Exec(`INSERT INTO peers (name) VALUES ('bob')`); err != nil {
+    t.Fatal(err)
+  }
+  s.pool.Close()
+  writeTestFile(t, s.paths.Keys[0], "rotated")
+  writeTestFile(t, filepath.Join(s.paths.OutputDir, "2", "elysium-client"), "new")
+}
+
+func (s *testState) peers(t *testing.T) int {
+  t.Helper()
+  return countPeers(t, s.paths.Database)
+}
+
+func countPeers(t *testing.T, database string) int {
+  t.Helper()
+  pool, err := sql.Open("sqlite3", database)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer pool.Close()
+  var count int
+  if err := pool.QueryRow(`SELECT COUNT(*) FROM peers`).Scan(&count); err != nil {
+    t.Fatalf("failed to count peers: %v", err)
+  }
+  return count
+}
+
+func TestCreateAndRestore(t *testing.T) {
+  ctx := context.Background()
+  s := newTestState(t)
+
+  var archive bytes.Buffer
+  manifest, err := Create(ctx, &archive, s.pool, s.paths, "")
+  if err != nil {
+    t.Fatalf("Create failed: %v", err)
+  }
+  if manifest.SchemaVersion != 1 || manifest.Driver != "sqlite" || manifest.Encrypted {
+    t.Errorf("unexpected manifest %+v", manifest)
+  }
+  if read, err := ReadManifest(bytes.NewReader(archive.Bytes()), ""); err != nil || *read != *manifest {
+    t.Errorf("expected ReadManifest to return %+v, got %+v (%v)", manifest, read, err)
+  }
+
+  s.change(t)
+  if _, err := Restore(ctx, bytes.NewReader(archive.Bytes()), s.paths, 1, ""); err != nil {
+    t.Fatalf("Restore failed: %v", err)
+  }
+
+  if s.peers(t) != 1 {
+    t.Error("expected the database to be restored")
+  }
+  if readFile(t, s.paths.Keys[0]) != "server-key" || readFile(t, s.paths.Keys[1]) != "signing-key" {
+    t.Error("expected the keys to be restored")
+  }
+  if readFile(t, filepath.Join(s.paths.OutputDir, "1", "elysium-client")) != "binary" {
+    t.Error("expected the artifacts to be restored")
+  }
+  if readFile(t, filepath.Join(s.paths.OutputDir, "2", "elysium-client")) != "" {
+    t.Error("expected artifacts created after the backup to be gone")
+  }
+  if readFile(t, filepath.Join(s.paths.OutputDir, ".cache", "abc", "elysium-client")) != "" {
+    t.Error("expected the build cache not to be archived")
+  }
+
+  if countPeers(t, s.paths.Database+PreRestoreSuffix) != 2 || readFile(t, s.paths.Keys[0]+PreRestoreSuffix) != "rotated" {
+    t.Error("expected the previous database and keys to be kept")
+  }
+  if _, err := os.Stat(s.paths.OutputDir + PreRestoreSuffix); !errors.Is(err, os.ErrNotExist) {
+    t.Errorf("expected the previous output directory to be removed, got %v", err)
+  }
+}
+
+func TestRestoreRefusesOpenDatabase(t *testing.T) {
+  ctx := context.Background()
+  s := newTestState(t)
+
+  var archive bytes.Buffer
+  if _, err := Create(ctx, &archive, s.pool, s.paths, ""); err != nil {
+    t.Fatalf("Create failed: %v", err)
+  }
+  if _, err := s.pool.Exec(`INSERT INTO peers (name) VALUES ('bob')`); err != nil {
+    t.Fatal(err)
+  }
+
+  // The pool stands in for a running server.
+  if _, err := Restore(ctx, bytes.NewReader(archive.Bytes()), s.paths, 1, ""); !errors.Is(err, db.ErrDatabaseInUse) {
+    t.Fatalf("expected an open database to be refused, got %v", err)
+  }
+  if s.peers(t) != 2 {
+    t.Error("expected nothing to be replaced")
+  }
+
+  s.pool.Close()
+  unlock, err := db.LockSQLite(s.paths.Database, true)
+  if err != nil {
+    t.Fatalf("LockSQLite failed: %v", err)
+  }
+  defer unlock()
+  if _, err := db.Open(db.SQLite, s.paths.Database); !errors.Is(err, db.ErrDatabaseInUse) {
+    t.Errorf("expected the database not to open during a restore, got %v", err)
+  }
+}
+
+func TestRestoreRollsBackFailedReplace(t *testing.T) {
+  ctx := context.Background()
+  s := newTestState(t)
+
+  var archive bytes.Buffer
+  if _, err := Create(ctx, &archive, s.pool, s.paths, ""); err != nil {
+    t.Fatalf("Create failed: %v", err)
+  }
+  s.change(t)
+
+  // The keys cannot be put back where a file now stands in for their
+  // directory; the database has been replaced by then.
+  keys := filepath.Dir(s.paths.Keys[0])
+  if err := os.RemoveAll(keys); err != nil {
+    t.Fatal(err)
+  }
+  writeTestFile(t, keys, "not a directory")
+
+  _, err := Restore(ctx, bytes.NewReader(archive.Bytes()), s.paths, 1, "")
+  var replaceErr *ReplaceError
+  if !errors.As(err, &replaceErr) || replaceErr.RollbackErr != nil {
+    t.Fatalf("expected a rolled back ReplaceError, got %v", err)
+  }
+  if s.peers(t) != 2 {
+    t.Error("expected the previous database to be put back")
+  }
+  if _, err := os.Stat(s.paths.Database + PreRestoreSuffix); !errors.Is(err, os.ErrNotExist) {
+    t.Errorf("expected no copy to be left after the rollback, got %v", err)
+  }
+  if readFile(t, filepath.Join(s.paths.OutputDir, "2", "elysium-client")) != "new" {
+    t.Error("expected the output directory to be untouched")
+  }
+}
+
+func TestRestoreRefusesIncompatibleArchives(t *testing.T) {
+  ctx := context.Background()
+  s := newTestState(t)
+
+  var archive bytes.Buffer
+  if _, err := Create(ctx, &archive, s.pool, s.paths, ""); err != nil {
+    t.Fatalf("Create failed: %v", err)
+  }
+  s.change(t)
+
+  if _, err := Restore(ctx, bytes.NewReader(archive.Bytes()), s.paths, 0, ""); !errors.Is(err, ErrIncompatible) {
+    t.Errorf("expected a newer schema to be refused, got %v", err)
+  }
+  other := s.paths
+  other.Keys = other.Keys[:1]
+  if _, err := Restore(ctx, bytes.NewReader(archive.Bytes()), other, 1, ""); !errors.Is(err, ErrIncompatible) {
+    t.Errorf("expected an unknown key to be refused, got %v", err)
+  }
+  truncated := archive.Bytes()[:archive.Len()/2]
+  if _, err := Restore(ctx, bytes.NewReader(truncated), s.paths, 1, ""); err == nil {
+    t.Error("expected a truncated archive to be refused")
+  }
+  if _, err := Restore(ctx, bytes.NewReader([]byte("not an archive")), s.paths, 1, ""); !errors.Is(err, ErrIncompatible) {
+    t.Errorf("expected garbage to be refused, got %v", err)
+  }
+
+  if s.peers(t) != 2 || readFile(t, s.paths.Keys[0]) != "rotated" {
+    t.Error("expected nothing to be replaced")
+  }
+}
+
+func TestEncryptedBackup(t *testing.T) {
+  ctx := context.Background()
+  s := newTestState(t)
+
+  var archive bytes.Buffer
+  manifest, err := Create(ctx, &archive, s.pool, s.paths, "correct horse")
+  if err != nil {
+    t.Fatalf("Create failed: %v", err)
+  }
+  if !manifest.Encrypted || bytes.Contains(archive.Bytes(), []byte("server-key")) {
+    t.Fatal("expected the archive to be encrypted")
+  }
+  s.change(t)
+
+  if _, err := Restore(ctx, bytes.NewReader(archive.Bytes()), s.paths, 1, ""); !errors.Is(err, ErrPassphraseRequired) {
+    t.Errorf("expected a passphrase to be required, got %v", err)
+  }
+  if _, err := Restore(ctx, bytes.NewReader(archive.Bytes()), s.paths, 1, "wrong"); !errors.Is(err, ErrDecrypt) {
+    t.Errorf("expected a wrong passphrase to be refused, got %v", err)
+  }
+  if s.peers(t) != 2 {
+    t.Fatal("expected nothing to be replaced")
+  }
+  if _, err := Restore(ctx, bytes.NewReader(archive.Bytes()), s.paths, 1, "correct horse"); err != nil {
+    t.Fatalf("Restore failed: %v", err)
+  }
+  if s.peers(t) != 1 || readFile(t, s.paths.Keys[0]) != "server-key" {
+    t.Error("expected the state to be restored")
+  }
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+  for _, size := range []int{0, 10, chunkSize, 2*chunkSize + 5} {
+    plain := make([]byte, size)
+    rand.Read(plain)
+
+    var sealed bytes.Buffer
+    enc, err := NewEncryptWriter(&sealed, "secret")
+    if err != nil {
+      t.Fatalf("NewEncryptWriter failed: %v", err)
+    }
+    enc.Write(plain)
+    enc.Close()
+
+    r, _, err := openArchive(bytes.NewReader(sealed.Bytes()), "secret")
+    if err != nil {
+      t.Fatalf("openArchive failed: %v", err)
+    }
+    got, err := io.ReadAll(r)
+    if err != nil || !bytes.Equal(got, plain) {
+      t.Errorf("size %d: round trip failed: %v", size, err)
+    }
+
+    // Dropping the final chunk must not go unnoticed.
+    if size >= chunkSize {
+      r, _, _ := openArchive(bytes.NewReader(sealed.Bytes()[:sealed.Len()-16]), "secret")
+      if _, err := io.ReadAll(r); !errors.Is(err, ErrDecrypt) {
+        t.Errorf("size %d: expected a truncated archive to be detected, got %v", size, err)
+      }
+    }
+  }
+}
@@ -0,0 +1,192 @@
+package backup
+
+import (
+  "bufio"
+  "bytes"
+  "crypto/aes"
+  "crypto/cipher"
+  "crypto/rand"
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "io"
+
+  "golang.org/x/crypto/scrypt"
+)
+
+// Encrypted archives start with magic, followed by the scrypt salt and
+// cost. The rest is a sequence of AES-256-GCM sealed chunks of chunkSize
+// bytes, the last one, which may be empty, marked as final so a truncated
+// archive is detected.
+var magic = []byte("ELYBAK01")
+
+const (
+  saltSize   = 16
+  scryptLogN = 15
+  chunkSize  = 64 << 10
+)
+
+var (
+  ErrPassphraseRequired = errors.New("backup is encrypted, a passphrase is required")
+  ErrDecrypt            = errors.New("unable to decrypt backup: wrong passphrase or corrupted archive")
+)
+
+func deriveKey(passphrase string, salt []byte, logN byte) (cipher.AEAD, error) {
+  if logN < 10 || logN > 20 {
+    return nil, fmt.Errorf("unsupported scrypt cost 2^%d", logN)
+  }
+  key, err := scrypt.Key([]byte(passphrase), salt, 1<<logN, 8, 1, 32)
+  if err != nil {
+    return nil, err
+  }
+  block, err := aes.NewCipher(key)
+  if err != nil {
+    return nil, err
+  }
+  return cipher.NewGCM(block)
+}
+
+func chunkNonce(aead cipher.AEAD, counter uint64) []byte {
+  nonce := make([]byte, aead.NonceSize())
+  binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+  return nonce
+}
+
+func chunkAD(final bool) []byte {
+  if final {
+    return []byte{1}
+  }
+  return []byte{0}
+}
+
+type encryptWriter struct {
+  w       io.Writer
+  aead    cipher.AEAD
+  buf     []byte
+  counter uint64
+}
+
+// NewEncryptWriter returns a writer encrypting everything written to it
+// with a key derived from passphrase. Close must be called to write the
+// final chunk; it does not close w.
+func NewEncryptWriter(w io.Writer, passphrase string) (io.WriteCloser, error) {
+  salt := make([]byte, saltSize)
+  if _, err := rand.Read(salt); err != nil {
+    return nil, err
+  }
+  aead, err := deriveKey(passphrase, salt, scryptLogN)
+  if err != nil {
+    return nil, err
+  }
+
+  header := append(append(append([]byte{}, magic...), salt...), scryptLogN)
+  if _, err := w.Write(header); err != nil {
+    return nil, err
+  }
+  return &encryptWriter{w: w, aead: aead, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+  n := 0
+  for len(p) > 0 {
+    // A full chunk is only sealed once more data follows, so the last
+    // chunk can still be marked final on Close.
+    if len(e.buf) == chunkSize {
+      if err := e.seal(false); err != nil {
+        return n, err
+      }
+    }
+    k := min(chunkSize-len(e.buf), len(p))
+    e.buf = append(e.buf, p[:k]...)
+    p = p[k:]
+    n += k
+  }
+  return n, nil
+}
+
+func (e *encryptWriter) seal(final bool) error {
+  sealed := e.aead.Seal(nil, chunkNonce(e.aead, e.counter), e.buf, chunkAD(final))
+  e.counter++
+  e.buf = e.buf[:0]
+  _, err := e.w.Write(sealed)
+  return err
+}
+
+func (e *encryptWriter) Close() error {
+  return e.seal(true)
+}
+
+type decryptReader struct {
+  r       io.Reader
+  aead    cipher.AEAD
+  chunk   []byte
+  plain   []byte
+  counter uint64
+  done    bool
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+  for len(d.plain) == 0 {
+    if d.done {
+      // Anything after the final chunk was appended to the archive.
+      if n, _ := d.r.Read(d.chunk[:1]); n > 0 {
+        return 0, ErrDecrypt
+      }
+      return 0, io.EOF
+    }
+    if err := d.next(); err != nil {
+      return 0, err
+    }
+  }
+  n := copy(p, d.plain)
+  d.plain = d.plain[n:]
+  return n, nil
+}
+
+func (d *decryptReader) next() error {
+  n, err := io.ReadFull(d.r, d.chunk)
+  if errors.Is(err, io.EOF) {
+    return fmt.Errorf("%w: archive is truncated", ErrDecrypt)
+  } else if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+    return err
+  }
+
+  nonce := chunkNonce(d.aead, d.counter)
+  d.counter++
+  if n == len(d.chunk) {
+    if plain, err := d.aead.Open(nil, nonce, d.chunk, chunkAD(false)); err == nil {
+      d.plain = plain
+      return nil
+    }
+  }
+  plain, err := d.aead.Open(nil, nonce, d.chunk[:n], chunkAD(true))
+  if err != nil {
+    return ErrDecrypt
+  }
+  d.plain = plain
+  d.done = true
+  return nil
+}
+
+// openArchive returns a reader for the plain archive in r, decrypting it
+// with passphrase when it is encrypted.
+func openArchive(r io.Reader, passphrase string) (io.Reader, bool, error) {
+  br := bufio.NewReader(r)
+  head, err := br.Peek(len(magic))
+  if err != nil || !bytes.Equal(head, magic) {
+    return br, false, nil
+  }
+  if passphrase == "" {
+    return nil, true, ErrPassphraseRequired
+  }
+
+  header := make([]byte, len(magic)+saltSize+1)
+  if _, err := io.ReadFull(br, header); err != nil {
+    return nil, true, fmt.Errorf("%w: archive is truncated", ErrDecrypt)
+  }
+  aead, err := deriveKey(passphrase, header[len(magic):len(magic)+saltSize], header[len(header)-1])
+  if err != nil {
+    return nil, true, err
+  }
+  return &decryptReader{r: br, aead: aead, chunk: make([]byte, chunkSize+aead.Overhead())}, true, nil
+}
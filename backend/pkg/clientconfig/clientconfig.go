@@ -0,0 +1,113 @@
+// Package clientconfig packs the per-peer configuration the client reads at
+// startup. A cached client binary is built once per target and each peer's
+// configuration is appended to a copy of it as a signed trailer:
+//
+//  binary | body | signature (64) | body length (uint32 LE) | "ELYCFG01"
+//
+// The body is a list of KEY=VALUE lines using the same names the client's
+// build script accepts, and the signature is an Ed25519 signature over it
+// made with the key whose public half is compiled into the client.
+package clientconfig
+
+import (
+  "bytes"
+  "crypto/ed25519"
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "os"
+  "sort"
+  "strings"
+)
+
+// Magic terminates every payload.
+const Magic = "ELYCFG01"
+
+const trailerSize = ed25519.SignatureSize + 4 + len(Magic)
+
+// ErrNoPayload is returned by Extract for data that does not end in a
+// payload.
+var ErrNoPayload = errors.New("no configuration payload found")
+
+// Encode returns the body for values, one KEY=VALUE line per entry in key
+// order.
+func Encode(values map[string]string) ([]byte, error) {
+  keys := make([]string, 0, len(values))
+  for key := range values {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+
+  var body bytes.Buffer
+  for _, key := range keys {
+    value := values[key]
+    if key == "" || strings.ContainsAny(key, "=\n") || strings.Contains(value, "\n") {
+      return nil, fmt.Errorf("invalid configuration entry %q", key)
+    }
+    fmt.Fprintf(&body, "%s=%s\n", key, value)
+  }
+  return body.Bytes(), nil
+}
+
+// Payload returns the signed trailer for values.
+func Payload(values map[string]string, key ed25519.PrivateKey) ([]byte, error) {
+  body, err := Encode(values)
+  if err != nil {
+    return nil, err
+  }
+
+  payload := append(body, ed25519.Sign(key, body)...)
+  payload = binary.LittleEndian.AppendUint32(payload, uint32(len(body)))
+  return append(payload, Magic...), nil
+}
+
+// Append writes the signed payload for values to the end of the file at
+// path.
+func Append(path string, values map[string]string, key ed25519.PrivateKey) error {
+  payload, err := Payload(values, key)
+  if err != nil {
+    return err
+  }
+
+  file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+  if err != nil {
+    return err
+  }
+  if _, err := file.Write(payload); err != nil {
+    file.Close()
+    return err
+  }
+  return file.Close()
+}
+
+// Extract verifies and decodes the payload at the end of data.
+func Extract(data []byte, publicKey ed25519.PublicKey) (map[string]string, error) {
+  if len(data) < trailerSize || string(data[len(data)-len(Magic):]) != Magic {
+    return nil, ErrNoPayload
+  }
+
+  end := len(data) - len(Magic)
+  bodyLen := int(binary.LittleEndian.Uint32(data[end-4 : end]))
+  sigEnd := end - 4
+  bodyEnd := sigEnd - ed25519.SignatureSize
+  if bodyLen > bodyEnd {
+    return nil, fmt.Errorf("payload length %d exceeds the data", bodyLen)
+  }
+  body := data[bodyEnd-bodyLen : bodyEnd]
+  if !ed25519.Verify(publicKey, body, data[bodyEnd:sigEnd]) {
+    return nil, errors.New("payload signature does not verify")
+  }
+
+  values := make(map[string]string)
+  for _, line := range strings.Split(strings.TrimSuffix(string(body), "\n"), "\n") {
+    if line == "" {
+      continue
+    }
+    key, value, found := strings.Cut(line, "=")
+    if !found {
+      return nil, fmt.Errorf("malformed payload line %q", line)
+    }
+    values[key] = value
+  }
+  return values, nil
+}
@@ -0,0 +1,56 @@
+package clientconfig
+
+import (
+  "crypto/ed25519"
+  "errors"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+func TestAppendAndExtract(t *testing.T) {
+  public, private, _ := ed25519.GenerateKey(nil)
+  path := filepath.Join(t.TempDir(), "elysium-client")
+  os.WriteFile(path, []byte("\x7fELF binary contents"), 0o755)
+
+  values := map[string]string{"ADDR": "10.0.0.2", "CIDR": "24", "SERVERPUB": "abc="}
+  if err := Append(path, values, private); err != nil {
+    t.Fatalf("Append failed: %v", err)
+  }
+
+  data, _ := os.ReadFile(path)
+  got, err := Extract(data, public)
+  if err != nil {
+    t.Fatalf("Extract failed: %v", err)
+  }
+  if len(got) != 3 || got["ADDR"] != "10.0.0.2" || got["SERVERPUB"] != "abc=" {
+    t.Errorf("unexpected values %v", got)
+  }
+
+  otherPublic, _, _ := ed25519.GenerateKey(nil)
+  if _, err := Extract(data, otherPublic); err == nil {
+    t.Error("expected a payload signed with another key to be rejected")
+  }
+
+  tampered := append([]byte(nil), data...)
+  tampered[len("\x7fELF binary contents")] = 'B'
+  if _, err := Extract(tampered, public); err == nil {
+    t.Error("expected a tampered payload to be rejected")
+  }
+
+  if _, err := Extract([]byte("plain binary"), public); !errors.Is(err, ErrNoPayload) {
+    t.Errorf("expected ErrNoPayload, got %v", err)
+  }
+}
+
+func TestEncodeRejectsInvalidEntries(t *testing.T) {
+  for _, values := range []map[string]string{
+    {"": "x"},
+    {"A=B": "x"},
+    {"ADDR": "10.0.0.2\nCIDR=8"},
+  } {
+    if _, err := Encode(values); err == nil {
+      t.Errorf("expected %v to be rejected", values)
+    }
+  }
+}
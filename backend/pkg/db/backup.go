@@ -0,0 +1,100 @@
+package db
+
+import (
+  "context"
+  "database/sql"
+  "errors"
+  "fmt"
+
+  sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// BackupSQLite copies the database behind pool into a new SQLite file at
+// path with SQLite's online backup API. The copy is a consistent snapshot:
+// the source stays readable while it is taken and writers wait until it is
+// done.
+func BackupSQLite(ctx context.Context, pool *Pool, path string) error {
+  if pool.Dialect != SQLite {
+    return fmt.Errorf("online backup requires SQLite, not %s", pool.Dialect)
+  }
+
+  dest, err := sql.Open(SQLite.driverName(), path)
+  if err != nil {
+    return err
+  }
+  defer dest.Close()
+
+  destConn, err := dest.Conn(ctx)
+  if err != nil {
+    return err
+  }
+  defer destConn.Close()
+
+  srcConn, err := pool.Conn(ctx)
+  if err != nil {
+    return err
+  }
+  defer srcConn.Close()
+
+  return destConn.Raw(func(destDriver any) error {
+    return srcConn.Raw(func(srcDriver any) error {
+      destSQLite, ok := destDriver.(*sqlite3.SQLiteConn)
+      srcSQLite, ok2 := srcDriver.(*sqlite3.SQLiteConn)
+      if !ok || !ok2 {
+        return errors.New("online backup requires the sqlite3 driver")
+      }
+
+      backup, err := destSQLite.Backup("main", srcSQLite, "main")
+      if err != nil {
+        return err
+      }
+      if _, err := backup.Step(-1); err != nil {
+        backup.Finish()
+        return err
+      }
+      return backup.Finish()
+    })
+  })
+}
+
+// InspectSQLite checks the integrity of the SQLite database at path and
+// returns its schema version, the latest migration recorded as applied.
+func InspectSQLite(ctx context.Context, path string) (int, error) {
+  pool, err := sql.Open(SQLite.driverName(), "file:"+path+"?mode=ro")
+  if err != nil {
+    return 0, err
+  }
+  defer pool.Close()
+
+  var result string
+  if err := pool.QueryRowContext(ctx, `PRAGMA integrity_check`).Scan(&result); err != nil {
+    return 0, err
+  }
+  if result != "ok" {
+    return 0, fmt.Errorf("integrity check failed: %s", result)
+  }
+  return SchemaVersion(ctx, pool)
+}
+
+// SchemaVersion returns the latest migration recorded as applied in pool,
+// 0 when none is.
+func SchemaVersion(ctx context.Context, pool *sql.DB) (int, error) {
+  var version sql.NullInt64
+  if err := pool.QueryRowContext(ctx, `SELECT MAX(version) FROM migrations`).Scan(&version); err != nil {
+    return 0, fmt.Errorf("unable to read the schema version: %w", err)
+  }
+  return int(version.Int64), nil
+}
+
+// LatestMigration returns the highest version among the migrations for
+// dialect in migrationDir.
+func LatestMigration(dialect Dialect, migrationDir string) (int, error) {
+  migrations, err := LoadMigrations(dialect, migrationDir)
+  if err != nil {
+    return 0, err
+  }
+  if len(migrations) == 0 {
+    return 0, nil
+  }
+  return migrations[len(migrations)-1].Version, nil
+}
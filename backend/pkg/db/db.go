@@ -3,106 +3,78 @@ package db
 import (
   "database/sql"
   "elysium-backend/config"
-  "log"
+  "fmt"
+  "log/slog"
   "os"
   "path/filepath"
 
+  _ "github.com/jackc/pgx/v5/stdlib"
   _ "github.com/mattn/go-sqlite3"
 )
 
-var DBPool *sql.DB
-
-func InitializeDatabaseConnection() *sql.DB {
-  if config.GetLogLevel() == "DEBUG" {
-    log.Println("db.InitializeDatabaseConnection -> called")
+// InitializeDatabaseConnection opens the pool configured by cfg.
+func InitializeDatabaseConnection(cfg config.DatabaseConfig) (*Pool, error) {
+  dialect, err := ParseDialect(cfg.Driver)
+  if err != nil {
+    return nil, fmt.Errorf("invalid DB_DRIVER: %w", err)
   }
 
-  dsn := config.GetEnv("DB_NAME", "elysium.db")
-
-  dbPool, err := sql.Open("sqlite3", dsn)
+  dbPool, err := Open(dialect, cfg.DSN)
   if err != nil {
-    log.Fatalf("db.InitializeDatabaseConnection -> error connecting to the database: %v", err)
+    return nil, fmt.Errorf("connecting to the %s database: %w", dialect, err)
   }
 
-  log.Println("db.InitializeDatabaseConnection -> Successfully connected to SQLite database")
-  return dbPool
+  slog.Info("connected to database", "driver", dialect)
+  return dbPool, nil
 }
 
-func CloseDatabaseConnection() {
-  if config.GetLogLevel() == "DEBUG" {
-    log.Println("db.CloseDatabaseConnection -> called")
-  }
-
-  if DBPool != nil {
-    DBPool.Close()
-    log.Println("db.CloseDatabaseConnection -> Database connection closed successfully")
-  }
+// Pool is a connection pool together with the dialect of the database
+// behind it, which decides how queries are rebound and values written.
+type Pool struct {
+  *sql.DB
+  Dialect Dialect
+  unlock  func() error
 }
 
-func RunMigrations(migrationDir string) error {
-  if config.GetLogLevel() == "DEBUG" {
-    log.Println("db.RunMigrations -> called with migrationDir:", migrationDir)
-  }
-
-  _, err := DBPool.Exec(`
-    CREATE TABLE IF NOT EXISTS migrations (
-    id INTEGER PRIMARY KEY AUTOINCREMENT,
-    filename TEXT UNIQUE,
-    applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-    )
-    `)
-  if err != nil {
-    log.Println("db.RunMigrations -> error creating migrations table:", err)
-    return err
-  }
-
-  files, err := os.ReadDir(migrationDir)
+// Open opens a connection pool for dialect. The caller owns the pool and
+// closes it. A pool on an SQLite file holds a shared LockSQLite lock until
+// it is closed, so the database cannot be restored under it.
+func Open(dialect Dialect, dsn string) (*Pool, error) {
+  dbPool, err := sql.Open(dialect.driverName(), dsn)
   if err != nil {
-    log.Println("db.RunMigrations -> error reading migration directory:", err)
-    return err
+    return nil, err
   }
+  pool := &Pool{DB: dbPool, Dialect: dialect}
 
-  for _, file := range files {
-    if filepath.Ext(file.Name()) == ".sql" {
-      var exists bool
-      err := DBPool.QueryRow(`
-        SELECT EXISTS (
-        SELECT 1 FROM migrations WHERE filename = ?
-        )
-        `, file.Name()).Scan(&exists)
-      if err != nil {
-        log.Println("db.RunMigrations -> error checking migration status for", file.Name(), ":", err)
-        return err
-      }
-
-      if exists {
-        log.Println("db.RunMigrations -> Skipping already applied migration:", file.Name())
-        continue
-      }
+  if dialect == SQLite {
+    // SQLite only supports one writer; serialising access through a single
+    // connection avoids "database is locked" errors under concurrent requests.
+    dbPool.SetMaxOpenConns(1)
 
-      filePath := filepath.Join(migrationDir, file.Name())
-      query, err := os.ReadFile(filePath)
-      if err != nil {
-        log.Println("db.RunMigrations -> error reading migration file:", filePath, ":", err)
-        return err
-      }
-
-      _, err = DBPool.Exec(string(query))
-      if err != nil {
-        log.Println("db.RunMigrations -> error applying migration", file.Name(), ":", err)
-        return err
+    if file := SQLiteFile(dsn); file != "" {
+      if pool.unlock, err = LockSQLite(file, false); err != nil {
+        dbPool.Close()
+        return nil, err
       }
+    }
+  }
 
-      _, err = DBPool.Exec(`
-        INSERT INTO migrations (filename) VALUES (?)
-        `, file.Name())
-      if err != nil {
-        log.Println("db.RunMigrations -> error recording applied migration", file.Name(), ":", err)
-        return err
-      }
+  return pool, nil
+}
 
-      log.Println("db.RunMigrations -> Migration applied successfully:", file.Name())
+// Close closes the pool and releases its lock on the database.
+func (p *Pool) Close() error {
+  err := p.DB.Close()
+  if p.unlock != nil {
+    if unlockErr := p.unlock(); err == nil {
+      err = unlockErr
     }
   }
-  return nil
+  return err
+}
+
+func migrationFiles(dialect Dialect, migrationDir string) (string, []os.DirEntry, error) {
+  dir := filepath.Join(migrationDir, dialect.migrationSubdir())
+  files, err := os.ReadDir(dir)
+  return dir, files, err
 }
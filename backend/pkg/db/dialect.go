@@ -0,0 +1,91 @@
+package db
+
+import (
+  "fmt"
+  "strconv"
+  "strings"
+)
+
+// Dialect identifies the SQL database the backend is talking to. Queries are
+// written with ? placeholders and passed through Rebind before execution.
+type Dialect string
+
+const (
+  SQLite   Dialect = "sqlite"
+  Postgres Dialect = "postgres"
+)
+
+func ParseDialect(name string) (Dialect, error) {
+  switch strings.ToLower(name) {
+  case "", "sqlite", "sqlite3":
+    return SQLite, nil
+  case "postgres", "postgresql", "pgx":
+    return Postgres, nil
+  default:
+    return "", fmt.Errorf("unsupported database driver %q", name)
+  }
+}
+
+func (d Dialect) driverName() string {
+  if d == Postgres {
+    return "pgx"
+  }
+  return "sqlite3"
+}
+
+// migrationSubdir is the directory below MIGRATION_PATH holding the
+// migrations written for this dialect.
+func (d Dialect) migrationSubdir() string {
+  return string(d)
+}
+
+func (d Dialect) migrationsTableDDL() string {
+  if d == Postgres {
+    return `
+    CREATE TABLE IF NOT EXISTS migrations (
+    id SERIAL PRIMARY KEY,
+    filename TEXT UNIQUE,
+    applied_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    version INTEGER,
+    checksum TEXT
+    )
+    `
+  }
+  return `
+    CREATE TABLE IF NOT EXISTS migrations (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    filename TEXT UNIQUE,
+    applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    version INTEGER,
+    checksum TEXT
+    )
+    `
+}
+
+// Rebind rewrites ? placeholders into the form expected by the dialect.
+// Question marks inside single quoted literals are left alone.
+func (d Dialect) Rebind(query string) string {
+  if d != Postgres {
+    return query
+  }
+
+  var b strings.Builder
+  b.Grow(len(query) + 8)
+
+  n := 0
+  inQuote := false
+  for _, c := range query {
+    switch {
+    case c == '\'':
+      inQuote = !inQuote
+      b.WriteRune(c)
+    case c == '?' && !inQuote:
+      n++
+      b.WriteByte('$')
+      b.WriteString(strconv.Itoa(n))
+    default:
+      b.WriteRune(c)
+    }
+  }
+  return b.String()
+}
@@ -0,0 +1,52 @@
+package db
+
+import "testing"
+
+func TestRebind(t *testing.T) {
+  tests := []struct {
+    name     string
+    dialect  Dialect
+    query    string
+    expected string
+  }{
+    {
+      name:     "SQLite keeps question marks",
+      dialect:  SQLite,
+      query:    "SELECT 1 FROM peers WHERE id = ? AND status = ?",
+      expected: "SELECT 1 FROM peers WHERE id = ? AND status = ?",
+    },
+    {
+      name:     "Postgres numbers placeholders",
+      dialect:  Postgres,
+      query:    "INSERT INTO peers (a, b, c) VALUES (?, ?, ?)",
+      expected: "INSERT INTO peers (a, b, c) VALUES ($1, $2, $3)",
+    },
+    {
+      name:     "Postgres ignores quoted question marks",
+      dialect:  Postgres,
+      query:    "SELECT '?' FROM peers WHERE id = ?",
+      expected: "SELECT '?' FROM peers WHERE id = $1",
+    },
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      if got := tt.dialect.Rebind(tt.query); got != tt.expected {
+        t.Errorf("expected %q, got %q", tt.expected, got)
+      }
+    })
+  }
+}
+
+func TestParseDialect(t *testing.T) {
+  for input, expected := range map[string]Dialect{"": SQLite, "sqlite3": SQLite, "postgres": Postgres, "PostgreSQL": Postgres} {
+    got, err := ParseDialect(input)
+    if err != nil || got != expected {
+      t.Errorf("ParseDialect(%q) = %q, %v; expected %q", input, got, err, expected)
+    }
+  }
+
+  if _, err := ParseDialect("mysql"); err == nil {
+    t.Error("expected an error for an unsupported driver")
+  }
+}
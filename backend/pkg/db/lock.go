@@ -0,0 +1,58 @@
+package db
+
+import (
+  "errors"
+  "fmt"
+  "os"
+  "strings"
+  "sync"
+  "syscall"
+)
+
+// ErrDatabaseInUse is returned when the SQLite database is locked by
+// another process in a conflicting mode: a restore while the database is
+// open, or opening it while a restore runs.
+var ErrDatabaseInUse = errors.New("database is in use by another process")
+
+// SQLiteFile returns the file of the SQLite database named by dsn, empty
+// for an in-memory database.
+func SQLiteFile(dsn string) string {
+  name, query, _ := strings.Cut(strings.TrimPrefix(dsn, "file:"), "?")
+  if name == "" || name == ":memory:" || strings.Contains(query, "mode=memory") {
+    return ""
+  }
+  return name
+}
+
+// LockSQLite takes an advisory lock on the lock file next to the SQLite
+// database at path: shared for the processes using the database, exclusive
+// for a restore replacing it. It does not wait; ErrDatabaseInUse is
+// returned when the lock is held in a conflicting mode. The lock lasts
+// until the returned function is called or the process exits. A separate
+// file is locked because closing a descriptor of the database itself would
+// drop the locks SQLite holds on it.
+func LockSQLite(path string, exclusive bool) (func() error, error) {
+  file, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+  if err != nil {
+    return nil, err
+  }
+
+  how := syscall.LOCK_SH
+  if exclusive {
+    how = syscall.LOCK_EX
+  }
+  if err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB); err != nil {
+    file.Close()
+    if errors.Is(err, syscall.EWOULDBLOCK) {
+      return nil, fmt.Errorf("%w: %s", ErrDatabaseInUse, path)
+    }
+    return nil, fmt.Errorf("locking %s: %w", path, err)
+  }
+
+  var once sync.Once
+  return func() error {
+    var err error
+    once.Do(func() { err = file.Close() })
+    return err
+  }, nil
+}
@@ -0,0 +1,411 @@
+package db
+
+import (
+  "context"
+  "crypto/sha256"
+  "database/sql"
+  "encoding/hex"
+  "fmt"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// Migration is one versioned schema change. Files are named
+// NNN_description.sql, with an optional NNN_description.down.sql that
+// reverts it.
+type Migration struct {
+  Version  int
+  Filename string
+  UpSQL    string
+  DownSQL  string
+  Checksum string
+}
+
+// MigrationStatus describes a migration as known to both the migration
+// directory and the migrations table.
+type MigrationStatus struct {
+  Version   int        `json:"version"`
+  Filename  string     `json:"filename"`
+  Applied   bool       `json:"applied"`
+  AppliedAt *time.Time `json:"applied_at,omitempty"`
+  // State is "pending", "applied", "modified" when the file changed after
+  // it was applied, or "missing" when an applied migration has no file.
+  State      string `json:"state"`
+  Reversible bool   `json:"reversible"`
+}
+
+type appliedMigration struct {
+  version   int
+  filename  string
+  checksum  string
+  appliedAt time.Time
+}
+
+func checksum(content []byte) string {
+  sum := sha256.Sum256(content)
+  return hex.EncodeToString(sum[:])
+}
+
+func parseVersion(filename string) (int, error) {
+  prefix, _, found := strings.Cut(filename, "_")
+  if !found {
+    return 0, fmt.Errorf("migration %s is not named NNN_description.sql", filename)
+  }
+  version, err := strconv.Atoi(prefix)
+  if err != nil {
+    return 0, fmt.Errorf("migration %s has no numeric version prefix", filename)
+  }
+  return version, nil
+}
+
+// LoadMigrations reads the migrations for dialect from migrationDir,
+// ordered by version.
+func LoadMigrations(dialect Dialect, migrationDir string) ([]Migration, error) {
+  dir, files, err := migrationFiles(dialect, migrationDir)
+  if err != nil {
+    return nil, err
+  }
+
+  byVersion := make(map[int]*Migration)
+  downs := make(map[int]string)
+
+  for _, file := range files {
+    name := file.Name()
+    if file.IsDir() || filepath.Ext(name) != ".sql" {
+      continue
+    }
+
+    version, err := parseVersion(name)
+    if err != nil {
+      return nil, err
+    }
+
+    content, err := os.ReadFile(filepath.Join(dir, name))
+    if err != nil {
+      return nil, err
+    }
+
+    if strings.HasSuffix(name, ".down.sql") {
+      if _, exists := downs[version]; exists {
+        return nil, fmt.Errorf("duplicate down migration for version %d", version)
+      }
+      downs[version] = string(content)
+      continue
+    }
+
+    if existing, exists := byVersion[version]; exists {
+      return nil, fmt.Errorf("migrations %s and %s share version %d", existing.Filename, name, version)
+    }
+    byVersion[version] = &Migration{
+      Version:  version,
+      Filename: name,
+      UpSQL:    string(content),
+      Checksum: checksum(content),
+    }
+  }
+
+  migrations := make([]Migration, 0, len(byVersion))
+  for version, migration := range byVersion {
+    migration.DownSQL = downs[version]
+    delete(downs, version)
+    migrations = append(migrations, *migration)
+  }
+  for version := range downs {
+    return nil, fmt.Errorf("down migration for version %d has no matching up migration", version)
+  }
+
+  sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+  return migrations, nil
+}
+
+// ensureMigrationsTable creates the bookkeeping table and upgrades tables
+// created before versions and checksums were recorded. Rows written by the
+// old runner are backfilled from the files on disk.
+func ensureMigrationsTable(ctx context.Context, pool *Pool, migrations []Migration) error {
+  if _, err := pool.ExecContext(ctx, pool.Dialect.migrationsTableDDL()); err != nil {
+    return fmt.Errorf("creating migrations table: %w", err)
+  }
+
+  if _, err := pool.ExecContext(ctx, `SELECT version, checksum FROM migrations WHERE 1 = 0`); err != nil {
+    for _, ddl := range []string{
+      `ALTER TABLE migrations ADD COLUMN version INTEGER`,
+      `ALTER TABLE migrations ADD COLUMN checksum TEXT`,
+    } {
+      if _, err := pool.ExecContext(ctx, ddl); err != nil {
+        return fmt.Errorf("upgrading migrations table: %w", err)
+      }
+    }
+  }
+
+  for _, migration := range migrations {
+    _, err := pool.ExecContext(ctx, pool.Dialect.Rebind(`
+      UPDATE migrations SET version = ?, checksum = ?
+      WHERE filename = ? AND checksum IS NULL
+      `), migration.Version, migration.Checksum, migration.Filename)
+    if err != nil {
+      return fmt.Errorf("backfilling migration %s: %w", migration.Filename, err)
+    }
+  }
+  return nil
+}
+
+func loadApplied(ctx context.Context, pool *Pool) (map[int]appliedMigration, error) {
+  rows, err := pool.QueryContext(ctx, `SELECT version, filename, COALESCE(checksum, ''), applied_at FROM migrations WHERE version IS NOT NULL`)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+
+  applied := make(map[int]appliedMigration)
+  for rows.Next() {
+    var m appliedMigration
+    var appliedAt sql.NullTime
+    if err := rows.Scan(&m.version, &m.filename, &m.checksum, &appliedAt); err != nil {
+      return nil, err
+    }
+    m.appliedAt = appliedAt.Time
+    applied[m.version] = m
+  }
+  return applied, rows.Err()
+}
+
+type migrator struct {
+  pool       *Pool
+  migrations []Migration
+  applied    map[int]appliedMigration
+}
+
+// newMigrator loads the migration files and the applied state. prepare
+// creates or upgrades the bookkeeping table first; read-only callers such as
+// the readiness probe leave it untouched.
+func newMigrator(ctx context.Context, pool *Pool, migrationDir string, prepare bool) (*migrator, error) {
+  migrations, err := LoadMigrations(pool.Dialect, migrationDir)
+  if err != nil {
+    return nil, err
+  }
+  if prepare {
+    if err := ensureMigrationsTable(ctx, pool, migrations); err != nil {
+      return nil, err
+    }
+  }
+  applied, err := loadApplied(ctx, pool)
+  if err != nil {
+    return nil, err
+  }
+  return &migrator{pool: pool, migrations: migrations, applied: applied}, nil
+}
+
+// verify refuses to continue when an applied migration was edited after the
+// fact, since the schema would no longer match what the file describes.
+func (m *migrator) verify() error {
+  for _, migration := range m.migrations {
+    applied, ok := m.applied[migration.Version]
+    if ok && applied.checksum != "" && applied.checksum != migration.Checksum {
+      return fmt.Errorf("migration %s was modified after it was applied (checksum %s, recorded %s)",
+        migration.Filename, migration.Checksum[:12], applied.checksum[:12])
+    }
+  }
+  return nil
+}
+
+func (m *migrator) current() int {
+  current := 0
+  for version := range m.applied {
+    if version > current {
+      current = version
+    }
+  }
+  return current
+}
+
+func (m *migrator) up(ctx context.Context, target int) error {
+  if err := m.verify(); err != nil {
+    return err
+  }
+
+  for _, migration := range m.migrations {
+    if migration.Version > target {
+      break
+    }
+    if _, ok := m.applied[migration.Version]; ok {
+      slog.Debug("skipping already applied migration", "migration", migration.Filename)
+      continue
+    }
+
+    err := m.inTx(ctx, func(tx *sql.Tx) error {
+      if _, err := tx.ExecContext(ctx, migration.UpSQL); err != nil {
+        return err
+      }
+      _, err := tx.ExecContext(ctx, m.pool.Dialect.Rebind(`
+        INSERT INTO migrations (filename, version, checksum) VALUES (?, ?, ?)
+        `), migration.Filename, migration.Version, migration.Checksum)
+      return err
+    })
+    if err != nil {
+      slog.Error("error applying migration", "migration", migration.Filename, "err", err)
+      return fmt.Errorf("applying %s: %w", migration.Filename, err)
+    }
+
+    m.applied[migration.Version] = appliedMigration{version: migration.Version, filename: migration.Filename, checksum: migration.Checksum}
+    slog.Info("migration applied", "migration", migration.Filename)
+  }
+  return nil
+}
+
+func (m *migrator) down(ctx context.Context, target int) error {
+  for i := len(m.migrations) - 1; i >= 0; i-- {
+    migration := m.migrations[i]
+    if migration.Version <= target {
+      break
+    }
+    if _, ok := m.applied[migration.Version]; !ok {
+      continue
+    }
+    if migration.DownSQL == "" {
+      return fmt.Errorf("migration %s has no down migration", migration.Filename)
+    }
+
+    err := m.inTx(ctx, func(tx *sql.Tx) error {
+      if _, err := tx.ExecContext(ctx, migration.DownSQL); err != nil {
+        return err
+      }
+      _, err := tx.ExecContext(ctx, m.pool.Dialect.Rebind(`DELETE FROM migrations WHERE version = ?`), migration.Version)
+      return err
+    })
+    if err != nil {
+      slog.Error("error rolling back migration", "migration", migration.Filename, "err", err)
+      return fmt.Errorf("rolling back %s: %w", migration.Filename, err)
+    }
+
+    delete(m.applied, migration.Version)
+    slog.Info("migration rolled back", "migration", migration.Filename)
+  }
+  return nil
+}
+
+func (m *migrator) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+  tx, err := m.pool.BeginTx(ctx, nil)
+  if err != nil {
+    return err
+  }
+  if err := fn(tx); err != nil {
+    tx.Rollback()
+    return err
+  }
+  return tx.Commit()
+}
+
+// RunMigrations applies every pending migration, each in its own
+// transaction together with its bookkeeping row.
+func RunMigrations(pool *Pool, migrationDir string) error {
+  return MigrateUp(context.Background(), pool, migrationDir)
+}
+
+func MigrateUp(ctx context.Context, pool *Pool, migrationDir string) error {
+  slog.Debug("running migrations", "dir", migrationDir, "driver", pool.Dialect)
+
+  m, err := newMigrator(ctx, pool, migrationDir, true)
+  if err != nil {
+    return err
+  }
+  if len(m.migrations) == 0 {
+    return nil
+  }
+  return m.up(ctx, m.migrations[len(m.migrations)-1].Version)
+}
+
+// MigrateDown rolls back the most recent steps applied migrations.
+func MigrateDown(ctx context.Context, pool *Pool, migrationDir string, steps int) error {
+  m, err := newMigrator(ctx, pool, migrationDir, true)
+  if err != nil {
+    return err
+  }
+
+  target := m.current()
+  for i := len(m.migrations) - 1; i >= 0 && steps > 0; i-- {
+    if _, ok := m.applied[m.migrations[i].Version]; ok {
+      target = m.migrations[i].Version - 1
+      steps--
+    }
+  }
+  return m.down(ctx, target)
+}
+
+// MigrateTo moves the schema to version, applying or rolling back as needed.
+func MigrateTo(ctx context.Context, pool *Pool, migrationDir string, version int) error {
+  m, err := newMigrator(ctx, pool, migrationDir, true)
+  if err != nil {
+    return err
+  }
+
+  if version >= m.current() {
+    return m.up(ctx, version)
+  }
+  return m.down(ctx, version)
+}
+
+func MigrationStatuses(ctx context.Context, pool *Pool, migrationDir string) ([]MigrationStatus, error) {
+  return migrationStatuses(ctx, pool, migrationDir, true)
+}
+
+func migrationStatuses(ctx context.Context, pool *Pool, migrationDir string, prepare bool) ([]MigrationStatus, error) {
+  m, err := newMigrator(ctx, pool, migrationDir, prepare)
+  if err != nil {
+    return nil, err
+  }
+
+  var statuses []MigrationStatus
+  known := make(map[int]bool)
+  for _, migration := range m.migrations {
+    known[migration.Version] = true
+    status := MigrationStatus{
+      Version:    migration.Version,
+      Filename:   migration.Filename,
+      State:      "pending",
+      Reversible: migration.DownSQL != "",
+    }
+    if applied, ok := m.applied[migration.Version]; ok {
+      status.Applied = true
+      status.State = "applied"
+      if !applied.appliedAt.IsZero() {
+        appliedAt := applied.appliedAt
+        status.AppliedAt = &appliedAt
+      }
+      if applied.checksum != migration.Checksum {
+        status.State = "modified"
+      }
+    }
+    statuses = append(statuses, status)
+  }
+
+  for version, applied := range m.applied {
+    if !known[version] {
+      statuses = append(statuses, MigrationStatus{Version: version, Filename: applied.filename, Applied: true, State: "missing"})
+    }
+  }
+
+  sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+  return statuses, nil
+}
+
+// PendingMigrations returns the migration files in migrationDir that have not
+// been recorded as applied.
+func PendingMigrations(ctx context.Context, pool *Pool, migrationDir string) ([]string, error) {
+  statuses, err := migrationStatuses(ctx, pool, migrationDir, false)
+  if err != nil {
+    return nil, err
+  }
+
+  var pending []string
+  for _, status := range statuses {
+    if !status.Applied {
+      pending = append(pending, status.Filename)
+    }
+  }
+  return pending, nil
+}
@@ -0,0 +1,181 @@
+package db
+
+import (
+  "context"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+func setupMigrationTest(t *testing.T, files map[string]string) (*Pool, string) {
+  t.Helper()
+
+  pool, err := Open(SQLite, filepath.Join(t.TempDir(), "migrate.db"))
+  if err != nil {
+    t.Fatalf("failed to open database: %v", err)
+  }
+  t.Cleanup(func() { pool.Close() })
+
+  root := t.TempDir()
+  dir := filepath.Join(root, string(SQLite))
+  if err := os.MkdirAll(dir, 0o755); err != nil {
+    t.Fatalf("failed to create migration dir: %v", err)
+  }
+  for name, content := range files {
+    writeMigration(t, root, name, content)
+  }
+  return pool, root
+}
+
+func writeMigration(t *testing.T, root, name, content string) {
+  t.Helper()
+  if err := os.WriteFile(filepath.Join(root, string(SQLite), name), []byte(content), 0o644); err != nil {
+    t.Fatalf("failed to write migration %s: %v", name, err)
+  }
+}
+
+func tableExists(t *testing.T, pool *Pool, name string) bool {
+  t.Helper()
+  var count int
+  if err := pool.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, name).Scan(&count); err != nil {
+    t.Fatalf("failed to query sqlite_master: %v", err)
+  }
+  return count == 1
+}
+
+func states(t *testing.T, pool *Pool, root string) string {
+  t.Helper()
+  statuses, err := MigrationStatuses(context.Background(), pool, root)
+  if err != nil {
+    t.Fatalf("MigrationStatuses failed: %v", err)
+  }
+  var parts []string
+  for _, status := range statuses {
+    parts = append(parts, status.Filename+"="+status.State)
+  }
+  return strings.Join(parts, ",")
+}
+
+var baseMigrations = map[string]string{
+  "001_create_a.sql":      "CREATE TABLE a (id INTEGER);",
+  "001_create_a.down.sql": "DROP TABLE a;",
+  "002_create_b.sql":      "CREATE TABLE b (id INTEGER);",
+  "002_create_b.down.sql": "DROP TABLE b;",
+  "003_create_c.sql":      "CREATE TABLE c (id INTEGER);",
+}
+
+func TestMigrateUpDownAndTo(t *testing.T) {
+  ctx := context.Background()
+  pool, root := setupMigrationTest(t, baseMigrations)
+
+  if err := MigrateTo(ctx, pool, root, 2); err != nil {
+    t.Fatalf("MigrateTo(2) failed: %v", err)
+  }
+  if !tableExists(t, pool, "b") || tableExists(t, pool, "c") {
+    t.Fatal("expected migrations up to version 2 only")
+  }
+
+  if err := MigrateUp(ctx, pool, root); err != nil {
+    t.Fatalf("MigrateUp failed: %v", err)
+  }
+  if got := states(t, pool, root); got != "001_create_a.sql=applied,002_create_b.sql=applied,003_create_c.sql=applied" {
+    t.Errorf("unexpected status after up: %s", got)
+  }
+
+  if err := MigrateDown(ctx, pool, root, 1); err == nil {
+    t.Fatal("expected rolling back a migration without a down file to fail")
+  }
+
+  if err := MigrateTo(ctx, pool, root, 2); err == nil {
+    t.Fatal("expected MigrateTo(2) to fail while 003 has no down file")
+  }
+
+  writeMigration(t, root, "003_create_c.down.sql", "DROP TABLE c;")
+  if err := MigrateDown(ctx, pool, root, 2); err != nil {
+    t.Fatalf("MigrateDown(2) failed: %v", err)
+  }
+  if tableExists(t, pool, "b") || tableExists(t, pool, "c") || !tableExists(t, pool, "a") {
+    t.Fatal("expected only table a after rolling back two migrations")
+  }
+  if got := states(t, pool, root); got != "001_create_a.sql=applied,002_create_b.sql=pending,003_create_c.sql=pending" {
+    t.Errorf("unexpected status after down: %s", got)
+  }
+}
+
+func TestFailedMigrationIsRolledBack(t *testing.T) {
+  pool, root := setupMigrationTest(t, map[string]string{
+    "001_partial.sql": "CREATE TABLE partial (id INTEGER); INSERT INTO missing_table VALUES (1);",
+  })
+
+  if err := RunMigrations(pool, root); err == nil {
+    t.Fatal("expected failing migration to return an error")
+  }
+  if tableExists(t, pool, "partial") {
+    t.Error("expected statements of the failed migration to be rolled back")
+  }
+  if got := states(t, pool, root); got != "001_partial.sql=pending" {
+    t.Errorf("expected failed migration to stay pending, got %s", got)
+  }
+}
+
+func TestModifiedMigrationIsDetected(t *testing.T) {
+  pool, root := setupMigrationTest(t, map[string]string{
+    "001_create_a.sql": "CREATE TABLE a (id INTEGER);",
+  })
+
+  if err := RunMigrations(pool, root); err != nil {
+    t.Fatalf("RunMigrations failed: %v", err)
+  }
+
+  writeMigration(t, root, "001_create_a.sql", "CREATE TABLE a (id INTEGER, name TEXT);")
+  if got := states(t, pool, root); got != "001_create_a.sql=modified" {
+    t.Errorf("expected modified state, got %s", got)
+  }
+  if err := RunMigrations(pool, root); err == nil || !strings.Contains(err.Error(), "modified") {
+    t.Errorf("expected RunMigrations to refuse a modified migration, got %v", err)
+  }
+}
+
+func TestLegacyMigrationsTableIsUpgraded(t *testing.T) {
+  pool, root := setupMigrationTest(t, map[string]string{
+    "001_create_a.sql": "CREATE TABLE a (id INTEGER);",
+    "002_create_b.sql": "CREATE TABLE b (id INTEGER);",
+  })
+
+  _, err := pool.Exec(`
+    CREATE TABLE migrations (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    filename TEXT UNIQUE,
+    applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    );
+    CREATE TABLE a (id INTEGER);
+    INSERT INTO migrations (filename) VALUES ('001_create_a.sql');
+  `)
+  if err != nil {
+    t.Fatalf("failed to create legacy migrations table: %v", err)
+  }
+
+  if err := RunMigrations(pool, root); err != nil {
+    t.Fatalf("RunMigrations failed on legacy table: %v", err)
+  }
+  if got := states(t, pool, root); got != "001_create_a.sql=applied,002_create_b.sql=applied" {
+    t.Errorf("unexpected status after upgrade: %s", got)
+  }
+
+  pending, err := PendingMigrations(context.Background(), pool, root)
+  if err != nil || len(pending) != 0 {
+    t.Errorf("expected no pending migrations, got %v (%v)", pending, err)
+  }
+}
+
+func TestLoadMigrationsRejectsDuplicateVersions(t *testing.T) {
+  _, root := setupMigrationTest(t, map[string]string{
+    "001_a.sql": "SELECT 1;",
+    "001_b.sql": "SELECT 1;",
+  })
+
+  if _, err := LoadMigrations(SQLite, root); err == nil {
+    t.Error("expected duplicate versions to be rejected")
+  }
+}
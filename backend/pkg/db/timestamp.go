@@ -0,0 +1,124 @@
+package db
+
+import (
+  "database/sql/driver"
+  "fmt"
+  "strings"
+  "time"
+)
+
+// TimestampLayout is the canonical text form of timestamps stored in SQLite:
+// UTC with a fixed number of fractional digits, so values sort and compare
+// correctly as strings. PostgreSQL stores timestamps as TIMESTAMPTZ.
+const TimestampLayout = "2006-01-02T15:04:05.000000Z"
+
+// timestampLayouts lists the text forms found in existing databases: the
+// canonical layout, the format the SQLite driver writes for time.Time
+// values, the output of time.Time.String and the SQLite CURRENT_TIMESTAMP
+// form.
+var timestampLayouts = []string{
+  TimestampLayout,
+  time.RFC3339Nano,
+  "2006-01-02 15:04:05.999999999-07:00",
+  "2006-01-02T15:04:05.999999999-07:00",
+  "2006-01-02 15:04:05.999999999Z07:00",
+  "2006-01-02 15:04:05.999999999 -0700 MST",
+  "2006-01-02 15:04:05.999999999",
+  "2006-01-02T15:04:05.999999999",
+  "2006-01-02 15:04",
+  "2006-01-02T15:04",
+  "2006-01-02",
+}
+
+// Timestamp is a nullable point in time that scans from every
+// representation the supported drivers return and is written in a single
+// canonical form. Scanned values are always in UTC.
+type Timestamp struct {
+  Time  time.Time
+  Valid bool
+
+  // postgres selects the form Value writes.
+  postgres bool
+}
+
+// NewTimestamp returns t in the form written to SQLite.
+func NewTimestamp(t time.Time) Timestamp {
+  return Timestamp{Time: t.UTC(), Valid: !t.IsZero()}
+}
+
+// Timestamp returns t in the form written to databases of dialect d.
+func (d Dialect) Timestamp(t time.Time) Timestamp {
+  ts := NewTimestamp(t)
+  ts.postgres = d == Postgres
+  return ts
+}
+
+// Ptr returns the time, or nil when the value is NULL.
+func (t Timestamp) Ptr() *time.Time {
+  if !t.Valid {
+    return nil
+  }
+  v := t.Time
+  return &v
+}
+
+func (t *Timestamp) Scan(src any) error {
+  switch v := src.(type) {
+  case nil:
+    *t = Timestamp{}
+    return nil
+  case time.Time:
+    *t = Timestamp{Time: v.UTC(), Valid: true}
+    return nil
+  case int64:
+    *t = Timestamp{Time: time.Unix(v, 0).UTC(), Valid: true}
+    return nil
+  case []byte:
+    return t.parse(string(v))
+  case string:
+    return t.parse(v)
+  default:
+    return fmt.Errorf("cannot scan %T into db.Timestamp", src)
+  }
+}
+
+func (t *Timestamp) parse(s string) error {
+  s = strings.TrimSpace(s)
+  // time.Time.String appends the monotonic clock reading, e.g. " m=+0.5".
+  if i := strings.Index(s, " m="); i >= 0 {
+    s = s[:i]
+  }
+  if s == "" {
+    *t = Timestamp{}
+    return nil
+  }
+
+  for _, layout := range timestampLayouts {
+    if parsed, err := time.Parse(layout, s); err == nil {
+      *t = Timestamp{Time: parsed.UTC(), Valid: true}
+      return nil
+    }
+  }
+
+  // Zones without a name print their offset twice ("-0130 -0130"), which
+  // the MST layout element does not accept; the numeric offset suffices.
+  if fields := strings.Fields(s); len(fields) == 4 {
+    if parsed, err := time.Parse("2006-01-02 15:04:05.999999999 -0700", strings.Join(fields[:3], " ")); err == nil {
+      *t = Timestamp{Time: parsed.UTC(), Valid: true}
+      return nil
+    }
+  }
+  return fmt.Errorf("unrecognised timestamp %q", s)
+}
+
+// Value writes the canonical text form for SQLite and a time.Time for
+// PostgreSQL.
+func (t Timestamp) Value() (driver.Value, error) {
+  if !t.Valid {
+    return nil, nil
+  }
+  if t.postgres {
+    return t.Time.UTC(), nil
+  }
+  return t.Time.UTC().Format(TimestampLayout), nil
+}
@@ -0,0 +1,85 @@
+package db
+
+import (
+  "testing"
+  "time"
+)
+
+func TestTimestampScan(t *testing.T) {
+  micro := time.Date(2024, 3, 1, 10, 11, 12, 123456000, time.UTC)
+  nano := time.Date(2024, 3, 1, 10, 11, 12, 123456789, time.UTC)
+  whole := time.Date(2024, 3, 1, 10, 11, 12, 0, time.UTC)
+
+  tests := []struct {
+    name     string
+    src      any
+    expected time.Time
+    valid    bool
+  }{
+    {name: "canonical", src: "2024-03-01T10:11:12.123456Z", expected: micro, valid: true},
+    {name: "RFC 3339", src: "2024-03-01T10:11:12Z", expected: whole, valid: true},
+    {name: "RFC 3339 with offset", src: "2024-03-01T12:11:12.123456789+02:00", expected: nano, valid: true},
+    {name: "sqlite driver format", src: "2024-03-01 10:11:12.123456789+00:00", expected: nano, valid: true},
+    {name: "sqlite driver format without fraction", src: "2024-03-01 10:11:12+00:00", expected: whole, valid: true},
+    {name: "time.Time.String", src: "2024-03-01 10:11:12.123456789 +0000 UTC", expected: nano, valid: true},
+    {name: "time.Time.String with offset", src: "2024-03-01 08:41:12.123456789 -0130 -0130", expected: nano, valid: true},
+    {name: "time.Time.String with monotonic clock", src: "2024-03-01 10:11:12.123456789 +0000 UTC m=+0.001234", expected: nano, valid: true},
+    {name: "CURRENT_TIMESTAMP", src: "2024-03-01 10:11:12", expected: whole, valid: true},
+    {name: "without seconds", src: "2024-03-01T10:11", expected: time.Date(2024, 3, 1, 10, 11, 0, 0, time.UTC), valid: true},
+    {name: "date only", src: "2024-03-01", expected: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), valid: true},
+    {name: "bytes", src: []byte("2024-03-01T10:11:12Z"), expected: whole, valid: true},
+    {name: "time.Time from driver", src: time.Date(2024, 3, 1, 11, 11, 12, 0, time.FixedZone("CET", 3600)), expected: whole, valid: true},
+    {name: "unix seconds", src: whole.Unix(), expected: whole, valid: true},
+    {name: "NULL", src: nil},
+    {name: "empty string", src: ""},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      var ts Timestamp
+      if err := ts.Scan(tt.src); err != nil {
+        t.Fatalf("Scan(%v) failed: %v", tt.src, err)
+      }
+      if ts.Valid != tt.valid {
+        t.Fatalf("expected Valid=%v, got %v", tt.valid, ts.Valid)
+      }
+      if !ts.Time.Equal(tt.expected) {
+        t.Errorf("expected %s, got %s", tt.expected, ts.Time)
+      }
+      if tt.valid && ts.Time.Location() != time.UTC {
+        t.Errorf("expected UTC, got %s", ts.Time.Location())
+      }
+    })
+  }
+}
+
+func TestTimestampScanRejectsGarbage(t *testing.T) {
+  var ts Timestamp
+  if err := ts.Scan("yesterday"); err == nil {
+    t.Error("expected an unrecognised timestamp to fail")
+  }
+  if err := ts.Scan(3.5); err == nil {
+    t.Error("expected an unsupported type to fail")
+  }
+}
+
+func TestTimestampValue(t *testing.T) {
+  at := time.Date(2024, 3, 1, 11, 11, 12, 5000, time.FixedZone("CET", 3600))
+
+  v, err := SQLite.Timestamp(at).Value()
+  if err != nil || v != "2024-03-01T10:11:12.000005Z" {
+    t.Errorf("expected canonical text for SQLite, got %v (%v)", v, err)
+  }
+
+  v, err = Postgres.Timestamp(at).Value()
+  if tv, ok := v.(time.Time); err != nil || !ok || !tv.Equal(at) {
+    t.Errorf("expected time.Time for PostgreSQL, got %v (%v)", v, err)
+  }
+
+  if v, _ := (Timestamp{}).Value(); v != nil {
+    t.Errorf("expected NULL for an invalid timestamp, got %v", v)
+  }
+  if NewTimestamp(time.Time{}).Valid {
+    t.Error("expected the zero time to be stored as NULL")
+  }
+}
@@ -0,0 +1,275 @@
+// Package keystore keeps private keys on disk readable only by their owner
+// and, when a key encryption key (KEK) or passphrase is configured, sealed
+// with NaCl secretbox so neither the key files nor backups of them contain
+// usable secrets.
+package keystore
+
+import (
+  "bytes"
+  "crypto/rand"
+  "encoding/base64"
+  "encoding/pem"
+  "errors"
+  "fmt"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "strconv"
+  "sync"
+
+  "golang.org/x/crypto/nacl/secretbox"
+  "golang.org/x/crypto/scrypt"
+)
+
+// Sealed keys are PEM blocks of type blockType holding the secretbox nonce
+// followed by the sealed key. Keys sealed with a passphrase carry the scrypt
+// salt and cost in their headers.
+const (
+  blockType  = "ELYSIUM SEALED KEY"
+  kdfKEK     = "kek"
+  kdfScrypt  = "scrypt"
+  saltSize   = 16
+  scryptLogN = 15
+  nonceSize  = 24
+)
+
+var (
+  ErrLocked = errors.New("key is encrypted and no key encryption key or passphrase is configured")
+  ErrOpen   = errors.New("unable to decrypt key: wrong key encryption key or passphrase")
+)
+
+// Keystore seals and opens private keys. The zero value stores keys in
+// plaintext, still with owner-only permissions.
+type Keystore struct {
+  kek        *[32]byte
+  passphrase string
+
+  mu      sync.Mutex
+  salt    []byte
+  derived map[string]*[32]byte
+}
+
+// New returns a Keystore sealing keys with kek, the base64 encoding of 32
+// random bytes, or with a key derived from passphrase. Both may be empty,
+// in which case keys are stored in plaintext.
+func New(kek, passphrase string) (*Keystore, error) {
+  if kek != "" && passphrase != "" {
+    return nil, errors.New("set either a key encryption key or a passphrase, not both")
+  }
+
+  k := &Keystore{passphrase: passphrase, derived: make(map[string]*[32]byte)}
+  if kek != "" {
+    raw, err := base64.StdEncoding.DecodeString(kek)
+    if err != nil || len(raw) != 32 {
+      return nil, errors.New("key encryption key must be 32 base64 encoded bytes")
+    }
+    k.kek = new([32]byte)
+    copy(k.kek[:], raw)
+  }
+  return k, nil
+}
+
+// Encrypted reports whether keys are sealed before they are written.
+func (k *Keystore) Encrypted() bool {
+  return k.kek != nil || k.passphrase != ""
+}
+
+// Sealed reports whether data holds a sealed key.
+func Sealed(data []byte) bool {
+  return bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN "+blockType+"-----"))
+}
+
+// Seal returns plain sealed with the configured key, or plain itself when
+// the Keystore does not encrypt.
+func (k *Keystore) Seal(plain []byte) ([]byte, error) {
+  if !k.Encrypted() {
+    return plain, nil
+  }
+
+  block := &pem.Block{Type: blockType, Headers: map[string]string{"KDF": kdfKEK}}
+  key := k.kek
+  if key == nil {
+    salt, derived, err := k.sealingKey()
+    if err != nil {
+      return nil, err
+    }
+    key = derived
+    block.Headers = map[string]string{
+      "KDF":  kdfScrypt,
+      "Salt": base64.StdEncoding.EncodeToString(salt),
+      "N":    strconv.Itoa(scryptLogN),
+    }
+  }
+
+  var nonce [nonceSize]byte
+  if _, err := rand.Read(nonce[:]); err != nil {
+    return nil, err
+  }
+  block.Bytes = secretbox.Seal(nonce[:], plain, &nonce, key)
+  return pem.EncodeToMemory(block), nil
+}
+
+// Open returns the key in data, decrypting it when it is sealed.
+func (k *Keystore) Open(data []byte) ([]byte, error) {
+  if !Sealed(data) {
+    return data, nil
+  }
+
+  block, _ := pem.Decode(bytes.TrimSpace(data))
+  if block == nil || block.Type != blockType || len(block.Bytes) < nonceSize+secretbox.Overhead {
+    return nil, errors.New("malformed sealed key")
+  }
+
+  var key *[32]byte
+  switch block.Headers["KDF"] {
+  case kdfKEK:
+    if k.kek == nil {
+      return nil, fmt.Errorf("%w: sealed with a key encryption key", ErrLocked)
+    }
+    key = k.kek
+  case kdfScrypt:
+    if k.passphrase == "" {
+      return nil, fmt.Errorf("%w: sealed with a passphrase", ErrLocked)
+    }
+    salt, err := base64.StdEncoding.DecodeString(block.Headers["Salt"])
+    if err != nil || len(salt) != saltSize {
+      return nil, errors.New("malformed sealed key: invalid salt")
+    }
+    logN, err := strconv.Atoi(block.Headers["N"])
+    if err != nil || logN < 10 || logN > 20 {
+      return nil, errors.New("malformed sealed key: unsupported scrypt cost")
+    }
+    if key, err = k.derive(salt, logN); err != nil {
+      return nil, err
+    }
+  default:
+    return nil, fmt.Errorf("malformed sealed key: unknown KDF %q", block.Headers["KDF"])
+  }
+
+  var nonce [nonceSize]byte
+  copy(nonce[:], block.Bytes)
+  plain, ok := secretbox.Open(nil, block.Bytes[nonceSize:], &nonce, key)
+  if !ok {
+    return nil, ErrOpen
+  }
+  return plain, nil
+}
+
+// sealingKey returns the salt and key passphrase sealed keys are written
+// with. The salt is drawn once per Keystore so scrypt only runs once.
+func (k *Keystore) sealingKey() ([]byte, *[32]byte, error) {
+  k.mu.Lock()
+  salt := k.salt
+  if salt == nil {
+    salt = make([]byte, saltSize)
+    if _, err := rand.Read(salt); err != nil {
+      k.mu.Unlock()
+      return nil, nil, err
+    }
+    k.salt = salt
+  }
+  k.mu.Unlock()
+
+  key, err := k.derive(salt, scryptLogN)
+  return salt, key, err
+}
+
+func (k *Keystore) derive(salt []byte, logN int) (*[32]byte, error) {
+  cacheKey := string(salt) + strconv.Itoa(logN)
+  k.mu.Lock()
+  defer k.mu.Unlock()
+  if key, ok := k.derived[cacheKey]; ok {
+    return key, nil
+  }
+
+  raw, err := scrypt.Key([]byte(k.passphrase), salt, 1<<logN, 8, 1, 32)
+  if err != nil {
+    return nil, err
+  }
+  key := new([32]byte)
+  copy(key[:], raw)
+  if k.derived == nil {
+    k.derived = make(map[string]*[32]byte)
+  }
+  k.derived[cacheKey] = key
+  return key, nil
+}
+
+// WriteFile seals plain and writes it to path with mode 0600, creating
+// missing directories with mode 0700 and restricting an existing directory
+// to its owner. The file is replaced atomically.
+func (k *Keystore) WriteFile(path string, plain []byte) error {
+  data, err := k.Seal(plain)
+  if err != nil {
+    return err
+  }
+
+  dir := filepath.Dir(path)
+  if err := os.MkdirAll(dir, 0o700); err != nil {
+    return err
+  }
+  if err := restrict(dir, 0o700); err != nil {
+    return err
+  }
+  tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*")
+  if err != nil {
+    return err
+  }
+  defer os.Remove(tmp.Name())
+
+  if err := tmp.Chmod(0o600); err != nil {
+    tmp.Close()
+    return err
+  }
+  if _, err := tmp.Write(data); err != nil {
+    tmp.Close()
+    return err
+  }
+  if err := tmp.Close(); err != nil {
+    return err
+  }
+  return os.Rename(tmp.Name(), path)
+}
+
+// ReadFile returns the key stored at path. Files and their directory
+// accessible by others are restricted to their owner, and plaintext keys are
+// sealed in place when the Keystore encrypts, so existing installations
+// migrate on first use.
+func (k *Keystore) ReadFile(path string) ([]byte, error) {
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+
+  if err := restrict(path, 0o600); err != nil {
+    return nil, err
+  }
+  if err := restrict(filepath.Dir(path), 0o700); err != nil {
+    return nil, err
+  }
+
+  if !Sealed(data) && k.Encrypted() {
+    if err := k.WriteFile(path, data); err != nil {
+      return nil, fmt.Errorf("sealing plaintext key %s: %w", path, err)
+    }
+    slog.Info("sealed plaintext key file", "path", path)
+    return data, nil
+  }
+
+  plain, err := k.Open(data)
+  if err != nil {
+    return nil, fmt.Errorf("%s: %w", path, err)
+  }
+  return plain, nil
+}
+
+// restrict changes the mode of path to mode when its group or other users
+// have any access to it.
+func restrict(path string, mode os.FileMode) error {
+  info, err := os.Stat(path)
+  if err != nil || info.Mode().Perm()&0o077 == 0 {
+    return err
+  }
+  slog.Warn("key path is accessible by other users, restricting it", "path", path, "mode", info.Mode().Perm())
+  return os.Chmod(path, mode)
+}
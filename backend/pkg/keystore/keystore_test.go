@@ -0,0 +1,105 @@
+package keystore
+
+import (
+  "bytes"
+  "errors"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+const testKEK = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+func TestSealAndOpen(t *testing.T) {
+  withKEK, err := New(testKEK, "")
+  if err != nil {
+    t.Fatalf("New failed: %v", err)
+  }
+  withPassphrase, err := New("", "correct horse")
+  if err != nil {
+    t.Fatalf("New failed: %v", err)
+  }
+
+  for name, keys := range map[string]*Keystore{"kek": withKEK, "passphrase": withPassphrase} {
+    sealed, err := keys.Seal([]byte("private key"))
+    if err != nil {
+      t.Fatalf("%s: Seal failed: %v", name, err)
+    }
+    if !Sealed(sealed) || bytes.Contains(sealed, []byte("private key")) {
+      t.Fatalf("%s: expected a sealed key, got %q", name, sealed)
+    }
+    plain, err := keys.Open(sealed)
+    if err != nil || string(plain) != "private key" {
+      t.Fatalf("%s: expected the key back, got %q (%v)", name, plain, err)
+    }
+    if _, err := (&Keystore{}).Open(sealed); !errors.Is(err, ErrLocked) {
+      t.Errorf("%s: expected ErrLocked without a key, got %v", name, err)
+    }
+  }
+
+  otherKEK, _ := New("ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA=", "")
+  sealed, _ := withKEK.Seal([]byte("private key"))
+  if _, err := otherKEK.Open(sealed); !errors.Is(err, ErrOpen) {
+    t.Errorf("expected ErrOpen with the wrong KEK, got %v", err)
+  }
+  otherPassphrase, _ := New("", "wrong")
+  sealed, _ = withPassphrase.Seal([]byte("private key"))
+  if _, err := otherPassphrase.Open(sealed); !errors.Is(err, ErrOpen) {
+    t.Errorf("expected ErrOpen with the wrong passphrase, got %v", err)
+  }
+
+  if _, err := New("c2hvcnQ=", ""); err == nil {
+    t.Error("expected a short KEK to be rejected")
+  }
+  if _, err := New(testKEK, "passphrase"); err == nil {
+    t.Error("expected a KEK and a passphrase to be mutually exclusive")
+  }
+}
+
+func TestFiles(t *testing.T) {
+  dir := filepath.Join(t.TempDir(), "keys")
+  path := filepath.Join(dir, "server.key")
+  keys, _ := New(testKEK, "")
+
+  if err := keys.WriteFile(path, []byte("private key")); err != nil {
+    t.Fatalf("WriteFile failed: %v", err)
+  }
+  if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != 0o700 {
+    t.Fatalf("expected a directory with mode 0700, got %v (%v)", info, err)
+  }
+  if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+    t.Fatalf("expected a key file with mode 0600, got %v (%v)", info, err)
+  }
+  data, _ := os.ReadFile(path)
+  if !Sealed(data) {
+    t.Fatalf("expected the key to be sealed on disk, got %q", data)
+  }
+  if plain, err := keys.ReadFile(path); err != nil || string(plain) != "private key" {
+    t.Fatalf("expected the key back, got %q (%v)", plain, err)
+  }
+
+  // Plaintext keys from earlier versions are restricted and sealed on read,
+  // and so is a directory left open to others.
+  os.Chmod(dir, 0o755)
+  legacy := filepath.Join(dir, "legacy.key")
+  os.WriteFile(legacy, []byte("legacy key"), 0o644)
+  if plain, err := keys.ReadFile(legacy); err != nil || string(plain) != "legacy key" {
+    t.Fatalf("expected the legacy key back, got %q (%v)", plain, err)
+  }
+  data, _ = os.ReadFile(legacy)
+  info, _ := os.Stat(legacy)
+  if !Sealed(data) || info.Mode().Perm() != 0o600 {
+    t.Errorf("expected the legacy key to be sealed with mode 0600, got %v %q", info.Mode().Perm(), data)
+  }
+  if info, _ := os.Stat(dir); info.Mode().Perm() != 0o700 {
+    t.Errorf("expected the directory to be restricted to 0700, got %v", info.Mode().Perm())
+  }
+
+  os.Chmod(dir, 0o750)
+  if err := keys.WriteFile(path, []byte("rotated key")); err != nil {
+    t.Fatalf("WriteFile failed: %v", err)
+  }
+  if info, _ := os.Stat(dir); info.Mode().Perm() != 0o700 {
+    t.Errorf("expected writing a key to restrict its directory, got %v", info.Mode().Perm())
+  }
+}
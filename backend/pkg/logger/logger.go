@@ -0,0 +1,67 @@
+package logger
+
+import (
+  "context"
+  "fmt"
+  "io"
+  "log/slog"
+  "os"
+  "strings"
+)
+
+type ctxKey struct{}
+
+// Init installs the process wide slog logger. format is either "text" or
+// "json"; levelName is one of DEBUG, INFO, WARN or ERROR. The returned level
+// can be changed later without rebuilding the handler.
+func Init(format, levelName string) (*slog.LevelVar, error) {
+  return InitWriter(os.Stderr, format, levelName)
+}
+
+func InitWriter(w io.Writer, format, levelName string) (*slog.LevelVar, error) {
+  l, err := ParseLevel(levelName)
+  if err != nil {
+    return nil, err
+  }
+  level := new(slog.LevelVar)
+  level.Set(l)
+
+  opts := &slog.HandlerOptions{Level: level}
+
+  var handler slog.Handler
+  switch strings.ToLower(format) {
+  case "", "text":
+    handler = slog.NewTextHandler(w, opts)
+  case "json":
+    handler = slog.NewJSONHandler(w, opts)
+  default:
+    return nil, fmt.Errorf("unknown log format %q", format)
+  }
+
+  slog.SetDefault(slog.New(handler))
+  return level, nil
+}
+
+func ParseLevel(levelName string) (slog.Level, error) {
+  var l slog.Level
+  if err := l.UnmarshalText([]byte(strings.ToUpper(levelName))); err != nil {
+    return l, fmt.Errorf("unknown log level %q", levelName)
+  }
+  return l, nil
+}
+
+// WithContext returns a copy of ctx carrying l, so code further down the call
+// chain logs with the same request scoped fields.
+func WithContext(ctx context.Context, l *slog.Logger) context.Context {
+  return context.WithValue(ctx, ctxKey{}, l)
+}
+
+// FromContext returns the logger stored in ctx, or the default logger.
+func FromContext(ctx context.Context) *slog.Logger {
+  if ctx != nil {
+    if l, ok := ctx.Value(ctxKey{}).(*slog.Logger); ok {
+      return l
+    }
+  }
+  return slog.Default()
+}
@@ -0,0 +1,96 @@
+package logger
+
+import (
+  "bytes"
+  "encoding/json"
+  "log/slog"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+)
+
+func TestParseLevel(t *testing.T) {
+  tests := []struct {
+    input     string
+    expected  slog.Level
+    expectErr bool
+  }{
+    {input: "DEBUG", expected: slog.LevelDebug},
+    {input: "info", expected: slog.LevelInfo},
+    {input: "WARN", expected: slog.LevelWarn},
+    {input: "ERROR", expected: slog.LevelError},
+    {input: "VERBOSE", expectErr: true},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.input, func(t *testing.T) {
+      l, err := ParseLevel(tt.input)
+      if (err != nil) != tt.expectErr {
+        t.Fatalf("unexpected error: %v", err)
+      }
+      if !tt.expectErr && l != tt.expected {
+        t.Errorf("expected %v, got %v", tt.expected, l)
+      }
+    })
+  }
+}
+
+func TestSetLevelAtRuntime(t *testing.T) {
+  var buf bytes.Buffer
+  level, err := InitWriter(&buf, "json", "INFO")
+  if err != nil {
+    t.Fatalf("InitWriter failed: %v", err)
+  }
+
+  slog.Debug("hidden")
+  if buf.Len() != 0 {
+    t.Fatalf("expected debug record to be dropped at INFO, got %s", buf.String())
+  }
+
+  level.Set(slog.LevelDebug)
+  slog.Debug("visible")
+  if buf.Len() == 0 {
+    t.Fatal("expected debug record after switching to DEBUG")
+  }
+}
+
+func TestMiddlewareAddsRequestFields(t *testing.T) {
+  var buf bytes.Buffer
+  if _, err := InitWriter(&buf, "json", "INFO"); err != nil {
+    t.Fatalf("InitWriter failed: %v", err)
+  }
+
+  handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    FromContext(r.Context()).Info("handled", "peer_id", "abc")
+    w.WriteHeader(http.StatusCreated)
+  }))
+
+  req := httptest.NewRequest(http.MethodPost, "/peer", nil)
+  req.Header.Set(RequestIDHeader, "req-1")
+  rec := httptest.NewRecorder()
+  handler.ServeHTTP(rec, req)
+
+  if rec.Header().Get(RequestIDHeader) != "req-1" {
+    t.Errorf("expected request ID to be echoed, got %q", rec.Header().Get(RequestIDHeader))
+  }
+
+  decoder := json.NewDecoder(&buf)
+  var records []map[string]interface{}
+  for decoder.More() {
+    var record map[string]interface{}
+    if err := decoder.Decode(&record); err != nil {
+      t.Fatalf("failed to decode log record: %v", err)
+    }
+    records = append(records, record)
+  }
+
+  if len(records) != 2 {
+    t.Fatalf("expected 2 log records, got %d", len(records))
+  }
+  if records[0]["request_id"] != "req-1" || records[0]["peer_id"] != "abc" || records[0]["remote_addr"] == nil {
+    t.Errorf("handler record is missing request fields: %v", records[0])
+  }
+  if records[1]["status"] != float64(http.StatusCreated) {
+    t.Errorf("expected completion record with status 201, got %v", records[1])
+  }
+}
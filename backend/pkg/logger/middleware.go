@@ -0,0 +1,70 @@
+package logger
+
+import (
+  "log/slog"
+  "net/http"
+  "time"
+
+  "github.com/google/uuid"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+// StatusRecorder remembers the status code written through it for the
+// middlewares that report on completed requests.
+type StatusRecorder struct {
+  http.ResponseWriter
+  Status int
+}
+
+func NewStatusRecorder(w http.ResponseWriter) *StatusRecorder {
+  return &StatusRecorder{ResponseWriter: w, Status: http.StatusOK}
+}
+
+func (r *StatusRecorder) WriteHeader(code int) {
+  // Informational responses such as 103 Early Hints precede the final one.
+  if code >= 200 {
+    r.Status = code
+  }
+  r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *StatusRecorder) Flush() {
+  if f, ok := r.ResponseWriter.(http.Flusher); ok {
+    f.Flush()
+  }
+}
+
+func (r *StatusRecorder) Unwrap() http.ResponseWriter {
+  return r.ResponseWriter
+}
+
+// Middleware attaches a request scoped logger carrying the request ID and
+// remote address to the request context and logs each completed request.
+// An incoming X-Request-ID header is reused so IDs can be correlated with an
+// upstream proxy.
+func Middleware(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    requestID := r.Header.Get(RequestIDHeader)
+    if requestID == "" {
+      requestID = uuid.NewString()
+    }
+    w.Header().Set(RequestIDHeader, requestID)
+
+    l := slog.Default().With(
+      slog.String("request_id", requestID),
+      slog.String("remote_addr", r.RemoteAddr),
+    )
+
+    rec := NewStatusRecorder(w)
+    start := time.Now()
+    next.ServeHTTP(rec, r.WithContext(WithContext(r.Context(), l)))
+
+    l.Info("request completed",
+      slog.String("method", r.Method),
+      slog.String("path", r.URL.Path),
+      slog.Int("status", rec.Status),
+      slog.Duration("duration", time.Since(start)),
+    )
+  })
+}
@@ -0,0 +1,69 @@
+// Package signing manages the Ed25519 key the backend signs delivered
+// artifacts with.
+package signing
+
+import (
+  "crypto/ed25519"
+  "crypto/rand"
+  "crypto/x509"
+  "encoding/pem"
+  "errors"
+  "fmt"
+  "log/slog"
+  "os"
+
+  "elysium-backend/pkg/keystore"
+)
+
+// LoadOrCreateKey reads the PKCS #8 PEM encoded Ed25519 private key at path
+// through keys, generating and saving a new one when the file does not exist
+// yet.
+func LoadOrCreateKey(keys *keystore.Keystore, path string) (ed25519.PrivateKey, error) {
+  data, err := keys.ReadFile(path)
+  if errors.Is(err, os.ErrNotExist) {
+    return createKey(keys, path)
+  } else if err != nil {
+    return nil, err
+  }
+
+  block, _ := pem.Decode(data)
+  if block == nil || block.Type != "PRIVATE KEY" {
+    return nil, fmt.Errorf("%s: no PEM encoded private key found", path)
+  }
+  parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+  if err != nil {
+    return nil, fmt.Errorf("%s: %w", path, err)
+  }
+  key, ok := parsed.(ed25519.PrivateKey)
+  if !ok {
+    return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+  }
+  return key, nil
+}
+
+func createKey(keys *keystore.Keystore, path string) (ed25519.PrivateKey, error) {
+  _, key, err := ed25519.GenerateKey(rand.Reader)
+  if err != nil {
+    return nil, err
+  }
+  der, err := x509.MarshalPKCS8PrivateKey(key)
+  if err != nil {
+    return nil, err
+  }
+
+  if err := keys.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})); err != nil {
+    return nil, err
+  }
+  slog.Info("generated artifact signing key", "path", path, "encrypted", keys.Encrypted())
+  return key, nil
+}
+
+// PublicKeyPEM returns the PKIX PEM encoding of key, as accepted by
+// openssl pkeyutl -verify -pubin.
+func PublicKeyPEM(key ed25519.PublicKey) ([]byte, error) {
+  der, err := x509.MarshalPKIXPublicKey(key)
+  if err != nil {
+    return nil, err
+  }
+  return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
@@ -0,0 +1,50 @@
+package signing
+
+import (
+  "crypto/ed25519"
+  "crypto/x509"
+  "encoding/pem"
+  "os"
+  "path/filepath"
+  "testing"
+
+  "elysium-backend/pkg/keystore"
+)
+
+func TestLoadOrCreateKey(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "keys", "signing.pem")
+  keys := &keystore.Keystore{}
+
+  key, err := LoadOrCreateKey(keys, path)
+  if err != nil {
+    t.Fatalf("creating key failed: %v", err)
+  }
+  info, err := os.Stat(path)
+  if err != nil || info.Mode().Perm() != 0o600 {
+    t.Fatalf("expected key file with mode 0600, got %v (%v)", info, err)
+  }
+
+  again, err := LoadOrCreateKey(keys, path)
+  if err != nil || !key.Equal(again) {
+    t.Fatalf("expected the saved key to be loaded, got %v", err)
+  }
+
+  publicPEM, err := PublicKeyPEM(key.Public().(ed25519.PublicKey))
+  if err != nil {
+    t.Fatalf("PublicKeyPEM failed: %v", err)
+  }
+  block, _ := pem.Decode(publicPEM)
+  public, err := x509.ParsePKIXPublicKey(block.Bytes)
+  if err != nil {
+    t.Fatalf("parsing public key failed: %v", err)
+  }
+  signature := ed25519.Sign(key, []byte("artifact"))
+  if !ed25519.Verify(public.(ed25519.PublicKey), []byte("artifact"), signature) {
+    t.Error("expected the exported public key to verify signatures")
+  }
+
+  os.WriteFile(path, []byte("garbage"), 0o600)
+  if _, err := LoadOrCreateKey(keys, path); err == nil {
+    t.Error("expected an invalid key file to be rejected")
+  }
+}
@@ -0,0 +1,164 @@
+package tlsutil
+
+import (
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/tls"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "encoding/pem"
+  "errors"
+  "fmt"
+  "log/slog"
+  "math/big"
+  "net"
+  "os"
+  "path/filepath"
+  "time"
+)
+
+type DevPaths struct {
+  CACert     string
+  CAKey      string
+  ServerCert string
+  ServerKey  string
+}
+
+func devPaths(dir string) DevPaths {
+  return DevPaths{
+    CACert:     filepath.Join(dir, "ca.crt"),
+    CAKey:      filepath.Join(dir, "ca.key"),
+    ServerCert: filepath.Join(dir, "server.crt"),
+    ServerKey:  filepath.Join(dir, "server.key"),
+  }
+}
+
+// EnsureDevCertificates creates a self-signed CA and a server certificate for
+// hosts in dir on first run and reuses them afterwards. It is meant for local
+// development only; clients have to trust ca.crt explicitly.
+func EnsureDevCertificates(dir string, hosts []string) (DevPaths, error) {
+  paths := devPaths(dir)
+
+  if fileExists(paths.ServerCert) && fileExists(paths.ServerKey) {
+    return paths, nil
+  }
+
+  if err := os.MkdirAll(dir, 0o700); err != nil {
+    return paths, err
+  }
+
+  caCert, caKey, err := loadOrCreateCA(paths)
+  if err != nil {
+    return paths, err
+  }
+
+  key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    return paths, err
+  }
+
+  template, err := newTemplate("elysium-backend", 365*24*time.Hour)
+  if err != nil {
+    return paths, err
+  }
+  template.KeyUsage = x509.KeyUsageDigitalSignature
+  template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+  for _, host := range hosts {
+    if ip := net.ParseIP(host); ip != nil {
+      template.IPAddresses = append(template.IPAddresses, ip)
+    } else if host != "" {
+      template.DNSNames = append(template.DNSNames, host)
+    }
+  }
+
+  der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+  if err != nil {
+    return paths, err
+  }
+
+  if err := writeKeyPair(paths.ServerCert, paths.ServerKey, der, key); err != nil {
+    return paths, err
+  }
+
+  slog.Warn("generated self-signed development TLS certificate", "cert", paths.ServerCert, "ca", paths.CACert, "hosts", hosts)
+  return paths, nil
+}
+
+func loadOrCreateCA(paths DevPaths) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+  if fileExists(paths.CACert) && fileExists(paths.CAKey) {
+    pair, err := tls.LoadX509KeyPair(paths.CACert, paths.CAKey)
+    if err != nil {
+      return nil, nil, fmt.Errorf("loading development CA: %w", err)
+    }
+    cert, err := x509.ParseCertificate(pair.Certificate[0])
+    if err != nil {
+      return nil, nil, err
+    }
+    key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+    if !ok {
+      return nil, nil, errors.New("development CA key is not an ECDSA key")
+    }
+    return cert, key, nil
+  }
+
+  key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    return nil, nil, err
+  }
+
+  template, err := newTemplate("elysium development CA", 10*365*24*time.Hour)
+  if err != nil {
+    return nil, nil, err
+  }
+  template.IsCA = true
+  template.BasicConstraintsValid = true
+  template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+
+  der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+  if err != nil {
+    return nil, nil, err
+  }
+
+  if err := writeKeyPair(paths.CACert, paths.CAKey, der, key); err != nil {
+    return nil, nil, err
+  }
+
+  cert, err := x509.ParseCertificate(der)
+  if err != nil {
+    return nil, nil, err
+  }
+  return cert, key, nil
+}
+
+func newTemplate(commonName string, validity time.Duration) (*x509.Certificate, error) {
+  serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+  if err != nil {
+    return nil, err
+  }
+
+  now := time.Now()
+  return &x509.Certificate{
+    SerialNumber: serial,
+    Subject:      pkix.Name{CommonName: commonName, Organization: []string{"elysium"}},
+    NotBefore:    now.Add(-time.Hour),
+    NotAfter:     now.Add(validity),
+  }, nil
+}
+
+func writeKeyPair(certPath, keyPath string, der []byte, key *ecdsa.PrivateKey) error {
+  keyDER, err := x509.MarshalECPrivateKey(key)
+  if err != nil {
+    return err
+  }
+
+  if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+    return err
+  }
+  return os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+}
+
+func fileExists(path string) bool {
+  _, err := os.Stat(path)
+  return err == nil
+}
@@ -0,0 +1,123 @@
+package tlsutil
+
+import (
+  "context"
+  "crypto/tls"
+  "crypto/x509"
+  "fmt"
+  "log/slog"
+  "os"
+  "sync"
+  "time"
+)
+
+// CertReloader serves a certificate loaded from disk and reloads it when the
+// certificate or key file changes, so renewed certificates are picked up
+// without restarting the server.
+type CertReloader struct {
+  certFile string
+  keyFile  string
+
+  mu      sync.RWMutex
+  cert    *tls.Certificate
+  modTime time.Time
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+  r := &CertReloader{certFile: certFile, keyFile: keyFile}
+  if err := r.reload(); err != nil {
+    return nil, err
+  }
+  return r, nil
+}
+
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+  r.mu.RLock()
+  defer r.mu.RUnlock()
+  return r.cert, nil
+}
+
+// Watch polls the certificate files every interval until ctx is cancelled.
+func (r *CertReloader) Watch(ctx context.Context, interval time.Duration) {
+  ticker := time.NewTicker(interval)
+  defer ticker.Stop()
+
+  for {
+    select {
+    case <-ctx.Done():
+      return
+    case <-ticker.C:
+      if err := r.MaybeReload(); err != nil {
+        slog.Error("failed to reload TLS certificate, keeping the previous one", "cert", r.certFile, "err", err)
+      }
+    }
+  }
+}
+
+// MaybeReload reloads the key pair if either file was modified since the
+// last successful load.
+func (r *CertReloader) MaybeReload() error {
+  modTime, err := r.latestModTime()
+  if err != nil {
+    return err
+  }
+
+  r.mu.RLock()
+  changed := modTime.After(r.modTime)
+  r.mu.RUnlock()
+
+  if !changed {
+    return nil
+  }
+  if err := r.reload(); err != nil {
+    return err
+  }
+  slog.Info("reloaded TLS certificate", "cert", r.certFile)
+  return nil
+}
+
+func (r *CertReloader) reload() error {
+  modTime, err := r.latestModTime()
+  if err != nil {
+    return err
+  }
+
+  cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+  if err != nil {
+    return fmt.Errorf("loading key pair: %w", err)
+  }
+
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  r.cert = &cert
+  r.modTime = modTime
+  return nil
+}
+
+func (r *CertReloader) latestModTime() (time.Time, error) {
+  var latest time.Time
+  for _, path := range []string{r.certFile, r.keyFile} {
+    info, err := os.Stat(path)
+    if err != nil {
+      return time.Time{}, err
+    }
+    if info.ModTime().After(latest) {
+      latest = info.ModTime()
+    }
+  }
+  return latest, nil
+}
+
+// LoadCertPool reads a PEM bundle of CA certificates.
+func LoadCertPool(caFile string) (*x509.CertPool, error) {
+  pem, err := os.ReadFile(caFile)
+  if err != nil {
+    return nil, err
+  }
+
+  pool := x509.NewCertPool()
+  if !pool.AppendCertsFromPEM(pem) {
+    return nil, fmt.Errorf("no certificates found in %s", caFile)
+  }
+  return pool, nil
+}
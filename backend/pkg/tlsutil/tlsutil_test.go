@@ -0,0 +1,111 @@
+package tlsutil
+
+import (
+  "crypto/tls"
+  "crypto/x509"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+func TestEnsureDevCertificates(t *testing.T) {
+  dir := t.TempDir()
+
+  paths, err := EnsureDevCertificates(dir, []string{"localhost", "127.0.0.1"})
+  if err != nil {
+    t.Fatalf("EnsureDevCertificates failed: %v", err)
+  }
+
+  pool, err := LoadCertPool(paths.CACert)
+  if err != nil {
+    t.Fatalf("LoadCertPool failed: %v", err)
+  }
+
+  pair, err := tls.LoadX509KeyPair(paths.ServerCert, paths.ServerKey)
+  if err != nil {
+    t.Fatalf("failed to load generated key pair: %v", err)
+  }
+  leaf, err := x509.ParseCertificate(pair.Certificate[0])
+  if err != nil {
+    t.Fatalf("failed to parse server certificate: %v", err)
+  }
+
+  for _, host := range []string{"localhost", "127.0.0.1"} {
+    if _, err := leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: pool}); err != nil {
+      t.Errorf("server certificate does not verify for %s: %v", host, err)
+    }
+  }
+
+  info, err := os.Stat(paths.ServerKey)
+  if err != nil {
+    t.Fatalf("stat server key: %v", err)
+  }
+  if info.Mode().Perm() != 0o600 {
+    t.Errorf("expected server key mode 0600, got %v", info.Mode().Perm())
+  }
+
+  again, err := EnsureDevCertificates(dir, []string{"localhost"})
+  if err != nil {
+    t.Fatalf("second EnsureDevCertificates failed: %v", err)
+  }
+  reused, _ := os.ReadFile(again.ServerCert)
+  original, _ := os.ReadFile(paths.ServerCert)
+  if string(reused) != string(original) {
+    t.Error("expected existing development certificate to be reused")
+  }
+}
+
+func TestCertReloaderPicksUpNewCertificate(t *testing.T) {
+  dir := t.TempDir()
+  paths, err := EnsureDevCertificates(dir, []string{"localhost"})
+  if err != nil {
+    t.Fatalf("EnsureDevCertificates failed: %v", err)
+  }
+
+  reloader, err := NewCertReloader(paths.ServerCert, paths.ServerKey)
+  if err != nil {
+    t.Fatalf("NewCertReloader failed: %v", err)
+  }
+  before, _ := reloader.GetCertificate(nil)
+
+  os.Remove(paths.ServerCert)
+  os.Remove(paths.ServerKey)
+  if _, err := EnsureDevCertificates(dir, []string{"localhost"}); err != nil {
+    t.Fatalf("regenerating certificate failed: %v", err)
+  }
+  future := time.Now().Add(time.Minute)
+  os.Chtimes(paths.ServerCert, future, future)
+
+  if err := reloader.MaybeReload(); err != nil {
+    t.Fatalf("MaybeReload failed: %v", err)
+  }
+  after, _ := reloader.GetCertificate(nil)
+  if string(before.Certificate[0]) == string(after.Certificate[0]) {
+    t.Error("expected reloader to serve the regenerated certificate")
+  }
+}
+
+func TestCertReloaderKeepsCertificateOnInvalidFiles(t *testing.T) {
+  dir := t.TempDir()
+  paths, err := EnsureDevCertificates(dir, []string{"localhost"})
+  if err != nil {
+    t.Fatalf("EnsureDevCertificates failed: %v", err)
+  }
+
+  reloader, err := NewCertReloader(paths.ServerCert, paths.ServerKey)
+  if err != nil {
+    t.Fatalf("NewCertReloader failed: %v", err)
+  }
+
+  os.WriteFile(filepath.Join(dir, "server.crt"), []byte("garbage"), 0o644)
+  future := time.Now().Add(time.Minute)
+  os.Chtimes(paths.ServerCert, future, future)
+
+  if err := reloader.MaybeReload(); err == nil {
+    t.Fatal("expected reload of an invalid certificate to fail")
+  }
+  if cert, _ := reloader.GetCertificate(nil); cert == nil {
+    t.Error("expected previous certificate to remain in use")
+  }
+}
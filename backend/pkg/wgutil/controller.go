@@ -0,0 +1,218 @@
+package wgutil
+
+import (
+  "context"
+  "errors"
+  "net"
+  "sync"
+  "time"
+
+  "elysium-backend/pkg/keystore"
+)
+
+// Endpoint is a server interface, the port it listens on and the file its
+// private key is saved in.
+type Endpoint struct {
+  Interface string `json:"interface"`
+  Port      int    `json:"port"`
+  KeyFile   string `json:"-"`
+}
+
+// ErrNoRotation is returned by the rotation methods of Controller when no
+// rotation is in progress.
+var ErrNoRotation = errors.New("no key rotation in progress")
+
+// Controller manages the server WireGuard interface described by its
+// fields. It satisfies services.WireGuard. The server private key is stored
+// through Keys as KeyFile, ServerKeyFile when empty. Interface, Port and
+// KeyFile change when a key rotation completes and must not be read
+// directly afterwards; use Endpoint.
+type Controller struct {
+  Interface   string
+  Port        int
+  KeyFile     string
+  IP          net.IP
+  NetworkMask string
+  Keys        *keystore.Keystore
+
+  mu   sync.Mutex
+  next *Endpoint
+}
+
+// Endpoint returns the interface currently serving the server key.
+func (c *Controller) Endpoint() Endpoint {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return c.current()
+}
+
+func (c *Controller) current() Endpoint {
+  keyFile := c.KeyFile
+  if keyFile == "" {
+    keyFile = ServerKeyFile
+  }
+  return Endpoint{Interface: c.Interface, Port: c.Port, KeyFile: keyFile}
+}
+
+func (c *Controller) Init(ctx context.Context) (string, error) {
+  current := c.Endpoint()
+  return InitWireGuardInterface(c.Keys, current.KeyFile, current.Interface, current.Port, c.IP, c.NetworkMask)
+}
+
+func (c *Controller) PublicKey() (string, error) {
+  return ServerPublicKey(c.Keys, c.Endpoint().KeyFile)
+}
+
+// Check verifies the current interface and, during a rotation, the one
+// serving the new key.
+func (c *Controller) Check(ctx context.Context) error {
+  c.mu.Lock()
+  endpoints := []Endpoint{c.current()}
+  if c.next != nil {
+    endpoints = append(endpoints, *c.next)
+  }
+  c.mu.Unlock()
+
+  for _, endpoint := range endpoints {
+    expectedKey, err := ServerPublicKey(c.Keys, endpoint.KeyFile)
+    if err != nil {
+      return err
+    }
+    if err := CheckInterface(endpoint.Interface, endpoint.Port, expectedKey); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func (c *Controller) Peers(ctx context.Context) ([]DevicePeer, error) {
+  return ListPeers(c.Endpoint().Interface)
+}
+
+// ConfigurePeers configures the peers on the current interface and, during
+// a rotation, on the one serving the new key as well.
+func (c *Controller) ConfigurePeers(ctx context.Context, set []DevicePeer, remove []string) error {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  if err := ConfigurePeers(c.Interface, set, remove); err != nil {
+    return err
+  }
+  if c.next != nil {
+    return ConfigurePeers(c.next.Interface, set, remove)
+  }
+  return nil
+}
+
+// BeginRotation brings up next with a new key pair, or with the one saved
+// when the rotation started if resume is set, configures the peers of the
+// current interface on it and returns its public key.
+func (c *Controller) BeginRotation(ctx context.Context, next Endpoint, resume bool) (string, error) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  if c.next != nil && c.next.Interface != next.Interface {
+    return "", errors.New("another key rotation is in progress")
+  }
+  publicKey, err := InitRotationInterface(c.Keys, next.KeyFile, next.Interface, next.Port, c.IP, resume)
+  if err != nil {
+    return "", err
+  }
+  c.next = &next
+
+  peers, err := ListPeers(c.Interface)
+  if err != nil {
+    return "", err
+  }
+  if err := ConfigurePeers(next.Interface, peers, nil); err != nil {
+    return "", err
+  }
+  return publicKey, nil
+}
+
+// Handshakes returns the latest handshake of every peer that has connected
+// to the current interface or, during a rotation, to the one serving the
+// new key.
+func (c *Controller) Handshakes(ctx context.Context) (map[string]time.Time, error) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  handshakes, err := Handshakes(c.Interface)
+  if err != nil || c.next == nil {
+    return handshakes, err
+  }
+  next, err := Handshakes(c.next.Interface)
+  if err != nil {
+    return nil, err
+  }
+  for key, at := range next {
+    if at.After(handshakes[key]) {
+      handshakes[key] = at
+    }
+  }
+  return handshakes, nil
+}
+
+// RotationHandshakes returns the latest handshake of every peer that has
+// connected to the interface serving the new key.
+func (c *Controller) RotationHandshakes(ctx context.Context) (map[string]time.Time, error) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  if c.next == nil {
+    return nil, ErrNoRotation
+  }
+  return Handshakes(c.next.Interface)
+}
+
+// RoutePeers sends the traffic for ips, the addresses of peers that have
+// migrated, through the interface serving the new key.
+func (c *Controller) RoutePeers(ctx context.Context, ips []net.IP) error {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  if c.next == nil {
+    return ErrNoRotation
+  }
+  return RouteToInterface(c.next.Interface, ips)
+}
+
+// EndRotation finishes the rotation in progress. With promote the current
+// interface and its key are deleted and the interface serving the new key
+// takes over; otherwise that interface and the new key are discarded.
+func (c *Controller) EndRotation(ctx context.Context, promote bool) error {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  if c.next == nil {
+    return ErrNoRotation
+  }
+  retired, next := c.current(), *c.next
+  if !promote {
+    retired = next
+  } else if err := PromoteInterface(next.Interface, c.IP, c.NetworkMask); err != nil {
+    return err
+  }
+
+  if err := DeleteWireGuardInterface(retired.Interface); err != nil {
+    return err
+  }
+  if err := RemoveKeyFile(retired.KeyFile); err != nil {
+    return err
+  }
+  if promote {
+    c.Interface, c.Port, c.KeyFile = next.Interface, next.Port, next.KeyFile
+  }
+  c.next = nil
+  return nil
+}
+
+func (c *Controller) Teardown() error {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  if c.next != nil {
+    DeleteWireGuardInterface(c.next.Interface)
+  }
+  return DeleteWireGuardInterface(c.Interface)
+}
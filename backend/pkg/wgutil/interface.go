@@ -1,12 +1,11 @@
 package wgutil
 
 import (
-  "elysium-backend/config"
-  "elysium-backend/internal/models"
-  "elysium-backend/internal/services"
-  "log"
+  "fmt"
+  "log/slog"
   "net"
-  "time"
+
+  "elysium-backend/pkg/keystore"
 
   "github.com/vishvananda/netlink"
   "golang.zx2c4.com/wireguard/wgctrl"
@@ -14,8 +13,9 @@ import (
 )
 
 func CreateWireGuardInterface(ifaceName string) error {
-  if config.GetLogLevel() == "DEBUG" {
-    log.Println("wgutil.CreateWireGuardInterface -> called with ifaceName:", ifaceName)
+  if existing, err := netlink.LinkByName(ifaceName); err == nil {
+    slog.Info("reusing existing WireGuard interface", "interface", ifaceName)
+    return netlink.LinkSetUp(existing)
   }
 
   link := &netlink.GenericLink{
@@ -25,109 +25,201 @@ func CreateWireGuardInterface(ifaceName string) error {
     LinkType: "wireguard",
   }
   if err := netlink.LinkAdd(link); err != nil {
-    log.Println("wgutil.CreateWireGuardInterface -> error creating WireGuard interface:", err)
+    slog.Error("error creating WireGuard interface", "err", err)
     return err
   }
 
   createdLink, err := netlink.LinkByName(ifaceName)
   if err != nil {
-    log.Println("wgutil.CreateWireGuardInterface -> error retrieving interface after creation:", err)
+    slog.Error("error retrieving interface after creation", "err", err)
     return err
   }
 
   if err := netlink.LinkSetUp(createdLink); err != nil {
-    log.Println("wgutil.CreateWireGuardInterface -> error setting interface up:", err)
+    slog.Error("error setting interface up", "err", err)
     return err
   }
 
-  log.Println("wgutil.CreateWireGuardInterface -> successfully created and set up interface:", ifaceName)
+  slog.Info("created and set up interface", "interface", ifaceName)
   return nil
 }
 
-func setIPAddress(ifaceName, ipAddress, ipMask string) error {
-  if config.GetLogLevel() == "DEBUG" {
-    log.Println("wgutil.setIPAddress -> called with ifaceName:", ifaceName, "ipAddress:", ipAddress, "ipMask:", ipMask)
+func DeleteWireGuardInterface(ifaceName string) error {
+  link, err := netlink.LinkByName(ifaceName)
+  if err != nil {
+    slog.Error("error retrieving interface for deletion", "interface", ifaceName, "err", err)
+    return err
+  }
+
+  if err := netlink.LinkDel(link); err != nil {
+    slog.Error("error deleting WireGuard interface", "interface", ifaceName, "err", err)
+    return err
   }
 
+  slog.Info("deleted WireGuard interface", "interface", ifaceName)
+  return nil
+}
+
+func setIPAddress(ifaceName, ipAddress, ipMask string) error {
   link, err := netlink.LinkByName(ifaceName)
   if err != nil {
-    log.Println("wgutil.setIPAddress -> error retrieving link:", err)
+    slog.Error("error retrieving link", "err", err)
     return err
   }
 
   addr, err := netlink.ParseAddr(ipAddress + ipMask)
   if err != nil {
-    log.Println("wgutil.setIPAddress -> error parsing IP address:", err)
+    slog.Error("error parsing IP address", "err", err)
     return err
   }
 
-  if err := netlink.AddrAdd(link, addr); err != nil {
-    log.Println("wgutil.setIPAddress -> error adding IP address:", err)
+  if err := netlink.AddrReplace(link, addr); err != nil {
+    slog.Error("error adding IP address", "err", err)
     return err
   }
 
-  log.Println("wgutil.setIPAddress -> successfully set IP address:", ipAddress+ipMask)
+  slog.Info("set interface IP address", "interface", ifaceName, "address", ipAddress+ipMask)
   return nil
 }
 
-func InitWireGuardInterface(server_interface string, server_port int, server_IP net.IP, network_mask string) error {
-  if config.GetLogLevel() == "DEBUG" {
-    log.Println("wgutil.InitWireGuardInterface -> called")
+// InitWireGuardInterface creates and configures server_interface with the
+// key pair saved through keys as keyFile, generated on first start, and
+// returns the public key of the server.
+func InitWireGuardInterface(keys *keystore.Keystore, keyFile string, server_interface string, server_port int, server_IP net.IP, network_mask string) (string, error) {
+  privKey, err := loadOrGenerateKey(keys, keyFile, false)
+  if err != nil {
+    slog.Error("error loading server key", "err", err)
+    return "", err
   }
+  return configureInterface(server_interface, server_port, privKey, server_IP, network_mask)
+}
 
-  if err := CreateWireGuardInterface(server_interface); err != nil {
-    log.Println("wgutil.InitWireGuardInterface -> failed to create WireGuard interface:", err)
-    return err
+// InitRotationInterface creates and configures ifaceName for a key
+// rotation with a new key pair saved as keyFile, or with the one saved
+// earlier when resume is set, and returns its public key. The interface only
+// gets the server address as a /32, so the routes of the current interface
+// stay in place until traffic for migrated peers is moved with
+// RouteToInterface.
+func InitRotationInterface(keys *keystore.Keystore, keyFile string, ifaceName string, port int, serverIP net.IP, resume bool) (string, error) {
+  privKey, err := loadOrGenerateKey(keys, keyFile, !resume)
+  if err != nil {
+    slog.Error("error loading rotation key", "err", err)
+    return "", err
   }
+  return configureInterface(ifaceName, port, privKey, serverIP, "/32")
+}
 
-  client, err := wgctrl.New()
-  if err != nil {
-    log.Println("wgutil.InitWireGuardInterface -> error initializing WireGuard client:", err)
-    return err
+func configureInterface(ifaceName string, port int, privKey string, serverIP net.IP, mask string) (string, error) {
+  if err := CreateWireGuardInterface(ifaceName); err != nil {
+    slog.Error("failed to create WireGuard interface", "err", err)
+    return "", err
   }
-  defer client.Close()
 
-  privKey, pubKey, err := GenerateKeys()
+  client, err := wgctrl.New()
   if err != nil {
-    log.Println("wgutil.InitWireGuardInterface -> error generating keys:", err)
-    return err
+    slog.Error("error initializing WireGuard client", "err", err)
+    return "", err
   }
-  SaveKeyToFile("config/keys/", "server_private.key", privKey)
+  defer client.Close()
 
   privateKey, err := wgtypes.ParseKey(privKey)
   if err != nil {
-    log.Println("wgutil.InitWireGuardInterface -> error parsing private key:", err)
-    return err
+    slog.Error("error parsing private key", "err", err)
+    return "", err
   }
 
   config := wgtypes.Config{
     PrivateKey: &privateKey,
-    ListenPort: &server_port,
+    ListenPort: &port,
+  }
+
+  if err := client.ConfigureDevice(ifaceName, config); err != nil {
+    slog.Error("error configuring WireGuard interface", "err", err)
+    return "", err
   }
 
-  if err := client.ConfigureDevice(server_interface, config); err != nil {
-    log.Println("wgutil.InitWireGuardInterface -> error configuring WireGuard interface:", err)
+  if err := setIPAddress(ifaceName, serverIP.String(), mask); err != nil {
+    slog.Error("error setting IP address for interface", "err", err)
+    return "", err
+  }
+
+  slog.Info("initialized WireGuard interface", "interface", ifaceName, "port", port)
+  return privateKey.PublicKey().String(), nil
+}
+
+// RouteToInterface routes the traffic for ips through ifaceName, overriding
+// the network route of another interface with the same address.
+func RouteToInterface(ifaceName string, ips []net.IP) error {
+  link, err := netlink.LinkByName(ifaceName)
+  if err != nil {
+    return fmt.Errorf("interface %s not found: %w", ifaceName, err)
+  }
+
+  for _, ip := range ips {
+    route := &netlink.Route{
+      LinkIndex: link.Attrs().Index,
+      Dst:       &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)},
+      Scope:     netlink.SCOPE_LINK,
+    }
+    if err := netlink.RouteReplace(route); err != nil {
+      slog.Error("error routing peer", "interface", ifaceName, "ip", ip.String(), "err", err)
+      return err
+    }
+  }
+  slog.Info("routed peers", "interface", ifaceName, "peers", len(ips))
+  return nil
+}
+
+// PromoteInterface gives ifaceName, brought up by InitRotationInterface,
+// the server address with network_mask, so it takes over the routes of the
+// network once the interface it replaces is deleted.
+func PromoteInterface(ifaceName string, serverIP net.IP, network_mask string) error {
+  if err := setIPAddress(ifaceName, serverIP.String(), network_mask); err != nil {
     return err
   }
 
-  if err := setIPAddress(server_interface, server_IP.String(), network_mask); err != nil {
-    log.Println("wgutil.InitWireGuardInterface -> error setting IP address for interface:", err)
+  link, err := netlink.LinkByName(ifaceName)
+  if err != nil {
     return err
   }
+  hostAddr, err := netlink.ParseAddr(serverIP.String() + "/32")
+  if err != nil {
+    return err
+  }
+  if err := netlink.AddrDel(link, hostAddr); err != nil {
+    slog.Warn("error removing host address", "interface", ifaceName, "err", err)
+  }
+  return nil
+}
 
-  backend_server := models.Peer{
-    PublicKey:  pubKey,
-    AssignedIP: server_IP,
-    Status:     "active",
-    IsGateway:  false,
-    CreatedOn:  time.Now().UTC(),
+// CheckInterface verifies that ifaceName is up and configured with the
+// expected public key and listen port.
+func CheckInterface(ifaceName string, port int, expectedPublicKey string) error {
+  link, err := netlink.LinkByName(ifaceName)
+  if err != nil {
+    return fmt.Errorf("interface %s not found: %w", ifaceName, err)
+  }
+  if link.Attrs().Flags&net.FlagUp == 0 {
+    return fmt.Errorf("interface %s is down", ifaceName)
   }
 
-  if err := services.InsertPeer(&backend_server); err != nil {
-    log.Println("wgutil.InitWireGuardInterface -> error saving backend server in peer table:", err)
+  client, err := wgctrl.New()
+  if err != nil {
     return err
   }
+  defer client.Close()
+
+  device, err := client.Device(ifaceName)
+  if err != nil {
+    return fmt.Errorf("unable to query device %s: %w", ifaceName, err)
+  }
+
+  if device.ListenPort != port {
+    return fmt.Errorf("interface %s listens on port %d, expected %d", ifaceName, device.ListenPort, port)
+  }
+  if device.PublicKey.String() != expectedPublicKey {
+    return fmt.Errorf("interface %s has public key %s, expected %s", ifaceName, device.PublicKey.String(), expectedPublicKey)
+  }
 
-  log.Println("wgutil.InitWireGuardInterface -> successfully initialized WireGuard interface:", server_interface)
   return nil
 }
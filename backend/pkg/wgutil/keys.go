@@ -1,58 +1,110 @@
 package wgutil
 
 import (
-  "elysium-backend/config"
-  "log"
+  "errors"
+  "io/fs"
+  "log/slog"
   "os"
   "path/filepath"
+  "strings"
+
+  "elysium-backend/pkg/keystore"
 
   "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-func GenerateKeys() (string, string, error) {
-  if config.GetLogLevel() == "DEBUG" {
-    log.Println("wgutil.GenerateKeys -> called")
-  }
+// The server key of the configured interface is saved as ServerKeyFile and
+// the key of the alternate interface key rotations switch to as
+// AltServerKeyFile.
+const (
+  ServerKeyDir     = "config/keys/"
+  ServerKeyFile    = "server_private.key"
+  AltServerKeyFile = "server_private.alt.key"
+)
 
+func GenerateKeys() (string, string, error) {
   privateKey, err := wgtypes.GeneratePrivateKey()
   if err != nil {
-    log.Println("wgutil.GenerateKeys -> failed to generate private key:", err)
+    slog.Error("failed to generate private key", "err", err)
     return "", "", err
   }
 
   publicKey := privateKey.PublicKey()
 
-  log.Println("wgutil.GenerateKeys -> keys generated successfully")
+  slog.Debug("keys generated")
   return privateKey.String(), publicKey.String(), nil
 }
 
-func SaveKeyToFile(path, filename, key string) error {
-  if config.GetLogLevel() == "DEBUG" {
-    log.Println("wgutil.SaveKeyToFile -> called with path:", path, "filename:", filename)
+// SaveKeyToFile writes key to filename in path through keys, readable only
+// by the owner and sealed when keys encrypts.
+func SaveKeyToFile(keys *keystore.Keystore, path, filename, key string) error {
+  keyPath := filepath.Join(path, filename)
+
+  if err := keys.WriteFile(keyPath, []byte(key)); err != nil {
+    slog.Error("failed to write key to file", "path", keyPath, "err", err)
+    return err
   }
 
+  slog.Debug("key saved", "path", keyPath, "encrypted", keys.Encrypted())
+  return nil
+}
+
+func LoadKeyFromFile(keys *keystore.Keystore, path, filename string) (string, error) {
   keyPath := filepath.Join(path, filename)
 
-  if err := os.MkdirAll(path, os.ModePerm); err != nil {
-    log.Println("wgutil.SaveKeyToFile -> failed to create directory:", err)
-    return err
+  key, err := keys.ReadFile(keyPath)
+  if err != nil {
+    slog.Error("failed to read key file", "path", keyPath, "err", err)
+    return "", err
   }
 
-  file, err := os.Create(keyPath)
+  return strings.TrimSpace(string(key)), nil
+}
+
+// ServerPublicKey derives the public key of the server from the private key
+// saved as keyFile when the interface was initialised.
+func ServerPublicKey(keys *keystore.Keystore, keyFile string) (string, error) {
+  privKey, err := LoadKeyFromFile(keys, ServerKeyDir, keyFile)
   if err != nil {
-    log.Println("wgutil.SaveKeyToFile -> failed to create file:", err)
-    return err
+    return "", err
   }
-  defer file.Close()
 
-  _, err = file.WriteString(key)
+  privateKey, err := wgtypes.ParseKey(privKey)
   if err != nil {
-    log.Println("wgutil.SaveKeyToFile -> failed to write key to file:", err)
-    return err
+    slog.Error("failed to parse server private key", "err", err)
+    return "", err
+  }
+
+  return privateKey.PublicKey().String(), nil
+}
+
+// loadOrGenerateKey returns the private key saved as keyFile, generating and
+// saving a new one when there is none yet or fresh is set.
+func loadOrGenerateKey(keys *keystore.Keystore, keyFile string, fresh bool) (string, error) {
+  if !fresh {
+    privKey, err := LoadKeyFromFile(keys, ServerKeyDir, keyFile)
+    if err == nil {
+      return privKey, nil
+    } else if !errors.Is(err, fs.ErrNotExist) {
+      return "", err
+    }
   }
 
-  if config.GetLogLevel() == "DEBUG" {
-    log.Println("wgutil.SaveKeyToFile -> key saved successfully to:", keyPath)
+  privKey, _, err := GenerateKeys()
+  if err != nil {
+    return "", err
+  }
+  if err := SaveKeyToFile(keys, ServerKeyDir, keyFile, privKey); err != nil {
+    return "", err
+  }
+  slog.Info("generated server key", "file", keyFile)
+  return privKey, nil
+}
+
+// RemoveKeyFile deletes the private key saved as keyFile, if any.
+func RemoveKeyFile(keyFile string) error {
+  if err := os.Remove(filepath.Join(ServerKeyDir, keyFile)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+    return err
   }
   return nil
 }
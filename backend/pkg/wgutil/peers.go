@@ -0,0 +1,142 @@
+package wgutil
+
+import (
+  "fmt"
+  "log/slog"
+  "net"
+  "sort"
+  "time"
+
+  "golang.zx2c4.com/wireguard/wgctrl"
+  "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// DevicePeer is a peer configured on a WireGuard device. AllowedIPs are in
+// CIDR notation and sorted. PresharedKey is the base64 encoded preshared key
+// of the peer; ConfigurePeers leaves the key on the device alone when it is
+// empty.
+type DevicePeer struct {
+  PublicKey    string   `json:"public_key"`
+  AllowedIPs   []string `json:"allowed_ips"`
+  PresharedKey string   `json:"-"`
+}
+
+// GeneratePresharedKey returns a new random base64 encoded preshared key.
+func GeneratePresharedKey() (string, error) {
+  key, err := wgtypes.GenerateKey()
+  if err != nil {
+    return "", err
+  }
+  return key.String(), nil
+}
+
+// ValidateKey reports whether key is a base64 encoded WireGuard key.
+func ValidateKey(key string) error {
+  _, err := wgtypes.ParseKey(key)
+  return err
+}
+
+// ListPeers returns the peers configured on ifaceName.
+func ListPeers(ifaceName string) ([]DevicePeer, error) {
+  client, err := wgctrl.New()
+  if err != nil {
+    return nil, err
+  }
+  defer client.Close()
+
+  device, err := client.Device(ifaceName)
+  if err != nil {
+    return nil, fmt.Errorf("unable to query device %s: %w", ifaceName, err)
+  }
+
+  peers := make([]DevicePeer, 0, len(device.Peers))
+  for _, peer := range device.Peers {
+    allowed := make([]string, 0, len(peer.AllowedIPs))
+    for _, ipNet := range peer.AllowedIPs {
+      allowed = append(allowed, ipNet.String())
+    }
+    sort.Strings(allowed)
+    devicePeer := DevicePeer{PublicKey: peer.PublicKey.String(), AllowedIPs: allowed}
+    if peer.PresharedKey != (wgtypes.Key{}) {
+      devicePeer.PresharedKey = peer.PresharedKey.String()
+    }
+    peers = append(peers, devicePeer)
+  }
+  return peers, nil
+}
+
+// ConfigurePeers adds or replaces the allowed IPs and preshared keys of the
+// peers in set on ifaceName and removes the peers with the public keys in
+// remove. Peers not mentioned are left alone.
+func ConfigurePeers(ifaceName string, set []DevicePeer, remove []string) error {
+  var peers []wgtypes.PeerConfig
+  for _, peer := range set {
+    key, err := wgtypes.ParseKey(peer.PublicKey)
+    if err != nil {
+      return fmt.Errorf("invalid public key %q: %w", peer.PublicKey, err)
+    }
+    var allowed []net.IPNet
+    for _, cidr := range peer.AllowedIPs {
+      _, ipNet, err := net.ParseCIDR(cidr)
+      if err != nil {
+        return fmt.Errorf("invalid allowed IP %q: %w", cidr, err)
+      }
+      allowed = append(allowed, *ipNet)
+    }
+    config := wgtypes.PeerConfig{PublicKey: key, ReplaceAllowedIPs: true, AllowedIPs: allowed}
+    if peer.PresharedKey != "" {
+      presharedKey, err := wgtypes.ParseKey(peer.PresharedKey)
+      if err != nil {
+        return fmt.Errorf("invalid preshared key for %q: %w", peer.PublicKey, err)
+      }
+      config.PresharedKey = &presharedKey
+    }
+    peers = append(peers, config)
+  }
+  for _, publicKey := range remove {
+    key, err := wgtypes.ParseKey(publicKey)
+    if err != nil {
+      return fmt.Errorf("invalid public key %q: %w", publicKey, err)
+    }
+    peers = append(peers, wgtypes.PeerConfig{PublicKey: key, Remove: true})
+  }
+  if len(peers) == 0 {
+    return nil
+  }
+
+  client, err := wgctrl.New()
+  if err != nil {
+    return err
+  }
+  defer client.Close()
+
+  if err := client.ConfigureDevice(ifaceName, wgtypes.Config{Peers: peers}); err != nil {
+    slog.Error("error configuring WireGuard peers", "interface", ifaceName, "err", err)
+    return err
+  }
+  slog.Info("configured WireGuard peers", "interface", ifaceName, "set", len(set), "removed", len(remove))
+  return nil
+}
+
+// Handshakes returns the time of the latest handshake of every peer of
+// ifaceName that has completed one, by public key.
+func Handshakes(ifaceName string) (map[string]time.Time, error) {
+  client, err := wgctrl.New()
+  if err != nil {
+    return nil, err
+  }
+  defer client.Close()
+
+  device, err := client.Device(ifaceName)
+  if err != nil {
+    return nil, fmt.Errorf("unable to query device %s: %w", ifaceName, err)
+  }
+
+  handshakes := make(map[string]time.Time)
+  for _, peer := range device.Peers {
+    if !peer.LastHandshakeTime.IsZero() {
+      handshakes[peer.PublicKey.String()] = peer.LastHandshakeTime
+    }
+  }
+  return handshakes, nil
+}
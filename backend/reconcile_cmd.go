@@ -0,0 +1,105 @@
+package main
+
+import (
+  "context"
+  "flag"
+  "fmt"
+  "io"
+  "log/slog"
+  "os"
+
+  "elysium-backend/config"
+  "elysium-backend/internal/models"
+  "elysium-backend/internal/repositories"
+  "elysium-backend/internal/services"
+  "elysium-backend/pkg/db"
+  "elysium-backend/pkg/wgutil"
+)
+
+const reconcileUsage = `usage: main [flags] reconcile [-apply] <file>
+
+Diffs the desired state in <file> (YAML or JSON, - for stdin) against the
+peers in the database and on the WireGuard interface and prints the plan.
+With -apply the plan is carried out unless it has conflicts. The interface
+is only reconciled when -setupWg is set.`
+
+// runReconcile implements the reconcile subcommand and returns the exit
+// code: 1 when the plan has conflicts or reconciling failed.
+func runReconcile(args []string, manageWg bool) int {
+  flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+  apply := flags.Bool("apply", false, "Apply the plan")
+  flags.Usage = func() { fmt.Fprintln(os.Stderr, reconcileUsage) }
+  if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+    flags.Usage()
+    return 2
+  }
+
+  state, err := readDesiredState(flags.Arg(0))
+  if err != nil {
+    slog.Error("unable to read desired state", "file", flags.Arg(0), "err", err)
+    return 1
+  }
+
+  cfg, err := config.Load()
+  if err != nil {
+    slog.Error("invalid configuration", "err", err)
+    return 1
+  }
+
+  pool, err := db.InitializeDatabaseConnection(cfg.Database)
+  if err != nil {
+    slog.Error("unable to connect to the database", "err", err)
+    return 1
+  }
+  defer pool.Close()
+  store := repositories.NewSQLStore(pool, cfg.DBQueryTimeout)
+
+  keys, err := openKeystore(cfg)
+  if err != nil {
+    slog.Error("invalid key encryption configuration", "err", err)
+    return 1
+  }
+  var wireGuard services.WireGuard
+  if manageWg {
+    endpoint, err := services.CurrentEndpoint(context.Background(), store, cfg.WireGuard)
+    if err != nil {
+      slog.Error("failed to look up the interface serving the server key", "err", err)
+      return 1
+    }
+    wireGuard = &wgutil.Controller{
+      Interface:   endpoint.Interface,
+      Port:        endpoint.Port,
+      KeyFile:     endpoint.KeyFile,
+      IP:          cfg.WireGuard.IP,
+      NetworkMask: cfg.WireGuard.NetworkMask,
+      Keys:        keys,
+    }
+  }
+
+  psks := services.NewPresharedKeys(store, wireGuard, keys, cfg.WireGuard.PresharedKeys)
+  plan, err := services.NewReconciler(store, services.NewHashAllocator(store, cfg.IPRanges), wireGuard, cfg, psks).Reconcile(context.Background(), state, *apply)
+  if err != nil {
+    slog.Error("reconcile failed", "err", err)
+    return 1
+  }
+  if err := services.WritePlan(os.Stdout, plan); err != nil {
+    return 1
+  }
+  if len(plan.Conflicts) > 0 {
+    return 1
+  }
+  return 0
+}
+
+func readDesiredState(path string) (*models.DesiredState, error) {
+  var r io.Reader = os.Stdin
+  if path != "-" {
+    file, err := os.Open(path)
+    if err != nil {
+      return nil, err
+    }
+    defer file.Close()
+    r = file
+  }
+  return services.ParseDesiredState(r)
+}
@@ -6,22 +6,29 @@ use std::{env, process};
 This build script performs the following tasks:
 
 1. Ensures the Cargo build process reruns this script if specific environment variables change.
-2. Validates that mandatory environment variables are set; if any are missing, it terminates the build process with an error message.
-3. Parses and validates mandatory environment variables to ensure they are in the correct format (e.g., IP addresses and CIDR values).
-4. Handles optional environment variables like `CLIENTPUB`, logging whether they are set or not.
+2. Requires `CONFIGPUB` in release mode: the hex encoded Ed25519 public key the client verifies
+   the configuration payload appended by the backend with (see `src/config.rs`). Release
+   binaries are built once per target and carry no per-peer values of their own.
+3. Parses and validates the per-peer environment variables when they are set, to ensure they
+   are in the correct format (e.g., IP addresses and CIDR values).
+4. Handles optional environment variables like `CLIENTPUB` and `PRESHAREDKEY`, logging whether
+   they are set or not.
 5. Sets a default value for `IFCNAME` if it is not provided.
-6. Embeds the environment variable values into the binary at compile time by using the `cargo:rustc-env` directive.
+6. Embeds the environment variable values into the binary at compile time by using the
+   `cargo:rustc-env` directive; the client falls back to them when no payload is present.
 7. Compiles a C source file (`wireguard.c`) into a static library (`libwireguard.a`) using GCC, and links it with the Rust code.
 8. Informs Cargo to link the generated static library and sets up the required linker search paths.
 9. Ensures that changes to the `src/wireguard/wireguard.c` file trigger a rebuild.
-10. Adds logic to set default environment variables when building in debug mode but requires these variables in release mode.**
+10. Sets default per-peer environment variables when building in debug mode.
 */
 
 fn main() {
     let is_release = env::var("PROFILE").unwrap_or_default() == "release";
 
     for var in [
+        "CONFIGPUB",
         "CLIENTPUB",
+        "PRESHAREDKEY",
         "IFCNAME",
         "ADDR",
         "CIDR",
@@ -32,25 +39,23 @@ fn main() {
         println!("cargo:rerun-if-env-changed={}", var);
     }
 
-    let required_vars = ["ADDR", "CIDR", "SERVERPUB", "SERVERENDPOINT", "SERVERIP"];
-
-    let mut missing_vars = vec![];
-
-    for var in &required_vars {
-        if env::var(var).is_err() {
-            missing_vars.push(*var);
+    match env::var("CONFIGPUB") {
+        Ok(key) => {
+            if key.len() != 64 || !key.chars().all(|c| c.is_ascii_hexdigit()) {
+                eprintln!("Error: CONFIGPUB must be a hex encoded 32 byte Ed25519 public key");
+                process::exit(1);
+            }
+            println!("Using CONFIGPUB: {}", key);
+            println!("cargo:rustc-env=CONFIGPUB={}", key);
         }
-    }
-
-    if is_release {
-        if !missing_vars.is_empty() {
-            eprintln!(
-                "Error: Missing mandatory environment variables in release mode: {:?}",
-                missing_vars
-            );
+        Err(_) if is_release => {
+            eprintln!("Error: Missing mandatory environment variable in release mode: CONFIGPUB");
             process::exit(1);
         }
-    } else {
+        Err(_) => println!("CONFIGPUB is not set, configuration payloads will be rejected"),
+    }
+
+    if !is_release {
         if env::var("ADDR").is_err() {
             env::set_var("ADDR", "192.168.1.2");
         }
@@ -68,45 +73,66 @@ fn main() {
         }
     }
 
-    let addr = env::var("ADDR")
-        .unwrap()
-        .parse::<std::net::Ipv4Addr>()
-        .expect("Invalid ADDR");
-    let cidr = env::var("CIDR")
-        .unwrap()
-        .parse::<u8>()
-        .expect("Invalid CIDR");
-    let server_pub = env::var("SERVERPUB").unwrap();
-    let endpoint = env::var("SERVERENDPOINT").unwrap();
-    let server_ip = env::var("SERVERIP")
-        .unwrap()
-        .parse::<std::net::Ipv4Addr>()
-        .expect("Invalid SERVERIP");
-
     let client_pub = env::var("CLIENTPUB").ok();
     if let Some(key) = &client_pub {
         println!("Using CLIENTPUB: {}", key);
+        println!("cargo:rustc-env=CLIENTPUB={}", key);
     } else {
         println!("CLIENTPUB is not set, proceeding without it");
     }
 
+    if let Ok(key) = env::var("PRESHAREDKEY") {
+        // The key is a secret and is not echoed.
+        println!("Using PRESHAREDKEY");
+        println!("cargo:rustc-env=PRESHAREDKEY={}", key);
+    }
+
     let ifc_name = env::var("IFCNAME").unwrap_or_else(|_| "wg0".to_string());
     println!("Using IFCNAME: {}", ifc_name);
+    println!("cargo:rustc-env=IFCNAME={}", ifc_name);
 
-    println!("Using ADDR: {}/{}", addr, cidr);
-    println!("Using SERVERPUB: {}", server_pub);
-    println!("Using SERVERENDPOINT: {}", endpoint);
-    println!("Using SERVERIP: {}", server_ip);
-
-    if let Some(key) = client_pub {
-        println!("cargo:rustc-env=CLIENTPUB={}", key);
+    let required_vars = ["ADDR", "CIDR", "SERVERPUB", "SERVERENDPOINT", "SERVERIP"];
+    let missing_vars: Vec<&str> = required_vars
+        .iter()
+        .copied()
+        .filter(|var| env::var(var).is_err())
+        .collect();
+
+    if missing_vars.len() == required_vars.len() {
+        println!("No per-peer configuration set, the client requires a configuration payload");
+    } else if !missing_vars.is_empty() {
+        eprintln!(
+            "Error: Incomplete per-peer configuration, missing: {:?}",
+            missing_vars
+        );
+        process::exit(1);
+    } else {
+        let addr = env::var("ADDR")
+            .unwrap()
+            .parse::<std::net::Ipv4Addr>()
+            .expect("Invalid ADDR");
+        let cidr = env::var("CIDR")
+            .unwrap()
+            .parse::<u8>()
+            .expect("Invalid CIDR");
+        let server_pub = env::var("SERVERPUB").unwrap();
+        let endpoint = env::var("SERVERENDPOINT").unwrap();
+        let server_ip = env::var("SERVERIP")
+            .unwrap()
+            .parse::<std::net::Ipv4Addr>()
+            .expect("Invalid SERVERIP");
+
+        println!("Using ADDR: {}/{}", addr, cidr);
+        println!("Using SERVERPUB: {}", server_pub);
+        println!("Using SERVERENDPOINT: {}", endpoint);
+        println!("Using SERVERIP: {}", server_ip);
+
+        println!("cargo:rustc-env=ADDR={}", addr);
+        println!("cargo:rustc-env=CIDR={}", cidr);
+        println!("cargo:rustc-env=SERVERPUB={}", server_pub);
+        println!("cargo:rustc-env=SERVERENDPOINT={}", endpoint);
+        println!("cargo:rustc-env=SERVERIP={}", server_ip);
     }
-    println!("cargo:rustc-env=IFCNAME={}", ifc_name);
-    println!("cargo:rustc-env=ADDR={}", addr);
-    println!("cargo:rustc-env=CIDR={}", cidr);
-    println!("cargo:rustc-env=SERVERPUB={}", server_pub);
-    println!("cargo:rustc-env=SERVERENDPOINT={}", endpoint);
-    println!("cargo:rustc-env=SERVERIP={}", server_ip);
 
     let out_dir = env::var("OUT_DIR").unwrap();
 
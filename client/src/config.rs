@@ -0,0 +1,251 @@
+use ed25519_dalek::{Signature, VerifyingKey};
+use std::collections::HashMap;
+use std::net::Ipv4Addr;
+use std::path::Path;
+use std::{env, fs};
+
+/*
+Per-peer configuration of the client. The backend compiles the client once per target and
+appends each peer's configuration to a copy of the binary as a signed payload:
+
+    binary | body | signature (64 bytes) | body length (u32 LE) | "ELYCFG01"
+
+The body holds KEY=VALUE lines using the same names as the build script (ADDR, CIDR,
+SERVERPUB, SERVERENDPOINT, SERVERIP and optionally IFCNAME, CLIENTPUB and PRESHAREDKEY), plus
+the BUILDID
+the backend recorded the build under, which `GET /builds/{id}` resolves. The signature is
+an Ed25519 signature over the body made with the backend key whose public half is embedded
+at compile time as CONFIGPUB.
+
+The configuration is looked up in this order:
+
+1. The payload appended to the running executable.
+2. A file next to the executable with the extension `.conf` holding the same payload, for
+   configurations shipped alongside the binary.
+3. Values embedded at compile time through the build script, for development builds.
+*/
+
+const MAGIC: &[u8] = b"ELYCFG01";
+const SIGNATURE_LEN: usize = 64;
+const TRAILER_LEN: usize = SIGNATURE_LEN + 4 + MAGIC.len();
+
+#[derive(Debug)]
+pub struct Config {
+    pub ifc_name: String,
+    pub addr: Ipv4Addr,
+    pub cidr: u8,
+    pub server_pub: String,
+    pub server_endpoint: String,
+    pub server_ip: Ipv4Addr,
+    pub client_pub: Option<String>,
+    pub preshared_key: Option<String>,
+    pub build_id: Option<String>,
+}
+
+impl Config {
+    pub fn load() -> Result<Config, String> {
+        let exe = env::current_exe().map_err(|e| format!("Unable to locate executable: {e}"))?;
+
+        for path in [exe.clone(), exe.with_extension("conf")] {
+            if let Some(values) = read_payload(&path)? {
+                println!("Using configuration from {}", path.display());
+                return Config::from_values(&values);
+            }
+        }
+
+        Config::from_build()
+    }
+
+    fn from_values(values: &HashMap<String, String>) -> Result<Config, String> {
+        let get = |key: &str| {
+            values
+                .get(key)
+                .cloned()
+                .ok_or_else(|| format!("Configuration is missing {key}"))
+        };
+
+        Ok(Config {
+            ifc_name: values
+                .get("IFCNAME")
+                .cloned()
+                .unwrap_or_else(|| "wg0".to_string()),
+            addr: get("ADDR")?
+                .parse()
+                .map_err(|_| "Invalid IPv4 address in ADDR".to_string())?,
+            cidr: get("CIDR")?
+                .parse()
+                .map_err(|_| "Invalid CIDR value in CIDR".to_string())?,
+            server_pub: get("SERVERPUB")?,
+            server_endpoint: get("SERVERENDPOINT")?,
+            server_ip: get("SERVERIP")?
+                .parse()
+                .map_err(|_| "Invalid IPv4 address in SERVERIP".to_string())?,
+            client_pub: values.get("CLIENTPUB").cloned(),
+            preshared_key: values.get("PRESHAREDKEY").cloned(),
+            build_id: values.get("BUILDID").cloned(),
+        })
+    }
+
+    fn from_build() -> Result<Config, String> {
+        let mut values = HashMap::new();
+        for (key, value) in [
+            ("IFCNAME", option_env!("IFCNAME")),
+            ("ADDR", option_env!("ADDR")),
+            ("CIDR", option_env!("CIDR")),
+            ("SERVERPUB", option_env!("SERVERPUB")),
+            ("SERVERENDPOINT", option_env!("SERVERENDPOINT")),
+            ("SERVERIP", option_env!("SERVERIP")),
+            ("CLIENTPUB", option_env!("CLIENTPUB")),
+            ("PRESHAREDKEY", option_env!("PRESHAREDKEY")),
+        ] {
+            if let Some(value) = value {
+                values.insert(key.to_string(), value.to_string());
+            }
+        }
+
+        if !values.contains_key("ADDR") {
+            return Err(
+                "No configuration payload found and none was embedded at build time".to_string(),
+            );
+        }
+        println!("Using configuration embedded at build time");
+        Config::from_values(&values)
+    }
+}
+
+fn read_payload(path: &Path) -> Result<Option<HashMap<String, String>>, String> {
+    let data = match fs::read(path) {
+        Ok(data) => data,
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(None),
+        Err(e) => return Err(format!("Unable to read {}: {e}", path.display())),
+    };
+
+    let key = match option_env!("CONFIGPUB") {
+        Some(hex) => verifying_key(hex)?,
+        None if has_payload(&data) => {
+            return Err(
+                "Found a configuration payload, but the client was built without CONFIGPUB"
+                    .to_string(),
+            )
+        }
+        None => return Ok(None),
+    };
+    extract(&data, &key)
+}
+
+fn has_payload(data: &[u8]) -> bool {
+    data.len() >= TRAILER_LEN && data.ends_with(MAGIC)
+}
+
+fn verifying_key(hex: &str) -> Result<VerifyingKey, String> {
+    let bytes = decode_hex(hex).ok_or("CONFIGPUB is not valid hex")?;
+    let bytes: [u8; 32] = bytes
+        .try_into()
+        .map_err(|_| "CONFIGPUB must be 32 bytes".to_string())?;
+    VerifyingKey::from_bytes(&bytes).map_err(|e| format!("Invalid CONFIGPUB: {e}"))
+}
+
+fn decode_hex(hex: &str) -> Option<Vec<u8>> {
+    if hex.len() % 2 != 0 {
+        return None;
+    }
+    (0..hex.len())
+        .step_by(2)
+        .map(|i| u8::from_str_radix(hex.get(i..i + 2)?, 16).ok())
+        .collect()
+}
+
+/// Verifies and decodes the payload at the end of data, returning None when there is none.
+fn extract(data: &[u8], key: &VerifyingKey) -> Result<Option<HashMap<String, String>>, String> {
+    if !has_payload(data) {
+        return Ok(None);
+    }
+
+    let end = data.len() - MAGIC.len();
+    let body_len = u32::from_le_bytes(data[end - 4..end].try_into().unwrap()) as usize;
+    let sig_end = end - 4;
+    let body_end = sig_end - SIGNATURE_LEN;
+    if body_len > body_end {
+        return Err("Configuration payload is truncated".to_string());
+    }
+
+    let body = &data[body_end - body_len..body_end];
+    let signature = Signature::from_bytes(data[body_end..sig_end].try_into().unwrap());
+    key.verify_strict(body, &signature)
+        .map_err(|_| "Configuration payload signature does not verify".to_string())?;
+
+    let body =
+        std::str::from_utf8(body).map_err(|_| "Configuration payload is not UTF-8".to_string())?;
+    let mut values = HashMap::new();
+    for line in body.lines().filter(|line| !line.is_empty()) {
+        let (key, value) = line
+            .split_once('=')
+            .ok_or_else(|| format!("Malformed configuration line {line:?}"))?;
+        values.insert(key.to_string(), value.to_string());
+    }
+    Ok(Some(values))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use ed25519_dalek::{Signer, SigningKey};
+
+    fn payload(body: &[u8], key: &SigningKey) -> Vec<u8> {
+        let mut data = b"\x7fELF binary".to_vec();
+        data.extend_from_slice(body);
+        data.extend_from_slice(&key.sign(body).to_bytes());
+        data.extend_from_slice(&(body.len() as u32).to_le_bytes());
+        data.extend_from_slice(MAGIC);
+        data
+    }
+
+    #[test]
+    fn extracts_signed_payload() {
+        let key = SigningKey::from_bytes(&[7; 32]);
+        let body = b"ADDR=10.0.0.2\nBUILDID=42\nCIDR=24\nSERVERENDPOINT=192.168.0.1:51820\nSERVERIP=10.0.0.1\nSERVERPUB=abc=\n";
+        let data = payload(body, &key);
+
+        let values = extract(&data, &key.verifying_key()).unwrap().unwrap();
+        let config = Config::from_values(&values).unwrap();
+        assert_eq!(config.addr, Ipv4Addr::new(10, 0, 0, 2));
+        assert_eq!(config.cidr, 24);
+        assert_eq!(config.server_pub, "abc=");
+        assert_eq!(config.ifc_name, "wg0");
+        assert_eq!(config.build_id.as_deref(), Some("42"));
+        assert!(config.preshared_key.is_none());
+    }
+
+    #[test]
+    fn rejects_tampered_or_foreign_payloads() {
+        let key = SigningKey::from_bytes(&[7; 32]);
+        let mut data = payload(b"ADDR=10.0.0.2\n", &key);
+
+        let other = SigningKey::from_bytes(&[8; 32]);
+        assert!(extract(&data, &other.verifying_key()).is_err());
+
+        data[b"\x7fELF binary".len() + 8] = b'9';
+        assert!(extract(&data, &key.verifying_key()).is_err());
+    }
+
+    #[test]
+    fn ignores_binaries_without_payload() {
+        let key = SigningKey::from_bytes(&[7; 32]);
+        assert!(extract(b"plain binary", &key.verifying_key())
+            .unwrap()
+            .is_none());
+    }
+
+    #[test]
+    fn decodes_hex_keys() {
+        let key = SigningKey::from_bytes(&[7; 32]);
+        let hex: String = key
+            .verifying_key()
+            .to_bytes()
+            .iter()
+            .map(|b| format!("{b:02x}"))
+            .collect();
+        assert_eq!(verifying_key(&hex).unwrap(), key.verifying_key());
+        assert!(verifying_key("zz").is_err());
+    }
+}
@@ -1,8 +1,9 @@
-use std::net::Ipv4Addr;
-
+mod config;
 mod interface;
 mod wg_common;
 
+use config::Config;
+
 use wg_common::{
     wg_common::{gen_private_key, gen_public_key, list_device_names, update_device},
     wireguard_cffi::WgKeyBase64String,
@@ -13,13 +14,14 @@ use interface::{create_wireguard_ifc, update_wireguard_ifc, Operation};
 /*
 This is the main entry point for the Elysium Project Client setup. It performs the following tasks:
 
-1. **Environment Variable Retrieval and Parsing**:
-   - Retrieves compile-time constants embedded by the build script.
-   - Ensures mandatory variables are correctly parsed (e.g., IP addresses and CIDR values).
+1. **Configuration Loading**:
+   - Reads the signed per-peer configuration appended to the binary or shipped next to it,
+     falling back to values embedded by the build script (see `config.rs`).
+   - Ensures mandatory values are correctly parsed (e.g., IP addresses and CIDR values).
    - Optionally retrieves `CLIENTPUB` if provided.
 
 2. **Logging Setup Information**:
-   - Logs the retrieved environment variables to verify correctness.
+   - Logs the loaded configuration to verify correctness.
 
 3. **WireGuard Key Pair Generation**:
    - Generates a new private key and corresponding public key using the WireGuard CFFI interface.
@@ -40,29 +42,32 @@ This is the main entry point for the Elysium Project Client setup. It performs t
 async fn main() {
     println!("Starting Elysium Project Client setup");
 
-    const IFCNAME: &str = env!("IFCNAME");
-    const ADDR: &str = env!("ADDR");
-    const CIDR: &str = env!("CIDR");
-    const SERVERPUB: &str = env!("SERVERPUB");
-    const SERVERENDPOINT: &str = env!("SERVERENDPOINT");
-    const SERVERIP: &str = env!("SERVERIP");
+    let config = match Config::load() {
+        Ok(config) => config,
+        Err(e) => {
+            eprintln!("Unable to load configuration: {}", e);
+            std::process::exit(1);
+        }
+    };
 
-    let client_pub = option_env!("CLIENTPUB");
-    if let Some(key) = client_pub {
+    if let Some(build_id) = &config.build_id {
+        println!("Build ID: {}", build_id);
+    }
+
+    if let Some(key) = &config.client_pub {
         println!("CLIENTPUB: {}", key);
     } else {
         println!("CLIENTPUB is not set");
     }
 
-    let addr = ADDR
-        .parse::<Ipv4Addr>()
-        .expect("Invalid IPv4 address in ADDR");
-    let cidr = CIDR.parse::<u8>().expect("Invalid CIDR value in CIDR");
+    if config.preshared_key.is_some() {
+        println!("Using a preshared key");
+    }
 
-    println!("Interface Name: {}", IFCNAME);
-    println!("Address: {}/{}", addr, cidr);
-    println!("Server Public Key: {}", SERVERPUB);
-    println!("Server endpoint: {}", SERVERENDPOINT);
+    println!("Interface Name: {}", config.ifc_name);
+    println!("Address: {}/{}", config.addr, config.cidr);
+    println!("Server Public Key: {}", config.server_pub);
+    println!("Server endpoint: {}", config.server_endpoint);
 
     let private_key: WgKeyBase64String = gen_private_key();
     let public_key: WgKeyBase64String = gen_public_key(&private_key);
@@ -70,18 +75,28 @@ async fn main() {
     println!("New Private Key: {:?}", private_key);
     println!("New Public Key: {:?}", public_key);
 
+    let ifc_name = config.ifc_name.as_str();
+    let server_ip = config.server_ip.to_string();
+
     match (
-        create_wireguard_ifc(IFCNAME).await,
-        update_wireguard_ifc(IFCNAME, Some(addr), Some(cidr), Operation::Update).await,
+        create_wireguard_ifc(ifc_name).await,
+        update_wireguard_ifc(
+            ifc_name,
+            Some(config.addr),
+            Some(config.cidr),
+            Operation::Update,
+        )
+        .await,
         update_device(
             &private_key,
             54161,
-            IFCNAME,
-            SERVERPUB,
-            SERVERENDPOINT,
-            SERVERIP,
+            ifc_name,
+            &config.server_pub,
+            &config.server_endpoint,
+            &server_ip,
+            config.preshared_key.as_deref(),
         ),
-        update_wireguard_ifc(IFCNAME, None, None, Operation::Enable).await,
+        update_wireguard_ifc(ifc_name, None, None, Operation::Enable).await,
     ) {
         (Ok(()), Ok(()), Ok(()), Ok(())) => {
             println!("Interface setup completed successfully.");
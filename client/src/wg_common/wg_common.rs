@@ -2,6 +2,7 @@ use super::wireguard_cffi::{wg_get_device, wg_set_device, WgDevice};
 use crate::wg_common::wireguard_cffi::{
     wg_generate_private_key, wg_generate_public_key, wg_key_from_base64, wg_key_to_base64,
     wg_list_device_names, WgAllowedIp, WgDeviceFlags, WgEndpoint, WgKey, WgKeyBase64String, WgPeer,
+    WgPeerFlags,
 };
 use std::ffi::{CStr, CString};
 
@@ -69,6 +70,7 @@ pub fn update_device(
     server_pub: &str,
     s_endpoint: &str,
     s_ip: &str,
+    preshared_key: Option<&str>,
 ) -> Result<(), i32> {
     let c_device_name = CString::new(device_name).map_err(|_| -1)?;
     let mut device: *mut WgDevice = std::ptr::null_mut();
@@ -78,6 +80,10 @@ pub fn update_device(
     let server_endpoint = WgEndpoint::from(s_endpoint);
     let mut server_allowed_ip = WgAllowedIp::from(s_ip);
     let mut server_peer = WgPeer::init(server_pub_key_int, server_endpoint, &mut server_allowed_ip);
+    if let Some(key) = preshared_key {
+        server_peer.preshared_key = wg_key_from_str(key);
+        server_peer.flags.insert(WgPeerFlags::HAS_PRESHARED_KEY);
+    }
 
     unsafe {
         if wg_get_device(&mut device, c_device_name.as_ptr()) != 0 {